@@ -0,0 +1,137 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// AccessCause is the likely reason an AccessError's path can't be read.
+type AccessCause int
+
+const (
+	// AccessPermissions: the path's permissions, or its ACL, deny the
+	// process.
+	AccessPermissions AccessCause = iota
+
+	// AccessPrivacy: macOS' privacy protection denies the process, as
+	// it does below Desktop, Documents, Downloads and other users' homes
+	// until the process, or the app running it, is granted Full Disk
+	// Access or the user's consent. FSEvents then reports nothing there,
+	// without failing.
+	AccessPrivacy
+)
+
+func (c AccessCause) String() string {
+	switch c {
+	case AccessPermissions:
+		return "Permissions"
+	case AccessPrivacy:
+		return "Privacy"
+	}
+	return fmt.Sprintf("AccessCause(%d)", int(c))
+}
+
+// AccessError is sent on Errors by Start for each watched path the
+// process can't read, as CheckAccess finds them, since the events below
+// it are likely to go missing.
+type AccessError struct {
+	Path  string
+	Cause AccessCause
+	Err   error // from opening or listing Path
+}
+
+func (e *AccessError) Error() string {
+	if e.Cause == AccessPrivacy {
+		return fmt.Sprintf("fsevents: can't read %s (%v): it's likely protected by macOS privacy settings, and events below it won't be reported unless this process has Full Disk Access", e.Path, e.Err)
+	}
+	return fmt.Sprintf("fsevents: can't read %s (%v): its permissions deny this process, and events below it may not be reported", e.Path, e.Err)
+}
+
+func (e *AccessError) Unwrap() error { return e.Err }
+
+// probeAccess opens path and, if it's a directory, lists an entry, as a
+// watch on it needs to. A seam for the tests.
+var probeAccess = func(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF && !errors.Is(err, syscall.ENOTDIR) {
+		return err
+	}
+	return nil
+}
+
+// CheckAccess looks at whether the process can read paths, as a stream
+// watching them needs to, and returns an AccessError for each it can't,
+// with the likely cause, for a program to ask for Full Disk Access
+// before it starts watching. Paths that don't exist, or fail otherwise,
+// aren't reported.
+func CheckAccess(paths []string) []*AccessError {
+	var errs []*AccessError
+	for _, path := range paths {
+		err := probeAccess(path)
+		if err == nil || !errors.Is(err, fs.ErrPermission) {
+			continue
+		}
+		errs = append(errs, &AccessError{Path: path, Cause: accessCause(path, err), Err: err})
+	}
+	return errs
+}
+
+// privacyFolders are the folders of a home directory macOS' privacy
+// protection covers.
+var privacyFolders = []string{
+	"Desktop",
+	"Documents",
+	"Downloads",
+	"Library/Mail",
+	"Library/Messages",
+	"Library/Safari",
+	"Library/Mobile Documents",
+}
+
+// accessCause guesses why path can't be read: the privacy protection
+// denies with EPERM where permissions deny with EACCES, and covers
+// privacyFolders and other users' homes.
+func accessCause(path string, err error) AccessCause {
+	if errors.Is(err, syscall.EPERM) {
+		return AccessPrivacy
+	}
+	abs, aerr := filepath.Abs(path)
+	if aerr != nil {
+		return AccessPermissions
+	}
+	home, _ := os.UserHomeDir()
+	if home != "" {
+		for _, folder := range privacyFolders {
+			if underAny(abs, []string{filepath.Join(home, folder)}) {
+				return AccessPrivacy
+			}
+		}
+	}
+	const users = "/Users/"
+	if strings.HasPrefix(abs, users) && !underAny(abs, []string{"/Users/Shared"}) && (home == "" || !underAny(abs, []string{home})) {
+		return AccessPrivacy
+	}
+	return AccessPermissions
+}
+
+// reportAccess sends an AccessError on Errors for each watched path the
+// process can't read. Device-relative and Manual streams watch no paths
+// of their own.
+func (es *EventStream) reportAccess() {
+	if es.Errors == nil || es.conf().Device != 0 || es.conf().Backend == Manual {
+		return
+	}
+	for _, err := range CheckAccess(es.watched) {
+		es.report(err)
+	}
+}
@@ -0,0 +1,107 @@
+package fsevents
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCheckAccess(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions don't deny root")
+	}
+	tmp := t.TempDir()
+	locked := filepath.Join(tmp, "locked")
+	if err := os.Mkdir(locked, 0o000); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0o755) })
+
+	errs := CheckAccess([]string{tmp, locked, filepath.Join(tmp, "missing")})
+	if len(errs) != 1 || errs[0].Path != locked || errs[0].Cause != AccessPermissions || !errors.Is(errs[0], fs.ErrPermission) {
+		t.Fatalf("CheckAccess() = %v", errs)
+	}
+
+	es := &EventStream{Paths: []string{locked}, Backend: Poll, PollInterval: time.Hour, Errors: make(chan error, 1)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	var aerr *AccessError
+	select {
+	case err := <-es.ErrorsChan():
+		if !errors.As(err, &aerr) || aerr.Path != locked {
+			t.Errorf("Start sent %v", err)
+		}
+	default:
+		t.Error("Start sent no AccessError")
+	}
+}
+
+func TestAccessCause(t *testing.T) {
+	home := "/Users/me"
+	t.Setenv("HOME", home)
+	prev := probeAccess
+	t.Cleanup(func() { probeAccess = prev })
+	denied := map[string]syscall.Errno{
+		"/Users/me/Desktop/project": syscall.EACCES,
+		"/Users/me/src":             syscall.EACCES,
+		"/Users/me/src/sandboxed":   syscall.EPERM,
+		"/Users/other":              syscall.EACCES,
+		"/Users/Shared/locked":      syscall.EACCES,
+		"/opt/locked":               syscall.EACCES,
+	}
+	probeAccess = func(path string) error {
+		if errno, ok := denied[path]; ok {
+			return &fs.PathError{Op: "open", Path: path, Err: errno}
+		}
+		if path == "/missing" {
+			return &fs.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+		}
+		return nil
+	}
+	want := map[string]AccessCause{
+		"/Users/me/Desktop/project": AccessPrivacy,
+		"/Users/me/src":             AccessPermissions,
+		"/Users/me/src/sandboxed":   AccessPrivacy,
+		"/Users/other":              AccessPrivacy,
+		"/Users/Shared/locked":      AccessPermissions,
+		"/opt/locked":               AccessPermissions,
+	}
+	paths := []string{"/missing", "/Users/me"}
+	for path := range denied {
+		paths = append(paths, path)
+	}
+	errs := CheckAccess(paths)
+	if len(errs) != len(want) {
+		t.Errorf("CheckAccess() = %v", errs)
+	}
+	for _, err := range errs {
+		if err.Cause != want[err.Path] {
+			t.Errorf("%s: cause %v, want %v", err.Path, err.Cause, want[err.Path])
+		}
+	}
+
+	// A stream reports them as it starts, and only then.
+	tmp := t.TempDir()
+	denied[tmp] = syscall.EPERM
+	es := &EventStream{Paths: []string{tmp}, Backend: Poll, PollInterval: time.Hour, Errors: make(chan error, 2)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	var aerr *AccessError
+	if err := <-es.ErrorsChan(); !errors.As(err, &aerr) || aerr.Path != tmp || aerr.Cause != AccessPrivacy {
+		t.Errorf("Start sent %v", err)
+	}
+	es.Flush(true)
+	select {
+	case err := <-es.ErrorsChan():
+		t.Errorf("then sent %v", err)
+	default:
+	}
+}
@@ -0,0 +1,236 @@
+package fsevents
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirSummary counts the changes in a directory over an interval. An event
+// with several of the changes counts for each.
+type DirSummary struct {
+	Dir string
+
+	// Events counts the events in the directory.
+	Events int
+
+	Created  int
+	Removed  int
+	Modified int // ItemModified, metadata changes and renames
+
+	// LastID is the highest event ID counted.
+	LastID uint64
+}
+
+// Aggregator counts the events fed to it by directory and delivers the
+// counts every interval, for dashboards and the like that want to know
+// how busy each directory is rather than see every event. An event counts
+// for the directory that holds the item, cut down to AggregateDepth
+// levels below its root. Events about the stream itself, such as MustScanSubDirs,
+// aren't counted.
+type Aggregator struct {
+	// Summaries receives each interval's summaries, sorted by directory,
+	// if there were any events. A slow receiver doesn't hold up Add: the
+	// counts go on accumulating until the summaries can be sent. It's
+	// closed after Close.
+	Summaries chan []DirSummary
+
+	roots  []string
+	depth  int
+	rollup bool
+
+	mu     sync.Mutex // guards counts
+	counts map[string]*DirSummary
+
+	flushReq chan chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// AggregateOption configures an Aggregator.
+type AggregateOption func(*Aggregator)
+
+// AggregateRoots sets the directories Depth counts from, such as the
+// stream's Paths. An event below none of them counts from "/".
+func AggregateRoots(roots ...string) AggregateOption {
+	return func(a *Aggregator) { a.roots = append([]string(nil), roots...) }
+}
+
+// AggregateDepth counts the events below depth levels under their root
+// for the directory at that level. Zero, the default, means no limit.
+func AggregateDepth(depth int) AggregateOption {
+	return func(a *Aggregator) { a.depth = depth }
+}
+
+// AggregateRollup makes events count for every directory between theirs
+// and their root too, so a directory's summary includes those of its
+// subdirectories.
+func AggregateRollup() AggregateOption {
+	return func(a *Aggregator) { a.rollup = true }
+}
+
+// AggregateBuffer sets the capacity of the Summaries channel. The default
+// is unbuffered.
+func AggregateBuffer(n int) AggregateOption {
+	return func(a *Aggregator) { a.Summaries = make(chan []DirSummary, n) }
+}
+
+// NewAggregator returns an Aggregator delivering summaries every interval,
+// configured by opts. Feed it with Add, as a stream's Handler or from a
+// Subscription.
+func NewAggregator(interval time.Duration, opts ...AggregateOption) *Aggregator {
+	a := &Aggregator{
+		counts:   map[string]*DirSummary{},
+		flushReq: make(chan chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.Summaries == nil {
+		a.Summaries = make(chan []DirSummary)
+	}
+	for i, root := range a.roots {
+		if len(root) > 1 {
+			a.roots[i] = strings.TrimSuffix(root, "/")
+		}
+	}
+	go a.run(interval)
+	return a
+}
+
+// Add counts a batch of events.
+func (a *Aggregator) Add(events []Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.counts == nil {
+		return
+	}
+	for _, e := range events {
+		if e.Flags&streamFlags != 0 {
+			continue
+		}
+		dir, root := a.bucket(e.Path)
+		for {
+			a.count(dir, e)
+			if !a.rollup || dir == root || dir == "/" {
+				break
+			}
+			dir = parentDir(dir)
+		}
+	}
+}
+
+// parentDir returns the directory holding path, which may be "/".
+func parentDir(path string) string {
+	if i := strings.LastIndexByte(path, '/'); i > 0 {
+		return path[:i]
+	}
+	return "/"
+}
+
+// bucket returns the directory an event on path counts for, and its root.
+func (a *Aggregator) bucket(path string) (dir, root string) {
+	dir = parentDir(path)
+	root = "/"
+	for _, r := range a.roots {
+		if len(r) > len(root) && underAny(dir, []string{r}) {
+			root = r
+		}
+	}
+	if a.depth > 0 {
+		rest := strings.TrimPrefix(dir[len(root):], "/")
+		n := 0
+		for i := 0; i < len(rest); i++ {
+			if rest[i] == '/' {
+				if n++; n == a.depth {
+					dir = dir[:len(dir)-len(rest)+i]
+					break
+				}
+			}
+		}
+	}
+	return dir, root
+}
+
+func (a *Aggregator) count(dir string, e Event) {
+	s := a.counts[dir]
+	if s == nil {
+		s = &DirSummary{Dir: dir}
+		a.counts[dir] = s
+	}
+	s.Events++
+	if e.Flags&ItemCreated != 0 {
+		s.Created++
+	}
+	if e.Flags&ItemRemoved != 0 {
+		s.Removed++
+	}
+	if e.Flags&(ItemModified|ItemInodeMetaMod|ItemFinderInfoMod|ItemChangeOwner|ItemXattrMod|ItemRenamed) != 0 {
+		s.Modified++
+	}
+	if e.ID > s.LastID {
+		s.LastID = e.ID
+	}
+}
+
+// Flush delivers the summaries counted so far without waiting for the
+// interval to end, returning once they've been sent.
+func (a *Aggregator) Flush() {
+	reply := make(chan struct{})
+	select {
+	case a.flushReq <- reply:
+		<-reply
+	case <-a.done:
+	}
+}
+
+// Close stops the Aggregator: the summaries still counted are delivered,
+// and then Summaries is closed. Events added afterwards aren't counted.
+func (a *Aggregator) Close() {
+	a.once.Do(func() { close(a.quit) })
+}
+
+func (a *Aggregator) run(interval time.Duration) {
+	defer close(a.done)
+	defer close(a.Summaries)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.emit(false)
+		case reply := <-a.flushReq:
+			a.emit(false)
+			close(reply)
+		case <-a.quit:
+			a.emit(true)
+			return
+		}
+	}
+}
+
+// emit sends the counts and starts over, or stops counting if final is
+// set.
+func (a *Aggregator) emit(final bool) {
+	a.mu.Lock()
+	counts := a.counts
+	if final {
+		a.counts = nil
+	} else if len(counts) > 0 {
+		a.counts = map[string]*DirSummary{}
+	}
+	a.mu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+	summaries := make([]DirSummary, 0, len(counts))
+	for _, s := range counts {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Dir < summaries[j].Dir })
+	a.Summaries <- summaries
+}
@@ -0,0 +1,79 @@
+package fsevents
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var aggregateEvents = []Event{
+	{Path: "/w/a/f", Flags: ItemCreated | ItemIsFile, ID: 1},
+	{Path: "/w/a/f", Flags: ItemModified | ItemIsFile, ID: 2},
+	{Path: "/w/a/b/g", Flags: ItemCreated | ItemModified | ItemIsFile, ID: 3},
+	{Path: "/w/a/b/c/h", Flags: ItemRemoved | ItemIsFile, ID: 4},
+	{Path: "/w/a/b", Flags: ItemRenamed | ItemIsDir, ID: 5},
+	{Path: "/w/i", Flags: ItemInodeMetaMod | ItemIsFile, ID: 6},
+	{Path: "/w/a", Flags: MustScanSubDirs, ID: 7},
+	{Path: "/x/j", Flags: ItemCreated | ItemIsFile, ID: 8},
+}
+
+func TestAggregator(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []AggregateOption
+		want []DirSummary
+	}{
+		{"flat", nil, []DirSummary{
+			{Dir: "/w", Events: 1, Modified: 1, LastID: 6},
+			{Dir: "/w/a", Events: 3, Created: 1, Modified: 2, LastID: 5},
+			{Dir: "/w/a/b", Events: 1, Created: 1, Modified: 1, LastID: 3},
+			{Dir: "/w/a/b/c", Events: 1, Removed: 1, LastID: 4},
+			{Dir: "/x", Events: 1, Created: 1, LastID: 8},
+		}},
+		{"depth", []AggregateOption{AggregateRoots("/w/"), AggregateDepth(1)}, []DirSummary{
+			{Dir: "/w", Events: 1, Modified: 1, LastID: 6},
+			{Dir: "/w/a", Events: 5, Created: 2, Removed: 1, Modified: 3, LastID: 5},
+			{Dir: "/x", Events: 1, Created: 1, LastID: 8},
+		}},
+		{"rollup", []AggregateOption{AggregateRoots("/w"), AggregateRollup()}, []DirSummary{
+			{Dir: "/", Events: 1, Created: 1, LastID: 8},
+			{Dir: "/w", Events: 6, Created: 2, Removed: 1, Modified: 4, LastID: 6},
+			{Dir: "/w/a", Events: 5, Created: 2, Removed: 1, Modified: 3, LastID: 5},
+			{Dir: "/w/a/b", Events: 2, Created: 1, Removed: 1, Modified: 1, LastID: 4},
+			{Dir: "/w/a/b/c", Events: 1, Removed: 1, LastID: 4},
+			{Dir: "/x", Events: 1, Created: 1, LastID: 8},
+		}},
+	}
+	for _, tt := range tests {
+		a := NewAggregator(time.Hour, append(tt.opts, AggregateBuffer(10))...)
+		a.Add(aggregateEvents[:4])
+		a.Add(aggregateEvents[4:])
+		a.Flush()
+		if have := <-a.Summaries; !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, have, tt.want)
+		}
+		a.Close()
+		if s, ok := <-a.Summaries; ok {
+			t.Errorf("%s: got %+v after Close, want the channel closed", tt.name, s)
+		}
+	}
+}
+
+func TestAggregatorInterval(t *testing.T) {
+	a := NewAggregator(50 * time.Millisecond)
+	a.Add(aggregateEvents[:1])
+	first := <-a.Summaries
+	a.Add(aggregateEvents[1:2])
+	a.Add(aggregateEvents[1:2])
+	a.Close()
+	var rest []DirSummary
+	for s := range a.Summaries {
+		rest = append(rest, s...)
+	}
+	if len(first) != 1 || first[0].Created != 1 {
+		t.Errorf("first interval got %+v", first)
+	}
+	if len(rest) != 1 || rest[0].Modified != 2 {
+		t.Errorf("rest got %+v, want both modifications in one summary", rest)
+	}
+}
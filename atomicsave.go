@@ -0,0 +1,215 @@
+package fsevents
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// AtomicSaves recognizes the saves that replace a file by way of another
+// with a temporary name next to it, as editors do so that a reader never
+// sees the file half written: the new contents are written to the
+// temporary file and renamed over the file, or the file is renamed to a
+// backup, written afresh and the backup removed. Set as
+// EventStream.AtomicSaves, it delivers such a save as a single
+// ItemModified event on the file, with ItemIsFile, the latest ID of the
+// save's events and in the place of the last, instead of the creates,
+// renames and removes of both. The save must be in one batch, as FSEvents
+// gathers them over Latency, and the stream see files, as with the
+// FileEvents flag. A file whose event says it was removed isn't taken for
+// saved.
+type AtomicSaves struct {
+	// TempNames are the names a file's temporary file can have. Nil
+	// means DefaultTempNames.
+	TempNames []TempName
+
+	// KeepEvents delivers the events of the save too, before the
+	// ItemModified made up for it. Otherwise they're counted in Stats
+	// as filtered.
+	KeepEvents bool
+}
+
+// TempName matches the names of a file's temporary files that are made of
+// the file's name with a prefix, a suffix or both: Prefix and Suffix must
+// match the whole of what comes before and after it. A nil Prefix or
+// Suffix matches nothing being there.
+type TempName struct {
+	Prefix *regexp.Regexp
+	Suffix *regexp.Regexp
+}
+
+// DefaultTempNames are the temporary names of the common editors and
+// libraries: "name.tmp" and "name.tmp" followed by letters and digits, as
+// os.CreateTemp makes them with a pattern of "name.tmp*"; "name~", the
+// backup of vim and Emacs; "name.vsctmp", from VS Code; and the
+// "name___jb_tmp___" and "name___jb_old___" of JetBrains' IDEs.
+var DefaultTempNames = []TempName{
+	{Suffix: regexp.MustCompile(`\.tmp[0-9A-Za-z]*`)},
+	{Suffix: regexp.MustCompile(`~`)},
+	{Suffix: regexp.MustCompile(`\.vsctmp`)},
+	{Suffix: regexp.MustCompile(`___jb_(tmp|old)___`)},
+}
+
+// tempName is a TempName compiled to match whole strings.
+type tempName struct {
+	prefix, suffix *regexp.Regexp // nil to match ""
+}
+
+// compileTempNames anchors the AtomicSaves' TempNames for the stream to
+// match with.
+func (a *AtomicSaves) compileTempNames() []tempName {
+	names := a.TempNames
+	if names == nil {
+		names = DefaultTempNames
+	}
+	anchor := func(re *regexp.Regexp) *regexp.Regexp {
+		if re == nil {
+			return nil
+		}
+		return regexp.MustCompile(`^(?:` + re.String() + `)$`)
+	}
+	var compiled []tempName
+	for _, n := range names {
+		if n.Prefix == nil && n.Suffix == nil {
+			// A file would be its own temporary file.
+			continue
+		}
+		compiled = append(compiled, tempName{anchor(n.Prefix), anchor(n.Suffix)})
+	}
+	return compiled
+}
+
+// matches reports whether temp is a temporary name for name.
+func (n tempName) matches(temp, name string) bool {
+	for i := 0; ; i++ {
+		j := strings.Index(temp[i:], name)
+		if j < 0 {
+			return false
+		}
+		i += j
+		if matchWhole(n.prefix, temp[:i]) && matchWhole(n.suffix, temp[i+len(name):]) {
+			return true
+		}
+	}
+}
+
+func matchWhole(re *regexp.Regexp, s string) bool {
+	if re == nil {
+		return s == ""
+	}
+	return re.MatchString(s)
+}
+
+// atomicSaves applies es.AtomicSaves to the batch, reusing its storage
+// unless KeepEvents adds to it.
+func (es *EventStream) atomicSaves(events []Event) []Event {
+	if es.conf().AtomicSaves == nil || len(es.saveNames) == 0 || len(events) < 2 {
+		return events
+	}
+
+	// The flags of every event on each file, and the files by
+	// directory.
+	flags := map[string]EventFlags{}
+	dirs := map[string][]string{}
+	for _, e := range events {
+		if !isFileEvent(e) {
+			continue
+		}
+		if _, ok := flags[e.Path]; !ok {
+			dir := filepath.Dir(e.Path)
+			dirs[dir] = append(dirs[dir], e.Path)
+		}
+		flags[e.Path] |= e.Flags
+	}
+
+	// A temporary file came and went, by a rename, next to a file that
+	// was renamed over or created and still is.
+	var saved map[string]string // the file each path belongs to the save of
+	for temp, f := range flags {
+		if f&ItemRenamed == 0 || f&(ItemCreated|ItemRemoved) == 0 {
+			continue
+		}
+		tempBase := filepath.Base(temp)
+		file := ""
+		for _, path := range dirs[filepath.Dir(temp)] {
+			base := filepath.Base(path)
+			if len(base) >= len(tempBase) || len(path) <= len(file) ||
+				flags[path]&(ItemRenamed|ItemCreated) == 0 || flags[path]&ItemRemoved != 0 {
+				continue
+			}
+			for _, n := range es.saveNames {
+				if n.matches(tempBase, base) {
+					file = path
+					break
+				}
+			}
+		}
+		if file == "" {
+			continue
+		}
+		if saved == nil {
+			saved = map[string]string{}
+		}
+		saved[temp], saved[file] = file, file
+	}
+	if saved == nil {
+		return events
+	}
+
+	// Each save's ItemModified goes where its last event was, as the
+	// file's last event would be but for its flags and ID.
+	last := map[string]int{}
+	made := map[string]Event{}
+	for i, e := range events {
+		file, ok := saved[e.Path]
+		if !ok || !isFileEvent(e) {
+			continue
+		}
+		last[file] = i
+		m, seen := made[file]
+		if !seen || e.Path == file {
+			id := m.ID
+			m = e
+			m.Path, m.Flags, m.ID = file, ItemModified|ItemIsFile, id
+		}
+		if e.ID > m.ID {
+			m.ID = e.ID
+		}
+		made[file] = m
+	}
+
+	var kept []Event
+	if es.conf().AtomicSaves.KeepEvents {
+		kept = newBatch(len(events) + len(made))[:0]
+	} else {
+		kept = events[:0]
+	}
+	for i, e := range events {
+		if file, ok := saved[e.Path]; ok && isFileEvent(e) {
+			if es.conf().AtomicSaves.KeepEvents {
+				kept = append(kept, e)
+			}
+			if last[file] == i {
+				kept = append(kept, made[file])
+			}
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if es.conf().AtomicSaves.KeepEvents {
+		recycle(events)
+		return kept
+	}
+	atomic.AddUint64(&es.stats.FilteredEvents, uint64(len(events)-len(kept)+len(made)))
+	tail := events[len(kept):]
+	for i := range tail {
+		tail[i] = Event{}
+	}
+	return kept
+}
+
+// isFileEvent reports whether e is about a file rather than the stream.
+func isFileEvent(e Event) bool {
+	return e.Flags&streamFlags == 0 && e.Flags&ItemIsFile != 0
+}
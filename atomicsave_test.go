@@ -0,0 +1,166 @@
+package fsevents
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// injectSaves starts a Manual stream with a, injects in and returns what
+// it delivers, as "path flags ID" lines.
+func injectSaves(t *testing.T, a *AtomicSaves, in []Event) []string {
+	t.Helper()
+	es := &EventStream{Paths: []string{"/d"}, Backend: Manual, AtomicSaves: a, Events: make(chan []Event, 1)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if err := es.Inject(in); err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, e := range <-es.EventsChan() {
+		have = append(have, fmt.Sprint(e.Path, " ", e.Flags, " ", e.ID))
+		if underAny(e.Path, []string{"/d"}) && e.Root != "/d" {
+			t.Errorf("%s attributed to %q", e.Path, e.Root)
+		}
+	}
+	return have
+}
+
+func TestAtomicSaves(t *testing.T) {
+	const (
+		created = ItemCreated | ItemIsFile
+		mod     = ItemModified | ItemIsFile
+		renamed = ItemRenamed | ItemIsFile
+		removed = ItemRemoved | ItemIsFile
+	)
+	saved := func(path string, id uint64) string { return fmt.Sprint(path, " ", mod, " ", id) }
+	for _, tt := range []struct {
+		name  string
+		names []TempName
+		in    []Event
+		want  []string // the events of in by index, or what's made up
+	}{{
+		name: "os.Rename",
+		in: []Event{
+			{Path: "/d/f.txt.tmp4183916", Flags: created, ID: 1},
+			{Path: "/d/g", Flags: mod, ID: 2},
+			{Path: "/d/f.txt.tmp4183916", Flags: mod, ID: 3},
+			{Path: "/d/f.txt.tmp4183916", Flags: renamed, ID: 4},
+			{Path: "/d/f.txt", Flags: renamed, ID: 5},
+		},
+		want: []string{"1", saved("/d/f.txt", 5)},
+	}, {
+		// vim with backupcopy=no: it checks it can write in the
+		// directory with a file named 4913, moves the file to its
+		// backup, writes it afresh and removes the backup, while the
+		// swap file is written to.
+		name: "vim",
+		in: []Event{
+			{Path: "/d/.f.txt.swp", Flags: mod, ID: 10},
+			{Path: "/d/4913", Flags: created | ItemRemoved, ID: 11},
+			{Path: "/d/f.txt", Flags: renamed, ID: 12},
+			{Path: "/d/f.txt~", Flags: renamed, ID: 13},
+			{Path: "/d/f.txt", Flags: created | ItemModified, ID: 14},
+			{Path: "/d/f.txt~", Flags: removed, ID: 15},
+			{Path: "/d/.f.txt.swp", Flags: mod, ID: 16},
+		},
+		want: []string{"0", "1", saved("/d/f.txt", 15), "6"},
+	}, {
+		// VS Code's atomic saves, each temporary file's events
+		// coalesced into one by FSEvents.
+		name: "VS Code",
+		in: []Event{
+			{Path: "/d/settings.json.vsctmp", Flags: created | ItemModified | ItemRenamed, ID: 20},
+			{Path: "/d/settings.json", Flags: renamed | ItemInodeMetaMod, ID: 21},
+			{Path: "/d/tasks.json.vsctmp", Flags: created | ItemModified | ItemRenamed, ID: 22},
+			{Path: "/d/tasks.json", Flags: renamed, ID: 23},
+		},
+		want: []string{saved("/d/settings.json", 21), saved("/d/tasks.json", 23)},
+	}, {
+		name:  "TempNames",
+		names: []TempName{{Prefix: regexp.MustCompile(`\.`), Suffix: regexp.MustCompile(`[0-9]+`)}},
+		in: []Event{
+			{Path: "/d/f.txt", Flags: renamed, ID: 31},
+			{Path: "/d/.f.txt2754", Flags: created | ItemModified | ItemRenamed, ID: 30},
+			{Path: "/d/f.txt.tmp", Flags: created | ItemRenamed, ID: 32},
+		},
+		want: []string{saved("/d/f.txt", 31), "2"},
+	}, {
+		name: "not saves",
+		in: []Event{
+			// Moved in from elsewhere.
+			{Path: "/d/a", Flags: renamed, ID: 40},
+			{Path: "/elsewhere/a.tmp", Flags: renamed, ID: 41},
+			// A backup renamed, but neither made nor removed.
+			{Path: "/d/b", Flags: mod, ID: 42},
+			{Path: "/d/b~", Flags: renamed, ID: 43},
+			// Replaced, then removed.
+			{Path: "/d/c.tmp", Flags: created | ItemRenamed, ID: 44},
+			{Path: "/d/c", Flags: renamed | ItemRemoved, ID: 45},
+			// A directory.
+			{Path: "/d/e.tmp", Flags: ItemCreated | ItemRenamed | ItemIsDir, ID: 46},
+			{Path: "/d/e", Flags: ItemRenamed | ItemIsDir, ID: 47},
+			{Path: "/d", Flags: MustScanSubDirs, ID: 48},
+			// A file of its own name.
+			{Path: "/d/k.tmp", Flags: created | ItemRenamed, ID: 49},
+		},
+		want: []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"},
+	}} {
+		var want []string
+		for _, w := range tt.want {
+			var i int
+			if _, err := fmt.Sscan(w, &i); err == nil {
+				e := tt.in[i]
+				w = fmt.Sprint(e.Path, " ", e.Flags, " ", e.ID)
+			}
+			want = append(want, w)
+		}
+		have := injectSaves(t, &AtomicSaves{TempNames: tt.names}, tt.in)
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: got %q, want %q", tt.name, have, want)
+		}
+	}
+}
+
+func TestAtomicSavesKeepEvents(t *testing.T) {
+	in := []Event{
+		{Path: "/d/f.txt~", Flags: ItemRenamed | ItemIsFile, ID: 1},
+		{Path: "/d/f.txt", Flags: ItemCreated | ItemRenamed | ItemIsFile, ID: 2},
+		{Path: "/d/f.txt~", Flags: ItemRemoved | ItemIsFile, ID: 3},
+		{Path: "/d/g", Flags: ItemModified | ItemIsFile, ID: 4},
+	}
+	var want []string
+	for _, e := range in[:3] {
+		want = append(want, fmt.Sprint(e.Path, " ", e.Flags, " ", e.ID))
+	}
+	want = append(want, fmt.Sprint("/d/f.txt ", ItemModified|ItemIsFile, " 3"), fmt.Sprint("/d/g ", in[3].Flags, " 4"))
+	if have := injectSaves(t, &AtomicSaves{KeepEvents: true}, in); !reflect.DeepEqual(have, want) {
+		t.Errorf("got %q, want %q", have, want)
+	}
+
+	es := &EventStream{Paths: []string{"/d"}, Backend: Manual, AtomicSaves: &AtomicSaves{}, Events: make(chan []Event, 1)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if err := es.Inject(in); err != nil {
+		t.Fatal(err)
+	}
+	if batch := <-es.EventsChan(); len(batch) != 2 {
+		t.Errorf("without KeepEvents, got %v", batch)
+	}
+	if n := es.Stats().FilteredEvents; n != 3 {
+		t.Errorf("FilteredEvents = %d, want 3", n)
+	}
+
+	c, err := es.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AtomicSaves == es.AtomicSaves || c.AtomicSaves.TempNames != nil {
+		t.Errorf("clone has AtomicSaves %+v", c.AtomicSaves)
+	}
+}
@@ -0,0 +1,56 @@
+package fsevents
+
+import "fmt"
+
+// Backend selects the mechanism an EventStream uses to watch its paths.
+// Every backend delivers through the same pipeline, so Filter, batching,
+// Overflow and Stats work the same way whichever is chosen.
+type Backend int
+
+const (
+	// Native watches with FSEvents. It's the zero value.
+	Native Backend = iota
+
+	// KQueue watches each path with a kqueue vnode filter. A directory
+	// is watched together with its immediate children, not recursively.
+	// Events are reported as they happen, with the closest EventFlags
+	// equivalent of each kqueue note. IDs are a sequence local to the
+	// stream: there's no history, so Resume, Latency, Device and the
+	// CreateFlags other than WatchRoot don't apply.
+	KQueue
+
+	// Poll walks the paths every PollInterval and reports the
+	// differences between walks, comparing size, modification time,
+	// mode and inode. It sees changes that FSEvents misses, such as
+	// those made by other machines on network mounts, and works on
+	// every platform. A path that disappears and reappears elsewhere
+	// with the same inode is reported as ItemRenamed on both paths.
+	// Like KQueue it has no history and ignores Resume, Latency, Device
+	// and CreateFlags.
+	Poll
+
+	// Manual watches nothing: the stream delivers the batches passed to
+	// Inject, for tests, such as those built on fseventstest, or for
+	// events that come from elsewhere. Their IDs are the caller's.
+	Manual
+)
+
+func (b Backend) String() string {
+	switch b {
+	case Native:
+		return "Native"
+	case KQueue:
+		return "KQueue"
+	case Poll:
+		return "Poll"
+	case Manual:
+		return "Manual"
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// source is a running backend other than Native.
+type source interface {
+	flush(sync bool)
+	stop()
+}
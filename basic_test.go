@@ -0,0 +1,118 @@
+//go:build darwin
+
+package fsevents_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+	"github.com/fsnotify/fsevents/fseventstest"
+)
+
+func TestBasicExample(t *testing.T) {
+	path, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := fsevents.DeviceForPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es := &fsevents.EventStream{
+		Paths:   []string{path},
+		Latency: 500 * time.Millisecond,
+		Device:  dev,
+		Flags:   fsevents.FileEvents,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	if err := os.WriteFile(filepath.Join(path, "example.txt"), []byte("example"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	event := fseventstest.WaitFor(t, es, nil, 5*time.Second)
+	t.Logf("Event: %#v", event)
+}
+
+func TestIssue48(t *testing.T) {
+	// FSEvents fails to start when watching >4096 paths
+	// This test validates that limit and checks that the error is propagated
+
+	path, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TODO: using this value fails to start
+	// dev, err := DeviceForPath(path)
+	// if err != nil {
+	// 	t.Fatal(err)
+	// }
+
+	var filenames []string
+	for i := 0; i < 4096; i++ {
+		newFilename := filepath.Join(path, fmt.Sprint("test", i))
+		if err := os.WriteFile(newFilename, []byte("test"), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, newFilename)
+	}
+
+	es := &fsevents.EventStream{
+		Paths:   filenames,
+		Latency: 500 * time.Millisecond,
+		Device:  0, // dev,
+		Flags:   fsevents.FileEvents,
+	}
+	// More than DefaultMaxPaths, unless MaxPaths lifts the limit.
+	if err := es.Start(); err != fsevents.ErrTooManyPaths {
+		es.Stop()
+		t.Fatalf("Start() with %d paths = %v, want ErrTooManyPaths", len(filenames), err)
+	}
+	es.MaxPaths = -1
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// write some new contents to test42 in the watchlist
+	if err := os.WriteFile(filenames[42], []byte("special"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	// should be reported as expected
+	event := fseventstest.WaitFor(t, es, nil, 5*time.Second)
+	t.Logf("Event: %#v", event)
+	es.Stop()
+
+	/////
+	// create one more file that puts it over the edge
+	newFilename := filepath.Join(path, fmt.Sprint("test", 4096))
+	if err := os.WriteFile(newFilename, []byte("test"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	filenames = append(filenames, newFilename)
+
+	// create an all-new instances to avoid problems
+	es2 := &fsevents.EventStream{
+		Paths:    filenames,
+		Latency:  500 * time.Millisecond,
+		Device:   0, // dev,
+		Flags:    fsevents.FileEvents,
+		MaxPaths: -1, // so that FSEvents rejects them, not MaxPaths
+	}
+	if err := es2.Start(); err == nil || errors.Is(err, fsevents.ErrTooManyPaths) {
+		if err == nil {
+			es2.Stop()
+		}
+		t.Fatalf("Start() with %d paths = %v, want FSEvents' error", len(filenames), err)
+	}
+}
@@ -0,0 +1,83 @@
+package fsevents
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errSpillBatchesMeta = errors.New("fsevents: the Spill policy needs the Events channel, but BatchesMeta is set")
+
+// Batch is a batch of events as BatchesMeta delivers it, with what the
+// stream knows of where it came from. Events belongs to the receiver, as
+// a batch received from Events does, and may be handed back with Recycle.
+type Batch struct {
+	Events []Event
+
+	// BatchSeq numbers the batches the stream delivers, from 1, and goes
+	// on across restarts, so that a gap says the Overflow policy dropped
+	// batches in between.
+	BatchSeq uint64
+
+	// ReceivedAt is when the first of the callbacks the events came from
+	// arrived, once the stream had filtered it.
+	ReceivedAt time.Time
+
+	// SourceCount is how many callbacks the events came from: more than
+	// one when MaxBatchDelay, DeliveryInterval or a window merged them,
+	// and one for each part MaxDeliveredBatch split a callback's into.
+	// The rate limiter's releases count as callbacks of their own.
+	SourceCount int
+
+	// EnqueuedAt is when the stream put the batch on BatchesMeta, for
+	// ReceiveBatch to tell how long it waited there.
+	EnqueuedAt time.Time
+}
+
+// stamp records on events, for BatchesMeta, that they came from a
+// callback of their own, and when.
+func (es *EventStream) stamp(events []Event) {
+	source := atomic.AddUint64(&es.sources, 1)
+	now := time.Now().UnixNano()
+	for i := range events {
+		events[i].source = source
+		events[i].received = now
+	}
+}
+
+// describe returns the Batch of events, as stamp recorded them, clearing
+// what it recorded.
+func (es *EventStream) describe(events []Event) Batch {
+	b := Batch{Events: events, BatchSeq: atomic.AddUint64(&es.batchSeq, 1)}
+	var first int64
+	var sources []uint64
+	for i := range events {
+		e := &events[i]
+		if e.source == 0 {
+			continue
+		}
+		if first == 0 || e.received < first {
+			first = e.received
+		}
+		// A callback's events stay together, but for SortBatches, which
+		// can interleave them.
+		if n := len(sources); n == 0 || sources[n-1] != e.source && !containsSource(sources, e.source) {
+			sources = append(sources, e.source)
+		}
+		e.source, e.received = 0, 0
+	}
+	b.SourceCount = len(sources)
+	if first != 0 {
+		b.ReceivedAt = time.Unix(0, first)
+	}
+	return b
+}
+
+func containsSource(sources []uint64, source uint64) bool {
+	for _, s := range sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package fsevents
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBatchesMeta(t *testing.T) {
+	es := &EventStream{
+		Paths:             []string{"/d"},
+		Backend:           Manual,
+		MaxBatchDelay:     time.Hour,
+		MaxDeliveredBatch: 2,
+		Overflow:          DropOldest,
+		BatchesMeta:       make(chan Batch, 2),
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if es.EventsChan() != nil {
+		t.Error("Start made Events for a stream with BatchesMeta")
+	}
+	var id uint64
+	inject := func(names ...string) {
+		t.Helper()
+		var batch []Event
+		for _, name := range names {
+			id++
+			batch = append(batch, Event{Path: "/d/" + name, ID: id})
+		}
+		if err := es.Inject(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type meta struct {
+		seq     uint64
+		paths   int
+		sources int
+	}
+	receive := func(n int) (have []meta, at []time.Time) {
+		t.Helper()
+		es.Flush(true)
+		for i := 0; i < n; i++ {
+			b := <-es.BatchesMeta
+			for _, e := range b.Events {
+				if want := (Event{Path: e.Path, Root: "/d", ID: e.ID, Continued: e.Continued}); !reflect.DeepEqual(e, want) {
+					t.Errorf("delivered %+v", e)
+				}
+			}
+			have = append(have, meta{b.BatchSeq, len(b.Events), b.SourceCount})
+			at = append(at, b.ReceivedAt)
+			es.Recycle(b.Events)
+		}
+		return have, at
+	}
+	check := func(name string, have, want []meta) {
+		t.Helper()
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: got %v, want %v", name, have, want)
+		}
+	}
+
+	// Merged. Splitting counts the callbacks of each part.
+	before := time.Now()
+	inject("a")
+	between := time.Now()
+	time.Sleep(time.Millisecond)
+	inject("b", "c")
+	have, at := receive(2)
+	check("merged", have, []meta{{1, 2, 2}, {2, 1, 1}})
+	if at[0].Before(before) || at[0].After(between) || !at[1].After(between) {
+		t.Errorf("received at %v, %v, want from %v, after %v", at[0], at[1], before, between)
+	}
+
+	// Split.
+	inject("d", "e", "f", "g", "h")
+	have, at = receive(2)
+	check("split, the first part dropped", have, []meta{{4, 2, 1}, {5, 1, 1}})
+	if !at[0].Equal(at[1]) {
+		t.Errorf("the parts of a batch received at %v and %v", at[0], at[1])
+	}
+	if st := es.Stats(); st.DroppedBatches != 1 || st.QueueCapacity != 2 {
+		t.Errorf("Stats() = %+v", st)
+	}
+}
+
+func TestBatchesMetaUnsupported(t *testing.T) {
+	es := &EventStream{
+		Paths:       []string{"/d"},
+		Backend:     Manual,
+		Overflow:    Spill(t.TempDir(), 1<<20),
+		BatchesMeta: make(chan Batch),
+	}
+	if err := es.Start(); err != errSpillBatchesMeta {
+		es.Stop()
+		t.Errorf("Start() with Spill = %v, want %v", err, errSpillBatchesMeta)
+	}
+	es.Overflow = Block
+	if err := Run(context.Background(), es, nil); err == nil {
+		t.Errorf("Run() with BatchesMeta = %v", err)
+	}
+}
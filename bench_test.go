@@ -0,0 +1,113 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// The benchmarks drive the callback with synthetic batches (see cBatch),
+// so they don't depend on the timing of real filesystem events.
+
+func BenchmarkCallbackDelivery(b *testing.B) {
+	for _, n := range []int{1, 100, 10000} {
+		cb := newCBatch(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			es := &EventStream{Events: make(chan []Event, 1)}
+			info := registry.Add(es)
+			defer registry.Delete(info)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cb.call(info)
+				<-es.EventsChan()
+			}
+		})
+	}
+}
+
+func BenchmarkCFStringConversion(b *testing.B) {
+	for _, tc := range []struct{ name, s string }{
+		{"ascii", "/Users/someone/src/project/internal/pkg/file.go"},
+		{"unicode", "/Users/someone/Documents/日本語/résumé-😀.txt"},
+		{"long", strings.Repeat("/segment", 128)},
+	} {
+		ref := goStringToCFString(tc.s)
+		b.Run(tc.name+"/to-go", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cfStringToGoString(ref)
+			}
+		})
+		cfReleaseCall(uintptr(ref))
+
+		b.Run(tc.name+"/from-go", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cfReleaseCall(uintptr(goStringToCFString(tc.s)))
+			}
+		})
+	}
+}
+
+func BenchmarkFilterPipeline(b *testing.B) {
+	re := regexp.MustCompile(`/dir-[0-4]/file-\d+$`)
+	filters := []struct {
+		name string
+		keep func(*Event) bool
+	}{
+		{"none", func(*Event) bool { return true }},
+		{"prefix", func(e *Event) bool { return strings.HasPrefix(e.Path, "/tmp/dir-1/") }},
+		{"glob", func(e *Event) bool {
+			ok, _ := path.Match("/tmp/dir-[0-4]/*", e.Path)
+			return ok
+		}},
+		{"regexp", func(e *Event) bool { return re.MatchString(e.Path) }},
+	}
+
+	cb := newCBatch(1000)
+	for _, f := range filters {
+		es := &EventStream{Filter: f.keep, Handler: func([]Event) {}}
+		b.Run(f.name, func(b *testing.B) {
+			info := registry.Add(es)
+			defer registry.Delete(info)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cb.call(info)
+			}
+		})
+	}
+}
+
+func BenchmarkRegistryGet(b *testing.B) {
+	ids := make([]uintptr, 8)
+	for i := range ids {
+		ids[i] = registry.Add(&EventStream{})
+	}
+	defer func() {
+		for _, id := range ids {
+			registry.Delete(id)
+		}
+	}()
+
+	// At least one goroutine per simulated stream, each looking up an ID as
+	// its callbacks would.
+	b.SetParallelism((len(ids) + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+	var next uint32
+	b.RunParallel(func(pb *testing.PB) {
+		id := ids[int(atomic.AddUint32(&next, 1))%len(ids)]
+		for pb.Next() {
+			if registry.Get(id) == nil {
+				b.Error("lookup failed")
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+// caseSensitive reports whether the volume holding path tells names
+// apart by case. It's a variable for tests.
+var caseSensitive = probeCaseSensitive
+
+// probeCaseSensitive looks up the nearest of path and its parents that
+// exists with the case of its name swapped, or failing that, a name in
+// it: the volume is case-sensitive if that finds nothing or another
+// file. Where no name has a letter to swap, it assumes what the
+// platform's default volumes do: macOS' aren't case-sensitive.
+func probeCaseSensitive(path string) bool {
+	for path = filepath.Clean(path); ; path = filepath.Dir(path) {
+		if _, err := os.Lstat(path); err == nil {
+			if sensitive, ok := probeCase(path); ok {
+				return sensitive
+			}
+			if f, err := os.Open(path); err == nil {
+				names, _ := f.Readdirnames(16)
+				f.Close()
+				for _, name := range names {
+					if sensitive, ok := probeCase(filepath.Join(path, name)); ok {
+						return sensitive
+					}
+				}
+			}
+		}
+		if filepath.Dir(path) == path {
+			return runtime.GOOS != "darwin"
+		}
+	}
+}
+
+// probeCase reports whether path and its name with the case swapped are
+// different files, if path exists and its name has a letter.
+func probeCase(path string) (sensitive, ok bool) {
+	name := filepath.Base(path)
+	swapped := strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, name)
+	if swapped == name {
+		return false, false
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return false, false
+	}
+	other, err := os.Lstat(filepath.Join(filepath.Dir(path), swapped))
+	if err != nil {
+		return true, os.IsNotExist(err)
+	}
+	return !os.SameFile(fi, other), true
+}
+
+// anchor is a path a filter matches events on and below: cleaned, so
+// without a trailing slash, and with fold set if its volume isn't
+// case-sensitive, for names to match whatever their case.
+type anchor struct {
+	path string
+	fold bool
+}
+
+// newAnchor returns the anchor for path, cleaned, which is looked up on
+// its volume unless it's relative, to a device's root.
+func newAnchor(path string) anchor {
+	path = filepath.Clean(path)
+	return anchor{path: path, fold: filepath.IsAbs(path) && !caseSensitive(path)}
+}
+
+// newAnchors returns the anchors for paths.
+func newAnchors(paths []string) []anchor {
+	if len(paths) == 0 {
+		return nil
+	}
+	anchors := make([]anchor, len(paths))
+	for i, path := range paths {
+		anchors[i] = newAnchor(path)
+	}
+	return anchors
+}
+
+// covers reports whether path is a's path or below it. A trailing slash
+// on path, as FSEvents reports some directories with, doesn't matter.
+func (a anchor) covers(path string) bool {
+	n := len(a.path)
+	if len(path) < n {
+		return false
+	}
+	if a.fold {
+		if !strings.EqualFold(path[:n], a.path) {
+			return false
+		}
+	} else if path[:n] != a.path {
+		return false
+	}
+	return len(path) == n || path[n] == '/' || strings.HasSuffix(a.path, "/")
+}
+
+// underAnchor reports whether path is covered by any of anchors.
+func underAnchor(path string, anchors []anchor) bool {
+	for _, a := range anchors {
+		if a.covers(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withCaseSensitive has every volume be case-sensitive or not for the
+// rest of the test.
+func withCaseSensitive(t *testing.T, sensitive bool) {
+	prev := caseSensitive
+	caseSensitive = func(string) bool { return sensitive }
+	t.Cleanup(func() { caseSensitive = prev })
+}
+
+// tempDirCaseSensitive reports whether the volume of dir is, by creating
+// a file and looking it up with another case.
+func tempDirCaseSensitive(t *testing.T, dir string) bool {
+	if err := os.WriteFile(filepath.Join(dir, "probe"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(dir, "probe"))
+	_, err := os.Stat(filepath.Join(dir, "PROBE"))
+	return err != nil
+}
+
+func TestProbeCaseSensitive(t *testing.T) {
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tempDirCaseSensitive(t, tmp)
+	if err := os.MkdirAll(filepath.Join(tmp, "Dir", "123"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join(tmp, "Dir"),
+		filepath.Join(tmp, "Dir") + "/",
+		filepath.Join(tmp, "Dir", "123"),            // no letters; its parent's
+		filepath.Join(tmp, "Dir", "123", "missing"), // looked up on its parent
+	} {
+		if have := probeCaseSensitive(path); have != want {
+			t.Errorf("probeCaseSensitive(%q) = %v, want %v", path, have, want)
+		}
+	}
+}
+
+func TestAnchorCovers(t *testing.T) {
+	for _, tt := range []struct {
+		anchor anchor
+		path   string
+		want   bool
+	}{
+		{anchor{path: "/Users/me/Cache"}, "/Users/me/Cache", true},
+		{anchor{path: "/Users/me/Cache"}, "/Users/me/Cache/", true},
+		{anchor{path: "/Users/me/Cache"}, "/Users/me/Cache/file", true},
+		{anchor{path: "/Users/me/Cache"}, "/Users/me/cache/file", false},
+		{anchor{path: "/Users/me/Cache"}, "/Users/me/Caches", false},
+		{anchor{path: "/Users/me/Cache", fold: true}, "/Users/me/cache/file", true},
+		{anchor{path: "/Users/me/Cache", fold: true}, "/USERS/ME/CACHE", true},
+		{anchor{path: "/Users/me/Cache", fold: true}, "/Users/me/caches", false},
+		{anchor{path: "/Users/me/Cache", fold: true}, "/Users/me", false},
+		{anchor{path: "/"}, "/anything", true},
+	} {
+		if have := tt.anchor.covers(tt.path); have != tt.want {
+			t.Errorf("%+v covers %q = %v, want %v", tt.anchor, tt.path, have, tt.want)
+		}
+	}
+	if a := newAnchor("/Users/me/Cache/"); a.path != "/Users/me/Cache" {
+		t.Errorf("newAnchor kept the trailing slash: %q", a.path)
+	}
+	if a := newAnchor("Cache"); a.fold {
+		t.Error("newAnchor folds a path relative to a device's root")
+	}
+}
+
+func TestExclusionPathsCase(t *testing.T) {
+	events := []Event{
+		{Path: "/Users/me/cache/file", ID: 1},
+		{Path: "/Users/me/Cache/", ID: 2},
+		{Path: "/Users/me/Documents/file", ID: 3},
+	}
+	for _, tt := range []struct {
+		sensitive bool
+		want      []uint64
+	}{
+		{false, []uint64{3}},
+		{true, []uint64{1, 3}},
+	} {
+		withCaseSensitive(t, tt.sensitive)
+		es := &EventStream{Events: make(chan []Event, 1), Backend: Poll, ExclusionPaths: []string{"/Users/me/Cache/"}}
+		_, rest := es.splitExclusions()
+		es.excluded = newAnchors(rest)
+		es.deliver(append([]Event(nil), events...))
+		var have []uint64
+		for _, e := range <-es.EventsChan() {
+			have = append(have, e.ID)
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("case-sensitive %v: got %v, want %v", tt.sensitive, have, tt.want)
+		}
+	}
+}
+
+// TestExclusionPathsVolume excludes a directory by another case on the
+// temporary directory's volume, which on macOS isn't case-sensitive by
+// default.
+func TestExclusionPathsVolume(t *testing.T) {
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensitive := tempDirCaseSensitive(t, tmp)
+	es := &EventStream{
+		Paths:          []string{tmp},
+		Events:         make(chan []Event, 1),
+		Backend:        Poll,
+		PollInterval:   time.Hour,
+		ExclusionPaths: []string{filepath.Join(tmp, "Cache") + "/"},
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if err := os.Mkdir(filepath.Join(tmp, "cache"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "cache", "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+
+	want := 0
+	if sensitive {
+		want = 2
+	}
+	var batch []Event
+	select {
+	case batch = <-es.EventsChan():
+	default:
+	}
+	if len(batch) != want {
+		t.Errorf("case-sensitive %v: got %v, want %d events", sensitive, batch, want)
+	}
+}
+
+func TestSubscribePrefixCase(t *testing.T) {
+	withCaseSensitive(t, false)
+	es := &EventStream{Events: make(chan []Event, 10)}
+	folded, cancelFolded := es.SubscribePrefix("/w/Projects/")
+	defer cancelFolded()
+	withCaseSensitive(t, true)
+	exact, cancelExact := es.SubscribePrefix("/w/Projects/")
+	defer cancelExact()
+
+	es.deliver([]Event{
+		{Path: "/w/projects/a", ID: 1},
+		{Path: "/w/Projects/", ID: 2},
+		{Path: "/W/PROJECTS/b", ID: 3},
+		{Path: "/w/Projectsb", ID: 4},
+	})
+	if have, want := drain(folded), []uint64{1, 2, 3}; !reflect.DeepEqual(have, want) {
+		t.Errorf("folded got %v, want %v", have, want)
+	}
+	if have, want := drain(exact), []uint64{2}; !reflect.DeepEqual(have, want) {
+		t.Errorf("case-sensitive got %v, want %v", have, want)
+	}
+
+	cancelFolded()
+	r := es.prefixes.Load().(*prefixRouter)
+	if len(r.folded.children) != 0 {
+		t.Errorf("folded tree left with %v after cancel", r.folded.children)
+	}
+}
+
+func TestIsRoot(t *testing.T) {
+	roots := []string{"/w/Root/"}
+	withCaseSensitive(t, true)
+	if !isRoot("/w/Root", roots) || !isRoot("/w/Root/", roots) || isRoot("/w/root", roots) {
+		t.Error("case-sensitive: wrong roots")
+	}
+	withCaseSensitive(t, false)
+	if !isRoot("/w/root/", roots) || isRoot("/w/Root/sub", roots) {
+		t.Error("not case-sensitive: wrong roots")
+	}
+}
@@ -0,0 +1,142 @@
+package fsevents
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ChangeClass says what an event changed of its item, as Event.Class
+// tells from its flags.
+type ChangeClass int
+
+const (
+	// Unclassified is the class of events with none of the flags of the
+	// others, such as those about the stream itself, MustScanSubDirs and
+	// HistoryDone. It's the zero value.
+	Unclassified ChangeClass = iota
+
+	// Content: the item's bytes, as ItemModified says.
+	Content
+
+	// Metadata: its permissions, owner, extended attributes or Finder
+	// info, as ItemInodeMetaMod, ItemChangeOwner, ItemXattrMod and
+	// ItemFinderInfoMod say.
+	Metadata
+
+	// Structure: the tree, with the item created, removed or renamed, as
+	// ItemCreated, ItemRemoved and ItemRenamed say.
+	Structure
+
+	// Mixed: more than one of those, as when FSEvents coalesces a chmod
+	// and a write, or a file's creation and the first write to it, into
+	// one event.
+	Mixed
+)
+
+func (c ChangeClass) String() string {
+	switch c {
+	case Unclassified:
+		return "Unclassified"
+	case Content:
+		return "Content"
+	case Metadata:
+		return "Metadata"
+	case Structure:
+		return "Structure"
+	case Mixed:
+		return "Mixed"
+	}
+	return fmt.Sprintf("ChangeClass(%d)", int(c))
+}
+
+// The flags of each ChangeClass.
+const (
+	contentClass   = ItemModified
+	metadataClass  = ItemInodeMetaMod | ItemChangeOwner | ItemXattrMod | ItemFinderInfoMod
+	structureClass = ItemCreated | ItemRemoved | ItemRenamed
+)
+
+// Class tells from e's flags what it changed of its item.
+func (e Event) Class() ChangeClass {
+	return classOf(e.Flags)
+}
+
+func classOf(flags EventFlags) ChangeClass {
+	class := Unclassified
+	for _, c := range [...]struct {
+		flags EventFlags
+		class ChangeClass
+	}{{contentClass, Content}, {metadataClass, Metadata}, {structureClass, Structure}} {
+		if flags&c.flags == 0 {
+			continue
+		}
+		if class != Unclassified {
+			return Mixed
+		}
+		class = c.class
+	}
+	return class
+}
+
+// Changes selects which classes of change an EventStream delivers.
+type Changes int
+
+const (
+	// AllChanges delivers every event. It's the zero value.
+	AllChanges Changes = iota
+
+	// ContentOnly delivers the events of class Content, leaving out
+	// those that only change metadata or the tree.
+	ContentOnly
+
+	// MetadataOnly delivers the events of class Metadata, leaving out
+	// those that only change content or the tree.
+	MetadataOnly
+)
+
+func (c Changes) String() string {
+	switch c {
+	case AllChanges:
+		return "AllChanges"
+	case ContentOnly:
+		return "ContentOnly"
+	case MetadataOnly:
+		return "MetadataOnly"
+	}
+	return fmt.Sprintf("Changes(%d)", int(c))
+}
+
+// selectChanges applies es.Changes and es.IgnoreMetadataOnly to the
+// batch, reusing its storage, and counts the events it leaves out as
+// filtered. Mixed and Unclassified events pass either way, as they may
+// hold what's asked for, or say something of the stream the consumer
+// can't do without.
+func (es *EventStream) selectChanges(events []Event) []Event {
+	var want ChangeClass
+	switch es.conf().Changes {
+	case ContentOnly:
+		want = Content
+	case MetadataOnly:
+		want = Metadata
+	}
+	ignore := es.conf().IgnoreMetadataOnly
+	if want == Unclassified && !ignore {
+		return events
+	}
+	kept := events[:0]
+	for _, e := range events {
+		c := classOf(e.Flags)
+		if c == Metadata && ignore || want != Unclassified && c != want && c != Mixed && c != Unclassified {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if n := len(events) - len(kept); n > 0 {
+		atomic.AddUint64(&es.stats.FilteredEvents, uint64(n))
+		tail := events[len(kept):]
+		for i := range tail {
+			tail[i] = Event{}
+		}
+	}
+	return kept
+}
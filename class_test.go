@@ -0,0 +1,196 @@
+package fsevents
+
+import (
+	"reflect"
+	"testing"
+)
+
+// changeFlags are the flags Event.Class goes by.
+var changeFlags = []EventFlags{
+	ItemModified,
+	ItemInodeMetaMod, ItemChangeOwner, ItemXattrMod, ItemFinderInfoMod,
+	ItemCreated, ItemRemoved, ItemRenamed,
+}
+
+// flagCombinations returns every combination of changeFlags.
+func flagCombinations() []EventFlags {
+	combos := make([]EventFlags, 0, 1<<len(changeFlags))
+	for mask := 0; mask < 1<<len(changeFlags); mask++ {
+		var flags EventFlags
+		for i, f := range changeFlags {
+			if mask&(1<<i) != 0 {
+				flags |= f
+			}
+		}
+		combos = append(combos, flags)
+	}
+	return combos
+}
+
+func TestChangeClass(t *testing.T) {
+	tests := []struct {
+		flags EventFlags
+		want  ChangeClass
+	}{
+		{0, Unclassified},
+		{MustScanSubDirs, Unclassified},
+		{HistoryDone, Unclassified},
+		{RootChanged | MustScanSubDirs, Unclassified},
+		{ItemIsFile, Unclassified},
+		{ItemModified | ItemIsFile, Content},
+		{ItemModified | ItemIsDir, Content},
+		{ItemInodeMetaMod | ItemIsFile, Metadata},
+		{ItemChangeOwner | ItemIsDir, Metadata},
+		{ItemXattrMod | ItemIsFile, Metadata},
+		{ItemFinderInfoMod | ItemIsFile, Metadata},
+		{ItemInodeMetaMod | ItemChangeOwner | ItemXattrMod | ItemFinderInfoMod | ItemIsFile, Metadata},
+		{ItemCreated | ItemIsFile, Structure},
+		{ItemRemoved | ItemIsSymlink, Structure},
+		{ItemRenamed | ItemIsDir, Structure},
+		{ItemCreated | ItemRemoved | ItemRenamed | ItemIsFile, Structure},
+		{ItemInodeMetaMod | ItemModified | ItemIsFile, Mixed}, // a chmod and a write
+		{ItemCreated | ItemModified | ItemIsFile, Mixed},
+		{ItemRenamed | ItemXattrMod | ItemIsFile, Mixed},
+		{ItemCreated | ItemModified | ItemChangeOwner | ItemIsFile, Mixed},
+		{ItemModified | MustScanSubDirs, Content},
+	}
+	for _, tt := range tests {
+		if have := (Event{Flags: tt.flags}).Class(); have != tt.want {
+			t.Errorf("Class() of %v = %v, want %v", tt.flags, have, tt.want)
+		}
+	}
+
+	// Every combination, on every kind of item: one class if its flags
+	// are all of it, Mixed if they're of more than one.
+	for _, flags := range flagCombinations() {
+		var classes []ChangeClass
+		if flags&ItemModified != 0 {
+			classes = append(classes, Content)
+		}
+		if flags&(ItemInodeMetaMod|ItemChangeOwner|ItemXattrMod|ItemFinderInfoMod) != 0 {
+			classes = append(classes, Metadata)
+		}
+		if flags&(ItemCreated|ItemRemoved|ItemRenamed) != 0 {
+			classes = append(classes, Structure)
+		}
+		want := Unclassified
+		switch len(classes) {
+		case 0:
+		case 1:
+			want = classes[0]
+		default:
+			want = Mixed
+		}
+		for _, kind := range []EventFlags{0, ItemIsFile, ItemIsDir, ItemIsSymlink} {
+			if have := (Event{Flags: flags | kind}).Class(); have != want {
+				t.Errorf("Class() of %v = %v, want %v", flags|kind, have, want)
+			}
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	// Every combination passes or not according to its class.
+	combos := flagCombinations()
+	for _, changes := range []Changes{AllChanges, ContentOnly, MetadataOnly} {
+		workload := make([]Event, len(combos))
+		for i, flags := range combos {
+			workload[i] = Event{Path: "/w/f", Flags: flags | ItemIsFile, ID: uint64(i + 1)}
+		}
+		var want []Event
+		for _, e := range workload {
+			switch c := e.Class(); {
+			case changes == AllChanges,
+				c == Mixed, c == Unclassified,
+				changes == ContentOnly && c == Content,
+				changes == MetadataOnly && c == Metadata:
+				want = append(want, e)
+			}
+		}
+		es := &EventStream{Events: make(chan []Event, 1), Changes: changes}
+		es.deliver(append([]Event(nil), workload...))
+		if have := <-es.EventsChan(); !reflect.DeepEqual(have, want) {
+			t.Errorf("%v got %d events, want %d", changes, len(have), len(want))
+		}
+		if st := es.Stats(); st.FilteredEvents != uint64(len(workload)-len(want)) || st.DeliveredEvents != uint64(len(want)) {
+			t.Errorf("%v stats %+v, want %d filtered", changes, st, len(workload)-len(want))
+		}
+	}
+
+	workload := []Event{
+		{Path: "/w", Flags: MustScanSubDirs, ID: 1},
+		{Path: "/w/a", Flags: ItemModified | ItemIsFile, ID: 2},
+		{Path: "/w/b", Flags: ItemInodeMetaMod | ItemIsFile, ID: 3},
+		{Path: "/w/c", Flags: ItemInodeMetaMod | ItemModified | ItemIsFile, ID: 4},
+		{Path: "/w/d", Flags: ItemCreated | ItemIsFile, ID: 5},
+		{Path: "/w/e/f", Flags: ItemXattrMod | ItemIsFile, ID: 6},
+	}
+	tests := []struct {
+		changes Changes
+		kind    Kind
+		want    []Event
+	}{
+		{AllChanges, All, workload},
+		{ContentOnly, All, []Event{workload[0], workload[1], workload[3]}},
+		{MetadataOnly, All, []Event{workload[0], workload[2], workload[3], workload[5]}},
+		// The directories of the metadata changes kept.
+		{MetadataOnly, DirsOnly, []Event{
+			workload[0],
+			{Path: "/w", Flags: ItemModified | ItemIsDir, ID: 4},
+			{Path: "/w/e", Flags: ItemModified | ItemIsDir, ID: 6},
+		}},
+	}
+	for _, tt := range tests {
+		es := &EventStream{Events: make(chan []Event, 1), Changes: tt.changes, Kind: tt.kind}
+		es.deliver(append([]Event(nil), workload...))
+		if have := <-es.EventsChan(); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%v and %v got %v, want %v", tt.changes, tt.kind, have, tt.want)
+		}
+	}
+}
+
+func TestIgnoreMetadataOnly(t *testing.T) {
+	combos := flagCombinations()
+	workload := make([]Event, len(combos))
+	for i, flags := range combos {
+		workload[i] = Event{Path: "/w/f", Flags: flags | ItemIsFile, ID: uint64(i + 1)}
+	}
+	for _, changes := range []Changes{AllChanges, ContentOnly, MetadataOnly} {
+		var want []Event
+		for _, e := range workload {
+			// Metadata bits OR'd with any others are kept.
+			if e.Flags&(ItemInodeMetaMod|ItemChangeOwner|ItemXattrMod|ItemFinderInfoMod) != 0 && e.Flags&(ItemModified|ItemCreated|ItemRemoved|ItemRenamed) == 0 {
+				continue
+			}
+			if c := e.Class(); changes == ContentOnly && c == Structure || changes == MetadataOnly && (c == Content || c == Structure) {
+				continue
+			}
+			want = append(want, e)
+		}
+		es := &EventStream{Events: make(chan []Event, 1), Changes: changes, IgnoreMetadataOnly: true}
+		es.deliver(append([]Event(nil), workload...))
+		if have := <-es.EventsChan(); !reflect.DeepEqual(have, want) {
+			t.Errorf("with %v, got %d events, want %d", changes, len(have), len(want))
+		}
+		if st := es.Stats(); st.FilteredEvents != uint64(len(workload)-len(want)) {
+			t.Errorf("with %v, %d filtered, want %d", changes, st.FilteredEvents, len(workload)-len(want))
+		}
+	}
+
+	es := &EventStream{Events: make(chan []Event, 1), IgnoreMetadataOnly: true}
+	es.deliver([]Event{
+		{Path: "/w", Flags: MustScanSubDirs, ID: 1},
+		{Path: "/w/a", Flags: ItemXattrMod | ItemIsFile, ID: 2},
+		{Path: "/w/b", Flags: ItemFinderInfoMod | ItemXattrMod | ItemIsDir, ID: 3},
+		{Path: "/w/c", Flags: ItemXattrMod | ItemModified | ItemIsFile, ID: 4},
+		{Path: "/w/d", Flags: ItemInodeMetaMod | ItemCreated | ItemIsFile, ID: 5},
+	})
+	want := []Event{
+		{Path: "/w", Flags: MustScanSubDirs, ID: 1},
+		{Path: "/w/c", Flags: ItemXattrMod | ItemModified | ItemIsFile, ID: 4},
+		{Path: "/w/d", Flags: ItemInodeMetaMod | ItemCreated | ItemIsFile, ID: 5},
+	}
+	if have := <-es.EventsChan(); !reflect.DeepEqual(have, want) {
+		t.Errorf("got %v, want %v", have, want)
+	}
+}
@@ -0,0 +1,230 @@
+// Command fsevents prints file system events for the given paths.
+//
+// Usage:
+//
+//	fsevents [flags] path...
+//
+// Events are printed one per line as "id flags path", or as JSON objects
+// with -json. With -resume-file the last event ID is saved on exit and the
+// next run resumes from it, replaying what happened in between. Interrupt
+// (Ctrl-C) flushes pending events and saves the state before exiting.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+)
+
+var createFlagNames = map[string]fsevents.CreateFlags{
+	"nodefer":    fsevents.NoDefer,
+	"watchroot":  fsevents.WatchRoot,
+	"ignoreself": fsevents.IgnoreSelf,
+	"fileevents": fsevents.FileEvents,
+}
+
+var eventFlagNames = []struct {
+	flag fsevents.EventFlags
+	name string
+}{
+	{fsevents.MustScanSubDirs, "MustScanSubDirs"},
+	{fsevents.KernelDropped, "KernelDropped"},
+	{fsevents.UserDropped, "UserDropped"},
+	{fsevents.EventIDsWrapped, "EventIDsWrapped"},
+	{fsevents.HistoryDone, "HistoryDone"},
+	{fsevents.RootChanged, "RootChanged"},
+	{fsevents.Mount, "Mount"},
+	{fsevents.Unmount, "Unmount"},
+	{fsevents.ItemCreated, "ItemCreated"},
+	{fsevents.ItemRemoved, "ItemRemoved"},
+	{fsevents.ItemInodeMetaMod, "ItemInodeMetaMod"},
+	{fsevents.ItemRenamed, "ItemRenamed"},
+	{fsevents.ItemModified, "ItemModified"},
+	{fsevents.ItemFinderInfoMod, "ItemFinderInfoMod"},
+	{fsevents.ItemChangeOwner, "ItemChangeOwner"},
+	{fsevents.ItemXattrMod, "ItemXattrMod"},
+	{fsevents.ItemIsFile, "ItemIsFile"},
+	{fsevents.ItemIsDir, "ItemIsDir"},
+	{fsevents.ItemIsSymlink, "ItemIsSymlink"},
+}
+
+var backendNames = map[string]fsevents.Backend{
+	"native": fsevents.Native,
+	"kqueue": fsevents.KQueue,
+	"poll":   fsevents.Poll,
+}
+
+// globs collects -exclude patterns.
+type globs []string
+
+func (g *globs) String() string { return strings.Join(*g, ",") }
+
+func (g *globs) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return err
+	}
+	*g = append(*g, s)
+	return nil
+}
+
+// match reports whether path or its base name matches a pattern.
+func (g globs) match(path string) bool {
+	for _, p := range g {
+		if ok, _ := filepath.Match(p, path); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "fsevents:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("fsevents", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: fsevents [flags] path...")
+		fs.PrintDefaults()
+	}
+	var (
+		latency    = fs.Duration("latency", 100*time.Millisecond, "how long FSEvents `waits` to coalesce events")
+		flagList   = fs.String("flags", "fileevents", "comma-separated stream `flags`: nodefer, watchroot, ignoreself, fileevents")
+		asJSON     = fs.Bool("json", false, "print events as JSON objects")
+		sinceTime  = fs.String("since-time", "", "replay events since this RFC 3339 `time`")
+		resumeFile = fs.String("resume-file", "", "`file` to resume from and save the last event ID to")
+		backend    = fs.String("backend", "native", "`backend` to watch with: native, kqueue or poll")
+		interval   = fs.Duration("poll-interval", time.Second, "time between walks with -backend poll")
+		exclude    globs
+	)
+	fs.Var(&exclude, "exclude", "skip paths whose path or base name matches this `glob`; may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no paths given")
+	}
+
+	es := &fsevents.EventStream{
+		Paths:        fs.Args(),
+		Latency:      *latency,
+		PollInterval: *interval,
+	}
+	var ok bool
+	if es.Backend, ok = backendNames[*backend]; !ok {
+		return fmt.Errorf("unknown backend %q", *backend)
+	}
+	for _, name := range strings.Split(*flagList, ",") {
+		if name = strings.TrimSpace(strings.ToLower(name)); name == "" {
+			continue
+		}
+		f, ok := createFlagNames[name]
+		if !ok {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		es.Flags |= f
+	}
+	if len(exclude) > 0 {
+		es.Filter = func(e *fsevents.Event) bool { return !exclude.match(e.Path) }
+	}
+
+	if *sinceTime != "" {
+		t, err := time.Parse(time.RFC3339, *sinceTime)
+		if err != nil {
+			return fmt.Errorf("-since-time: %w", err)
+		}
+		es.EventID = fsevents.EventIDForDeviceBeforeTime(es.Device, t)
+		es.Resume = true
+	}
+	var store *fsevents.StateStore
+	if *resumeFile != "" {
+		store = fsevents.NewStateStore(*resumeFile)
+		st, err := store.Load()
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case errors.Is(err, fsevents.ErrBadState):
+			fmt.Fprintf(os.Stderr, "%v, not resuming\n", err)
+		case err != nil:
+			return err
+		case !es.Resume && st.EventID != 0:
+			es.EventID, es.UUID = st.EventID, st.UUID
+			es.Resume = true
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	var writeErr atomic.Value
+	es.Handler = func(batch []fsevents.Event) {
+		for _, e := range batch {
+			if *asJSON {
+				enc.Encode(jsonEvent{ID: e.ID, Path: e.Path, Flags: flagNames(e.Flags)})
+			} else {
+				fmt.Fprintf(out, "%d %s %s\n", e.ID, strings.Join(flagNames(e.Flags), "|"), e.Path)
+			}
+		}
+		if err := out.Flush(); err != nil {
+			writeErr.Store(err)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	err := es.Start()
+	if errors.Is(err, fsevents.ErrHistoryUnavailable) {
+		fmt.Fprintf(os.Stderr, "fsevents: %s: %v, not resuming\n", *resumeFile, err)
+		es.Resume, es.EventID = false, 0
+		err = es.Start()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "fsevents: watching %s\n", strings.Join(es.Paths, ", "))
+	<-sig
+
+	es.Flush(true)
+	es.Stop()
+	if store != nil {
+		if err := es.SaveState(store); err != nil {
+			return err
+		}
+	}
+	if err, _ := writeErr.Load().(error); err != nil {
+		return err
+	}
+	return nil
+}
+
+type jsonEvent struct {
+	ID    uint64   `json:"id"`
+	Path  string   `json:"path"`
+	Flags []string `json:"flags"`
+}
+
+func flagNames(flags fsevents.EventFlags) []string {
+	names := []string{}
+	for _, f := range eventFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
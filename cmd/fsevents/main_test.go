@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+)
+
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "fsevents-cmd")
+	if err != nil {
+		panic(err)
+	}
+	binary = filepath.Join(dir, "fsevents")
+	if out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		panic("building fsevents: " + err.Error() + "\n" + string(out))
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// watcher is a running fsevents command.
+type watcher struct {
+	cmd    *exec.Cmd
+	lines  chan string
+	stderr *lockedBuffer
+}
+
+// lockedBuffer collects stderr while the command runs.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// start runs the command with the poll backend, which works on every
+// platform, and waits until it's watching.
+func start(t *testing.T, args ...string) *watcher {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("interrupting a process isn't supported on Windows")
+	}
+
+	args = append([]string{"-backend", "poll", "-poll-interval", "20ms"}, args...)
+	w := &watcher{cmd: exec.Command(binary, args...), lines: make(chan string, 100), stderr: &lockedBuffer{}}
+	stdout, err := w.cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := w.cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.cmd.Process.Kill() })
+
+	go func() {
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			w.lines <- s.Text()
+		}
+		close(w.lines)
+	}()
+	ready := make(chan struct{})
+	go func() {
+		r := bufio.NewReader(stderr)
+		line, _ := r.ReadString('\n')
+		io.WriteString(w.stderr, line)
+		close(ready)
+		io.Copy(w.stderr, r)
+	}()
+	select {
+	case <-ready:
+	case <-time.After(10 * time.Second):
+		t.Fatal("fsevents didn't start")
+	}
+	if !strings.Contains(w.stderr.String(), "watching") {
+		t.Fatalf("fsevents failed: %s", w.stderr)
+	}
+	return w
+}
+
+// waitFor returns the first output line containing s.
+func (w *watcher) waitFor(t *testing.T, s string) string {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				t.Fatalf("output ended before %q", s)
+			}
+			if strings.Contains(line, s) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("no output line containing %q", s)
+		}
+	}
+}
+
+// interrupt stops the command the way Ctrl-C would and returns the rest of
+// its output.
+func (w *watcher) interrupt(t *testing.T) []string {
+	t.Helper()
+	if err := w.cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	var rest []string
+	for line := range w.lines {
+		rest = append(rest, line)
+	}
+	if err := w.cmd.Wait(); err != nil {
+		t.Fatalf("fsevents exited with %v: %s", err, w.stderr)
+	}
+	return rest
+}
+
+func TestJSONOutput(t *testing.T) {
+	tmp := t.TempDir()
+	w := start(t, "-json", "-exclude", "*.tmp", tmp)
+
+	for _, name := range []string{"skipped.tmp", "kept.txt"} {
+		if err := os.WriteFile(filepath.Join(tmp, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var e jsonEvent
+	if err := json.Unmarshal([]byte(w.waitFor(t, "kept.txt")), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Path != filepath.Join(tmp, "kept.txt") || e.ID == 0 || len(e.Flags) == 0 || e.Flags[0] != "ItemCreated" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	for _, line := range w.interrupt(t) {
+		if strings.Contains(line, "skipped.tmp") {
+			t.Errorf("excluded path was reported: %s", line)
+		}
+	}
+}
+
+func TestInterruptFlushesAndSavesState(t *testing.T) {
+	tmp, state := t.TempDir(), filepath.Join(t.TempDir(), "state")
+	// Nothing is polled until the interrupt flushes the stream.
+	w := start(t, "-resume-file", state, "-poll-interval", "1h", tmp)
+
+	if err := os.Mkdir(filepath.Join(tmp, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	rest := w.interrupt(t)
+	if want := "ItemCreated|ItemIsDir " + filepath.Join(tmp, "dir"); len(rest) != 1 || !strings.HasSuffix(rest[0], want) {
+		t.Errorf("got %q, want one line ending in %q", rest, want)
+	}
+
+	st, err := fsevents.NewStateStore(state).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.EventID == 0 {
+		t.Errorf("saved event ID is 0")
+	}
+
+	// A second run picks the state up again.
+	w = start(t, "-resume-file", state, tmp)
+	w.interrupt(t)
+	if strings.Contains(w.stderr.String(), "not resuming") {
+		t.Errorf("state wasn't resumed: %s", w.stderr)
+	}
+}
@@ -0,0 +1,167 @@
+package fsevents
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// coalescer merges callback batches for a stream with MaxBatchDelay,
+// DeliveryInterval, a ReorderWindow or TransientWindow set. Callbacks
+// hand batches to a goroutine that owns the pending batch and emits it
+// when the delay expires, at the next tick or when the size cap is
+// reached.
+type coalescer struct {
+	es       *EventStream
+	start    time.Time // when the DeliveryInterval ticks count from
+	in       chan []Event
+	flushReq chan chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// startDelivery starts the statter and the coalescer if the stream is
+// configured for them, and the handler goroutine if it needs one.
+func (es *EventStream) startDelivery() {
+	es.startStats()
+	if es.conf().MaxBatchDelay <= 0 && es.conf().DeliveryInterval <= 0 && es.reorderWindow() <= 0 && es.conf().TransientWindow <= 0 || es.coalescer != nil {
+		es.startHandlers()
+		return
+	}
+	c := &coalescer{
+		es:       es,
+		start:    time.Now(),
+		in:       make(chan []Event),
+		flushReq: make(chan chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	es.coalescer = c
+	go c.run()
+}
+
+// stopDelivery emits anything still pending and stops the statter, the
+// coalescer and the handler goroutine. It must only be called once
+// callbacks can no longer reach the stream.
+func (es *EventStream) stopDelivery() {
+	es.stopStats()
+	if c := es.coalescer; c != nil {
+		close(c.quit)
+		<-c.done
+		es.coalescer = nil
+	}
+	es.stopHandlers()
+}
+
+// add queues a batch for merging. It blocks while the coalescer is busy
+// emitting, which preserves the backpressure of unmerged delivery.
+func (c *coalescer) add(events []Event) {
+	select {
+	case c.in <- events:
+	case <-c.quit:
+	}
+}
+
+// flush emits the pending batch. If wait is true it blocks until it has
+// been handed over.
+func (c *coalescer) flush(wait bool) {
+	reply := make(chan struct{})
+	select {
+	case c.flushReq <- reply:
+	case <-c.done:
+		return
+	}
+	if wait {
+		<-reply
+	}
+}
+
+func (c *coalescer) run() {
+	defer close(c.done)
+
+	var (
+		pending []Event
+		timer   = time.NewTimer(time.Hour)
+		timerC  <-chan time.Time
+	)
+	timer.Stop()
+
+	emit := func() {
+		if timerC != nil {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timerC = nil
+		}
+		if len(pending) > 0 {
+			atomic.AddInt64(&c.es.pending, -int64(len(pending)))
+			if c.es.conf().TransientWindow > 0 {
+				pending = c.es.dropTransients(pending)
+			}
+			if len(pending) > 0 {
+				c.es.emit(pending)
+			} else {
+				recycle(pending)
+			}
+			pending = nil
+		}
+	}
+
+	for {
+		select {
+		case events := <-c.in:
+			if pending == nil {
+				pending = newBatch(len(events))[:0]
+			}
+			pending = append(pending, events...)
+			atomic.AddInt64(&c.es.pending, int64(len(events)))
+			recycle(events)
+
+			if max := c.es.conf().MaxBatchSize; max > 0 && len(pending) >= max {
+				emit()
+			} else if timerC == nil {
+				timer.Reset(c.wait())
+				timerC = timer.C
+			}
+		case <-timerC:
+			timerC = nil
+			emit()
+		case reply := <-c.flushReq:
+			emit()
+			close(reply)
+		case <-c.quit:
+			emit()
+			return
+		}
+	}
+}
+
+// reorderWindow returns how long SortBatches holds batches back, if it
+// does.
+func (es *EventStream) reorderWindow() time.Duration {
+	if !es.conf().SortBatches {
+		return 0
+	}
+	return es.conf().ReorderWindow
+}
+
+// wait returns how long a batch that just started pending is held: until
+// MaxBatchDelay, the ReorderWindow or TransientWindow has passed or the
+// next DeliveryInterval tick, whichever comes first.
+func (c *coalescer) wait() time.Duration {
+	d := c.es.conf().MaxBatchDelay
+	for _, w := range []time.Duration{c.es.reorderWindow(), c.es.conf().TransientWindow} {
+		if w > 0 && (d <= 0 || w < d) {
+			d = w
+		}
+	}
+	if iv := c.es.conf().DeliveryInterval; iv > 0 {
+		tick := iv - time.Since(c.start)%iv
+		if d <= 0 || tick < d {
+			d = tick
+		}
+	}
+	return d
+}
@@ -0,0 +1,162 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"testing"
+	"time"
+)
+
+// burst injects n batches of size events each, with IDs counting up from 1.
+func burst(t *testing.T, es *EventStream, n, size int) {
+	id := uint64(0)
+	for i := 0; i < n; i++ {
+		batch := make([]Event, size)
+		for j := range batch {
+			id++
+			batch[j] = Event{Path: "/tmp/file", ID: id}
+		}
+		inject(t, es, batch...)
+	}
+}
+
+// collect receives from es.Events until quiet has passed without a batch.
+func collect(es *EventStream, quiet time.Duration) (receives int, events []Event) {
+	for {
+		select {
+		case batch := <-es.EventsChan():
+			receives++
+			events = append(events, batch...)
+		case <-time.After(quiet):
+			return receives, events
+		}
+	}
+}
+
+func TestCoalesceDelay(t *testing.T) {
+	es := &EventStream{
+		Events:        make(chan []Event, 100),
+		MaxBatchDelay: 200 * time.Millisecond,
+	}
+	es.startDelivery()
+	defer es.stopDelivery()
+
+	burst(t, es, 100, 10)
+	receives, events := collect(es, 500*time.Millisecond)
+
+	if len(events) != 1000 {
+		t.Fatalf("got %d events, want 1000", len(events))
+	}
+	if receives > 3 {
+		t.Errorf("got %d channel receives for one burst, want at most 3", receives)
+	}
+	for i, e := range events {
+		if e.ID != uint64(i+1) {
+			t.Fatalf("event %d has ID %d; merged batches out of order", i, e.ID)
+		}
+	}
+}
+
+func TestCoalesceMaxBatchSize(t *testing.T) {
+	es := &EventStream{
+		Events:        make(chan []Event, 100),
+		MaxBatchDelay: time.Minute,
+		MaxBatchSize:  250,
+	}
+	es.startDelivery()
+	defer es.stopDelivery()
+
+	burst(t, es, 100, 10)
+	receives, events := collect(es, 200*time.Millisecond)
+
+	if receives != 4 || len(events) != 1000 {
+		t.Errorf("got %d events in %d receives, want 1000 in 4", len(events), receives)
+	}
+}
+
+func TestCoalesceFlushAndStop(t *testing.T) {
+	es := &EventStream{
+		Events:        make(chan []Event, 100),
+		MaxBatchDelay: time.Minute,
+	}
+	es.startDelivery()
+
+	burst(t, es, 3, 2)
+	es.Flush(true)
+	if receives, events := collect(es, 50*time.Millisecond); receives != 1 || len(events) != 6 {
+		t.Errorf("after Flush: got %d events in %d receives, want 6 in 1", len(events), receives)
+	}
+
+	burst(t, es, 2, 2)
+	es.stopDelivery()
+	if receives, events := collect(es, 50*time.Millisecond); receives != 1 || len(events) != 4 {
+		t.Errorf("after stop: got %d events in %d receives, want 4 in 1", len(events), receives)
+	}
+}
+
+func TestDeliveryInterval(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	es := &EventStream{
+		Events:           make(chan []Event, 100),
+		DeliveryInterval: interval,
+	}
+	es.startDelivery()
+
+	// A steady source: a batch every 5ms for a second.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			burst(t, es, 1, 1)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	var times []time.Time
+	events := 0
+	for {
+		select {
+		case batch := <-es.EventsChan():
+			times = append(times, time.Now())
+			events += len(batch)
+			continue
+		case <-done:
+		}
+		break
+	}
+	es.stopDelivery()
+	receives, rest := collect(es, 50*time.Millisecond)
+	events += len(rest)
+
+	if events != 200 {
+		t.Fatalf("got %d events, want 200", events)
+	}
+	if n := len(times) + receives; n < 5 || n > 20 {
+		t.Errorf("got %d receives in about a second, want about 10", n)
+	}
+	if len(times) > 2 {
+		avg := times[len(times)-1].Sub(times[0]) / time.Duration(len(times)-1)
+		if avg < interval*7/10 || avg > interval*2 {
+			t.Errorf("receives %v apart on average, want about %v", avg, interval)
+		}
+	}
+}
+
+func TestDeliveryIntervalFlush(t *testing.T) {
+	es := &EventStream{
+		Events:           make(chan []Event, 100),
+		DeliveryInterval: time.Minute,
+		MaxBatchSize:     5,
+	}
+	es.startDelivery()
+	defer es.stopDelivery()
+
+	burst(t, es, 1, 3)
+	es.Flush(true)
+	if receives, events := collect(es, 50*time.Millisecond); receives != 1 || len(events) != 3 {
+		t.Errorf("after Flush: got %d events in %d receives, want 3 in 1", len(events), receives)
+	}
+	burst(t, es, 3, 2)
+	if receives, events := collect(es, 50*time.Millisecond); receives != 1 || len(events) != 6 {
+		t.Errorf("at MaxBatchSize: got %d events in %d receives, want 6 in 1", len(events), receives)
+	}
+}
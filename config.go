@@ -0,0 +1,224 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrAlreadyStarted is returned by Start on a stream that's already
+// running.
+var ErrAlreadyStarted = errors.New("fsevents: stream already started")
+
+// config is the configuration a stream runs with: its exported fields as
+// of Start, so that changing them while it runs neither changes nor races
+// with what it does. Its fields are named after theirs.
+type config struct {
+	Handler            func([]Event)
+	DeliveryMode       DeliveryMode
+	RawHandler         func(*RawBatch)
+	Paths              []string
+	KeepNestedPaths    bool
+	RawPaths           bool
+	Symlinks           SymlinkMode
+	UserData           interface{}
+	MaxPaths           int
+	Flags              CreateFlags
+	Latency            time.Duration
+	Device             int32
+	MaxBatchDelay      time.Duration
+	DeliveryInterval   time.Duration
+	MaxBatchSize       int
+	SortBatches        bool
+	ReorderWindow      time.Duration
+	TransientWindow    time.Duration
+	MaxDeliveredBatch  int
+	InternPaths        int
+	Filter             func(*Event) bool
+	ExclusionPaths     []string
+	ExclusionPatterns  []string
+	Kind               Kind
+	Changes            Changes
+	IgnoreMetadataOnly bool
+	RateLimit          float64
+	AtomicSaves        *AtomicSaves
+	OnGap              func(from, to uint64)
+	Rescanner          *Rescanner
+	AutoFlushOnDrop    bool
+	StatRenames        int
+	Enrich             bool
+	Workers            int
+	BufferSize         int
+	Overflow           OverflowPolicy
+	DispatchQueue      uintptr
+	SharedQueue        *SharedQueue
+	QoS                QoS
+	Backend            Backend
+	PollInterval       time.Duration
+	PollNetwork        bool
+	FallbackToPolling  bool
+	WaitForRoot        bool
+	AutoRestart        *RestartPolicy
+}
+
+// fields returns a copy of the stream's exported configuration, with
+// copies of what its slices and pointers hold but for the Rescanner and
+// SharedQueue, which are shared.
+func (es *EventStream) fields() *config {
+	c := &config{
+		Handler:            es.Handler,
+		DeliveryMode:       es.DeliveryMode,
+		RawHandler:         es.RawHandler,
+		Paths:              append([]string(nil), es.Paths...),
+		KeepNestedPaths:    es.KeepNestedPaths,
+		RawPaths:           es.RawPaths,
+		Symlinks:           es.Symlinks,
+		UserData:           es.UserData,
+		MaxPaths:           es.MaxPaths,
+		Flags:              es.Flags,
+		Latency:            es.Latency,
+		Device:             es.Device,
+		MaxBatchDelay:      es.MaxBatchDelay,
+		DeliveryInterval:   es.DeliveryInterval,
+		MaxBatchSize:       es.MaxBatchSize,
+		SortBatches:        es.SortBatches,
+		ReorderWindow:      es.ReorderWindow,
+		TransientWindow:    es.TransientWindow,
+		MaxDeliveredBatch:  es.MaxDeliveredBatch,
+		InternPaths:        es.InternPaths,
+		Filter:             es.Filter,
+		ExclusionPaths:     append([]string(nil), es.ExclusionPaths...),
+		ExclusionPatterns:  append([]string(nil), es.ExclusionPatterns...),
+		Kind:               es.Kind,
+		Changes:            es.Changes,
+		IgnoreMetadataOnly: es.IgnoreMetadataOnly,
+		RateLimit:          es.RateLimit,
+		OnGap:              es.OnGap,
+		Rescanner:          es.Rescanner,
+		AutoFlushOnDrop:    es.AutoFlushOnDrop,
+		StatRenames:        es.StatRenames,
+		Enrich:             es.Enrich,
+		Workers:            es.Workers,
+		BufferSize:         es.BufferSize,
+		Overflow:           es.Overflow,
+		DispatchQueue:      es.DispatchQueue,
+		SharedQueue:        es.SharedQueue,
+		QoS:                es.QoS,
+		Backend:            es.Backend,
+		PollInterval:       es.PollInterval,
+		PollNetwork:        es.PollNetwork,
+		FallbackToPolling:  es.FallbackToPolling,
+		WaitForRoot:        es.WaitForRoot,
+	}
+	if es.Paths == nil {
+		c.Paths = nil
+	}
+	if es.ExclusionPaths == nil {
+		c.ExclusionPaths = nil
+	}
+	if es.ExclusionPatterns == nil {
+		c.ExclusionPatterns = nil
+	}
+	if es.AutoRestart != nil {
+		p := *es.AutoRestart
+		c.AutoRestart = &p
+	}
+	if es.AtomicSaves != nil {
+		a := *es.AtomicSaves
+		if a.TempNames != nil {
+			a.TempNames = append([]TempName{}, a.TempNames...)
+		}
+		c.AtomicSaves = &a
+	}
+	return c
+}
+
+// conf returns the configuration the stream runs with: the one frozen by
+// Start, or while it's stopped, that of its fields.
+func (es *EventStream) conf() *config {
+	if c := es.frozen(); c != nil {
+		return c
+	}
+	return es.fields()
+}
+
+// frozen returns the configuration frozen by Start, or nil.
+func (es *EventStream) frozen() *config {
+	c, _ := es.cfg.Load().(*config)
+	return c
+}
+
+// freeze has the stream run with c from then on, or with nil, with what
+// its fields say again. es.lifecycle must be held.
+func (es *EventStream) freeze(c *config) {
+	es.cfg.Store(c)
+}
+
+// ConfigChangedError is sent on Errors as a stream stops, by Stop,
+// Restart or Reconfigure, when fields of it were changed while it ran,
+// which it took no notice of: use Reconfigure to change a running stream.
+type ConfigChangedError struct {
+	Fields []string // the names of the fields changed
+}
+
+func (e *ConfigChangedError) Error() string {
+	return fmt.Sprintf("fsevents: %s changed while the stream was running, which it ignored; use Reconfigure", strings.Join(e.Fields, ", "))
+}
+
+// changed returns the names of the fields that differ from c, comparing
+// funcs by their code and the rest by their values.
+func (es *EventStream) changed(c *config) []string {
+	var names []string
+	have := reflect.ValueOf(es).Elem()
+	want := reflect.ValueOf(c).Elem()
+	for i := 0; i < want.NumField(); i++ {
+		name := want.Type().Field(i).Name
+		h, w := have.FieldByName(name), want.Field(i)
+		var same bool
+		if w.Kind() == reflect.Func {
+			same = h.IsNil() == w.IsNil() && h.Pointer() == w.Pointer()
+		} else {
+			same = reflect.DeepEqual(h.Interface(), w.Interface())
+		}
+		if !same {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Reconfigure changes the stream's configuration with opts, the
+// supported way to change that of a running one, which takes no notice of
+// its fields from Start until Stop. It fails if the result couldn't be
+// started, as Clone does, changing nothing. A stream that isn't running
+// is only configured, for its next Start; a running one is restarted with
+// the new configuration, as by Restart, carrying on from its EventID, and
+// fails as Restart would.
+func (es *EventStream) Reconfigure(opts ...Option) error {
+	if es.inHandler() {
+		return ErrStopInHandler
+	}
+	if atomic.LoadInt32(&es.poisoned) != 0 {
+		return ErrStopTimeout
+	}
+	if _, err := es.Clone(opts...); err != nil {
+		return err
+	}
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	running := atomic.LoadInt32(&es.running) != 0
+	if running {
+		es.stopLocked()
+	}
+	for _, opt := range opts {
+		opt(es)
+	}
+	if !running {
+		return nil
+	}
+	es.Resume = true
+	return es.startLocked()
+}
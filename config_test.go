@@ -0,0 +1,99 @@
+package fsevents
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFrozenConfig(t *testing.T) {
+	filter := func(e *Event) bool { return !strings.HasSuffix(e.Path, ".skip") }
+	es := &EventStream{
+		Paths:   []string{"/d"},
+		Backend: Manual,
+		Filter:  filter,
+		Events:  make(chan []Event, 1),
+		Errors:  make(chan error, 1),
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if err := es.Start(); err != ErrAlreadyStarted {
+		t.Errorf("Start() on a running stream = %v", err)
+	}
+	inject := func() []string {
+		t.Helper()
+		if err := es.Inject([]Event{{Path: "/d/a.skip", ID: 1}, {Path: "/d/b", ID: 2}}); err != nil {
+			t.Fatal(err)
+		}
+		var have []string
+		for _, e := range <-es.EventsChan() {
+			have = append(have, e.Path+" in "+e.Root)
+		}
+		return have
+	}
+	want := []string{"/d/b in /d"}
+
+	// Changed as the stream runs, racing with it if it took notice.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		es.Paths = []string{"/elsewhere"}
+		es.Filter = nil
+		es.MaxDeliveredBatch = 1
+	}()
+	for i := 0; i < 10; i++ {
+		if have := inject(); !reflect.DeepEqual(have, want) {
+			t.Fatalf("delivered %q, want %q", have, want)
+		}
+	}
+	wg.Wait()
+
+	// Restart keeps to the configuration, saying it was changed.
+	if err := es.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *ConfigChangedError
+	if err := <-es.ErrorsChan(); !errors.As(err, &cerr) || !reflect.DeepEqual(cerr.Fields, []string{"Paths", "MaxDeliveredBatch", "Filter"}) {
+		t.Errorf("got error %v, want a ConfigChangedError for Paths, MaxDeliveredBatch and Filter", err)
+	}
+	if have := inject(); !reflect.DeepEqual(have, want) {
+		t.Errorf("delivered %q after Restart, want %q", have, want)
+	}
+
+	// Reconfigure is how it's changed.
+	if err := es.Reconfigure(WithMaxPaths(1), WithPaths("/d", "/e")); err != ErrTooManyPaths {
+		t.Errorf("Reconfigure() to too many paths = %v", err)
+	}
+	if es.MaxPaths != 0 {
+		t.Errorf("failed Reconfigure set MaxPaths %d", es.MaxPaths)
+	}
+	es.Paths, es.Filter, es.MaxDeliveredBatch = []string{"/d"}, filter, 0
+	if err := es.Reconfigure(WithFilter(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if st := es.Stats(); !st.Running {
+		t.Error("stream stopped by Reconfigure")
+	}
+	select {
+	case err := <-es.ErrorsChan():
+		t.Errorf("Reconfigure sent %v", err)
+	default:
+	}
+	want = []string{"/d/a.skip in /d", "/d/b in /d"}
+	if have := inject(); !reflect.DeepEqual(have, want) {
+		t.Errorf("delivered %q after Reconfigure, want %q", have, want)
+	}
+
+	es.Stop()
+	if err := es.Reconfigure(WithPaths("/e")); err != nil || !reflect.DeepEqual(es.Paths, []string{"/e"}) {
+		t.Errorf("Reconfigure() on a stopped stream = %v, Paths %q", err, es.Paths)
+	}
+	if es.Stats().Running {
+		t.Error("Reconfigure started a stopped stream")
+	}
+}
@@ -0,0 +1,88 @@
+package fsevents
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConformance runs the same file operations against every backend and
+// checks each reports them with the same flags. Backends the platform
+// doesn't support are skipped.
+func TestConformance(t *testing.T) {
+	for _, b := range []Backend{Native, KQueue, Poll} {
+		b := b
+		t.Run(b.String(), func(t *testing.T) {
+			testConformance(t, b)
+		})
+	}
+}
+
+func testConformance(t *testing.T, b Backend) {
+	// FSEvents reports paths with symlinks resolved (/private/var/...).
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := &EventStream{
+		Paths:        []string{tmp},
+		Flags:        FileEvents,
+		Latency:      10 * time.Millisecond,
+		Backend:      b,
+		PollInterval: 20 * time.Millisecond,
+	}
+	if err := es.Start(); errors.Is(err, ErrUnsupportedPlatform) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	file, renamed, dir := filepath.Join(tmp, "file"), filepath.Join(tmp, "renamed"), filepath.Join(tmp, "dir")
+	steps := []struct {
+		name string
+		op   func() error
+		path string
+		want EventFlags
+	}{
+		{"create", func() error {
+			f, err := os.Create(file)
+			if err == nil {
+				err = f.Close()
+			}
+			return err
+		}, file, ItemCreated | ItemIsFile},
+		{"write", func() error { return os.WriteFile(file, []byte("data"), 0o644) }, file, ItemModified | ItemIsFile},
+		{"chmod", func() error { return os.Chmod(file, 0o600) }, file, ItemInodeMetaMod | ItemIsFile},
+		{"rename", func() error { return os.Rename(file, renamed) }, file, ItemRenamed | ItemIsFile},
+		{"remove", func() error { return os.Remove(renamed) }, renamed, ItemRemoved | ItemIsFile},
+		{"mkdir", func() error { return os.Mkdir(dir, 0o755) }, dir, ItemCreated | ItemIsDir},
+	}
+
+	for _, step := range steps {
+		if err := step.op(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		timeout := time.After(5 * time.Second)
+	wait:
+		for {
+			select {
+			case batch := <-es.EventsChan():
+				for _, e := range batch {
+					if e.Path == step.path && e.Flags&step.want == step.want {
+						break wait
+					}
+				}
+			case <-timeout:
+				t.Fatalf("%s: no event for %s with %#x", step.name, step.path, uint32(step.want))
+			}
+		}
+	}
+	if atomic.LoadUint64(&es.EventID) == 0 {
+		t.Error("EventID wasn't updated")
+	}
+}
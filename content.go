@@ -0,0 +1,178 @@
+package fsevents
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// ContentCheck tells the ItemModified events that changed a file's
+// content from those that didn't, such as writes of the same bytes or
+// ones FSEvents reports for metadata changes. Its Filter method, used as
+// or from EventStream.Filter, hashes the file of each ItemModified event
+// and compares with the hash from its last one. If they match, the event
+// loses ItemModified, and is left out if that was its only change. The
+// first event on a file always passes, as there's nothing to compare with.
+//
+// The file is read when the event is filtered, not when it happened, so
+// a write still in progress is hashed as far as it got; if the file's
+// size or modification time changes while it's read, the event passes
+// and the hash is forgotten, as the rest of the write brings another
+// event. Paths must be openable, so it doesn't work with device-relative
+// streams. The zero value is ready to use, and it's safe for concurrent
+// use, as with Workers.
+type ContentCheck struct {
+	// Hash returns the hash to use. Nil means SHA-256, truncated to 128
+	// bits.
+	Hash func() hash.Hash
+
+	// Entries is how many files' hashes are remembered, evicting the
+	// least recently checked. Zero means 10000.
+	Entries int
+
+	// MaxSize is the size above which files aren't read whole. Zero
+	// means 64 MiB.
+	MaxSize int64
+
+	// SampleSize, if positive, has files above MaxSize hashed from their
+	// size and three samples of SampleSize bytes, at the start, middle
+	// and end, so a change elsewhere goes unnoticed. Otherwise their
+	// events always pass.
+	SampleSize int64
+
+	mu  sync.Mutex
+	lru *list.List // of *contentEntry, most recently used first
+	m   map[string]*list.Element
+}
+
+// contentEntry is the hash ContentCheck remembers for a path.
+type contentEntry struct {
+	path string
+	sum  string
+}
+
+// contentFlags are the flags of changes other than ItemModified that
+// ContentCheck leaves on an event.
+const contentFlags = ItemCreated | ItemInodeMetaMod | ItemFinderInfoMod | ItemChangeOwner | ItemXattrMod
+
+// Filter reports whether to keep e, clearing its ItemModified flag if the
+// file's content is unchanged.
+func (c *ContentCheck) Filter(e *Event) bool {
+	if e.Flags&ItemIsFile == 0 {
+		return true
+	}
+	if e.Flags&(ItemRemoved|ItemRenamed) != 0 {
+		c.forget(e.Path)
+		return true
+	}
+	if e.Flags&ItemModified == 0 {
+		return true
+	}
+	sum, ok := c.hashFile(e.Path)
+	if !ok {
+		c.forget(e.Path)
+		return true
+	}
+	if c.swap(e.Path, sum) != sum {
+		return true
+	}
+	e.Flags &^= ItemModified
+	return e.Flags&contentFlags != 0
+}
+
+// swap remembers sum for path and returns the sum it replaces, if any.
+func (c *ContentCheck) swap(path, sum string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.lru = list.New()
+		c.m = map[string]*list.Element{}
+	}
+	if el, ok := c.m[path]; ok {
+		c.lru.MoveToFront(el)
+		ce := el.Value.(*contentEntry)
+		old := ce.sum
+		ce.sum = sum
+		return old
+	}
+	c.m[path] = c.lru.PushFront(&contentEntry{path: path, sum: sum})
+	max := c.Entries
+	if max <= 0 {
+		max = 10000
+	}
+	if c.lru.Len() > max {
+		delete(c.m, c.lru.Remove(c.lru.Back()).(*contentEntry).path)
+	}
+	return ""
+}
+
+func (c *ContentCheck) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.m[path]; ok {
+		c.lru.Remove(el)
+		delete(c.m, path)
+	}
+}
+
+// hashFile returns the hash of the file at path. It fails if the file
+// can't be read, is too large and not sampled, or changes while it's read.
+func (c *ContentCheck) hashFile(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	before, err := f.Stat()
+	if err != nil || !before.Mode().IsRegular() {
+		return "", false
+	}
+
+	var h hash.Hash
+	if c.Hash != nil {
+		h = c.Hash()
+	} else {
+		h = sha256.New()
+	}
+	size := before.Size()
+	max := c.MaxSize
+	if max <= 0 {
+		max = 64 << 20
+	}
+	switch {
+	case size <= max:
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+			return "", false
+		}
+	case c.SampleSize > 0:
+		n := c.SampleSize
+		if 3*n > size {
+			n = size / 3
+		}
+		var b [8]byte
+		for i := range b {
+			b[i] = byte(size >> (8 * i))
+		}
+		h.Write(b[:])
+		for _, off := range []int64{0, size/2 - n/2, size - n} {
+			if _, err := io.Copy(h, io.NewSectionReader(f, off, n)); err != nil {
+				return "", false
+			}
+		}
+	default:
+		return "", false
+	}
+
+	after, err := os.Stat(path)
+	if err != nil || after.Size() != size || !after.ModTime().Equal(before.ModTime()) || !os.SameFile(before, after) {
+		return "", false
+	}
+	sum := h.Sum(nil)
+	if c.Hash == nil {
+		sum = sum[:16]
+	}
+	return string(sum), true
+}
@@ -0,0 +1,160 @@
+package fsevents
+
+import (
+	"crypto/sha256"
+	"hash"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var c ContentCheck
+	check := func(flags EventFlags) (EventFlags, bool) {
+		e := Event{Path: path, Flags: flags | ItemIsFile}
+		keep := c.Filter(&e)
+		return e.Flags &^ ItemIsFile, keep
+	}
+
+	write("one")
+	if _, keep := check(ItemModified); !keep {
+		t.Error("first event on a file was left out")
+	}
+	write("one")
+	if _, keep := check(ItemModified); keep {
+		t.Error("rewrite of the same content was kept")
+	}
+	write("two")
+	if _, keep := check(ItemModified); !keep {
+		t.Error("write of new content was left out")
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if flags, keep := check(ItemModified | ItemInodeMetaMod); !keep || flags != ItemInodeMetaMod {
+		t.Errorf("metadata change kept %v, flags %v; want kept with only ItemInodeMetaMod", keep, flags)
+	}
+	if _, keep := check(ItemInodeMetaMod); !keep {
+		t.Error("event without ItemModified was left out")
+	}
+
+	if _, keep := check(ItemRemoved); !keep {
+		t.Error("removal was left out")
+	}
+	if _, keep := check(ItemModified); !keep {
+		t.Error("event after a removal was compared with the hash before it")
+	}
+	if e := (Event{Path: filepath.Dir(path), Flags: ItemModified | ItemIsDir}); !c.Filter(&e) {
+		t.Error("directory event was left out")
+	}
+}
+
+func TestContentCheckEntries(t *testing.T) {
+	dir := t.TempDir()
+	c := ContentCheck{Entries: 1}
+	modified := func(name string) bool {
+		e := Event{Path: filepath.Join(dir, name), Flags: ItemModified | ItemIsFile}
+		return c.Filter(&e)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		modified(name)
+	}
+	if !modified("a") {
+		t.Error("evicted file's event was left out")
+	}
+	if modified("a") {
+		t.Error("unchanged file's event was kept")
+	}
+}
+
+func TestContentCheckLargeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	content := make([]byte, 3000)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modified := func(c *ContentCheck) bool {
+		e := Event{Path: path, Flags: ItemModified | ItemIsFile}
+		return c.Filter(&e)
+	}
+
+	whole := &ContentCheck{MaxSize: 1000}
+	modified(whole)
+	if !modified(whole) {
+		t.Error("file above MaxSize was checked without SampleSize")
+	}
+
+	sampled := &ContentCheck{MaxSize: 1000, SampleSize: 100}
+	modified(sampled)
+	if modified(sampled) {
+		t.Error("unchanged sampled file's event was kept")
+	}
+	content[2999] = 1
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !modified(sampled) {
+		t.Error("change in the last sample was left out")
+	}
+	content[1000] = 1
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if modified(sampled) {
+		t.Error("change between samples was noticed; want it missed")
+	}
+}
+
+// growingHash appends to a file as it's written to, like a write still in
+// progress while the file is hashed.
+type growingHash struct {
+	hash.Hash
+	path string
+}
+
+func (h growingHash) Write(p []byte) (int, error) {
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_WRONLY, 0)
+	if err == nil {
+		f.Write([]byte("more"))
+		f.Close()
+	}
+	return h.Hash.Write(p)
+}
+
+func TestContentCheckWriteInProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, []byte("start"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	growing := true
+	c := ContentCheck{Hash: func() hash.Hash {
+		if growing {
+			return growingHash{sha256.New(), path}
+		}
+		return sha256.New()
+	}}
+	modified := func() bool {
+		e := Event{Path: path, Flags: ItemModified | ItemIsFile}
+		return c.Filter(&e)
+	}
+
+	modified()
+	if !modified() {
+		t.Error("file changing while hashed was left out")
+	}
+	growing = false
+	modified()
+	if modified() {
+		t.Error("unchanged file's event was kept")
+	}
+}
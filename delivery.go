@@ -0,0 +1,159 @@
+package fsevents
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// DeliveryMode says where a stream's Handler runs.
+type DeliveryMode int
+
+const (
+	// Goroutine runs Handler on a goroutine of the stream's, which the
+	// callbacks hand each batch to in turn. It's the default.
+	Goroutine DeliveryMode = iota
+
+	// DispatchThread runs Handler inside the callback itself, on the
+	// stream's dispatch queue or run loop, or on the goroutine of a
+	// KQueue or Poll backend, with no scheduling in between. The
+	// callback, and with it FSEvents' queue, waits for Handler, so it
+	// must be fast; it must not call Stop, StopWithTimeout or Restart,
+	// which would wait for the callback to end, and get ErrStopInHandler
+	// instead; and it mustn't block on anything that in turn waits for
+	// the stream. It rules out MaxBatchDelay, DeliveryInterval,
+	// ReorderWindow, TransientWindow, RateLimit, StatRenames and Enrich,
+	// which deliver batches later from goroutines of their own.
+	DispatchThread
+)
+
+func (m DeliveryMode) String() string {
+	switch m {
+	case Goroutine:
+		return "Goroutine"
+	case DispatchThread:
+		return "DispatchThread"
+	}
+	return fmt.Sprintf("DeliveryMode(%d)", int(m))
+}
+
+// ErrStopInHandler is returned by StopWithTimeout, Restart, Suspend and
+// Continue, and sent on Errors by Stop, when they're called from the
+// stream's own Handler, which they'd otherwise wait for forever. They do
+// nothing.
+var ErrStopInHandler = errors.New("fsevents: stream stopped from its own Handler")
+
+var errDispatchThread = errors.New("fsevents: DispatchThread delivery rules out MaxBatchDelay, DeliveryInterval, ReorderWindow, TransientWindow, RateLimit, StatRenames and Enrich")
+
+// checkDelivery reports whether the stream's DeliveryMode can be used
+// with its other settings.
+func (es *EventStream) checkDelivery() error {
+	if es.conf().DeliveryMode == DispatchThread && (es.conf().MaxBatchDelay > 0 || es.conf().DeliveryInterval > 0 || es.reorderWindow() > 0 || es.conf().TransientWindow > 0 || es.conf().RateLimit > 0 || es.conf().StatRenames > 0 || es.conf().Enrich) {
+		return errDispatchThread
+	}
+	return nil
+}
+
+// handlerQueue is the goroutine that runs Handler in Goroutine mode, or
+// sends on Events or BatchesMeta under BlockWithTimeout, so that the
+// timed wait is never on the dispatch thread.
+type handlerQueue struct {
+	in       chan Batch
+	flushReq chan chan struct{}
+	done     chan struct{}
+}
+
+// startHandlers starts the handler goroutine if Handler runs on one of
+// its own, in Goroutine mode, or the stream sends under BlockWithTimeout,
+// unless the coalescer already does either.
+func (es *EventStream) startHandlers() {
+	if es.coalescer != nil || es.handlers != nil {
+		return
+	}
+	c := es.conf()
+	if c.Handler != nil && c.DeliveryMode != Goroutine || c.Handler == nil && (c.RawHandler != nil || c.Overflow.kind != overflowBlockTimeout) {
+		return
+	}
+	q := &handlerQueue{
+		in:       make(chan Batch),
+		flushReq: make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	es.handlers = q
+	go q.run(es)
+}
+
+// stopHandlers waits for the handler goroutine to finish with its batch
+// and stops it. Like stopDelivery, it must only be called once nothing
+// else can emit.
+func (es *EventStream) stopHandlers() {
+	q := es.handlers
+	if q == nil {
+		return
+	}
+	close(q.in)
+	<-q.done
+	es.handlers = nil
+}
+
+func (q *handlerQueue) run(es *EventStream) {
+	defer close(q.done)
+	id := goid()
+	for {
+		select {
+		case b, ok := <-q.in:
+			if !ok {
+				return
+			}
+			if es.conf().Handler == nil {
+				es.send(b)
+				continue
+			}
+			es.callHandler(b.Events, id)
+		case reply := <-q.flushReq:
+			close(reply)
+		}
+	}
+}
+
+// flush waits for Handler to return from, or send to have placed or
+// dropped, the batches handed over so far.
+func (q *handlerQueue) flush() {
+	reply := make(chan struct{})
+	select {
+	case q.flushReq <- reply:
+		<-reply
+	case <-q.done:
+	}
+}
+
+// callHandler runs Handler on events, on the goroutine with ID id, and
+// recycles them.
+func (es *EventStream) callHandler(events []Event, id int64) {
+	prev := atomic.SwapInt64(&es.handlerG, id)
+	es.conf().Handler(events)
+	atomic.StoreInt64(&es.handlerG, prev)
+	es.countDelivered(len(events))
+	recycle(events)
+}
+
+// inHandler reports whether it's called from within the stream's Handler.
+func (es *EventStream) inHandler() bool {
+	id := atomic.LoadInt64(&es.handlerG)
+	return id != 0 && id == goid()
+}
+
+// goid returns the ID of the calling goroutine, from the header of its
+// stack trace: "goroutine 123 [running]:".
+func goid() int64 {
+	var buf [32]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseInt(string(b), 10, 64)
+	return id
+}
@@ -0,0 +1,127 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startHandlerStream starts a Poll stream that doesn't poll by itself,
+// for tests to deliver to, with handler as its Handler.
+func startHandlerStream(t *testing.T, mode DeliveryMode, handler func([]Event)) *EventStream {
+	t.Helper()
+	es := &EventStream{
+		Paths:        []string{t.TempDir()},
+		Errors:       make(chan error, 10),
+		Backend:      Poll,
+		PollInterval: time.Hour,
+		Handler:      handler,
+		DeliveryMode: mode,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(es.Stop)
+	return es
+}
+
+func TestDeliveryModes(t *testing.T) {
+	var want []Event
+	for i := 1; i <= 100; i++ {
+		want = append(want, Event{Path: fmt.Sprintf("/f%d", i%7), Flags: ItemModified | ItemIsFile, ID: uint64(i)})
+	}
+
+	seqs := map[DeliveryMode][]Event{}
+	for _, mode := range []DeliveryMode{Goroutine, DispatchThread} {
+		var have []Event
+		var ids []int64
+		es := startHandlerStream(t, mode, func(batch []Event) {
+			have = append(have, batch...)
+			ids = append(ids, goid())
+		})
+		for i := 0; i < len(want); i += 10 {
+			batch := newBatch(10)
+			copy(batch, want[i:])
+			es.deliver(batch)
+		}
+		es.Flush(true)
+		seqs[mode] = have
+
+		self := goid()
+		for _, id := range ids {
+			if (id == self) != (mode == DispatchThread) {
+				t.Errorf("%v: Handler ran on goroutine %d, delivering from %d", mode, id, self)
+				break
+			}
+		}
+	}
+	if !reflect.DeepEqual(seqs[Goroutine], want) {
+		t.Errorf("Goroutine delivered %v, want %v", seqs[Goroutine], want)
+	}
+	if !reflect.DeepEqual(seqs[DispatchThread], seqs[Goroutine]) {
+		t.Errorf("DispatchThread delivered %v, Goroutine %v", seqs[DispatchThread], seqs[Goroutine])
+	}
+}
+
+func TestStopInHandler(t *testing.T) {
+	for _, mode := range []DeliveryMode{Goroutine, DispatchThread} {
+		t.Run(mode.String(), func(t *testing.T) {
+			var errs []error
+			var es *EventStream
+			es = startHandlerStream(t, mode, func([]Event) {
+				es.Stop()
+				errs = append(errs, es.StopWithTimeout(time.Second), es.Restart())
+			})
+			es.deliver([]Event{{Path: "/a", Flags: ItemCreated | ItemIsFile, ID: 1}})
+			es.Flush(true)
+
+			if err := <-es.ErrorsChan(); err != ErrStopInHandler {
+				t.Errorf("Stop sent %v, want ErrStopInHandler", err)
+			}
+			for _, err := range errs {
+				if err != ErrStopInHandler {
+					t.Errorf("got %v, want ErrStopInHandler", err)
+				}
+			}
+			if !es.Stats().Running {
+				t.Error("stream stopped from its Handler")
+			}
+			// Outside the Handler it stops as usual.
+			if err := es.StopWithTimeout(time.Second); err != nil {
+				t.Errorf("StopWithTimeout() = %v", err)
+			}
+		})
+	}
+}
+
+func TestDispatchThreadRulesOut(t *testing.T) {
+	for _, es := range []*EventStream{
+		{MaxBatchDelay: time.Second},
+		{DeliveryInterval: time.Second},
+		{RateLimit: 10},
+		{StatRenames: 1},
+		{Enrich: true},
+	} {
+		es.Paths = []string{t.TempDir()}
+		es.Backend = Poll
+		es.DeliveryMode = DispatchThread
+		if err := es.Start(); !errors.Is(err, errDispatchThread) {
+			es.Stop()
+			t.Errorf("Start() = %v, want errDispatchThread", err)
+		}
+	}
+}
+
+func TestGoid(t *testing.T) {
+	self := goid()
+	if self <= 0 {
+		t.Fatalf("goid() = %d", self)
+	}
+	other := make(chan int64)
+	go func() { other <- goid() }()
+	if id := <-other; id == self || id <= 0 {
+		t.Errorf("goid() = %d on another goroutine, %d on this one", id, self)
+	}
+}
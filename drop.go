@@ -0,0 +1,103 @@
+package fsevents
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// DropRecovered is sent on Errors by an AutoFlushOnDrop stream once it
+// has flushed after events were dropped, and delivered what the flush
+// brought, so the consumer can rescan what the lost events were about.
+type DropRecovered struct {
+	// From and To bound the IDs of the events believed lost: from the
+	// one after the highest the stream had seen before the drop, to the
+	// highest it had seen once flushed.
+	From, To uint64
+
+	// Paths holds the paths of the events that reported the drop, and
+	// Flags their KernelDropped and UserDropped flags.
+	Paths []string
+	Flags EventFlags
+}
+
+func (d *DropRecovered) Error() string {
+	return fmt.Sprintf("fsevents: recovered from %v below %q, event IDs %d to %d", d.Flags, d.Paths, d.From, d.To)
+}
+
+// checkDrops records the events of a batch that report dropped events,
+// for watchDrops to recover from, prev being the highest ID seen before
+// the batch. It reports whether there were any.
+func (es *EventStream) checkDrops(events []Event, prev uint64) bool {
+	found := false
+	for _, e := range events {
+		if e.Flags&(KernelDropped|UserDropped) == 0 {
+			continue
+		}
+		es.dropMu.Lock()
+		d := es.dropPending
+		if d == nil {
+			d = &DropRecovered{From: prev + 1}
+			es.dropPending = d
+		}
+		d.Flags |= e.Flags & (KernelDropped | UserDropped)
+		if !containsString(d.Paths, e.Path) {
+			d.Paths = append(d.Paths, e.Path)
+		}
+		es.dropMu.Unlock()
+		found = true
+	}
+	if found {
+		select {
+		case es.dropCheck <- struct{}{}:
+		default:
+		}
+	}
+	return found
+}
+
+// watchDrops recovers from the drops checkDrops records whenever check is
+// signalled, until quit is closed.
+func (es *EventStream) watchDrops(quit, check chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-check:
+			es.recoverDrops(quit)
+		}
+	}
+}
+
+// recoverDrops flushes the stream synchronously, has the Rescanner, if
+// any, walk its roots and reports the drops as recovered, unless the
+// stream was stopped since watchDrops was started with quit.
+func (es *EventStream) recoverDrops(quit chan struct{}) {
+	es.lifecycle.Lock()
+	if es.dropQuit != quit {
+		es.lifecycle.Unlock()
+		return
+	}
+	es.flushLocked(true)
+	if r := es.conf().Rescanner; r != nil && es.conf().Device == 0 {
+		es.rescan(r.roots)
+	}
+	es.dropMu.Lock()
+	d := es.dropPending
+	es.dropPending = nil
+	es.dropMu.Unlock()
+	es.lifecycle.Unlock()
+	if d == nil {
+		return
+	}
+	d.To = atomic.LoadUint64(&es.EventID)
+	es.report(d)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
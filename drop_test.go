@@ -0,0 +1,60 @@
+package fsevents
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestAutoFlushOnDrop has a Rescanner catch up after a drop, once, off
+// the callback, and expects DropRecovered after what it found.
+func TestAutoFlushOnDrop(t *testing.T) {
+	tmp := rescanTree(t)
+	es := New([]string{tmp}, WithBackend(Manual), WithBufferSize(10))
+	es.Rescanner = NewRescanner(tmp)
+	es.AutoFlushOnDrop = true
+	es.Errors = make(chan error, 1)
+	want := mutate(t, tmp)
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	if err := es.Inject([]Event{{Path: filepath.Join(tmp, "x"), Flags: ItemCreated | ItemIsFile, ID: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Inject([]Event{{Path: tmp, Flags: UserDropped | MustScanSubDirs, ID: 8}, {Path: tmp, Flags: KernelDropped, ID: 8}}); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	select {
+	case err = <-es.ErrorsChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no DropRecovered")
+	}
+	d, ok := err.(*DropRecovered)
+	if !ok {
+		t.Fatalf("got %v, want a DropRecovered", err)
+	}
+	if wantD := (&DropRecovered{From: 6, To: 8, Paths: []string{tmp}, Flags: UserDropped | KernelDropped}); !reflect.DeepEqual(d, wantD) {
+		t.Errorf("got %+v, want %+v", d, wantD)
+	}
+
+	// By then the batches, and what the rescan found, are out.
+	var batches [][]string
+	for len(es.EventsChan()) > 0 {
+		var paths []string
+		for _, e := range <-es.EventsChan() {
+			paths = append(paths, e.Path)
+		}
+		batches = append(batches, paths)
+	}
+	var rescanned []string
+	for _, e := range want {
+		rescanned = append(rescanned, e.Path)
+	}
+	if wantB := [][]string{{filepath.Join(tmp, "x")}, {tmp, tmp}, rescanned}; !reflect.DeepEqual(batches, wantB) {
+		t.Errorf("got batches %q, want %q", batches, wantB)
+	}
+}
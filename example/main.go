@@ -30,7 +30,7 @@ func main() {
 		Device:  dev,
 		Flags:   fsevents.FileEvents | fsevents.WatchRoot}
 	es.Start()
-	ec := es.Events
+	ec := es.EventsChan()
 
 	log.Println("Device UUID", fsevents.GetDeviceUUID(dev))
 
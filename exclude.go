@@ -0,0 +1,209 @@
+package fsevents
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// maxKernelExclusions is how many exclusion paths FSEvents accepts.
+const maxKernelExclusions = 8
+
+// SystemRootExclusions are the paths WatchSystemRoot leaves out by
+// default: caches, logs and databases the system rewrites all the time,
+// Spotlight's and FSEvents' own stores, the system volumes and Time
+// Machine's local snapshots. The noisiest come first, for FSEvents to
+// skip.
+var SystemRootExclusions = []string{
+	"/private/var/folders",
+	"/private/var/db",
+	"/System/Volumes/VM",
+	"/.Spotlight-V100",
+	"/System/Volumes/Data/.Spotlight-V100",
+	"/.fseventsd",
+	"/System/Volumes/Data/.fseventsd",
+	"/private/var/log",
+	"/System/Volumes/Preboot",
+	"/System/Volumes/Update",
+	"/System/Volumes/xarts",
+	"/System/Volumes/iSCPreboot",
+	"/System/Volumes/Hardware",
+	"/.MobileBackups",
+	"/Volumes/com.apple.TimeMachine.localsnapshots",
+	"/Library/Caches",
+}
+
+// WatchSystemRoot starts a stream on "/", configured by opts, for tools
+// that watch everything, such as search indexers. Unless opts set
+// ExclusionPaths, it leaves out SystemRootExclusions; to add to them,
+// pass WithExclusionPaths with a copy of the list extended.
+func WatchSystemRoot(opts ...Option) (*EventStream, error) {
+	es := &EventStream{
+		Paths:          []string{"/"},
+		Flags:          FileEvents,
+		ExclusionPaths: append([]string(nil), SystemRootExclusions...),
+	}
+	for _, opt := range opts {
+		opt(es)
+	}
+	if err := startStream(es); err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+// WatchSystemRootStream is WatchSystemRoot returning the started stream as
+// a Stream.
+func WatchSystemRootStream(opts ...Option) (Stream, error) {
+	es, err := WatchSystemRoot(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+// splitExclusions returns the cleaned ExclusionPaths for FSEvents to
+// apply and those the stream filters out itself. FSEvents only applies
+// them for a Native stream that's neither device-relative nor polling
+// network paths.
+func (es *EventStream) splitExclusions() (kernel, rest []string) {
+	if len(es.conf().ExclusionPaths) == 0 {
+		return nil, nil
+	}
+	paths := make([]string, len(es.conf().ExclusionPaths))
+	for i, path := range es.conf().ExclusionPaths {
+		if es.conf().Device == 0 {
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+		}
+		paths[i] = filepath.Clean(path)
+	}
+	if es.conf().Backend != Native || es.conf().Device != 0 || es.polls() {
+		return nil, paths
+	}
+	if len(paths) > maxKernelExclusions {
+		return paths[:maxKernelExclusions], paths[maxKernelExclusions:]
+	}
+	return paths, nil
+}
+
+// exclude drops the events below es.excluded or matching es.patterns,
+// reusing the batch's storage. On a volume that isn't case-sensitive, an
+// exclusion path matches names whatever their case.
+func (es *EventStream) exclude(events []Event) []Event {
+	if len(es.excluded) == 0 && len(es.patterns) == 0 {
+		return events
+	}
+	kept := events[:0]
+	for _, e := range events {
+		if !underAnchor(e.Path, es.excluded) && !matchAny(e.Path, es.patterns) {
+			kept = append(kept, e)
+		}
+	}
+	if n := len(events) - len(kept); n > 0 {
+		atomic.AddUint64(&es.stats.FilteredEvents, uint64(n))
+		tail := events[len(kept):]
+		for i := range tail {
+			tail[i] = Event{}
+		}
+	}
+	return kept
+}
+
+// pattern is one of ExclusionPatterns split into its elements.
+type pattern struct {
+	elems    []string
+	absolute bool // matched from the root rather than at any depth
+}
+
+// checkPatterns fails for an ExclusionPatterns entry filepath.Match
+// can't take.
+func (es *EventStream) checkPatterns() error {
+	for _, p := range es.conf().ExclusionPatterns {
+		if p == "" {
+			return fmt.Errorf("fsevents: empty exclusion pattern: %w", filepath.ErrBadPattern)
+		}
+		for _, elem := range strings.Split(p, "/") {
+			if _, err := filepath.Match(elem, ""); err != nil {
+				return fmt.Errorf("fsevents: exclusion pattern %q: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// compilePatterns splits patterns, checked by checkPatterns, into their
+// elements.
+func compilePatterns(patterns []string) []pattern {
+	var compiled []pattern
+	for _, p := range patterns {
+		c := pattern{absolute: strings.HasPrefix(p, "/")}
+		for _, elem := range strings.Split(p, "/") {
+			if elem != "" {
+				c.elems = append(c.elems, elem)
+			}
+		}
+		if len(c.elems) > 0 {
+			compiled = append(compiled, c)
+		}
+	}
+	return compiled
+}
+
+// matchAny reports whether path, or a directory it's below, matches one
+// of patterns.
+func matchAny(path string, patterns []pattern) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	return matchSplit(pathElems(path), patterns)
+}
+
+// pathElems returns the elements of path.
+func pathElems(path string) []string {
+	var elems []string
+	for _, elem := range strings.Split(path, "/") {
+		if elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// matchSplit is matchAny for a path split by pathElems.
+func matchSplit(elems []string, patterns []pattern) bool {
+	for _, p := range patterns {
+		last := len(elems) - len(p.elems)
+		if p.absolute && last > 0 {
+			last = 0
+		}
+		for i := 0; i <= last; i++ {
+			if matchElems(elems[i:], p.elems) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchElems reports whether the first of elems match those of pattern.
+func matchElems(elems, pattern []string) bool {
+	for i, p := range pattern {
+		if ok, _ := filepath.Match(p, elems[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// underAny reports whether path is one of dirs or below one.
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir) && (strings.HasSuffix(dir, "/") || path[len(dir)] == '/') {
+			return true
+		}
+	}
+	return false
+}
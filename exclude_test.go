@@ -0,0 +1,146 @@
+package fsevents
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExclusionPaths(t *testing.T) {
+	tmp := t.TempDir()
+	es := &EventStream{
+		Paths:          []string{tmp},
+		Events:         make(chan []Event, 1),
+		Backend:        Poll,
+		PollInterval:   time.Hour,
+		ExclusionPaths: []string{filepath.Join(tmp, "cache") + "/", filepath.Join(tmp, "logs")},
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	for _, dir := range []string{"cache/sub", "logs", "logsbook"} {
+		if err := os.MkdirAll(filepath.Join(tmp, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "logs", "today"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+
+	batch := <-es.EventsChan()
+	if len(batch) != 1 || batch[0].Path != filepath.Join(tmp, "logsbook") {
+		t.Errorf("got %v, want only logsbook", batch)
+	}
+	if n := es.Stats().FilteredEvents; n != 4 {
+		t.Errorf("FilteredEvents = %d, want 4", n)
+	}
+}
+
+func TestWatchSystemRoot(t *testing.T) {
+	var started *EventStream
+	prev := startStream
+	startStream = func(es *EventStream) error { started = es; return nil }
+	t.Cleanup(func() { startStream = prev })
+
+	es, err := WatchSystemRoot(WithLatency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es != started || len(es.Paths) != 1 || es.Paths[0] != "/" || es.Latency != 2 {
+		t.Fatalf("stream paths=%q latency=%s", es.Paths, es.Latency)
+	}
+	if !reflect.DeepEqual(es.ExclusionPaths, SystemRootExclusions) {
+		t.Errorf("ExclusionPaths = %q, want SystemRootExclusions", es.ExclusionPaths)
+	}
+	es.ExclusionPaths[0] = "/changed"
+	if SystemRootExclusions[0] == "/changed" {
+		t.Error("the stream shares SystemRootExclusions")
+	}
+
+	// FSEvents skips the first eight; the rest are filtered out here.
+	es, _ = WatchSystemRoot()
+	es.Events = make(chan []Event, 1)
+	kernel, rest := es.splitExclusions()
+	if len(kernel) != maxKernelExclusions || len(rest) != len(SystemRootExclusions)-maxKernelExclusions {
+		t.Fatalf("split %d exclusions into %d and %d", len(SystemRootExclusions), len(kernel), len(rest))
+	}
+	es.excluded = newAnchors(rest)
+	es.deliver([]Event{
+		{Path: "/Library/Caches/com.apple.Safari/Cache.db", ID: 1},
+		{Path: "/System/Volumes/Update", ID: 2},
+		{Path: "/Library/CachesFolder/file", ID: 3},
+		{Path: "/Users/me/notes.txt", ID: 4},
+	})
+	batch := <-es.EventsChan()
+	if len(batch) != 2 || batch[0].ID != 3 || batch[1].ID != 4 {
+		t.Errorf("got %v, want events 3 and 4", batch)
+	}
+
+	es, _ = WatchSystemRoot(WithExclusionPaths("/Users/me/tmp"))
+	if !reflect.DeepEqual(es.ExclusionPaths, []string{"/Users/me/tmp"}) {
+		t.Errorf("ExclusionPaths = %q, want the option's", es.ExclusionPaths)
+	}
+
+	if s, err := WatchSystemRootStream(WithLatency(2)); err != nil || s != Stream(started) || started.Latency != 2 {
+		t.Errorf("WatchSystemRootStream() = %v, %v, want the started stream", s, err)
+	}
+	startStream = func(*EventStream) error { return errors.New("failed") }
+	if s, err := WatchSystemRootStream(); s != nil || err == nil {
+		t.Errorf("WatchSystemRootStream() = %v, %v, want a nil Stream and the error", s, err)
+	}
+}
+
+func TestExclusionPatterns(t *testing.T) {
+	es := &EventStream{
+		Paths:             []string{"/d"},
+		Backend:           Manual,
+		ExclusionPatterns: []string{"node_modules", ".git/objects", "/d/*/build", "*.swp"},
+		Events:            make(chan []Event, 1),
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	in := []string{
+		"/d/node_modules",
+		"/d/web/node_modules/left-pad/index.js",
+		"/d/node_modules_notes",
+		"/d/.git/objects/ab/cdef",
+		"/d/.git/HEAD",
+		"/d/objects",
+		"/d/app/build/out.o",
+		"/d/app/src/build",
+		"/d/.main.go.swp",
+		"/d/main.go",
+	}
+	var events []Event
+	for i, path := range in {
+		events = append(events, Event{Path: path, ID: uint64(i + 1)})
+	}
+	if err := es.Inject(events); err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, e := range <-es.EventsChan() {
+		have = append(have, e.Path)
+	}
+	want := []string{"/d/node_modules_notes", "/d/.git/HEAD", "/d/objects", "/d/app/src/build", "/d/main.go"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("got %q, want %q", have, want)
+	}
+	if n := es.Stats().FilteredEvents; n != 5 {
+		t.Errorf("FilteredEvents = %d, want 5", n)
+	}
+
+	for _, bad := range []string{"", "[a-"} {
+		if _, err := es.Clone(WithExclusionPatterns(bad)); !errors.Is(err, filepath.ErrBadPattern) {
+			t.Errorf("Clone with pattern %q = %v, want ErrBadPattern", bad, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package fsevents_test
+
+import (
+	"testing"
+
+	"github.com/fsnotify/fsevents"
+	"github.com/fsnotify/fsevents/fseventstest"
+)
+
+// The pipeline runs the same on top of fseventstest as on a backend.
+
+func TestFakeOverflow(t *testing.T) {
+	f := fseventstest.New(fsevents.WithBufferSize(1), fsevents.WithOverflow(fsevents.DropNewest))
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	for id := uint64(1); id <= 3; id++ {
+		if err := f.Emit([]fsevents.Event{{Path: "/a", Flags: fsevents.ItemModified | fsevents.ItemIsFile, ID: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have := <-f.EventsChan(); have[0].ID != 1 {
+		t.Errorf("kept event %d, want 1", have[0].ID)
+	}
+	st := f.Stats()
+	if st.DeliveredBatches != 1 || st.DroppedBatches != 2 || st.ReceivedEvents != st.DeliveredEvents+st.DroppedEvents {
+		t.Errorf("delivered %d, dropped %d batches of %d events received", st.DeliveredBatches, st.DroppedBatches, st.ReceivedEvents)
+	}
+}
+
+func TestFakeSubscribe(t *testing.T) {
+	f := fseventstest.New(fsevents.WithBufferSize(10))
+	sub := f.ES.Subscribe(fsevents.SubscribeBuffer(10), fsevents.SubscribeFilter(func(e *fsevents.Event) bool {
+		return e.Flags&fsevents.ItemRemoved != 0
+	}))
+	defer f.ES.Unsubscribe(sub)
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	if err := f.Emit([]fsevents.Event{
+		{Path: "/a", Flags: fsevents.ItemCreated | fsevents.ItemIsFile, ID: 1},
+		{Path: "/b", Flags: fsevents.ItemRemoved | fsevents.ItemIsFile, ID: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if have := <-f.EventsChan(); len(have) != 2 {
+		t.Errorf("stream got %v, want both events", have)
+	}
+	if have := <-sub.Events; len(have) != 1 || have[0].Path != "/b" {
+		t.Errorf("subscriber got %v, want the removal", have)
+	}
+}
+
+func TestInjectNeedsManual(t *testing.T) {
+	es := &fsevents.EventStream{Backend: fsevents.Poll}
+	if err := es.Inject([]fsevents.Event{{Path: "/a"}}); err == nil {
+		t.Error("Inject into a Poll stream succeeded")
+	}
+}
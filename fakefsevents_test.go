@@ -0,0 +1,1367 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ebitengine/purego"
+)
+
+// fakeFSEvents is an in-memory stand-in for FSEvents and libdispatch, on
+// top of fakeCF. It records the calls made to it and the streams created,
+// and drives their callbacks with synthetic batches, so the code in
+// wrap.go can be tested without touching the file system. Tests using it
+// are named TestUnit.
+type fakeFSEvents struct {
+	cf *fakeCF
+
+	mu            sync.Mutex
+	calls         []string
+	streams       []*fakeStream // in order of creation
+	byRef         map[uintptr]*fakeStream
+	startFailures int       // FSEventStreamStart calls yet to fail
+	failExclusion bool      // FSEventStreamSetExclusionPaths fails
+	latestID      uint64    // as reported system-wide and for any device
+	before        []float64 // the times asked for the ID before
+	uuids         map[int32]string
+	queueRelease  map[uintptr]int // dispatch_release calls by queue
+}
+
+// fakeStream is a stream created through fakeFSEvents.
+type fakeStream struct {
+	ref        uintptr
+	cb, info   uintptr
+	device     int32
+	paths      []string
+	since      uint64
+	latest     uint64 // since, then the last ID called back with
+	latency    float64
+	flags      CreateFlags
+	exclusions []string
+	queue      uintptr
+	started    bool
+	stopped    bool
+	released   bool
+	pending    []*cBatch // delivered by the next flush
+}
+
+// stream returns the i'th stream created.
+func (f *fakeFSEvents) stream(t *testing.T, i int) *fakeStream {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i >= len(f.streams) {
+		t.Fatalf("%d streams created, want at least %d", len(f.streams), i+1)
+	}
+	return f.streams[i]
+}
+
+// called returns the names of the calls made so far.
+func (f *fakeFSEvents) called() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeFSEvents) record(name string) {
+	f.calls = append(f.calls, name)
+}
+
+// fire runs s's callback with a batch, as FSEvents would on its queue.
+func (f *fakeFSEvents) fire(s *fakeStream, paths []string, flags []EventFlags, ids []uint64) {
+	f.call(s, newCBatchOf(paths, flags, ids))
+}
+
+func (f *fakeFSEvents) call(s *fakeStream, b *cBatch) {
+	f.mu.Lock()
+	for _, id := range (*[1 << 30]uint64)(fakePointer(b.ids))[:b.n:b.n] {
+		if id != 0 {
+			s.latest = id
+		}
+	}
+	f.mu.Unlock()
+	purego.SyscallN(s.cb, s.ref, s.info, uintptr(b.n), b.paths, b.flags, b.ids)
+	runtime.KeepAlive(b)
+}
+
+// queue holds a batch for s until the stream is flushed.
+func (f *fakeFSEvents) queue(s *fakeStream, paths []string, flags []EventFlags, ids []uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s.pending = append(s.pending, newCBatchOf(paths, flags, ids))
+}
+
+// flush delivers the batches queued for the stream ref, unless it's
+// stopped.
+func (f *fakeFSEvents) flush(ref uintptr, name string) {
+	f.mu.Lock()
+	f.record(name)
+	s := f.byRef[ref]
+	var pending []*cBatch
+	if s != nil && !s.stopped {
+		pending, s.pending = s.pending, nil
+	}
+	f.mu.Unlock()
+	for _, b := range pending {
+		f.call(s, b)
+	}
+}
+
+func (f *fakeFSEvents) create(cb, ctx, dev, paths, since uintptr, latency float64, flags uintptr) uintptr {
+	f.cf.mu.Lock()
+	s := &fakeStream{
+		ref:     f.cf.newRef(),
+		cb:      cb,
+		info:    (*[5]uintptr)(fakePointer(ctx))[1],
+		device:  int32(dev),
+		since:   uint64(since),
+		latest:  uint64(since),
+		latency: latency,
+		flags:   CreateFlags(flags),
+	}
+	for _, ref := range f.cf.arrays[paths] {
+		s.paths = append(s.paths, f.cf.strs[ref])
+	}
+	f.cf.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streams = append(f.streams, s)
+	f.byRef[s.ref] = s
+	return s.ref
+}
+
+// update records a call on the stream ref and applies fn to it.
+func (f *fakeFSEvents) update(name string, ref uintptr, fn func(*fakeStream)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(name)
+	if s := f.byRef[ref]; s != nil {
+		fn(s)
+	}
+}
+
+var (
+	fakeFS            = &fakeFSEvents{cf: fake}
+	fakeStreamsOnce   sync.Once
+	fakeStreamsLoader *loader
+)
+
+// withFakeStreams is withFakeLoader with fakeFSEvents standing in for
+// FSEvents and libdispatch: streams start and stop on a default queue,
+// on a DispatchQueue or relative to a device, and call back when the
+// test fires them. The first failures calls to FSEventStreamStart fail.
+func withFakeStreams(t *testing.T, failures int) *fakeFSEvents {
+	t.Helper()
+	withFakeLoader(t)
+	f := fakeFS
+
+	fakeStreamsOnce.Do(func() {
+		l := *fakeLoader
+		nop := func(name string) uintptr {
+			return purego.NewCallback(func(ref uintptr) uintptr {
+				f.update(name, ref, func(*fakeStream) {})
+				return 0
+			})
+		}
+		l.fseventsCreate = purego.NewCallback(func(alloc, cb, ctx, paths, since uintptr, latency float64, flags uintptr) uintptr {
+			return f.create(cb, ctx, 0, paths, since, latency, flags)
+		})
+		l.fseventsCreateRelativeToDevice = purego.NewCallback(func(alloc, cb, ctx, dev, paths, since uintptr, latency float64, flags uintptr) uintptr {
+			return f.create(cb, ctx, dev, paths, since, latency, flags)
+		})
+		l.fseventsStart = purego.NewCallback(func(ref uintptr) uintptr {
+			ok := uintptr(1)
+			f.update("FSEventStreamStart", ref, func(s *fakeStream) {
+				if f.startFailures > 0 {
+					f.startFailures--
+					ok = 0
+					return
+				}
+				s.started, s.stopped = true, false
+			})
+			return ok
+		})
+		l.fseventsStop = purego.NewCallback(func(ref uintptr) uintptr {
+			f.update("FSEventStreamStop", ref, func(s *fakeStream) { s.stopped = true })
+			return 0
+		})
+		l.fseventsInvalidate = nop("FSEventStreamInvalidate")
+		l.fseventsRelease = purego.NewCallback(func(ref uintptr) uintptr {
+			f.update("FSEventStreamRelease", ref, func(s *fakeStream) { s.released = true })
+			return 0
+		})
+		l.fseventsFlushSync = purego.NewCallback(func(ref uintptr) uintptr {
+			f.flush(ref, "FSEventStreamFlushSync")
+			return 0
+		})
+		l.fseventsFlushAsync = purego.NewCallback(func(ref uintptr) uintptr {
+			f.flush(ref, "FSEventStreamFlushAsync")
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if s := f.byRef[ref]; s != nil && s.latest != s.since {
+				return uintptr(s.latest)
+			}
+			return 0
+		})
+		l.fseventsSetDispatchQueue = purego.NewCallback(func(ref, queue uintptr) uintptr {
+			f.update("FSEventStreamSetDispatchQueue", ref, func(s *fakeStream) { s.queue = queue })
+			return 0
+		})
+		l.fseventsSetExclusionPaths = purego.NewCallback(func(ref, paths uintptr) uintptr {
+			f.cf.mu.Lock()
+			var exclusions []string
+			for _, p := range f.cf.arrays[paths] {
+				exclusions = append(exclusions, f.cf.strs[p])
+			}
+			f.cf.mu.Unlock()
+			ok := uintptr(1)
+			f.update("FSEventStreamSetExclusionPaths", ref, func(s *fakeStream) {
+				if f.failExclusion {
+					ok = 0
+					return
+				}
+				s.exclusions = exclusions
+			})
+			return ok
+		})
+		l.fseventsGetLatestEventID = purego.NewCallback(func(ref uintptr) uintptr {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if s := f.byRef[ref]; s != nil {
+				return uintptr(s.latest)
+			}
+			return 0
+		})
+		l.fseventsGetCurrentEventID = purego.NewCallback(func() uintptr {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			return uintptr(f.latestID)
+		})
+		l.fseventsGetLastEventIDForDeviceBeforeTime = purego.NewCallback(func(dev uintptr, before float64) uintptr {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.before = append(f.before, before)
+			return uintptr(f.latestID)
+		})
+		l.fseventsGetDeviceBeingWatched = purego.NewCallback(func(ref uintptr) uintptr {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if s := f.byRef[ref]; s != nil {
+				return uintptr(s.device)
+			}
+			return 0
+		})
+		// A UUID is its own string.
+		l.fseventsCopyUUIDForDevice = purego.NewCallback(func(dev uintptr) uintptr {
+			f.mu.Lock()
+			uuid, ok := f.uuids[int32(dev)]
+			f.mu.Unlock()
+			if !ok {
+				return 0
+			}
+			f.cf.mu.Lock()
+			defer f.cf.mu.Unlock()
+			r := f.cf.newRef()
+			f.cf.strs[r] = uuid
+			return r
+		})
+		l.cfUUIDCreateString = purego.NewCallback(func(alloc, uuid uintptr) uintptr {
+			f.cf.mu.Lock()
+			defer f.cf.mu.Unlock()
+			r := f.cf.newRef()
+			f.cf.strs[r] = f.cf.strs[uuid]
+			return r
+		})
+		l.fseventsCopyDescription = purego.NewCallback(func(ref uintptr) uintptr {
+			f.cf.mu.Lock()
+			defer f.cf.mu.Unlock()
+			r := f.cf.newRef()
+			f.cf.strs[r] = fmt.Sprintf("fake stream %d", ref)
+			return r
+		})
+		l.fseventsCopyPaths = purego.NewCallback(func(ref uintptr) uintptr {
+			f.mu.Lock()
+			var paths []string
+			if s := f.byRef[ref]; s != nil {
+				paths = s.paths
+			}
+			f.mu.Unlock()
+			f.cf.mu.Lock()
+			defer f.cf.mu.Unlock()
+			arr := f.cf.newRef()
+			for _, p := range paths {
+				r := f.cf.newRef()
+				f.cf.strs[r] = p
+				f.cf.arrays[arr] = append(f.cf.arrays[arr], r)
+			}
+			return arr
+		})
+
+		newQueue := purego.NewCallback(func(label, attr uintptr) uintptr {
+			f.cf.mu.Lock()
+			defer f.cf.mu.Unlock()
+			return f.cf.newRef()
+		})
+		l.dispatchQueueCreate = newQueue
+		l.dispatchQueueAttrMakeWithQoS = purego.NewCallback(func(attr, class, prio uintptr) uintptr { return class })
+		l.dispatchRelease = purego.NewCallback(func(queue uintptr) uintptr {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.queueRelease[queue]++
+			return 0
+		})
+		l.dispatchRetain = purego.NewCallback(func(uintptr) uintptr { return 0 })
+		l.dispatchQueueSetSpecific = purego.NewCallback(func(queue, key, ctx, destructor uintptr) uintptr { return 0 })
+		// Nothing runs on a fake queue.
+		l.dispatchGetSpecific = purego.NewCallback(func(key uintptr) uintptr { return 0 })
+		l.dispatchSyncF = purego.NewCallback(func(queue, ctx, fn uintptr) uintptr {
+			purego.SyscallN(fn, ctx)
+			return 0
+		})
+		fakeStreamsLoader = &l
+	})
+
+	f.mu.Lock()
+	f.calls = nil
+	f.streams = nil
+	f.byRef = map[uintptr]*fakeStream{}
+	f.startFailures = failures
+	f.failExclusion = false
+	f.latestID = 0
+	f.before = nil
+	f.uuids = map[int32]string{}
+	f.queueRelease = map[uintptr]int{}
+	f.mu.Unlock()
+	lib = fakeStreamsLoader
+	return f
+}
+
+// fakePaths are paths handed to fake streams. Nothing is there, so
+// nothing on the file system is touched.
+var fakePaths = []string{"/nonexistent/fsevents/a", "/nonexistent/fsevents/b"}
+
+func TestUnitDelivery(t *testing.T) {
+	f := withFakeStreams(t, 0)
+
+	es := &EventStream{
+		Paths:   fakePaths,
+		Latency: 250 * time.Millisecond,
+		Flags:   FileEvents | NoDefer,
+		Events:  make(chan []Event, 1),
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := f.stream(t, 0)
+	if !reflect.DeepEqual(s.paths, fakePaths) || s.since != eventIDSinceNow || s.latency != 0.25 || s.flags != FileEvents|NoDefer {
+		t.Errorf("created with paths %q, since %d, latency %v, flags %v", s.paths, s.since, s.latency, s.flags)
+	}
+	if !s.started || s.queue == 0 {
+		t.Errorf("started %v on queue %d, want started on a queue", s.started, s.queue)
+	}
+
+	want := []Event{
+		{Path: fakePaths[0] + "/x", Flags: ItemCreated | ItemIsFile, Root: fakePaths[0], ID: 7},
+		{Path: fakePaths[1] + "/y", Flags: ItemRemoved | ItemIsDir, Root: fakePaths[1], ID: 9},
+	}
+	f.fire(s, []string{want[0].Path, want[1].Path}, []EventFlags{want[0].Flags, want[1].Flags}, []uint64{7, 9})
+	if have := <-es.EventsChan(); !reflect.DeepEqual(have, want) {
+		t.Errorf("got %v, want %v", have, want)
+	}
+	if id := es.LastEventID(); id != 9 {
+		t.Errorf("EventID = %d, want 9", id)
+	}
+
+	es.Stop()
+	if !s.stopped || !s.released {
+		t.Errorf("stopped %v, released %v after Stop", s.stopped, s.released)
+	}
+	calls := f.called()
+	wantCalls := []string{"FSEventStreamSetDispatchQueue", "FSEventStreamStart", "FSEventStreamStop", "FSEventStreamInvalidate", "FSEventStreamRelease"}
+	if !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("calls %q, want %q", calls, wantCalls)
+	}
+}
+
+func TestUnitFlush(t *testing.T) {
+	f := withFakeStreams(t, 0)
+
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	s := f.stream(t, 0)
+	f.queue(s, []string{fakePaths[0]}, []EventFlags{ItemModified | ItemIsFile}, []uint64{3})
+	select {
+	case events := <-es.EventsChan():
+		t.Fatalf("got %v before Flush", events)
+	default:
+	}
+	es.Flush(true)
+	select {
+	case events := <-es.EventsChan():
+		if len(events) != 1 || events[0].ID != 3 {
+			t.Errorf("Flush delivered %v", events)
+		}
+	default:
+		t.Fatal("Flush(true) returned before delivering")
+	}
+}
+
+func TestUnitFlushAsync(t *testing.T) {
+	f := withFakeStreams(t, 0)
+
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if id, err := es.FlushAsync(); id != 0 || err != nil {
+		t.Errorf("FlushAsync() with nothing queued = %d, %v", id, err)
+	}
+
+	s := f.stream(t, 0)
+	f.queue(s, []string{fakePaths[0]}, []EventFlags{ItemModified | ItemIsFile}, []uint64{7})
+	id, err := es.FlushAsync()
+	if id != 7 || err != nil {
+		t.Fatalf("FlushAsync() = %d, %v, want 7", id, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := es.WaitForID(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case events := <-es.EventsChan():
+		if len(events) != 1 || events[0].ID != 7 {
+			t.Errorf("flushed %v", events)
+		}
+	default:
+		t.Fatal("WaitForID returned before delivering")
+	}
+}
+
+func TestUnitEventIDForDeviceSince(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	prev := deviceMounted
+	deviceMounted = func(dev int32) bool { return dev == 5 }
+	t.Cleanup(func() { deviceMounted = prev })
+	f.latestID = 77
+
+	if id := EventIDForDeviceBeforeTime(5, time.Date(2001, 1, 1, 0, 0, 10, 500e6, time.UTC)); id != 77 {
+		t.Errorf("EventIDForDeviceBeforeTime() = %d, want 77", id)
+	}
+	id, err := EventIDForDeviceSince(5, 2*time.Second)
+	want := float64(time.Now().Add(-2*time.Second).UnixNano())/1e9 - cfAbsoluteEpoch
+	if id != 77 || err != nil {
+		t.Errorf("EventIDForDeviceSince() = %d, %v, want 77", id, err)
+	}
+	if _, err := EventIDForDeviceSince(6, time.Second); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("EventIDForDeviceSince() of an unmounted device = %v, want os.ErrNotExist", err)
+	}
+
+	f.mu.Lock()
+	before := f.before
+	f.mu.Unlock()
+	if len(before) != 2 || before[0] != 10.5 || math.Abs(before[1]-want) > 1 {
+		t.Errorf("asked for the IDs before %v, want [10.5 %.0f]", before, want)
+	}
+}
+
+func TestUnitChangedSince(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	// started waits for the i'th stream to be started.
+	started := func(i int) *fakeStream {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			f.mu.Lock()
+			ok := len(f.streams) > i && f.streams[i].started
+			f.mu.Unlock()
+			if ok {
+				return f.stream(t, i)
+			}
+		}
+		t.Fatalf("stream %d not started", i)
+		return nil
+	}
+	type result struct {
+		events []Event
+		next   uint64
+		err    error
+	}
+	query := func(ctx context.Context) <-chan result {
+		c := make(chan result, 1)
+		go func() {
+			events, next, err := ChangedSince(ctx, fakePaths[0], 0, 40)
+			c <- result{events, next, err}
+		}()
+		return c
+	}
+
+	c := query(context.Background())
+	s := started(0)
+	if s.since != 40 || s.flags&FileEvents == 0 || !reflect.DeepEqual(s.paths, fakePaths[:1]) {
+		t.Errorf("stream since %d, flags %v, paths %q", s.since, s.flags, s.paths)
+	}
+	f.fire(s, []string{fakePaths[0] + "/a", fakePaths[0] + "/b"}, []EventFlags{ItemCreated | ItemIsFile, ItemModified | ItemIsFile}, []uint64{41, 43})
+	f.fire(s, []string{fakePaths[0], fakePaths[0] + "/live"}, []EventFlags{HistoryDone, ItemCreated | ItemIsFile}, []uint64{50, 51})
+	r := <-c
+	var ids []uint64
+	for _, e := range r.events {
+		ids = append(ids, e.ID)
+	}
+	if r.err != nil || !reflect.DeepEqual(ids, []uint64{41, 43}) || r.next != 50 {
+		t.Errorf("ChangedSince() = %v, %d, %v, want 41 and 43 and 50", ids, r.next, r.err)
+	}
+	if !s.stopped || !s.released {
+		t.Errorf("stream stopped %v, released %v", s.stopped, s.released)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c = query(ctx)
+	s = started(1)
+	f.fire(s, []string{fakePaths[0] + "/c"}, []EventFlags{ItemCreated | ItemIsFile}, []uint64{44})
+	cancel()
+	if r := <-c; r.err != context.Canceled || r.events != nil {
+		t.Errorf("ChangedSince() canceled = %v, %v", r.events, r.err)
+	}
+	if !s.stopped || !s.released {
+		t.Errorf("canceled, stream stopped %v, released %v", s.stopped, s.released)
+	}
+}
+
+func TestUnitSuspend(t *testing.T) {
+	f := withFakeStreams(t, 0)
+
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1)}
+	if err := es.Continue(); err != nil {
+		t.Errorf("Continue() on a stopped stream = %v", err)
+	}
+	if err := es.Suspend(); err != errNotRunning {
+		t.Errorf("Suspend() on a stopped stream = %v", err)
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	s := f.stream(t, 0)
+	for i := 0; i < 2; i++ {
+		if err := es.Suspend(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.stopped || s.released || !es.Stats().Suspended || !strings.HasPrefix(es.DebugDump(), "fsevents.EventStream suspended") {
+		t.Fatalf("stopped %v, released %v, Stats %+v after Suspend", s.stopped, s.released, es.Stats())
+	}
+	if registry.Get(es.registryID) != es {
+		t.Error("suspended stream not registered")
+	}
+
+	// What happens while suspended comes once continued.
+	f.queue(s, []string{fakePaths[0]}, []EventFlags{ItemModified | ItemIsFile}, []uint64{3})
+	es.Flush(true)
+	select {
+	case events := <-es.EventsChan():
+		t.Fatalf("got %v while suspended", events)
+	default:
+	}
+	if err := es.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	if s.stopped || es.Stats().Suspended {
+		t.Errorf("stopped %v, Stats %+v after Continue", s.stopped, es.Stats())
+	}
+	es.Flush(true)
+	select {
+	case events := <-es.EventsChan():
+		if len(events) != 1 || events[0].ID != 3 {
+			t.Errorf("continued with %v", events)
+		}
+	default:
+		t.Fatal("nothing delivered after Continue")
+	}
+	f.mu.Lock()
+	n := len(f.streams)
+	f.mu.Unlock()
+	if n != 1 {
+		t.Errorf("%d streams created, want the one", n)
+	}
+
+	// Stop doesn't stop it twice.
+	if err := es.Suspend(); err != nil {
+		t.Fatal(err)
+	}
+	before := strings.Count(strings.Join(f.called(), " "), "FSEventStreamStop")
+	es.Stop()
+	if after := strings.Count(strings.Join(f.called(), " "), "FSEventStreamStop"); after != before {
+		t.Errorf("FSEventStreamStop called %d more times by Stop", after-before)
+	}
+	if !s.released || es.Stats().Suspended {
+		t.Errorf("released %v, Stats %+v after Stop", s.released, es.Stats())
+	}
+
+	m := &EventStream{Paths: []string{"/d"}, Backend: Manual}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Suspend(); err != errSuspendBackend {
+		t.Errorf("Suspend() with the Manual backend = %v", err)
+	}
+}
+
+func TestUnitRegistry(t *testing.T) {
+	f := withFakeStreams(t, 0)
+
+	var streams []*EventStream
+	for i := 0; i < 2; i++ {
+		es := &EventStream{Paths: fakePaths[i : i+1], Events: make(chan []Event, 1)}
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer es.Stop()
+		streams = append(streams, es)
+	}
+	a, b := f.stream(t, 0), f.stream(t, 1)
+	if a.info == b.info {
+		t.Fatalf("both streams registered as %d", a.info)
+	}
+
+	f.fire(b, []string{fakePaths[1]}, []EventFlags{ItemModified}, []uint64{5})
+	f.fire(a, []string{fakePaths[0]}, []EventFlags{ItemModified}, []uint64{4})
+	for i, es := range streams {
+		if events := <-es.EventsChan(); len(events) != 1 || events[0].Path != fakePaths[i] {
+			t.Errorf("stream %d got %v", i, events)
+		}
+	}
+
+	streams[0].Stop()
+	if registry.Get(a.info) != nil {
+		t.Error("stopped stream still registered")
+	}
+	if registry.Get(b.info) != streams[1] {
+		t.Error("Stop unregistered the other stream")
+	}
+}
+
+func TestUnitResume(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	f.uuids[0] = "LIVE"
+	f.latestID = 100
+
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1), Resume: true, EventID: 42, UUID: "LIVE"}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	es.Stop()
+	if s := f.stream(t, 0); s.since != 42 {
+		t.Errorf("resumed since %d, want 42", s.since)
+	}
+	if es.UUID != "LIVE" {
+		t.Errorf("UUID = %q, want LIVE", es.UUID)
+	}
+
+	for _, tc := range []struct {
+		uuid   string
+		id     uint64
+		status ResumeStatus
+	}{
+		{"OLD", 42, ResumeUUIDMismatch},
+		{"LIVE", 200, ResumeIDInFuture},
+	} {
+		f := withFakeStreams(t, 0)
+		f.uuids[0] = "LIVE"
+		f.latestID = 100
+
+		es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1), Resume: true, EventID: tc.id, UUID: tc.uuid}
+		err := es.Start()
+		var herr *HistoryError
+		if !errors.As(err, &herr) || herr.Status != tc.status {
+			es.Stop()
+			t.Errorf("Start() with %s/%d = %v, want %v", tc.uuid, tc.id, err, tc.status)
+		}
+		if n := len(f.streams); n != 0 {
+			t.Errorf("%d streams created despite %v", n, tc.status)
+		}
+	}
+}
+
+func TestUnitLatestEventID(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	f.latestID = 100
+
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1), Resume: true, EventID: 42}
+	if id := es.LatestEventID(); id != 0 {
+		t.Errorf("before Start, LatestEventID() = %d, want 0", id)
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if id := es.LatestEventID(); id != 42 {
+		t.Errorf("before any events, LatestEventID() = %d, want 42 as started since", id)
+	}
+	f.fire(f.stream(t, 0), []string{fakePaths[0] + "/x"}, []EventFlags{ItemCreated}, []uint64{57})
+	<-es.EventsChan()
+	if id := es.LatestEventID(); id != 57 {
+		t.Errorf("after a delivery, LatestEventID() = %d, want 57", id)
+	}
+	if id := CurrentEventID(); id != 100 {
+		t.Errorf("CurrentEventID() = %d, want 100", id)
+	}
+	es.Stop()
+	if id := es.LatestEventID(); id != 0 {
+		t.Errorf("after Stop, LatestEventID() = %d, want 0", id)
+	}
+}
+
+func TestUnitStartFailure(t *testing.T) {
+	f := withFakeStreams(t, 1)
+
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1)}
+	if err := es.Start(); err == nil {
+		es.Stop()
+		t.Fatal("Start() succeeded, want the FSEventStreamStart failure")
+	}
+	if s := f.stream(t, 0); !s.released {
+		t.Error("failed stream not released")
+	}
+	if n := len(registry.load()); n != 0 {
+		t.Errorf("registry holds %d streams after a failed Start", n)
+	}
+	if es.Stats().Running {
+		t.Error("stream running after a failed Start")
+	}
+}
+
+func TestUnitExclusionFailure(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	f.failExclusion = true
+
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1), ExclusionPaths: []string{fakePaths[0] + "/skip"}}
+	if err := es.Start(); err == nil {
+		es.Stop()
+		t.Fatal("Start() succeeded, want the FSEventStreamSetExclusionPaths failure")
+	}
+	if s := f.stream(t, 0); s.started || !s.released {
+		t.Errorf("started %v, released %v, want released unstarted", s.started, s.released)
+	}
+	if n := len(registry.load()); n != 0 {
+		t.Errorf("registry holds %d streams after a failed Start", n)
+	}
+
+	f = withFakeStreams(t, 0)
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if s := f.stream(t, 0); !reflect.DeepEqual(s.exclusions, es.ExclusionPaths) {
+		t.Errorf("excluded %q, want %q", s.exclusions, es.ExclusionPaths)
+	}
+}
+
+func TestUnitDevice(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	prev := deviceMounted
+	deviceMounted = func(int32) bool { return true }
+	t.Cleanup(func() { deviceMounted = prev })
+
+	es := &EventStream{Paths: fakePaths[:1], Device: 7, Events: make(chan []Event, 1)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	s := f.stream(t, 0)
+	if s.device != 7 || !reflect.DeepEqual(s.paths, fakePaths[:1]) {
+		t.Errorf("created relative to device %d on %q", s.device, s.paths)
+	}
+	if dev := getStreamRefDeviceID(es.stream); dev != 7 {
+		t.Errorf("watching device %d, want 7", dev)
+	}
+	f.fire(s, []string{fakePaths[0] + "/f"}, []EventFlags{ItemCreated}, []uint64{1})
+	if events := <-es.EventsChan(); len(events) != 1 || events[0].Device != 7 {
+		t.Errorf("got %v, want an event on device 7", events)
+	}
+}
+
+func TestUnitLatency(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	for i, tt := range []struct {
+		latency time.Duration
+		flags   CreateFlags
+		want    time.Duration
+	}{
+		{0, FileEvents, DefaultLatency},
+		{100 * time.Microsecond, FileEvents, MinLatency},
+		{MinLatency, 0, MinLatency},
+		{2 * time.Second, FileEvents, 2 * time.Second},
+		{0, FileEvents | NoDefer, 0},
+		{100 * time.Microsecond, NoDefer, 100 * time.Microsecond},
+	} {
+		es := &EventStream{Paths: fakePaths, Latency: tt.latency, Flags: tt.flags, Events: make(chan []Event, 1)}
+		if have := es.EffectiveLatency(); have != tt.want {
+			t.Errorf("Latency %v, flags %v: EffectiveLatency() = %v, want %v", tt.latency, tt.flags, have, tt.want)
+		}
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		es.Stop()
+		if have, want := f.stream(t, i).latency, tt.want.Seconds(); have != want {
+			t.Errorf("Latency %v, flags %v: created with latency %v, want %v", tt.latency, tt.flags, have, want)
+		}
+		if es.Latency != tt.latency {
+			t.Errorf("Start changed Latency to %v", es.Latency)
+		}
+	}
+}
+
+func TestUnitString(t *testing.T) {
+	f := withFakeStreams(t, 1)
+
+	es := &EventStream{Paths: fakePaths, Device: 7, Latency: 500 * time.Millisecond, Events: make(chan []Event, 1)}
+	check := func(state, rest string) {
+		t.Helper()
+		want := "fsevents.EventStream{state=" + state + " paths=2 dev=7 latency=500ms" + rest + "}"
+		if have := fmt.Sprintf("%v", es); have != want {
+			t.Errorf("got %s, want %s", have, want)
+		}
+	}
+	check("idle", " lastID=0")
+	err := es.Start()
+	if err == nil || !strings.Contains(err.Error(), "fsevents.EventStream{state=idle paths=2") {
+		t.Fatalf("failed Start() = %v, want an error naming the stream", err)
+	}
+	check("failed", " lastID=0")
+
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	f.fire(f.stream(t, 1), []string{fakePaths[0] + "/x"}, []EventFlags{ItemCreated}, []uint64{123456})
+	<-es.EventsChan()
+	check("running", " lastID=123456")
+	if err := es.Suspend(); err != nil {
+		t.Fatal(err)
+	}
+	check("suspended", " lastID=123456")
+	es.Stop()
+	check("stopped", " lastID=123456")
+
+	m := &EventStream{Paths: fakePaths[:1], Backend: Manual}
+	if have, want := m.String(), "fsevents.EventStream{state=idle paths=1 dev=0 latency=100ms backend=Manual lastID=0}"; have != want {
+		t.Errorf("got %s, want %s", have, want)
+	}
+	if have := fmt.Sprint((*EventStream)(nil)); have != "fsevents.EventStream(nil)" {
+		t.Errorf("nil stream is %s", have)
+	}
+}
+
+func TestUnitDebugDump(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	f.uuids[0] = "UUID"
+	check := leakCheck(t)
+
+	es := &EventStream{Paths: fakePaths, Flags: FileEvents, Events: make(chan []Event, 1)}
+	want := []string{"fsevents.EventStream stopped", "paths: " + fmt.Sprintf("%q", fakePaths), "latency: 100ms (Latency 0s)", "registry: 0"}
+	dump := es.DebugDump()
+	for _, w := range want {
+		if !strings.Contains(dump, w) {
+			t.Errorf("before Start, DebugDump() = %q, missing %q", dump, w)
+		}
+	}
+
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.fire(f.stream(t, 0), []string{fakePaths[0] + "/x"}, []EventFlags{ItemCreated}, []uint64{3})
+	dump = es.DebugDump()
+	for _, w := range []string{
+		"fsevents.EventStream running",
+		"FSEvents paths: " + fmt.Sprintf("%q", fakePaths),
+		`uuid: "UUID"`,
+		"events: 1/1 queued",
+		"received: 1/1",
+		fmt.Sprintf("registry: %d", es.registryID),
+	} {
+		if !strings.Contains(dump, w) {
+			t.Errorf("running, DebugDump() = %q, missing %q", dump, w)
+		}
+	}
+	<-es.EventsChan()
+
+	// Concurrently with Stop, it neither races nor waits.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			es.DebugDump()
+		}
+	}()
+	es.Stop()
+	<-done
+	dump = es.DebugDump()
+	if !strings.Contains(dump, "fsevents.EventStream stopped") || strings.Contains(dump, "FSEvents paths") {
+		t.Errorf("after Stop, DebugDump() = %q", dump)
+	}
+	check()
+}
+
+// TestUnitSharedQueue starts streams on one SharedQueue, fires them all
+// at once, and stops one while another's callback is still running.
+func TestUnitSharedQueue(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	check := leakCheck(t)
+
+	q := NewSharedQueue(QoSUtility)
+	entered, release := make(chan struct{}), make(chan struct{})
+	var streams []*EventStream
+	for i := 0; i < 3; i++ {
+		es := New(fakePaths, WithSharedQueue(q), WithBufferSize(1))
+		if i == 2 {
+			es.RawHandler = func(*RawBatch) {
+				close(entered)
+				<-release
+			}
+		}
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, es)
+	}
+	queue := f.stream(t, 0).queue
+	for i := range streams {
+		if s := f.stream(t, i); s.queue != queue || queue == 0 {
+			t.Errorf("stream %d on queue %d, want all on %d", i, s.queue, queue)
+		}
+	}
+	if q.users != 3 {
+		t.Errorf("%d users, want 3", q.users)
+	}
+
+	var wg sync.WaitGroup
+	for i := range streams[:2] {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f.fire(f.stream(t, i), []string{fakePaths[0] + "/x"}, []EventFlags{ItemCreated}, []uint64{uint64(i + 1)})
+		}(i)
+	}
+	wg.Wait()
+	for i, es := range streams[:2] {
+		if have := <-es.EventsChan(); len(have) != 1 || have[0].ID != uint64(i+1) {
+			t.Errorf("stream %d got %v", i, have)
+		}
+	}
+
+	// The third stream's callback doesn't hold up the first's Stop, but
+	// its own Stop waits for it.
+	go f.fire(f.stream(t, 2), []string{fakePaths[0] + "/x"}, []EventFlags{ItemCreated}, []uint64{1})
+	<-entered
+	streams[0].Stop()
+	stopped := make(chan struct{})
+	go func() {
+		streams[2].Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned with its callback still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+	if n := f.queueRelease[queue]; n != 0 || q.users != 1 {
+		t.Errorf("queue released %d times with %d users left, want 0 and 1", n, q.users)
+	}
+
+	streams[1].Stop()
+	if n := f.queueRelease[queue]; n != 1 || q.users != 0 {
+		t.Errorf("queue released %d times after the last Stop, want 1", n)
+	}
+	// Once released, the next stream attaches to a new queue.
+	if err := streams[0].Start(); err != nil {
+		t.Fatal(err)
+	}
+	if s := f.stream(t, 3); s.queue == queue || s.queue == 0 {
+		t.Errorf("restarted on queue %d, want a new one", s.queue)
+	}
+	streams[0].Stop()
+	check()
+}
+
+// TestUnitRawPaths fires the same batch at a cooked and a raw stream on
+// a symbolic link, with the paths resolved as FSEvents reports them and
+// one of them not valid UTF-8, and expects the same bytes from both.
+func TestUnitRawPaths(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	tmp := t.TempDir()
+	link := filepath.Join(tmp, "link")
+	if err := os.Symlink(tmp, link); err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := filepath.EvalSymlinks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{resolved + "/x", resolved + "/caf\xe9", resolved + "/d/"}
+
+	var out [][]Event
+	for i, raw := range []bool{false, true} {
+		es := New([]string{link}, WithRawPaths(raw), WithBufferSize(1))
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		f.fire(f.stream(t, i), paths, []EventFlags{ItemCreated | ItemIsFile, ItemCreated | ItemIsFile, ItemCreated | ItemIsDir}, []uint64{1, 2, 3})
+		out = append(out, <-es.EventsChan())
+		es.Stop()
+	}
+	for _, batch := range out {
+		var have []string
+		for _, e := range batch {
+			have = append(have, e.Path)
+			if e.Root != link {
+				t.Errorf("%q has Root %q, want %q", e.Path, e.Root, link)
+			}
+		}
+		if !reflect.DeepEqual(have, paths) {
+			t.Errorf("got paths %q, want %q as reported", have, paths)
+		}
+	}
+	if !reflect.DeepEqual(out[0], out[1]) {
+		t.Errorf("raw %v, cooked %v", out[1], out[0])
+	}
+}
+
+// TestUnitAutoFlushOnDrop fires a batch reporting a drop while another
+// waits for a flush, and expects FSEventStreamFlushSync, that batch and
+// then DropRecovered.
+func TestUnitAutoFlushOnDrop(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 10), Errors: make(chan error, 1), AutoFlushOnDrop: true}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	s := f.stream(t, 0)
+
+	f.queue(s, []string{fakePaths[1] + "/y"}, []EventFlags{ItemModified | ItemIsFile}, []uint64{12})
+	f.fire(s, []string{fakePaths[0]}, []EventFlags{KernelDropped}, []uint64{10})
+	var d *DropRecovered
+	select {
+	case err := <-es.ErrorsChan():
+		d, _ = err.(*DropRecovered)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no DropRecovered")
+	}
+	if d == nil || d.From != 1 || d.To != 12 || !reflect.DeepEqual(d.Paths, fakePaths[:1]) || d.Flags != KernelDropped {
+		t.Errorf("got %+v", d)
+	}
+	if n := len(es.EventsChan()); n != 2 {
+		t.Fatalf("%d batches out before DropRecovered, want 2", n)
+	}
+	if have := (<-es.EventsChan())[0]; have.Flags != KernelDropped {
+		t.Errorf("first batch %v, want the drop", have)
+	}
+	if have := (<-es.EventsChan())[0]; have.ID != 12 {
+		t.Errorf("second batch %v, want the flushed one", have)
+	}
+	calls := f.called()
+	if !reflect.DeepEqual(calls[len(calls)-1:], []string{"FSEventStreamFlushSync"}) {
+		t.Errorf("calls %q, want FSEventStreamFlushSync last", calls)
+	}
+}
+
+// waitRestart waits for es's Stats to show the restart state want.
+func waitRestart(t *testing.T, es *EventStream, want RestartState) Stats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := es.Stats()
+		if st.Restart == want {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats().Restart = %v, want %v", st.Restart, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUnitAutoRestartStartFailure(t *testing.T) {
+	f := withFakeStreams(t, 2)
+
+	es := &EventStream{
+		Paths:       fakePaths,
+		EventID:     42,
+		Errors:      make(chan error, 10),
+		AutoRestart: &RestartPolicy{MinDelay: time.Millisecond},
+	}
+	if err := es.Start(); err != nil {
+		t.Fatalf("Start() = %v, want the failure retried", err)
+	}
+	defer es.Stop()
+
+	for i := 1; i <= 2; i++ {
+		var rerr *RestartError
+		if err := <-es.ErrorsChan(); !errors.As(err, &rerr) || rerr.Failures != i || rerr.Final {
+			t.Fatalf("got error %v, want a RestartError for failure %d", err, i)
+		}
+	}
+	st := waitRestart(t, es, RestartIdle)
+	if st.Restarts != 1 || st.RestartAttempts != 2 || !st.Running {
+		t.Errorf("Stats: Restarts %d, RestartAttempts %d, Running %v; want 1, 2, true", st.Restarts, st.RestartAttempts, st.Running)
+	}
+
+	var since []uint64
+	for i := 0; i < 3; i++ {
+		since = append(since, f.stream(t, i).since)
+	}
+	if since[0] != eventIDSinceNow || since[2] != 42 {
+		t.Errorf("streams created since %v, the last resuming from 42", since)
+	}
+}
+
+func TestUnitAutoRestartGivesUp(t *testing.T) {
+	withFakeStreams(t, 100)
+
+	es := &EventStream{
+		Paths:       fakePaths,
+		Errors:      make(chan error, 10),
+		AutoRestart: &RestartPolicy{MinDelay: time.Millisecond, MaxAttempts: 2},
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	for i := 1; i <= 3; i++ {
+		var rerr *RestartError
+		if err := <-es.ErrorsChan(); !errors.As(err, &rerr) || rerr.Failures != i || rerr.Final != (i == 3) {
+			t.Fatalf("got error %v, want a RestartError for failure %d", err, i)
+		}
+	}
+	for range es.EventsChan() {
+	}
+	st := waitRestart(t, es, RestartGaveUp)
+	if st.Running || st.Restarts != 0 || st.RestartAttempts != 2 {
+		t.Errorf("Stats: Running %v, Restarts %d, RestartAttempts %d; want false, 0, 2", st.Running, st.Restarts, st.RestartAttempts)
+	}
+	if n := len(registry.load()); n != 0 {
+		t.Errorf("registry holds %d streams after giving up", n)
+	}
+}
+
+func TestUnitAutoRestartUnsupported(t *testing.T) {
+	withFakeLoader(t)
+
+	es := &EventStream{Paths: fakePaths, AutoRestart: &RestartPolicy{}}
+	if err := es.Start(); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Fatalf("Start() = %v, want ErrUnsupportedPlatform without retrying", err)
+	}
+	if st := es.Stats(); st.Running || st.Restart != RestartIdle {
+		t.Errorf("Stats: Running %v, Restart %v; want false, Idle", st.Running, st.Restart)
+	}
+}
+
+func TestUnitFallbackToPolling(t *testing.T) {
+	f := withFakeStreams(t, 0)
+	local, fuse := t.TempDir(), t.TempDir()
+	withFakeFSTypes(t, map[string]string{fuse: "macfuse"})
+
+	es := &EventStream{
+		Paths:             []string{local, fuse},
+		Events:            make(chan []Event, 10),
+		Errors:            make(chan error, 10),
+		FallbackToPolling: true,
+		PollInterval:      time.Hour,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	s := f.stream(t, 0)
+	if !reflect.DeepEqual(s.paths, []string{local}) {
+		t.Errorf("FSEvents watches %q, want %q", s.paths, local)
+	}
+	var ferr *FallbackError
+	if err := <-es.ErrorsChan(); !errors.As(err, &ferr) || ferr.Path != fuse {
+		t.Errorf("Errors got %v, want a FallbackError for %s", err, fuse)
+	}
+	// receive returns the events delivered next, but those on the probe
+	// file, which HealthCheck leaves out.
+	receive := func() []Event {
+		t.Helper()
+		select {
+		case batch := <-es.EventsChan():
+			return batch
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing delivered")
+			return nil
+		}
+	}
+
+	// The two backends' events come on the same Events, those polled
+	// marked and without IDs.
+	f.fire(s, []string{local + "/a"}, []EventFlags{ItemCreated | ItemIsFile}, []uint64{7})
+	if err := os.WriteFile(filepath.Join(fuse, "b"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+	want := []Event{
+		{Path: local + "/a", Flags: ItemCreated | ItemIsFile, Root: local, ID: 7},
+		{Path: fuse + "/b", Flags: ItemCreated | ItemIsFile, Root: fuse, Synthetic: true},
+	}
+	if have := append(receive(), receive()...); !reflect.DeepEqual(have, want) {
+		t.Errorf("got %v, want %v", have, want)
+	}
+	if id := es.LastEventID(); id != 7 {
+		t.Errorf("EventID = %d, want 7", id)
+	}
+
+	// The fake stream reports nothing of the probe file, so its probe
+	// fails and the path is polled from then on, resuming FSEvents on
+	// the rest.
+	stop, err := es.HealthCheck(10*time.Millisecond, HealthDeadline(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	var uerr *UnhealthyError
+	if err := <-es.ErrorsChan(); !errors.As(err, &ferr) || ferr.Path != local || !errors.As(err, &uerr) {
+		t.Errorf("Errors got %v, want a FallbackError for %s", err, local)
+	}
+	if have, want := receive(), []Event{{Path: local, Flags: MustScanSubDirs, Root: local, Synthetic: true}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("on falling back, got %v, want %v", have, want)
+	}
+	if !s.stopped || !s.released {
+		t.Errorf("FSEvents stream stopped %v, released %v", s.stopped, s.released)
+	}
+	if err := os.WriteFile(filepath.Join(local, "c"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+	if have, want := receive(), []Event{{Path: local + "/c", Flags: ItemCreated | ItemIsFile, Root: local, Synthetic: true}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("once polled, got %v, want %v", have, want)
+	}
+	stop()
+
+	// Until the stream stops.
+	es.Stop()
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if s := f.stream(t, 1); !reflect.DeepEqual(s.paths, []string{local}) {
+		t.Errorf("started again, FSEvents watches %q, want %q", s.paths, local)
+	}
+}
+
+func TestUnitRawHandlerSynthetic(t *testing.T) {
+	// start starts es with a RawHandler, returning the events it gets.
+	start := func(t *testing.T, es *EventStream) <-chan Event {
+		t.Helper()
+		events := make(chan Event, 100)
+		es.RawHandler = func(b *RawBatch) {
+			for i := 0; i < b.Len(); i++ {
+				events <- b.Event(i)
+			}
+		}
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+	receive := func(t *testing.T, events <-chan Event, path string, flags EventFlags) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Path == path && e.Flags&flags == flags {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("RawHandler got no event on %s with %v", path, flags)
+			}
+		}
+	}
+	stop := func(t *testing.T, es *EventStream) {
+		t.Helper()
+		stopped := make(chan struct{})
+		go func() {
+			es.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Stop hung")
+		}
+	}
+
+	t.Run("RootChanged", func(t *testing.T) {
+		withFakeStreams(t, 0)
+		defer func(min, max time.Duration) { rootRetryMin, rootRetryMax = min, max }(rootRetryMin, rootRetryMax)
+		rootRetryMin, rootRetryMax = 5*time.Millisecond, 50*time.Millisecond
+
+		root := filepath.Join(t.TempDir(), "out")
+		es := &EventStream{Paths: []string{root}, WaitForRoot: true}
+		events := start(t, es)
+		if err := os.Mkdir(root, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, events, root, RootChanged|MustScanSubDirs)
+		stop(t, es)
+	})
+
+	t.Run("Unmount", func(t *testing.T) {
+		f := withFakeStreams(t, 0)
+		eject := withFakeMounts(t, time.Hour)
+
+		es := &EventStream{Device: 5, Paths: []string{"/"}, Errors: make(chan error, 1)}
+		events := start(t, es)
+		eject()
+		f.fire(f.stream(t, 0), []string{""}, []EventFlags{Unmount}, []uint64{3})
+		receive(t, events, "", Unmount)
+		var uerr *UnmountedError
+		select {
+		case err := <-es.ErrorsChan():
+			if !errors.As(err, &uerr) {
+				t.Fatalf("Errors got %v, want an UnmountedError", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stream didn't see its volume go")
+		}
+		stop(t, es)
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		dir := t.TempDir()
+		es := &EventStream{
+			Paths:        []string{dir},
+			Errors:       make(chan error, 10),
+			Backend:      Poll,
+			PollInterval: 10 * time.Millisecond,
+			AutoRestart:  &RestartPolicy{MinDelay: time.Millisecond},
+		}
+		events := start(t, es)
+		killSource(t, es)
+		receive(t, events, dir, MustScanSubDirs)
+		stop(t, es)
+	})
+}
@@ -0,0 +1,69 @@
+package fsevents
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// filter applies es.Filter to the batch, returning the kept events in
+// their original order. It reuses the batch's storage.
+func (es *EventStream) filter(events []Event) []Event {
+	if es.conf().Filter == nil || len(events) == 0 {
+		return events
+	}
+
+	workers := es.conf().Workers
+	if workers > len(events) {
+		workers = len(events)
+	}
+
+	var keep []bool
+	if workers > 1 {
+		keep = make([]bool, len(events))
+		// Workers claim a few chunks each, so a slow event doesn't hold
+		// up the rest of the batch behind it.
+		chunk := len(events) / (4 * workers)
+		if chunk == 0 {
+			chunk = 1
+		}
+		var (
+			next int64
+			wg   sync.WaitGroup
+		)
+		wg.Add(workers)
+		for w := 0; w < workers; w++ {
+			go func() {
+				defer wg.Done()
+				for {
+					start := int(atomic.AddInt64(&next, int64(chunk))) - chunk
+					if start >= len(events) {
+						return
+					}
+					end := start + chunk
+					if end > len(events) {
+						end = len(events)
+					}
+					for i := start; i < end; i++ {
+						keep[i] = es.conf().Filter(&events[i])
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	kept := events[:0]
+	for i := range events {
+		if keep != nil && keep[i] || keep == nil && es.conf().Filter(&events[i]) {
+			kept = append(kept, events[i])
+		}
+	}
+	if n := len(events) - len(kept); n > 0 {
+		atomic.AddUint64(&es.stats.FilteredEvents, uint64(n))
+		tail := events[len(kept):]
+		for i := range tail {
+			tail[i] = Event{}
+		}
+	}
+	return kept
+}
@@ -0,0 +1,88 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	for _, workers := range []int{0, 1, 4} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			var have []Event
+			es := &EventStream{
+				Workers: workers,
+				Filter: func(e *Event) bool {
+					e.Path = strings.ToUpper(e.Path)
+					return e.ID%3 == 0
+				},
+				Handler: func(batch []Event) { have = append(have, batch...) },
+			}
+			info := registry.Add(es)
+			defer registry.Delete(info)
+
+			newCBatch(1000).call(info)
+
+			if len(have) != 333 {
+				t.Fatalf("got %d events, want 333", len(have))
+			}
+			for i, e := range have {
+				if want := uint64(3 * (i + 1)); e.ID != want {
+					t.Fatalf("event %d has ID %d, want %d", i, e.ID, want)
+				}
+				if e.Path != strings.ToUpper(e.Path) {
+					t.Fatalf("event %d was not enriched: %q", i, e.Path)
+				}
+			}
+			if es.EventID != 1000 {
+				t.Errorf("EventID = %d, want 1000", es.EventID)
+			}
+			st := es.Stats()
+			if st.FilteredEvents != 667 || st.DeliveredEvents != 333 {
+				t.Errorf("filtered/delivered = %d/%d, want 667/333", st.FilteredEvents, st.DeliveredEvents)
+			}
+		})
+	}
+}
+
+func TestFilterRejectsBatch(t *testing.T) {
+	es := &EventStream{
+		Filter:  func(*Event) bool { return false },
+		Handler: func([]Event) { t.Error("Handler called for an empty batch") },
+	}
+	info := registry.Add(es)
+	defer registry.Delete(info)
+
+	newCBatch(10).call(info)
+
+	if es.EventID != 10 {
+		t.Errorf("EventID = %d, want 10", es.EventID)
+	}
+}
+
+// BenchmarkFilterWorkers runs a filter that spins for 100µs per event, a
+// stand-in for a stat call or an ignore-file lookup.
+func BenchmarkFilterWorkers(b *testing.B) {
+	slow := func(*Event) bool {
+		for start := time.Now(); time.Since(start) < 100*time.Microsecond; {
+		}
+		return true
+	}
+
+	cb := newCBatch(256)
+	for _, workers := range []int{1, 2, 4, runtime.NumCPU()} {
+		es := &EventStream{Filter: slow, Workers: workers, Handler: func([]Event) {}}
+		b.Run(fmt.Sprint(workers), func(b *testing.B) {
+			info := registry.Add(es)
+			defer registry.Delete(info)
+
+			for i := 0; i < b.N; i++ {
+				cb.call(info)
+			}
+		})
+	}
+}
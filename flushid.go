@@ -0,0 +1,86 @@
+package fsevents
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// FlushAsync has the stream deliver the events it holds, as Flush(false)
+// does, and returns where that takes it: the ID FSEvents returns, that of
+// the latest event ever queued for the stream, or zero if none was. Pass
+// it to WaitForID to wait for those events to reach the consumer. With
+// the Manual backend it returns the highest ID the stream has received,
+// and with the others, which report no IDs, zero. It fails if the stream
+// isn't running.
+func (es *EventStream) FlushAsync() (uint64, error) {
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if atomic.LoadInt32(&es.running) == 0 {
+		return 0, errNotRunning
+	}
+	id := es.flushLocked(false)
+	switch es.conf().Backend {
+	case Native:
+	case Manual:
+		id = atomic.LoadUint64(&es.EventID)
+	default:
+		id = 0
+	}
+	return id, nil
+}
+
+// WaitForID blocks until the stream has delivered the events up to id,
+// as from FlushAsync: sent them on Events, handed them to Handler or
+// RawHandler and seen it return or, for those Filter, ExclusionPaths or the like left
+// out or Overflow dropped, done with them. Events held back by
+// MaxBatchDelay, DeliveryInterval or a window are delivered early, as
+// Flush does. It returns at once for a zero id, and fails with ctx's
+// error, or if the stream stops first. It must not be called from
+// Handler, which it would wait for.
+func (es *EventStream) WaitForID(ctx context.Context, id uint64) error {
+	for {
+		es.idMu.Lock()
+		handed := es.handedID
+		wait := es.idWait
+		if handed < id && wait == nil {
+			wait = make(chan struct{})
+			es.idWait = wait
+		}
+		es.idMu.Unlock()
+
+		if handed >= id {
+			// Past the callbacks; what the stream's goroutines hold is
+			// delivered in turn.
+			es.Flush(true)
+			return nil
+		}
+		if atomic.LoadInt32(&es.running) == 0 {
+			return errNotRunning
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// markHanded records that the callbacks are done with the events up to
+// id, having handed them off or left them out, and wakes WaitForID.
+func (es *EventStream) markHanded(id uint64) {
+	es.idMu.Lock()
+	if id > es.handedID {
+		es.handedID = id
+	}
+	es.wakeWaitersLocked()
+	es.idMu.Unlock()
+}
+
+// wakeWaitersLocked wakes the WaitForID calls to look again. es.idMu must
+// be held.
+func (es *EventStream) wakeWaitersLocked() {
+	if es.idWait != nil {
+		close(es.idWait)
+		es.idWait = nil
+	}
+}
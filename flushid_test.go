@@ -0,0 +1,123 @@
+package fsevents
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWaitForID(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen []uint64
+	)
+	es := &EventStream{
+		Paths:         []string{"/d"},
+		Backend:       Manual,
+		MaxBatchDelay: time.Hour,
+		Filter:        func(e *Event) bool { return e.Path != "/d/skip" },
+		Handler: func(batch []Event) {
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, e := range batch {
+				seen = append(seen, e.ID)
+			}
+		},
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	ids := func() []uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]uint64(nil), seen...)
+	}
+	ctx := context.Background()
+
+	if err := es.WaitForID(ctx, 0); err != nil {
+		t.Errorf("WaitForID(0) = %v", err)
+	}
+	if id, err := es.FlushAsync(); id != 0 || err != nil {
+		t.Errorf("FlushAsync() before any events = %d, %v", id, err)
+	}
+
+	// Held back by MaxBatchDelay, and the latest left out by Filter.
+	es.Inject([]Event{{Path: "/d/a", ID: 1}, {Path: "/d/b", ID: 2}})
+	es.Inject([]Event{{Path: "/d/skip", ID: 3}})
+	id, err := es.FlushAsync()
+	if id != 3 || err != nil {
+		t.Fatalf("FlushAsync() = %d, %v, want 3", id, err)
+	}
+	if err := es.WaitForID(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if have := ids(); !reflect.DeepEqual(have, []uint64{1, 2}) {
+		t.Errorf("when WaitForID returned, Handler had seen %v", have)
+	}
+
+	// Waiting for events yet to come.
+	done := make(chan error)
+	go func() { done <- es.WaitForID(ctx, 5) }()
+	es.Inject([]Event{{Path: "/d/c", ID: 4}})
+	select {
+	case err := <-done:
+		t.Fatalf("WaitForID(5) returned %v after ID 4", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	es.Inject([]Event{{Path: "/d/d", ID: 5}})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if have := ids(); !reflect.DeepEqual(have, []uint64{1, 2, 4, 5}) {
+		t.Errorf("when WaitForID returned, Handler had seen %v", have)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := es.WaitForID(short, 6); err != context.DeadlineExceeded {
+		t.Errorf("WaitForID past the deadline = %v", err)
+	}
+	go func() { done <- es.WaitForID(ctx, 6) }()
+	time.Sleep(10 * time.Millisecond)
+	es.Stop()
+	if err := <-done; err != errNotRunning {
+		t.Errorf("WaitForID on a stopped stream = %v", err)
+	}
+	if _, err := es.FlushAsync(); err != errNotRunning {
+		t.Errorf("FlushAsync() on a stopped stream = %v", err)
+	}
+
+	// RawHandler streams are done with a batch once it returns.
+	var raw []uint64
+	es = &EventStream{
+		Paths:   []string{"/d"},
+		Backend: Manual,
+		RawHandler: func(b *RawBatch) {
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			for i := 0; i < b.Len(); i++ {
+				raw = append(raw, b.ID(i))
+			}
+		},
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	go es.Inject([]Event{{Path: "/d/a", ID: 1}, {Path: "/d/b", ID: 2}})
+	short, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := es.WaitForID(short, 2); err != nil {
+		t.Fatalf("WaitForID on a RawHandler stream = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(raw, []uint64{1, 2}) {
+		t.Errorf("when WaitForID returned, RawHandler had seen %v", raw)
+	}
+}
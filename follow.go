@@ -0,0 +1,168 @@
+package fsevents
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FollowOp is what happened to a followed file.
+type FollowOp int
+
+const (
+	// Grow means the file grew: there is more to read at the last
+	// offset.
+	Grow FollowOp = iota + 1
+
+	// Truncate means the file is shorter than before but still the same
+	// file, as after a copytruncate rotation: read again from the start.
+	Truncate
+
+	// Rotate means the file was renamed or removed. An open descriptor
+	// can still be read to its end; the path is empty until Recreate.
+	Rotate
+
+	// Recreate means a new file exists at the path: open it and read
+	// from the start.
+	Recreate
+)
+
+func (op FollowOp) String() string {
+	switch op {
+	case Grow:
+		return "Grow"
+	case Truncate:
+		return "Truncate"
+	case Rotate:
+		return "Rotate"
+	case Recreate:
+		return "Recreate"
+	}
+	return fmt.Sprintf("FollowOp(%d)", int(op))
+}
+
+// FollowEvent reports a change to a followed file.
+type FollowEvent struct {
+	Op FollowOp
+
+	// Size is the size of the file at the path afterwards, or zero for
+	// Rotate.
+	Size int64
+}
+
+// Follower reports how a single file changes, for tailing it across log
+// rotation. It watches the file's directory, so the file may be missing
+// when following starts or between Rotate and Recreate.
+//
+// Changes are derived by comparing the file's identity and size each time
+// the stream reports an event for it. Changes that cancel out between
+// two looks, such as a truncation followed by writes past the old size,
+// are reported as the net change only.
+type Follower struct {
+	// Events receives the changes. It's closed by Close.
+	//
+	// Deprecated: use EventsChan, as with Watcher.Events.
+	Events chan FollowEvent
+
+	path string // with the directory's symlinks resolved
+	es   *EventStream
+	last os.FileInfo // nil while the file is missing
+
+	mu     sync.Mutex // held while sending on Events
+	closed bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Follow starts following the file at path. Its directory must exist.
+// opts configure the stream on the directory, with FileEvents always set.
+func Follow(path string, opts ...Option) (*Follower, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	// FSEvents reports paths with symlinks resolved.
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Follower{
+		Events: make(chan FollowEvent),
+		path:   filepath.Join(dir, filepath.Base(abs)),
+		done:   make(chan struct{}),
+	}
+	if fi, err := os.Stat(f.path); err == nil {
+		f.last = fi
+	}
+	f.es = New([]string{dir}, opts...)
+	f.es.Flags |= FileEvents
+	f.es.Handler = f.handle
+	if err := f.es.Start(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// handle looks at the file again after an event for it.
+func (f *Follower) handle(batch []Event) {
+	for _, e := range batch {
+		if e.Path == f.path {
+			f.check()
+			return
+		}
+	}
+}
+
+func (f *Follower) check() {
+	prev := f.last
+	cur, err := os.Stat(f.path)
+	if err != nil {
+		cur = nil
+	}
+	f.last = cur
+
+	switch {
+	case prev == nil && cur == nil:
+	case cur == nil:
+		f.send(FollowEvent{Op: Rotate})
+	case prev == nil:
+		f.send(FollowEvent{Op: Recreate, Size: cur.Size()})
+	case !os.SameFile(prev, cur):
+		f.send(FollowEvent{Op: Rotate})
+		f.send(FollowEvent{Op: Recreate, Size: cur.Size()})
+	case cur.Size() > prev.Size():
+		f.send(FollowEvent{Op: Grow, Size: cur.Size()})
+	case cur.Size() < prev.Size():
+		f.send(FollowEvent{Op: Truncate, Size: cur.Size()})
+	}
+}
+
+func (f *Follower) send(ev FollowEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	select {
+	case f.Events <- ev:
+	case <-f.done:
+	}
+}
+
+// EventsChan returns f.Events, receive-only.
+func (f *Follower) EventsChan() <-chan FollowEvent { return f.Events }
+
+// Close stops following and closes Events.
+func (f *Follower) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+		f.mu.Lock()
+		f.closed = true
+		close(f.Events)
+		f.mu.Unlock()
+		f.es.Stop()
+	})
+	return nil
+}
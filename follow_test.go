@@ -0,0 +1,107 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startFollow follows name in a fresh temp dir with a fast Poll stream.
+func startFollow(t *testing.T, name string) (*Follower, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	f, err := Follow(path, WithBackend(Poll), WithPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, path
+}
+
+func expectFollow(t *testing.T, f *Follower, want ...FollowEvent) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case have := <-f.EventsChan():
+			if have != w {
+				t.Fatalf("got %v %d, want %v %d", have.Op, have.Size, w.Op, w.Size)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v", w.Op)
+		}
+	}
+}
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowCopyTruncate(t *testing.T) {
+	f, path := startFollow(t, "app.log")
+
+	appendFile(t, path, "one\n")
+	expectFollow(t, f, FollowEvent{Recreate, 4})
+	appendFile(t, path, "two\n")
+	expectFollow(t, f, FollowEvent{Grow, 8})
+
+	// logrotate's copytruncate: copy the contents away and truncate in
+	// place, so the file keeps its identity.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".1", data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectFollow(t, f, FollowEvent{Truncate, 0})
+	appendFile(t, path, "three\n")
+	expectFollow(t, f, FollowEvent{Grow, 6})
+}
+
+func TestFollowRenameCreate(t *testing.T) {
+	f, path := startFollow(t, "app.log")
+
+	appendFile(t, path, "one\n")
+	expectFollow(t, f, FollowEvent{Recreate, 4})
+
+	// logrotate's default: rename the file away, then let the writer
+	// create a new one.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	expectFollow(t, f, FollowEvent{Rotate, 0})
+	appendFile(t, path, "two!\n")
+	expectFollow(t, f, FollowEvent{Recreate, 5})
+
+	// Both at once are told apart by the file's identity.
+	if err := os.Rename(path, path+".2"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "three\n")
+	expectFollow(t, f, FollowEvent{Rotate, 0}, FollowEvent{Recreate, 6})
+}
+
+func TestFollowClose(t *testing.T) {
+	f, path := startFollow(t, "app.log")
+	appendFile(t, path, "one\n")
+	// Leave a change unreceived, so Close has a pending send to cancel.
+	time.Sleep(50 * time.Millisecond)
+	f.Close()
+	for range f.EventsChan() {
+	}
+	f.Close()
+}
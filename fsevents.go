@@ -1,14 +1,72 @@
-//go:build darwin
-
 // Package fsevents provides file system notifications on macOS.
+//
+// On other platforms the package still builds, with the same API, but
+// EventStream.Start returns ErrUnsupportedPlatform unless the Poll backend
+// is selected. This lets programs that pick a watcher at run time import it
+// unconditionally.
+//
+// A stream takes at most DefaultMaxPaths paths unless its MaxPaths says
+// otherwise, and Start fails with ErrTooManyPaths beyond it: set MaxPaths
+// to watch more with one stream, or shard them with WatchPaths.
 package fsevents
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 )
 
+// ErrUnsupportedPlatform is returned by EventStream.Start when the program
+// isn't running on macOS and the backend needs it.
+var ErrUnsupportedPlatform = errors.New("fsevents: unsupported platform")
+
+// ErrStopTimeout is returned by EventStream.StopWithTimeout when the
+// stream didn't stop in time, and by Start for a stream it gave up on.
+var ErrStopTimeout = errors.New("fsevents: stop timed out")
+
+// ErrTooManyPaths is returned by EventStream.Start for a stream with more
+// Paths than its MaxPaths allows.
+var ErrTooManyPaths = errors.New("fsevents: too many paths for one stream")
+
+// DefaultMaxPaths is how many Paths a stream takes when MaxPaths is zero.
+// FSEvents accepts more, but slows down, and its allocations balloon, as
+// they go into the thousands. WatchPaths shards longer lists.
+const DefaultMaxPaths = 256
+
+// DefaultLatency and MinLatency bound the Latency a Native stream passes
+// FSEvents unless its Flags have NoDefer: a zero Latency means
+// DefaultLatency, and a shorter one than MinLatency is raised to it.
+// In the default, deferred, mode FSEvents waits out the latency after
+// each event before calling back, so no latency at all makes it behave
+// erratically, and less than a millisecond only costs wakeups.
+const (
+	DefaultLatency = 100 * time.Millisecond
+	MinLatency     = time.Millisecond
+)
+
+// UnsupportedError reports that a system function the package needs isn't
+// available, as on iOS-derived platforms that lack parts of the FSEvents
+// API. It matches ErrUnsupportedPlatform with errors.Is.
+type UnsupportedError struct {
+	Func string // the missing function
+	Err  error  // why the libraries couldn't be loaded, if they couldn't
+}
+
+func (e *UnsupportedError) Error() string {
+	msg := "fsevents: " + e.Func + " is not available on this system"
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *UnsupportedError) Unwrap() error { return e.Err }
+
+func (e *UnsupportedError) Is(target error) bool { return target == ErrUnsupportedPlatform }
+
 // Event represents a single file system notification.
 type Event struct {
 	// Path holds the path to the item that's changed, relative
@@ -20,6 +78,50 @@ type Event struct {
 	// Flags holds details what has happened.
 	Flags EventFlags
 
+	// Device holds EventStream.Device for a device-relative stream, and
+	// is zero otherwise.
+	Device int32
+
+	// Root holds the one of EventStream.Paths, as given, that Path is
+	// on or below, the innermost if they're nested, and is empty for
+	// events elsewhere, such as those about the stream itself.
+	Root string
+
+	// UserData holds EventStream.UserData, so that the batches of
+	// streams merged into one consumer, as by a Watcher, can be told
+	// apart.
+	UserData interface{}
+
+	// Exists and Inode are set on the ItemRenamed and ItemRemoved events
+	// of a stream with StatRenames: whether Path was there when the
+	// stream looked, and if so its inode, on file systems that have them.
+	// A rename's source is gone and its destination there, so Exists
+	// tells them apart, as it tells a removed item from one made again
+	// since. The look is taken after the event, so the item may have
+	// changed again in between: it's a hint, not a guarantee. Both are
+	// zero on other events.
+	Exists bool
+	Inode  uint64
+
+	// Info is set on the events about items of a stream with Enrich: an
+	// lstat of Path, taken once for all the batch's events on it and
+	// shared with the Subscriptions and those of SubscribePrefix. It's
+	// nil if the lstat failed, as when the item is gone or out of reach,
+	// and on other events. Like Exists, it's as of when the stream
+	// looked, not of the event.
+	Info fs.FileInfo
+
+	// Continued is set on the last event of a batch MaxDeliveredBatch
+	// split off a larger one: the batch goes on in the next one
+	// delivered, so that the two can be put together again.
+	Continued bool
+
+	// Synthetic is set on the events of a Native stream's paths that are
+	// polled instead of watched with FSEvents, as PollNetwork and
+	// FallbackToPolling have them: they're derived from walks of the
+	// tree, and their ID is zero rather than an FSEvents event ID.
+	Synthetic bool
+
 	// ID holds the event ID.
 	//
 	// Each event ID comes from the most recent event being reported
@@ -33,15 +135,11 @@ type Event struct {
 	// EventStream, this is the value you would pass for the
 	// EventStream.EventID along with Resume=true.
 	ID uint64
-}
 
-// DeviceForPath returns the device ID for the specified volume.
-func DeviceForPath(path string) (int32, error) {
-	stat := syscall.Stat_t{}
-	if err := syscall.Lstat(path, &stat); err != nil {
-		return 0, err
-	}
-	return stat.Dev, nil
+	// For BatchesMeta: the callback the event came from, as numbered by
+	// stamp, and when it arrived, in nanoseconds since the Unix epoch.
+	source   uint64
+	received int64
 }
 
 // EventStream is the primary interface to FSEvents
@@ -53,20 +151,119 @@ func DeviceForPath(path string) (int32, error) {
 //	es.Stop()
 //	...
 type EventStream struct {
+	// EventID holds the highest event ID delivered so far.
+	//
+	// NOTE: this is updated asynchronously by the
+	// watcher; use atomic.LoadUint64 to read it while
+	// the stream has been started. It never decreases,
+	// even when a batch delivers IDs out of order.
+	EventID uint64
+
+	// EventID and the fields below it, which are used with 64-bit
+	// atomics, come first so that they're 64-bit aligned on 32-bit
+	// platforms too. Gauges reported by Stats: batches sent on Events
+	// but not yet passed to Recycle, and events held by the coalescer.
+	outstanding int64
+	pending     int64
+	handlerG    int64            // ID of the goroutine running Handler, or 0
+	sources     uint64           // the callbacks stamped for BatchesMeta
+	batchSeq    uint64           // the last Batch.BatchSeq
+	latency     latencyHistogram // for Stats.QueueLatency
+	stats       Stats
+
 	stream     fsEventStreamRef
 	qref       fsDispatchQueueRef
+	source     source
+	fallback   []string // the paths polled as their HealthCheck probes failed
 	registryID uintptr
-	uuid       string
+
+	// Set by ScheduleOnRunLoop.
+	runLoop        uintptr
+	runLoopMode    string
+	runLoopModeRef CFStringRef
 
 	// Events holds the channel on which events will be sent.
-	// It's initialized by EventStream.Start if nil.
+	// It's initialized by EventStream.Start if nil and none of
+	// Handler, RawHandler and BatchesMeta is set.
+	//
+	// A batch received from Events belongs to the receiver. Once
+	// it's no longer needed it may be handed back with Recycle so
+	// its storage is reused for later batches; after that neither
+	// the slice nor any copy of it may be used.
+	//
+	// Deprecated for receiving: use EventsChan, whose receive-only
+	// channel can't be closed or sent on, either of which corrupts the
+	// stream. The field stays, to supply a channel of one's own before
+	// Start, and for the code that reads it.
 	Events chan []Event
 
+	// BatchesMeta, if set, receives the batches Events would, as a
+	// Batch with what the stream knows of where each came from, in
+	// place of Events, which Start then leaves nil. As Events, it
+	// isn't used with Handler or RawHandler, the Overflow policy
+	// applies to it, but for Spill, and a stream that closed it as its
+	// volume went away replaces it on Start with one as large.
+	BatchesMeta chan Batch
+
+	// Handler, if set, is called with each batch instead of sending
+	// it on Events. It runs on a goroutine of the stream's (or, with
+	// MaxBatchDelay or DeliveryInterval set, on the goroutine merging
+	// batches), or on the dispatch queue as DeliveryMode says, one batch
+	// at a time, so a slow Handler delays further callbacks. Calling
+	// Stop from it gets ErrStopInHandler. The batch is recycled when
+	// Handler returns and must not be retained.
+	Handler func([]Event)
+
+	// DeliveryMode says where Handler runs.
+	DeliveryMode DeliveryMode
+
+	// RawHandler, if set, takes precedence over Handler and Events
+	// and receives each batch as a RawBatch, without converting paths
+	// to strings. The other backends' batches are copied into one in the
+	// same way. See RawBatch for its lifetime rules.
+	RawHandler func(*RawBatch)
+
+	raw rawArena
+
 	// Paths holds the set of paths to watch, each
 	// specifying the root of a filesystem hierarchy to be
 	// watched for modifications.
 	Paths []string
 
+	// KeepNestedPaths watches each of Paths as given. Otherwise Start
+	// watches only the outermost of those that are nested, once their
+	// symbolic links are resolved, so that the events below more than
+	// one aren't reported again for each; Event.Root still says which
+	// path an event is below.
+	KeepNestedPaths bool
+
+	// RawPaths guarantees that Event.Path holds the bytes FSEvents
+	// reported, untouched, which needn't be valid UTF-8: with symbolic
+	// links resolved, and relative to the device's root for a
+	// device-relative stream. Filter, ExclusionPaths and Root go by
+	// those. Start fails with settings that report other paths: a
+	// Backend other than Native or Manual, PollNetwork, FallbackToPolling,
+	// or a Kind of DirsOnly, which reports a file's directory in its
+	// place. A Watcher from WatchAllVolumes doesn't prefix the paths of
+	// such streams with the mount point.
+	RawPaths bool
+
+	// Symlinks says what to do about symbolic links to directories in
+	// the watched trees: see SymlinkMode. Start fails with any but
+	// SymlinksAsReported for a device-relative stream, and with
+	// FollowSymlinks for one with RawPaths.
+	Symlinks SymlinkMode
+
+	// UserData is attached to every Event the stream delivers, as is:
+	// the library doesn't look at it. It must not change while the
+	// stream is running.
+	UserData interface{}
+
+	// MaxPaths is how many paths the stream watches, not counting those
+	// nested in others; Start fails with ErrTooManyPaths beyond it. Zero
+	// means DefaultMaxPaths, and a negative value no limit.
+	MaxPaths int
+
 	// Flags specifies what events to receive on the stream.
 	Flags CreateFlags
 
@@ -74,18 +271,25 @@ type EventStream struct {
 	// specified by EventID.
 	Resume bool
 
-	// EventID holds the most recent event ID.
-	//
-	// NOTE: this is updated asynchronously by the
-	// watcher and should not be accessed while
-	// the stream has been started.
-	EventID uint64
+	// UUID identifies the FSEvents history EventID belongs to: that of
+	// Device, or of the first path's device if Device is zero. Start
+	// sets it. Saved with EventID, it lets Start tell, when resuming,
+	// that the history was purged since, and fail with a HistoryError
+	// instead of silently skipping what happened. Left empty, the check
+	// is skipped.
+	UUID string
 
 	// Latency holds the number of seconds the service should wait after hearing
 	// about an event from the kernel before passing it along to the
 	// client via its callback. Specifying a larger value may result
 	// in more effective temporal coalescing, resulting in fewer
 	// callbacks and greater overall efficiency.
+	//
+	// Unless Flags has NoDefer, zero means DefaultLatency and a shorter
+	// one than MinLatency is raised to it. For events as soon as they're
+	// seen, set NoDefer, which delivers the first of a burst at once and
+	// waits out Latency only after it, with a zero or short Latency.
+	// EffectiveLatency returns the latency used.
 	Latency time.Duration
 
 	// When Device is non-zero, the watcher will watch events on the
@@ -96,89 +300,978 @@ type EventStream struct {
 	// structure of a file on that device or the f_fsid[0] field of
 	// a statfs structure.
 	Device int32
+
+	// MaxBatchDelay, when non-zero, merges consecutive callback batches
+	// into one delivered batch. The merged batch is delivered once
+	// MaxBatchDelay has passed since its first event arrived, or
+	// earlier when it reaches MaxBatchSize events. Unlike Latency this
+	// happens after FSEvents hands the events over, so it bounds the
+	// number of channel receives rather than kernel wakeups.
+	MaxBatchDelay time.Duration
+
+	// DeliveryInterval, when non-zero, merges callback batches like
+	// MaxBatchDelay but delivers them on a steady cadence: every
+	// DeliveryInterval since Start, skipping the ticks with nothing to
+	// deliver. This keeps the consumer's receives regular while Latency
+	// stays low. With MaxBatchDelay also set, the merged batch goes out
+	// on whichever comes first. Either way it goes out early once it
+	// reaches MaxBatchSize, and on Flush and Stop. Overflow applies to
+	// each merged batch as it's delivered; with Block, a full Events
+	// channel holds up the merging, and so the callbacks, rather than
+	// letting the batch grow.
+	DeliveryInterval time.Duration
+
+	// MaxBatchSize, when MaxBatchDelay, DeliveryInterval, a
+	// ReorderWindow or TransientWindow is set, delivers the merged
+	// batch early once it holds at least this many events. A single
+	// callback batch larger than MaxBatchSize is not split. Zero means
+	// no limit.
+	MaxBatchSize int
+
+	// SortBatches delivers the events of each batch in ascending order
+	// of ID, and never an ID lower than one already delivered since
+	// Start, as FSEvents doesn't promise when several paths are watched:
+	// an event that comes after one with a higher ID was delivered gets
+	// that ID instead, counted in Stats as a late event. Events without
+	// an ID, such as those the stream makes up, keep their place.
+	SortBatches bool
+
+	// ReorderWindow, with SortBatches, holds each batch back for that
+	// long, merging in those that arrive meanwhile as MaxBatchDelay does
+	// (whichever of them, or the next DeliveryInterval tick, comes
+	// first), so that events reported out of order across callbacks are
+	// sorted rather than delivered late. It adds up to ReorderWindow to
+	// the latency of every event.
+	ReorderWindow time.Duration
+
+	// TransientWindow, when non-zero, holds each batch back for that
+	// long, merging in those that arrive meanwhile as MaxBatchDelay does
+	// (whichever of them, a ReorderWindow or the next DeliveryInterval
+	// tick comes first), and leaves out the events on the items the
+	// merged batch has both created and removed, such as the temporary
+	// files of builds, counting them in Stats as filtered. An item
+	// whose creation went out in an earlier batch has its removal
+	// delivered as usual. It adds up to TransientWindow to the latency
+	// of every event.
+	TransientWindow time.Duration
+
+	// MaxDeliveredBatch, when positive, splits the batches larger than
+	// that into consecutive ones of at most that many events, in order,
+	// each but the last ending with an event with Continued set. It
+	// applies to the batches as they're delivered, once MaxBatchDelay,
+	// DeliveryInterval and the windows have merged them and SortBatches
+	// has sorted them, so MaxBatchSize, which emits a merged batch early,
+	// can be larger; Subscriptions get the split batches too.
+	MaxDeliveredBatch int
+
+	// InternPaths, when non-zero, makes the stream reuse the string for
+	// a path it has delivered recently instead of allocating a new one,
+	// keeping up to InternPaths distinct paths. This helps workloads that
+	// touch the same files over and over. The cache is dropped on Stop.
+	InternPaths int
+
+	// Filter, if set, is called for every event before delivery and
+	// reports whether to keep it. It may modify the event, for example
+	// to enrich it. Events it rejects are counted in Stats but still
+	// advance EventID. RawHandler bypasses Filter.
+	Filter func(*Event) bool
+
+	// ExclusionPaths lists paths below Paths whose events aren't
+	// delivered, as real paths (/private/var rather than /var) or, for a
+	// device-relative stream, relative to the device's root. A Native
+	// stream has FSEvents skip up to eight of them; the stream filters
+	// out the rest itself, before Filter and likewise not for RawHandler,
+	// counting them in Stats; those match names whatever their case if
+	// the volume isn't case-sensitive, as on APFS by default.
+	ExclusionPaths []string
+
+	// ExclusionPatterns leaves out the events on the paths that match
+	// one of them, and on those below, as the ExclusionPaths the stream
+	// filters out itself are. They're patterns as filepath.Match takes
+	// them, matched element by element and case and all: an absolute one
+	// from the root, as "/Users/*/Library/Caches", and any other at any
+	// depth, so that "node_modules" leaves out every node_modules
+	// directory and ".git/objects" every repository's objects. See
+	// ExclusionPreset for those of common noise.
+	ExclusionPatterns []string
+
+	// Kind, when not All, delivers only the events on files or only
+	// those on directories; see Kind. It applies after ExclusionPaths
+	// and before Filter, counting what it leaves out in Stats, and not
+	// for RawHandler.
+	Kind Kind
+
+	// Changes, when not AllChanges, delivers only the events that change
+	// their items' content or only those that change their metadata, as
+	// Event.Class tells; see Changes. Events of more than one class pass
+	// either. It applies before Kind, so that DirsOnly reports the
+	// directories of the changes kept, counting what it leaves out in
+	// Stats, and not for RawHandler.
+	Changes Changes
+
+	// IgnoreMetadataOnly leaves out the events that change nothing but
+	// their items' metadata, those of class Metadata, such as the storms
+	// of ItemXattrMod and ItemFinderInfoMod Time Machine, Spotlight and
+	// the Finder cause. An event where FSEvents coalesced such a change
+	// with one of content or of the tree, of class Mixed, is kept. It
+	// applies with Changes, in the same way.
+	IgnoreMetadataOnly bool
+
+	// RateLimit, when positive, limits the events delivered for each
+	// path to that many per second, after Filter, with bursts of up to
+	// as many. Once a path is over its budget its events are merged into
+	// one, with the flags of all and the latest ID, delivered as soon as
+	// the budget allows or on Stop. Events about the stream itself, such
+	// as MustScanSubDirs or HistoryDone, aren't limited. RawHandler
+	// bypasses it.
+	RateLimit float64
+
+	// AtomicSaves, if set, delivers each save that replaces a file with a
+	// temporary file next to it as one ItemModified event on the file;
+	// see AtomicSaves. It applies before ExclusionPaths and Filter, and
+	// not for RawHandler.
+	AtomicSaves *AtomicSaves
+
+	// OnGap, if set, is called when a batch's lowest event ID is more
+	// than one past the highest delivered before it: the IDs from
+	// through to were skipped, as when the kernel drops events without
+	// the stream seeing KernelDropped. Event IDs are shared by every
+	// path, so gaps are only meaningful for a stream that sees all of a
+	// device's events, such as one on "/" with no Latency. The count
+	// restarts with Start, after HistoryDone and when the IDs wrap, and
+	// events without an ID are ignored. It runs before the batch is
+	// delivered, where Filter does.
+	OnGap func(from, to uint64)
+
+	// Rescanner, if set, recovers from lost events by walking the trees
+	// they were lost in and delivering the differences from its snapshot,
+	// right after the batch that called for it, as events without an ID:
+	// below the path of a MustScanSubDirs event, and below all of its
+	// roots after KernelDropped, UserDropped and, with its Gaps set, a
+	// gap in the IDs as OnGap sees them. The walk runs on the callback,
+	// holding up later ones. It doesn't apply to device-relative streams
+	// or RawHandler.
+	Rescanner *Rescanner
+
+	// AutoFlushOnDrop, when set, has the stream recover from a batch
+	// with KernelDropped or UserDropped by itself: off the callback, it
+	// flushes as Flush(true) does, has the Rescanner, if set, walk all
+	// of its roots, which it then doesn't do on the callback, and sends
+	// a DropRecovered on Errors once what that found is delivered. Drops
+	// reported meanwhile are recovered from together.
+	AutoFlushOnDrop bool
+
+	// StatRenames, when positive, looks up the path of each ItemRenamed
+	// and ItemRemoved event with lstat, setting Event.Exists and
+	// Event.Inode, on up to that many goroutines at a time. The lookups
+	// run after Filter, off the callback, one batch after another, so
+	// the batches keep their order and the callbacks wait only while a
+	// batch before is still being looked up. It doesn't apply to
+	// device-relative streams or RawHandler.
+	StatRenames int
+
+	// Enrich sets Event.Info on each event about an item, looking up its
+	// path as StatRenames does, on up to Workers goroutines at a time.
+	// It saves the consumers, and each Subscription, the lstat most of
+	// them make anyway. Like StatRenames, it doesn't apply to
+	// device-relative streams or RawHandler.
+	Enrich bool
+
+	// Workers, when greater than one, runs Filter on up to that many
+	// goroutines per batch. The batch keeps its original order. Filter
+	// must then be safe for concurrent use.
+	Workers int
+
+	// BufferSize sets the capacity of the Events channel when Start
+	// creates it.
+	BufferSize int
+
+	// Errors, if set, receives the problems the stream runs into once
+	// started, such as an UnmountedError. Sends don't block: an error
+	// that doesn't fit in the channel's buffer is dropped.
+	//
+	// Deprecated for receiving: use ErrorsChan, as with Events. The
+	// field is still how the channel is supplied.
+	Errors chan error
+
+	// Overflow decides what happens when the Events channel is full.
+	// The zero value is Block. Drops are counted in Stats.
+	Overflow OverflowPolicy
+
+	// DispatchQueue, if non-zero, is a dispatch_queue_t to run the
+	// callbacks on instead of a queue of the stream's own, so they are
+	// serialized with the caller's other work on it; Handler runs there
+	// too with DispatchThread delivery. The stream retains the queue
+	// while running and releases only that retain on Stop. Stop waits
+	// for a callback still running on the queue, so it must not be
+	// called while that callback is blocked on the Events channel;
+	// calling it from a block on the queue itself is fine.
+	DispatchQueue uintptr
+
+	// SharedQueue, if non-nil, runs the callbacks on a queue shared with
+	// the other streams started on it, instead of on a queue of the
+	// stream's own. Stop waits for the stream's own callback if one is
+	// still running, as with DispatchQueue, but not for the other
+	// streams'. It's ignored when DispatchQueue is set.
+	SharedQueue *SharedQueue
+
+	// QoS sets the quality-of-service class of the dispatch queue that
+	// runs the callbacks, for example QoSUtility for background work that
+	// shouldn't compete with the UI. It only applies to the Native backend,
+	// and not when DispatchQueue or SharedQueue is set.
+	QoS QoS
+
+	// Backend selects how the paths are watched; the zero value uses
+	// FSEvents. See Backend for what the others support.
+	Backend Backend
+
+	// PollInterval is the time between walks with the Poll backend.
+	// Zero means one second.
+	PollInterval time.Duration
+
+	// PollNetwork makes a Native stream watch its paths that are on
+	// network file systems, such as SMB or NFS shares, with Poll instead,
+	// while FSEvents watches the rest. FSEvents only sees the changes
+	// made by this machine on those. Either way, Start sends a
+	// NetworkFSError on Errors for each such path. The polled paths'
+	// events carry no ID. It doesn't apply to device-relative streams.
+	PollNetwork bool
+
+	// FallbackToPolling makes a Native stream watch with Poll, instead of
+	// FSEvents, its paths FSEvents stays silent on, while FSEvents watches
+	// the rest, all of them delivered on the same Events: those on
+	// network file systems, as with PollNetwork; those on file systems
+	// that report nothing to FSEvents, such as FUSE mounts and the
+	// shared folders of virtual machines, for which Start sends a
+	// FallbackError on Errors; and, with a HealthCheck, the path whose
+	// probe fails, which is polled from then on, until Stop, rather than
+	// reported unhealthy. The polled paths' events have Synthetic set.
+	// It doesn't apply to device-relative streams.
+	FallbackToPolling bool
+
+	// WaitForRoot keeps a stream going when one of its paths doesn't
+	// exist at Start, or is removed later, as build systems do with
+	// their output directories. The stream looks for the path again,
+	// backing off from a tenth of a second to every five seconds, and
+	// when it's back, starts watching afresh and delivers an event on
+	// the path with RootChanged and MustScanSubDirs set and no ID, to
+	// say that what happened in between was missed. A path that was a
+	// directory must come back as one, and a file as a file; otherwise
+	// the stream sends a RootError on Errors and goes on waiting. It
+	// doesn't apply to device-relative streams, and a KQueue stream
+	// still fails to start on a missing path.
+	WaitForRoot bool
+
+	// AutoRestart, if set, keeps a stream going when its backend fails
+	// to start, or dies once started, by retrying with backoff as the
+	// policy says, resuming from EventID. Start then succeeds unless the
+	// failure is one no retry can fix, such as ErrUnsupportedPlatform.
+	// Each failure is reported on Errors as a RestartError, and Stats
+	// shows how the restarting goes. A Native stream is retried only
+	// when FSEvents fails to start it, as nothing tells when one dies.
+	AutoRestart *RestartPolicy
+
+	// RootChanges, if set, receives a RootChangedEvent for each event
+	// with RootChanged on one of the Paths of a stream with the
+	// WatchRoot flag, saying where the path went, by looking for the
+	// item that was there when the stream started, or last changed, by
+	// its inode. The look is taken on the callback. Sends don't block:
+	// an event that doesn't fit in the channel's buffer is dropped. It
+	// doesn't apply to device-relative streams.
+	RootChanges chan RootChangedEvent
+
+	running   int32        // 1 between a successful Start and Stop; atomic
+	cfg       atomic.Value // *config, frozen by Start until Stop; read with conf
+	handlers  *handlerQueue
+	coalescer *coalescer
+	statter   *statter
+	interner  *interner
+	excluded  []anchor   // the ExclusionPaths FSEvents doesn't handle
+	patterns  []pattern  // the compiled ExclusionPatterns
+	saveNames []tempName // the compiled AtomicSaves.TempNames
+	watched   []string   // the Paths the backend watches
+	rootIndex []pathRoot // what Event.Root is set from
+	gapLast   uint64     // highest ID checked by OnGap; 0 to start over
+	orderMu   sync.Mutex // held by SortBatches while emitting
+	orderMax  uint64     // highest ID emitted by SortBatches since Start
+	spill     *spill
+	limiter   *rateLimiter
+	subMu     sync.Mutex    // serializes changes to subs and quiets
+	matchers  matcherSet    // the subscriptions' patterns, guarded by subMu
+	subs      atomic.Value  // []*Subscription
+	quiets    atomic.Value  // []*quietWatch, of OnQuiet
+	prefixes  atomic.Value  // *prefixRouter, once SubscribePrefix is called
+	health    atomic.Value  // *healthCheck, once HealthCheck is called
+	idMu      sync.Mutex    // guards handedID and idWait
+	handedID  uint64        // highest ID the callbacks are done with
+	idWait    chan struct{} // closed when handedID moves or the stream stops
+
+	// lifecycle serializes Start, Stop, Restart and Flush with each
+	// other and with the stream stopping itself when its volume goes away.
+	// dumpMu is held while stream, watched, registryID and UUID change,
+	// for DebugDump, which doesn't take lifecycle.
+	lifecycle    sync.Mutex
+	dumpMu       sync.Mutex
+	eventsClosed bool          // Events or BatchesMeta was closed by end
+	stopWait     bool          // stop waits for callbacks; set by unmounted
+	mountCheck   chan struct{} // asks watchMount to look now
+	mountQuit    chan struct{} // stops watchMount; nil if not running
+	rootCheck    chan struct{} // asks watchRoots to look now
+	rootQuit     chan struct{} // stops watchRoots; nil if not running
+	rootMu       sync.Mutex    // guards rootsRemoved and rootInfo
+	rootsRemoved []string      // roots events said were removed, for watchRoots
+	rootInfo     []rootID      // set with RootChanges, for resolveRootChanges
+	dropCheck    chan struct{} // asks watchDrops to recover now
+	dropQuit     chan struct{} // stops watchDrops; nil if not running
+	dropMu       sync.Mutex    // guards dropPending
+	dropPending  *DropRecovered
+	poisoned     int32         // 1 once StopWithTimeout has given up
+	suspended    int32         // 1 from Suspend until Continue or stop
+	state        int32         // streamState, for String
+	restartQuit  chan struct{} // stops restartBackend; nil if not running
+	restartState int32         // RestartState, for Stats
+
+	// shared is the SharedQueue the stream attached to on Start. The
+	// callbacks running on it are counted under cbMu for stop to wait
+	// for, until cbDetached.
+	shared     *SharedQueue
+	cbMu       sync.Mutex
+	cbIdle     *sync.Cond // signalled when cbActive drops to 0
+	cbActive   int
+	cbDetached bool
+
+	// links are the streams FollowSymlinks runs on the targets of the
+	// links, changed under lifecycle. linkDirs holds the paths in every
+	// form and linkRoots with symbolic links resolved.
+	links     map[string]*linkWatch
+	linkDirs  []string
+	linkRoots []string
+	linkCheck chan struct{} // asks watchLinks to look now; nil without FollowSymlinks
+	linkQuit  chan struct{} // stops watchLinks; nil if not running
 }
 
 // eventStreamRegistry is a lookup table for EventStream references passed to
 // cgo. In Go 1.6+ passing a Go pointer to a Go pointer to cgo is not allowed.
 // To get around this issue, we pass only an integer.
+//
+// Every callback does a lookup, so reads are lock-free: the table is an
+// immutable map swapped atomically on Add and Delete. IDs are never
+// reused, so a callback still in flight for a deleted stream can't
+// resolve to a newer one.
 type eventStreamRegistry struct {
-	sync.Mutex
-	m      map[uintptr]*EventStream
+	mu     sync.Mutex   // serializes writers
+	m      atomic.Value // map[uintptr]*EventStream; never modified once stored
 	lastID uintptr
 }
 
-var registry = eventStreamRegistry{m: map[uintptr]*EventStream{}}
+var registry = newEventStreamRegistry()
+
+func newEventStreamRegistry() *eventStreamRegistry {
+	r := &eventStreamRegistry{}
+	r.m.Store(map[uintptr]*EventStream{})
+	return r
+}
+
+func (r *eventStreamRegistry) load() map[uintptr]*EventStream {
+	return r.m.Load().(map[uintptr]*EventStream)
+}
+
+// update stores a copy of the table with fn applied. r.mu must be held.
+func (r *eventStreamRegistry) update(fn func(map[uintptr]*EventStream)) {
+	old := r.load()
+	m := make(map[uintptr]*EventStream, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	fn(m)
+	r.m.Store(m)
+}
 
 func (r *eventStreamRegistry) Add(e *EventStream) uintptr {
-	r.Lock()
-	defer r.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
 	r.lastID++
-	r.m[r.lastID] = e
-	return r.lastID
+	id := r.lastID
+	r.update(func(m map[uintptr]*EventStream) { m[id] = e })
+	return id
 }
 
 func (r *eventStreamRegistry) Get(i uintptr) *EventStream {
-	r.Lock()
-	defer r.Unlock()
+	return r.load()[i]
+}
 
-	return r.m[i]
+// Len returns the number of registered streams.
+func (r *eventStreamRegistry) Len() int {
+	return len(r.load())
 }
 
 func (r *eventStreamRegistry) Delete(i uintptr) {
-	r.Lock()
-	defer r.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	delete(r.m, i)
+	if _, ok := r.load()[i]; !ok {
+		return
+	}
+	r.update(func(m map[uintptr]*EventStream) { delete(m, i) })
 }
 
 // Start listening to an event stream. This creates es.Events if it's not already
-// a valid channel.
+// a valid channel. It fails if the stream is already running. The stream
+// runs with its fields as they are: it takes no notice of changes to
+// them until it's stopped, so use Reconfigure to change it.
 func (es *EventStream) Start() error {
-	if es.Events == nil {
-		es.Events = make(chan []Event)
+	if atomic.LoadInt32(&es.poisoned) != 0 {
+		return ErrStopTimeout
+	}
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	return es.startLocked()
+}
+
+// EffectiveLatency returns the latency Start passes FSEvents for the
+// stream's Latency and Flags, as DefaultLatency and MinLatency say.
+func (es *EventStream) EffectiveLatency() time.Duration {
+	switch {
+	case es.conf().Flags&NoDefer != 0:
+		return es.conf().Latency
+	case es.conf().Latency == 0:
+		return DefaultLatency
+	case es.conf().Latency < MinLatency:
+		return MinLatency
+	}
+	return es.conf().Latency
+}
+
+// maxPaths returns how many Paths the stream takes, or 0 for no limit.
+func (es *EventStream) maxPaths() int {
+	switch {
+	case es.conf().MaxPaths == 0:
+		return DefaultMaxPaths
+	case es.conf().MaxPaths < 0:
+		return 0
+	}
+	return es.conf().MaxPaths
+}
+
+// checkPaths reports whether the stream takes watched, its paths that
+// aren't nested.
+func (es *EventStream) checkPaths(watched []string) error {
+	if max := es.maxPaths(); max > 0 && len(watched) > max {
+		return ErrTooManyPaths
+	}
+	return nil
+}
+
+func (es *EventStream) startLocked() (err error) {
+	if atomic.LoadInt32(&es.running) != 0 {
+		return ErrAlreadyStarted
+	}
+	if es.frozen() == nil {
+		es.freeze(es.fields())
+	}
+	defer func() {
+		if err != nil {
+			es.freeze(nil)
+			atomic.StoreInt32(&es.state, int32(stateFailed))
+		}
+	}()
+	if es.eventsClosed && es.BatchesMeta != nil {
+		es.BatchesMeta = make(chan Batch, cap(es.BatchesMeta))
+		es.eventsClosed = false
+	}
+	if (es.Events == nil || es.eventsClosed) && es.conf().Handler == nil && es.conf().RawHandler == nil && es.BatchesMeta == nil {
+		es.Events = make(chan []Event, es.conf().BufferSize)
+		es.eventsClosed = false
+	}
+
+	watched := es.watchedPaths()
+	if err := es.checkPaths(watched); err != nil {
+		return err
+	}
+	if err := es.checkKind(); err != nil {
+		return err
+	}
+	if err := es.checkDelivery(); err != nil {
+		return err
+	}
+	if err := es.checkRawPaths(); err != nil {
+		return err
+	}
+	if err := es.checkSymlinks(); err != nil {
+		return err
+	}
+	if err := es.checkPatterns(); err != nil {
+		return err
+	}
+
+	if es.conf().Backend == Native {
+		dev := es.historyDevice()
+		if es.Resume && es.UUID != "" {
+			if err := checkHistory(dev, es.UUID, atomic.LoadUint64(&es.EventID)); err != nil {
+				return err
+			}
+		}
+		uuid := deviceUUID(dev)
+		es.dumpMu.Lock()
+		es.UUID = uuid
+		es.dumpMu.Unlock()
+	}
+
+	es.dumpMu.Lock()
+	es.watched = watched
+	es.dumpMu.Unlock()
+	es.fallback = nil
+	es.rootIndex = newRootIndex(es.conf().Paths, es.conf().Device)
+	if err := es.startSpill(); err != nil {
+		return err
 	}
 
 	// register eventstream in the local registry for later lookup
 	// in C callback
 	cbInfo := registry.Add(es)
-	es.registryID = cbInfo
-	es.uuid = GetDeviceUUID(es.Device)
-	err := es.start(es.Paths, cbInfo)
-	if err != nil {
-		es.stream = 0
-		es.qref = 0
+	es.setRegistryID(cbInfo)
+	if es.conf().InternPaths > 0 && (es.interner == nil || es.interner.max != es.conf().InternPaths) {
+		es.interner = newInterner(es.conf().InternPaths)
+	}
+	_, rest := es.splitExclusions()
+	es.excluded = newAnchors(rest)
+	es.patterns = compilePatterns(es.conf().ExclusionPatterns)
+	es.saveNames = nil
+	if es.conf().AtomicSaves != nil {
+		es.saveNames = es.conf().AtomicSaves.compileTempNames()
+	}
+	es.gapLast = 0
+	es.orderMax = 0
+	es.startDelivery()
+	es.startRateLimit()
+	var roots []rootState
+	es.rootCheck = nil
+	if es.conf().WaitForRoot && es.conf().Device == 0 {
+		roots = es.rootStates()
+		es.rootCheck = make(chan struct{}, 1)
+	}
+	es.rootMu.Lock()
+	es.rootInfo = nil
+	if es.RootChanges != nil && es.conf().Flags&WatchRoot != 0 && es.conf().Device == 0 {
+		es.rootInfo = es.rootIDs()
+	}
+	es.rootMu.Unlock()
+	es.dropCheck = nil
+	if es.conf().AutoFlushOnDrop {
+		es.dropCheck = make(chan struct{}, 1)
+		es.dropMu.Lock()
+		es.dropPending = nil
+		es.dropMu.Unlock()
+	}
+	if es.conf().Device != 0 && es.mountCheck == nil {
+		es.mountCheck = make(chan struct{}, 1)
+	}
+	// Before the backend, whose callbacks read what it sets up.
+	es.linkCheck = nil
+	es.startLinks()
+	atomic.StoreInt32(&es.restartState, int32(RestartIdle))
+	if err := es.startBackend(cbInfo); err != nil && !es.restartLater(err) {
 		// Remove eventstream from the registry
 		registry.Delete(es.registryID)
-		es.registryID = 0
+		es.setRegistryID(0)
+		es.stopLinks()
+		es.stopRateLimit()
+		es.stopDelivery()
+		es.stopSpill()
+		return err
+	}
+	atomic.StoreInt32(&es.running, 1)
+	atomic.StoreInt32(&es.state, int32(stateRunning))
+	es.reportAccess()
+	if es.conf().Device != 0 {
+		es.mountQuit = make(chan struct{})
+		go es.watchMount(es.mountQuit, es.mountCheck, unmountCheckInterval, deviceMounted)
+	}
+	if roots != nil {
+		es.rootQuit = make(chan struct{})
+		go es.watchRoots(es.rootQuit, es.rootCheck, roots, rootRetryMin, rootRetryMax)
+	}
+	if es.dropCheck != nil {
+		es.dropQuit = make(chan struct{})
+		go es.watchDrops(es.dropQuit, es.dropCheck)
+	}
+	if es.linkCheck != nil {
+		es.linkQuit = make(chan struct{})
+		go es.watchLinks(es.linkQuit, es.linkCheck)
+	}
+	return nil
+}
+
+// startBackend starts watching with es.Backend, leaving nothing running
+// if it fails.
+func (es *EventStream) startBackend(cbInfo uintptr) error {
+	var err error
+	switch es.conf().Backend {
+	case Native:
+		err = es.startNative(cbInfo)
+	case KQueue:
+		es.source, err = startKQueue(es)
+	case Poll:
+		es.source, err = startPoll(es)
+	case Manual:
+	default:
+		err = fmt.Errorf("fsevents: %v: unknown backend %v", es, es.conf().Backend)
+	}
+	if err != nil {
+		if es.source != nil {
+			es.source.stop()
+			es.source = nil
+		}
+		es.setStream(0)
+		es.qref = 0
 	}
 	return err
 }
 
+// setStream and setRegistryID change es.stream and es.registryID under
+// es.dumpMu.
+func (es *EventStream) setStream(stream fsEventStreamRef) {
+	es.dumpMu.Lock()
+	es.stream = stream
+	es.dumpMu.Unlock()
+}
+
+func (es *EventStream) setRegistryID(id uintptr) {
+	es.dumpMu.Lock()
+	es.registryID = id
+	es.dumpMu.Unlock()
+}
+
+// deliver records the highest event ID of the batch, filters it and
+// passes it on to the coalescer, if any, or straight to emit.
+func (es *EventStream) deliver(events []Event) {
+	if es.conf().RawHandler != nil {
+		// From a backend other than Native, or made by the stream
+		// itself, as when a root comes back or the backend restarts.
+		es.deliverRawEvents(events)
+		return
+	}
+	es.countReceived(len(events))
+	if h, _ := es.health.Load().(*healthCheck); h != nil {
+		events = h.see(es, events)
+	}
+
+	var max uint64
+	var mounts bool
+	for i := range events {
+		if events[i].ID > max {
+			max = events[i].ID
+		}
+		if events[i].Flags&(Mount|Unmount) != 0 {
+			mounts = true
+		}
+	}
+	dropped := false
+	if es.dropCheck != nil {
+		dropped = es.checkDrops(events, atomic.LoadUint64(&es.EventID))
+	}
+	es.storeEventID(max)
+	if max != 0 {
+		// Last, once the batch and what it calls for are out.
+		defer es.markHanded(max)
+	}
+	gap := false
+	if es.conf().OnGap != nil || es.conf().Rescanner != nil {
+		gap = es.checkGap(events)
+	}
+	// After a drop, recoverDrops rescans all the roots.
+	if r := es.conf().Rescanner; r != nil && es.conf().Device == 0 && !dropped {
+		if dirs := r.rescanTargets(events, gap); len(dirs) > 0 {
+			// Once the batch is out, deliver what it missed.
+			defer es.rescan(dirs)
+		}
+	}
+	if es.rootCheck != nil {
+		es.checkRoots(events)
+	}
+	if es.linkCheck != nil {
+		es.checkLinks(events)
+	}
+	if es.RootChanges != nil {
+		es.resolveRootChanges(events)
+	}
+	if mounts {
+		mountPoints.invalidate()
+		// Once the batch is out, see whether the stream's own volume
+		// went away.
+		defer es.checkMount()
+	}
+
+	es.attribute(events)
+	events = es.confine(events)
+	events = es.atomicSaves(events)
+	events = es.exclude(events)
+	events = es.selectChanges(events)
+	events = es.selectKind(events)
+	events = es.filter(events)
+	l := es.limiter
+	if l != nil {
+		events = l.limit(events)
+	}
+	if len(events) == 0 {
+		recycle(events)
+		return
+	}
+
+	if l != nil {
+		l.emitMu.Lock()
+		defer l.emitMu.Unlock()
+	}
+	es.handOff(events)
+}
+
+// handOff passes a batch on to the statter, if there is one, or else on
+// as merge does.
+func (es *EventStream) handOff(events []Event) {
+	if es.BatchesMeta != nil {
+		es.stamp(events)
+	}
+	if s := es.statter; s != nil {
+		s.in <- events
+		return
+	}
+	es.merge(events)
+}
+
+// merge passes a batch on to the coalescer, if there is one, or emits it.
+func (es *EventStream) merge(events []Event) {
+	if c := es.coalescer; c != nil {
+		c.add(events)
+		return
+	}
+	es.emit(events)
+}
+
+// emit hands a batch to the subscribers and to es.Handler or es.Events,
+// applying es.Overflow.
+func (es *EventStream) emit(events []Event) {
+	if es.conf().SortBatches {
+		es.orderMu.Lock()
+		defer es.orderMu.Unlock()
+		es.order(events)
+	}
+	if max := es.conf().MaxDeliveredBatch; max > 0 && len(events) > max {
+		for start := 0; start < len(events); start += max {
+			end := start + max
+			if end > len(events) {
+				end = len(events)
+			}
+			part := newBatch(end - start)
+			copy(part, events[start:end])
+			part[len(part)-1].Continued = end < len(events)
+			es.deliverBatch(part)
+		}
+		recycle(events)
+		return
+	}
+	es.deliverBatch(events)
+}
+
+// deliverBatch hands a batch as emitted to the subscribers and to
+// es.Handler, es.Events or es.BatchesMeta.
+func (es *EventStream) deliverBatch(events []Event) {
+	b := Batch{Events: events}
+	if es.BatchesMeta != nil {
+		b = es.describe(events)
+	}
+	if watches := es.quietWatches(); len(watches) > 0 {
+		// Once the batch is out, and before its consumer may recycle it.
+		defer noteDelivered(watches, maxID(events))
+	}
+	es.fanOut(events)
+	if q := es.handlers; q != nil {
+		q.in <- b
+		return
+	}
+	if es.conf().Handler != nil {
+		es.callHandler(events, goid())
+		return
+	}
+	es.send(b)
+}
+
+// storeEventID raises es.EventID to id. FSEvents does not guarantee
+// ascending IDs within or across batches when several paths are watched,
+// so the stored value is only ever moved forward.
+func (es *EventStream) storeEventID(id uint64) {
+	for {
+		cur := atomic.LoadUint64(&es.EventID)
+		if id <= cur || atomic.CompareAndSwapUint64(&es.EventID, cur, id) {
+			return
+		}
+	}
+}
+
 // Flush flushes events that have occurred but haven't been delivered.
 // If sync is true, it will block until all the events have been delivered,
-// otherwise it will return immediately.
+// otherwise it will return immediately. It waits for a Start, Stop or
+// Restart in progress on another goroutine.
 func (es *EventStream) Flush(sync bool) {
-	flush(es.stream, sync)
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	es.flushLocked(sync)
+}
+
+// flushLocked flushes as Flush does, returning what FSEventStreamFlushAsync
+// returns when sync is false.
+func (es *EventStream) flushLocked(sync bool) uint64 {
+	for _, lw := range es.links {
+		lw.es.Flush(sync)
+	}
+	if es.source != nil {
+		es.source.flush(sync)
+	}
+	id := flush(es.stream, sync)
+	if s := es.statter; s != nil && sync {
+		s.flush()
+	}
+	if c := es.coalescer; c != nil {
+		c.flush(sync)
+	}
+	if q := es.handlers; q != nil && sync {
+		q.flush()
+	}
+	return id
+}
+
+// ScheduleOnRunLoop makes the next Start deliver callbacks on the given
+// CFRunLoopRef in the given run loop mode, instead of on a dispatch queue.
+// An empty mode means kCFRunLoopDefaultMode; "kCFRunLoopCommonModes"
+// selects the common modes. The run loop must be running for events to
+// arrive, and with DispatchThread delivery Handler then runs on its
+// thread, for example the main thread of an AppKit application. A zero
+// runLoop goes back to dispatch queues.
+func (es *EventStream) ScheduleOnRunLoop(runLoop uintptr, mode string) {
+	es.runLoop = runLoop
+	es.runLoopMode = mode
 }
 
 // Stop stops listening to the event stream.
 func (es *EventStream) Stop() {
-	if es.stream != 0 {
-		stop(es.stream, es.qref)
-		es.stream = 0
-		es.qref = 0
+	if atomic.LoadInt32(&es.poisoned) != 0 {
+		return
+	}
+	if es.inHandler() {
+		es.report(ErrStopInHandler)
+		return
+	}
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	es.stopLocked()
+	releasePathStrings()
+}
+
+// StopWithTimeout flushes and stops the stream like Flush(true) and Stop,
+// but gives up after d, as when a Handler or a consumer of a Block stream
+// is deadlocked and the stream can't get its callbacks out of the way.
+// It then returns ErrStopTimeout, and the stop carries on in the
+// background for as long as it's stuck, holding on to the stream's
+// dispatch queue, goroutines and FSEvents stream: they're leaked rather
+// than released under a callback that may still use them. The stream is
+// poisoned: Start returns ErrStopTimeout and Stop does nothing from then
+// on.
+func (es *EventStream) StopWithTimeout(d time.Duration) error {
+	if atomic.LoadInt32(&es.poisoned) != 0 {
+		return ErrStopTimeout
+	}
+	if es.inHandler() {
+		return ErrStopInHandler
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		es.lifecycle.Lock()
+		defer es.lifecycle.Unlock()
+		if atomic.LoadInt32(&es.running) != 0 {
+			es.flushLocked(true)
+		}
+		es.stopLocked()
+		releasePathStrings()
+	}()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		atomic.StoreInt32(&es.poisoned, 1)
+		return ErrStopTimeout
+	}
+}
+
+func (es *EventStream) stopLocked() {
+	if atomic.SwapInt32(&es.running, 0) != 0 {
+		atomic.StoreInt32(&es.state, int32(stateStopped))
+	}
+	es.idMu.Lock()
+	es.wakeWaitersLocked()
+	es.idMu.Unlock()
+	// First, as they deliver through es.
+	es.stopLinks()
+	if es.mountQuit != nil {
+		close(es.mountQuit)
+		es.mountQuit = nil
+	}
+	if es.rootQuit != nil {
+		close(es.rootQuit)
+		es.rootQuit = nil
+	}
+	if es.dropQuit != nil {
+		close(es.dropQuit)
+		es.dropQuit = nil
+	}
+	if es.restartQuit != nil {
+		close(es.restartQuit)
+		es.restartQuit = nil
+		atomic.StoreInt32(&es.restartState, int32(RestartIdle))
+	}
+	es.stop()
+	if es.source != nil {
+		es.source.stop()
+		es.source = nil
 	}
 
 	// Remove eventstream from the registry
 	registry.Delete(es.registryID)
-	es.registryID = 0
+	es.setRegistryID(0)
+	es.stopRateLimit()
+	es.stopDelivery()
+	es.pauseQuiet()
+	es.stopSpill()
+	if es.interner != nil {
+		es.interner.reset()
+	}
+	if c := es.frozen(); c != nil {
+		if names := es.changed(c); len(names) > 0 {
+			es.report(&ConfigChangedError{Fields: names})
+		}
+		es.freeze(nil)
+	}
 }
 
-// Restart restarts the event listener. This
-// can be used to change the current watch flags.
+// Restart restarts the event listener, with the configuration it was
+// started with: use Reconfigure to change it.
 func (es *EventStream) Restart() error {
-	es.Stop()
+	if es.inHandler() {
+		return ErrStopInHandler
+	}
+	if atomic.LoadInt32(&es.poisoned) != 0 {
+		return ErrStopTimeout
+	}
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	c := es.frozen()
+	es.stopLocked()
+	if c != nil {
+		es.freeze(c)
+	}
 	es.Resume = true
-	return es.Start()
+	return es.startLocked()
 }
@@ -0,0 +1,112 @@
+//go:build !darwin
+
+package fsevents
+
+import "time"
+
+// Stubs for the functions that call into CoreServices, so the package
+// builds everywhere. EventStream.Start fails with ErrUnsupportedPlatform
+// and everything else reports nothing.
+
+// DeviceForPath returns the device ID for the specified volume.
+func DeviceForPath(path string) (int32, error) {
+	return 0, ErrUnsupportedPlatform
+}
+
+// ListDevices returns the mounted volumes.
+func ListDevices() ([]DeviceInfo, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// MountPointForDevice returns where the volume with device ID dev is
+// mounted, for making the paths of a device-relative stream absolute. The
+// mount table is cached; a running EventStream that reports a Mount or
+// Unmount event clears the cache, and a device the cache doesn't know
+// reloads it, so without such a stream only an ejected volume can linger.
+func MountPointForDevice(dev int32) (string, error) {
+	return "", ErrUnsupportedPlatform
+}
+
+// CFArrayLen retrieves the length of CFArray.
+func CFArrayLen(ref CFArrayRef) int {
+	return 0
+}
+
+// CurrentEventID returns the most recently generated event ID,
+// system-wide, whether or not any stream was told about it. It returns 0
+// where the FSEvents history isn't available.
+func CurrentEventID() uint64 {
+	return 0
+}
+
+// LatestEventID returns CurrentEventID().
+//
+// Deprecated: it was named after FSEventStreamGetLatestEventId, which is
+// about one stream, as EventStream.LatestEventID is; use CurrentEventID.
+func LatestEventID() uint64 {
+	return CurrentEventID()
+}
+
+// EventIDForDeviceBeforeTime returns an event ID before a given time.
+// It returns 0 where the FSEvents history isn't available.
+func EventIDForDeviceBeforeTime(dev int32, before time.Time) uint64 {
+	return 0
+}
+
+// EventIDForDeviceSince returns the ID of the last event on device dev
+// from before ago before now, for a stream to resume from to get the
+// events since. It fails if FSEvents isn't available or dev isn't
+// mounted, where FSEvents would return an ID that means nothing.
+func EventIDForDeviceSince(dev int32, ago time.Duration) (uint64, error) {
+	return 0, ErrUnsupportedPlatform
+}
+
+// GetDeviceUUID retrieves the UUID required to identify an EventID
+// in the FSEvents database
+func GetDeviceUUID(deviceID int32) string {
+	return ""
+}
+
+func (es *EventStream) start(paths []string, cbInfo uintptr) error {
+	return ErrUnsupportedPlatform
+}
+
+func startKQueue(es *EventStream) (source, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func fsType(path string) (string, error) {
+	return "", ErrUnsupportedPlatform
+}
+
+func flush(stream fsEventStreamRef, sync bool) uint64 { return 0 }
+
+func (es *EventStream) suspend(on bool) error {
+	return ErrUnsupportedPlatform
+}
+
+func (es *EventStream) stop() {}
+
+func getStreamRefDescription(stream fsEventStreamRef) string {
+	return ""
+}
+
+func getStreamRefPaths(stream fsEventStreamRef) []string {
+	return nil
+}
+
+func getStreamRefEventID(stream fsEventStreamRef) uint64 {
+	return 0
+}
+
+func getStreamRefDeviceID(stream fsEventStreamRef) int32 {
+	return 0
+}
+
+func newSharedDispatchQueue(qos QoS) fsDispatchQueueRef {
+	return 0
+}
+
+func releaseDispatchQueue(q fsDispatchQueueRef) {}
+
+func releasePathStrings() {}
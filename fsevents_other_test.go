@@ -0,0 +1,37 @@
+//go:build !darwin
+
+package fsevents
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStartUnsupported(t *testing.T) {
+	es := &EventStream{Paths: []string{t.TempDir()}}
+	if err := es.Start(); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Fatalf("Start() = %v, want ErrUnsupportedPlatform", err)
+	}
+	if n := len(registry.load()); n != 0 {
+		t.Errorf("registry holds %d streams after a failed Start", n)
+	}
+
+	// The rest of the API is safe to call on a stream that never started.
+	es.Flush(true)
+	es.Stop()
+	if err := es.Restart(); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("Restart() = %v, want ErrUnsupportedPlatform", err)
+	}
+	if _, err := DeviceForPath("/"); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("DeviceForPath() = %v, want ErrUnsupportedPlatform", err)
+	}
+	if _, err := MountPointForDevice(1); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("MountPointForDevice() = %v, want ErrUnsupportedPlatform", err)
+	}
+	if s := ValidateResume(1, "", 0); s != ResumeUUIDMismatch {
+		t.Errorf("ValidateResume() = %v, want ResumeUUIDMismatch", s)
+	}
+	if _, err := ListDevices(); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("ListDevices() = %v, want ErrUnsupportedPlatform", err)
+	}
+}
@@ -3,14 +3,20 @@
 package fsevents
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/ebitengine/purego"
 )
 
 func TestScript(t *testing.T) {
@@ -42,146 +48,32 @@ func TestScript(t *testing.T) {
 	}
 }
 
-func TestBasicExample(t *testing.T) {
-	path, err := os.MkdirTemp("", "fsexample")
-	if err != nil {
-		t.Fatal(err)
-	}
-	path, err = filepath.EvalSymlinks(path)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(path)
-
-	dev, err := DeviceForPath(path)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	es := &EventStream{
-		Paths:   []string{path},
-		Latency: 500 * time.Millisecond,
-		Device:  dev,
-		Flags:   FileEvents,
-	}
-
-	err = es.Start()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	wait := make(chan Event)
-	go func() {
-		for msg := range es.Events {
-			for _, event := range msg {
-				t.Logf("Event: %#v", event)
-				wait <- event
-				es.Stop()
-				return
-			}
-		}
-	}()
-
-	err = os.WriteFile(filepath.Join(path, "example.txt"), []byte("example"), 0o700)
-	if err != nil {
-		t.Fatal(err)
-	}
-	select {
-	case <-wait:
-	case <-time.After(5 * time.Second):
-		t.Fatal("timed out waiting for event")
-	}
-}
-
-func TestIssue48(t *testing.T) {
-	// FSEvents fails to start when watching >4096 paths
-	// This test validates that limit and checks that the error is propagated
-
-	path, err := os.MkdirTemp("", "fsmanyfiles")
-	if err != nil {
-		t.Fatal(err)
-	}
-	path, err = filepath.EvalSymlinks(path)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(path)
-
-	// TODO: using this value fails to start
-	// dev, err := DeviceForPath(path)
-	// if err != nil {
-	// 	t.Fatal(err)
-	// }
-
-	var filenames []string
-	for i := 0; i < 4096; i++ {
-		newFilename := filepath.Join(path, fmt.Sprint("test", i))
-		err = os.WriteFile(newFilename, []byte("test"), 0o700)
-		if err != nil {
-			t.Fatal(err)
-		}
-		filenames = append(filenames, newFilename)
-	}
-
-	es := &EventStream{
-		Paths:   filenames,
-		Latency: 500 * time.Millisecond,
-		Device:  0, // dev,
-		Flags:   FileEvents,
-	}
-
-	err = es.Start()
-	if err != nil {
+func TestRawStream(t *testing.T) {
+	es := &EventStream{Paths: []string{t.TempDir()}, Flags: FileEvents}
+	if err := es.Start(); err != nil {
 		t.Fatal(err)
 	}
 
-	wait := make(chan Event)
-	go func() {
-		for msg := range es.Events {
-			for _, event := range msg {
-				t.Logf("Event: %#v", event)
-				wait <- event
-				es.Stop()
-				return
-			}
-		}
-	}()
-
-	// write some new contents to test42 in the watchlist
-	err = os.WriteFile(filenames[42], []byte("special"), 0o700)
+	ref, err := es.RawStream()
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// should be reported as expected
-	<-wait
-
-	/////
-	// create one more file that puts it over the edge
-	newFilename := filepath.Join(path, fmt.Sprint("test", 4096))
-	err = os.WriteFile(newFilename, []byte("test"), 0o700)
-	if err != nil {
-		t.Fatal(err)
+	if q, err := es.RawQueue(); err != nil || q == 0 {
+		t.Fatalf("RawQueue() = %#x, %v", q, err)
 	}
-	filenames = append(filenames, newFilename)
-
-	// create an all-new instances to avoid problems
-	es2 := &EventStream{
-		Paths:   filenames,
-		Latency: 500 * time.Millisecond,
-		Device:  0, // dev,
-		Flags:   FileEvents,
+	// The reference works with the FSEvents API directly.
+	if desc := getStreamRefDescription(fsEventStreamRef(ref)); !strings.Contains(desc, "FSEventStream") {
+		t.Errorf("unexpected description %q", desc)
 	}
 
-	err = es2.Start()
-	if err == nil {
-		es2.Stop()
-		t.Fatal("eventstream error was not detected on >4096 files in watchlist")
+	es.Stop()
+	if _, err := es.RawStream(); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("RawStream after Stop: %v, want ErrNotStarted", err)
 	}
 }
 
 func TestRegistry(t *testing.T) {
-	if registry.m == nil {
+	if registry.load() == nil {
 		t.Fatal("registry not initialized at start")
 	}
 
@@ -235,7 +127,7 @@ func TestMany(t *testing.T) {
 	go func() {
 		for {
 			select {
-			case msg := <-es.Events:
+			case msg := <-es.EventsChan():
 				lock.Lock()
 
 				for _, event := range msg {
@@ -336,3 +228,351 @@ func TestMany(t *testing.T) {
 		}
 	}
 }
+
+func TestDeliverEventIDMonotonic(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 3)}
+
+	batches := [][]Event{
+		{{ID: 5}, {ID: 9}, {ID: 3}},
+		{{ID: 7}, {ID: 8}},
+		{{ID: 12}, {ID: 10}},
+	}
+	want := []uint64{9, 9, 12}
+
+	for i, b := range batches {
+		inject(t, es, b...)
+		<-es.EventsChan()
+		if have := atomic.LoadUint64(&es.EventID); have != want[i] {
+			t.Errorf("batch %d: EventID is %d, want %d", i, have, want[i])
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := CurrentEventID()
+	const n = 20
+	for i := 0; i < n; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// FSEvents records the history asynchronously.
+	time.Sleep(2 * time.Second)
+
+	es := &EventStream{Paths: []string{dir}, Flags: FileEvents}
+	seen := map[string]bool{}
+	calls := 0
+	res, err := es.Replay(from, func(e Event) error {
+		calls++
+		if e.Flags&ItemCreated != 0 && strings.HasPrefix(filepath.Base(e.Path), "file") {
+			seen[filepath.Base(e.Path)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != n {
+		t.Errorf("replayed %d of the %d files", len(seen), n)
+	}
+	if !res.Done || res.Events != calls || res.Batches == 0 || res.LastID <= from {
+		t.Errorf("result %+v after %d handler calls", res, calls)
+	}
+	if es.Stats().Running {
+		t.Error("Replay started the stream itself")
+	}
+
+	stop := errors.New("stop")
+	res, err = es.Replay(from, func(Event) error { return stop })
+	if err != stop || res.Events != 0 || res.Done {
+		t.Errorf("Replay() = %+v, %v after the handler failed", res, err)
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	write := func(names ...string) {
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// FSEvents records the history asynchronously.
+		time.Sleep(2 * time.Second)
+	}
+	created := func(since uint64) (map[string]bool, uint64) {
+		t.Helper()
+		events, next, err := ChangedSince(ctx, dir, 0, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]bool{}
+		for _, e := range events {
+			if e.Flags&ItemCreated != 0 && filepath.Dir(e.Path) == dir {
+				seen[filepath.Base(e.Path)] = true
+			}
+			if e.ID <= since || e.ID > next {
+				t.Errorf("event %v outside (%d, %d]", e, since, next)
+			}
+		}
+		return seen, next
+	}
+
+	from := CurrentEventID()
+	write("a", "b")
+	seen, checkpoint := created(from)
+	if !reflect.DeepEqual(seen, map[string]bool{"a": true, "b": true}) || checkpoint <= from {
+		t.Errorf("ChangedSince(%d) created %v, next %d", from, seen, checkpoint)
+	}
+	write("c", "d")
+	seen, next := created(checkpoint)
+	if !reflect.DeepEqual(seen, map[string]bool{"c": true, "d": true}) || next <= checkpoint {
+		t.Errorf("ChangedSince(checkpoint %d) created %v, next %d", checkpoint, seen, next)
+	}
+
+	canceled, stop := context.WithCancel(ctx)
+	stop()
+	if _, _, err := ChangedSince(canceled, dir, 0, from); err != context.Canceled {
+		t.Errorf("ChangedSince() canceled = %v", err)
+	}
+}
+
+func TestEventIDForDeviceSince(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := DeviceForPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string) {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("old")
+	time.Sleep(4 * time.Second)
+	write("new")
+	time.Sleep(time.Second)
+
+	from, err := EventIDForDeviceSince(dev, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now := EventIDForDeviceBeforeTime(dev, time.Now()); from == 0 || from >= now {
+		t.Fatalf("ID from 2s ago %d, now %d", from, now)
+	}
+	es := &EventStream{Paths: []string{dir}, Flags: FileEvents}
+	seen := map[string]bool{}
+	if _, err := es.Replay(from, func(e Event) error {
+		if e.Flags&ItemCreated != 0 {
+			seen[filepath.Base(e.Path)] = true
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !seen["new"] || seen["old"] {
+		t.Errorf("replayed from 2s ago: %v, want new and not old", seen)
+	}
+
+	if _, err := EventIDForDeviceSince(-1, time.Second); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("EventIDForDeviceSince(-1) = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestFlushAsync(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := &EventStream{Paths: []string{dir}, Flags: FileEvents, Latency: time.Minute, Events: make(chan []Event, 100)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	want := map[string]bool{}
+	for _, name := range []string{"a", "b", "c"} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		want[file] = true
+	}
+	// FSEvents may not have queued them yet.
+	var id uint64
+	for deadline := time.Now().Add(5 * time.Second); id == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if id, err = es.FlushAsync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if id == 0 {
+		t.Fatal("FlushAsync() = 0 after writing files")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := es.WaitForID(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	// Everything up to id is on the channel, well within Latency.
+	var highest uint64
+	for len(es.EventsChan()) > 0 {
+		for _, e := range <-es.EventsChan() {
+			delete(want, e.Path)
+			if e.ID > highest {
+				highest = e.ID
+			}
+		}
+	}
+	if highest < id {
+		t.Errorf("highest ID on the channel %d, want at least %d", highest, id)
+	}
+	if len(want) != 0 {
+		t.Logf("not flushed yet: %v", want)
+	}
+}
+
+func TestSuspend(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := &EventStream{Paths: []string{dir}, Flags: FileEvents, Latency: 10 * time.Millisecond, Events: make(chan []Event, 100)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if err := es.Suspend(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "written")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case events := <-es.EventsChan():
+		t.Fatalf("got %v while suspended", events)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := es.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, es, file, ItemCreated)
+}
+
+func TestLatestEventID(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := CurrentEventID()
+	if since == 0 {
+		t.Fatal("CurrentEventID() = 0")
+	}
+	es := &EventStream{Paths: []string{dir}, Flags: FileEvents, Resume: true, EventID: since}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	if id := es.LatestEventID(); id != since {
+		t.Errorf("before any events, LatestEventID() = %d, want %d", id, since)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+wait:
+	for {
+		select {
+		case batch := <-es.EventsChan():
+			for _, e := range batch {
+				if e.Path == file {
+					break wait
+				}
+			}
+		case <-timeout:
+			t.Fatal("no event delivered")
+		}
+	}
+	if id := es.LatestEventID(); id <= since {
+		t.Errorf("after a delivery, LatestEventID() = %d, want more than %d", id, since)
+	}
+}
+
+func TestIgnoreMetadataOnlyXattr(t *testing.T) {
+	libSystem, err := purego.Dlopen("/usr/lib/libSystem.B.dylib", purego.RTLD_LAZY)
+	if err != nil {
+		t.Skip(err)
+	}
+	// setxattr(2), as xattr -w calls it.
+	var setxattr func(path, name string, value *byte, size uintptr, position uint32, options int32) int32
+	purego.RegisterLibFunc(&setxattr, libSystem, "setxattr")
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged, written := filepath.Join(dir, "tagged"), filepath.Join(dir, "written")
+	for _, file := range []string{tagged, written} {
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// FSEvents may report a file's recent creation along with its next
+	// change otherwise.
+	time.Sleep(time.Second)
+
+	es := &EventStream{
+		Paths:              []string{dir},
+		Flags:              FileEvents,
+		Latency:            10 * time.Millisecond,
+		Events:             make(chan []Event, 100),
+		IgnoreMetadataOnly: true,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	value := []byte("1")
+	if setxattr(tagged, "org.fsnotify.fsevents.test", &value[0], uintptr(len(value)), 0, 0) != 0 {
+		t.Fatal("setxattr failed")
+	}
+	es.Flush(true)
+	if err := os.WriteFile(written, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Until the write is delivered and the xattr's event left out, in
+	// whichever order FSEvents reports them.
+	timeout := time.After(5 * time.Second)
+	for done := false; !done || es.Stats().FilteredEvents == 0; {
+		select {
+		case batch := <-es.EventsChan():
+			for _, e := range batch {
+				switch e.Path {
+				case tagged:
+					t.Errorf("got %v on %s, whose metadata alone changed", e.Flags, tagged)
+				case written:
+					done = done || e.Flags&ItemModified != 0
+				}
+			}
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("ItemModified on %s delivered %v, with %d events left out", written, done, es.Stats().FilteredEvents)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package fseventstest_test
+
+import (
+	"fmt"
+
+	"github.com/fsnotify/fsevents"
+	"github.com/fsnotify/fsevents/fseventstest"
+)
+
+// follow calls reload for every batch with an event on path, until the
+// stream reports an error. It stops the stream on the way out.
+func follow(s fsevents.Stream, path string, reload func()) error {
+	defer s.Stop()
+	for {
+		select {
+		case batch := <-s.EventsChan():
+			for _, e := range batch {
+				if e.Path == path {
+					reload()
+					break
+				}
+			}
+			s.Recycle(batch)
+		case err := <-s.ErrorsChan():
+			return err
+		}
+	}
+}
+
+// The consumer is tested with scripted events: no file is touched, and
+// nothing waits for FSEvents' latency.
+func Example() {
+	s := fseventstest.New()
+	if err := s.Start(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	done := make(chan error)
+	go func() { done <- follow(s, "/etc/app.conf", func() { fmt.Println("reload") }) }()
+
+	s.Emit([]fsevents.Event{{Path: "/etc/app.conf", Flags: fsevents.ItemModified | fsevents.ItemIsFile, ID: 1}})
+	s.Emit([]fsevents.Event{{Path: "/etc/other.conf", Flags: fsevents.ItemModified | fsevents.ItemIsFile, ID: 2}})
+	s.Emit([]fsevents.Event{
+		{Path: "/etc/app.conf", Flags: fsevents.ItemRemoved | fsevents.ItemIsFile, ID: 3},
+		{Path: "/etc/app.conf", Flags: fsevents.ItemCreated | fsevents.ItemIsFile, ID: 4},
+	})
+	s.SetError(&fsevents.UnmountedError{Device: 1})
+
+	fmt.Println(<-done)
+	fmt.Println("stopped:", s.Calls().Stop)
+	// Output:
+	// reload
+	// reload
+	// fsevents: device 1 was unmounted
+	// stopped: 1
+}
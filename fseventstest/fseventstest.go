@@ -0,0 +1,168 @@
+// Package fseventstest provides a fake fsevents.Stream for testing code
+// that consumes events, without a real file system or real timing.
+//
+// A FakeStream is an EventStream with the Manual backend: the test
+// scripts the batches it delivers, and they go through the same pipeline
+// as FSEvents' would, so Filter, Kind, ExclusionPaths, batching and the
+// Overflow policy apply to them. It also records the calls made to it,
+// for the test to check.
+package fseventstest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/fsnotify/fsevents"
+)
+
+// FakeStream is an fsevents.Stream whose events are scripted by the test.
+type FakeStream struct {
+	// ES is the EventStream behind the fake. Its fields can be changed
+	// before Start, as those of any EventStream.
+	ES *fsevents.EventStream
+
+	mu       sync.Mutex
+	calls    Calls
+	startErr error
+}
+
+// Calls counts the calls made to a FakeStream.
+type Calls struct {
+	Start     int
+	Stop      int
+	Restart   int
+	Flush     int // with sync false
+	FlushSync int // with sync true
+}
+
+var _ fsevents.Stream = (*FakeStream)(nil)
+
+// New returns an unstarted FakeStream configured by opts, with a buffered
+// Errors channel. Its Backend is always Manual.
+func New(opts ...fsevents.Option) *FakeStream {
+	es := fsevents.New(nil, opts...)
+	es.Backend = fsevents.Manual
+	if es.Errors == nil {
+		es.Errors = make(chan error, 16)
+	}
+	return &FakeStream{ES: es}
+}
+
+// Start starts the stream, or returns the error set by FailStart.
+func (f *FakeStream) Start() error {
+	f.mu.Lock()
+	f.calls.Start++
+	err := f.startErr
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.ES.Start()
+}
+
+// Stop stops the stream.
+func (f *FakeStream) Stop() {
+	f.mu.Lock()
+	f.calls.Stop++
+	f.mu.Unlock()
+	f.ES.Stop()
+}
+
+// Restart restarts the stream, or returns the error set by FailStart.
+func (f *FakeStream) Restart() error {
+	f.mu.Lock()
+	f.calls.Restart++
+	err := f.startErr
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.ES.Restart()
+}
+
+// Flush flushes the stream's pipeline.
+func (f *FakeStream) Flush(sync bool) {
+	f.mu.Lock()
+	if sync {
+		f.calls.FlushSync++
+	} else {
+		f.calls.Flush++
+	}
+	f.mu.Unlock()
+	f.ES.Flush(sync)
+}
+
+// EventsChan returns the stream's Events channel.
+func (f *FakeStream) EventsChan() <-chan []fsevents.Event { return f.ES.EventsChan() }
+
+// ErrorsChan returns the stream's Errors channel.
+func (f *FakeStream) ErrorsChan() <-chan error { return f.ES.ErrorsChan() }
+
+// Recycle returns a batch to the pool.
+func (f *FakeStream) Recycle(batch []fsevents.Event) { f.ES.Recycle(batch) }
+
+// Stats returns the stream's counters.
+func (f *FakeStream) Stats() fsevents.Stats { return f.ES.Stats() }
+
+// LastEventID returns the highest event ID delivered so far.
+func (f *FakeStream) LastEventID() uint64 { return f.ES.LastEventID() }
+
+// Emit delivers batch as if FSEvents had reported it, returning once the
+// stream is done with it; with an unbuffered Events channel, that's once
+// the consumer has received it. It fails if the stream isn't running.
+func (f *FakeStream) Emit(batch []fsevents.Event) error {
+	return f.ES.Inject(batch)
+}
+
+// EmitFlag delivers an event on no path with flags, such as HistoryDone
+// or MustScanSubDirs, and the ID after the last one delivered.
+func (f *FakeStream) EmitFlag(flags fsevents.EventFlags) error {
+	return f.Emit([]fsevents.Event{{Flags: flags, ID: f.LastEventID() + 1}})
+}
+
+// SetError sends err on the stream's Errors channel, as the stream does
+// for failures once running, such as an fsevents.UnmountedError. It
+// blocks while the channel is full.
+func (f *FakeStream) SetError(err error) {
+	f.ES.Errors <- err
+}
+
+// FailStart makes Start and Restart return err from now on without
+// starting the stream. A nil err lets them succeed again.
+func (f *FakeStream) FailStart(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.startErr = err
+}
+
+// Calls returns the calls made to the stream so far.
+func (f *FakeStream) Calls() Calls {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// AssertStopped fails t unless Stop was called, and the stream isn't
+// running.
+func (f *FakeStream) AssertStopped(t testing.TB) {
+	t.Helper()
+	if c := f.Calls(); c.Stop == 0 {
+		t.Error("fseventstest: Stop wasn't called")
+	}
+	if f.Stats().Running {
+		t.Error("fseventstest: stream still running")
+	}
+}
+
+// AssertFlushed fails t unless Flush was called with sync, or, when sync
+// is false, at all.
+func (f *FakeStream) AssertFlushed(t testing.TB, sync bool) {
+	t.Helper()
+	c := f.Calls()
+	switch {
+	case sync && c.FlushSync == 0:
+		t.Error("fseventstest: Flush(true) wasn't called")
+	case !sync && c.Flush+c.FlushSync == 0:
+		t.Error("fseventstest: Flush wasn't called")
+	}
+}
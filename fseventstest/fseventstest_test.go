@@ -0,0 +1,121 @@
+package fseventstest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+)
+
+func TestFakeStream(t *testing.T) {
+	f := New(fsevents.WithBufferSize(10), fsevents.WithFilter(func(e *fsevents.Event) bool {
+		return e.Path != "/skip"
+	}))
+	if err := f.Emit([]fsevents.Event{{Path: "/a"}}); err == nil {
+		t.Error("Emit before Start succeeded")
+	}
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := []fsevents.Event{
+		{Path: "/a", Flags: fsevents.ItemCreated | fsevents.ItemIsFile, ID: 10},
+		{Path: "/skip", Flags: fsevents.ItemCreated | fsevents.ItemIsFile, ID: 11},
+	}
+	if err := f.Emit(batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch[1].Path != "/skip" {
+		t.Error("Emit changed the caller's batch")
+	}
+	if err := f.EmitFlag(fsevents.HistoryDone); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]fsevents.Event{
+		{{Path: "/a", Flags: fsevents.ItemCreated | fsevents.ItemIsFile, ID: 10}},
+		{{Flags: fsevents.HistoryDone, ID: 12}},
+	}
+	for i, w := range want {
+		have := <-f.EventsChan()
+		if len(have) != len(w) || have[0] != w[0] {
+			t.Errorf("batch %d = %v, want %v", i, have, w)
+		}
+		f.Recycle(have)
+	}
+	if id := f.LastEventID(); id != 12 {
+		t.Errorf("LastEventID() = %d, want 12", id)
+	}
+	if st := f.Stats(); st.ReceivedEvents != 3 || st.FilteredEvents != 1 {
+		t.Errorf("Stats: received %d, filtered %d; want 3, 1", st.ReceivedEvents, st.FilteredEvents)
+	}
+
+	errBoom := errors.New("boom")
+	f.SetError(errBoom)
+	if err := <-f.ErrorsChan(); err != errBoom {
+		t.Errorf("got error %v, want %v", err, errBoom)
+	}
+
+	f.Flush(false)
+	f.Flush(true)
+	f.AssertFlushed(t, true)
+	f.Stop()
+	f.AssertStopped(t)
+	if c := f.Calls(); c != (Calls{Start: 1, Stop: 1, Flush: 1, FlushSync: 1}) {
+		t.Errorf("Calls() = %+v", c)
+	}
+}
+
+func TestFakeStreamFailStart(t *testing.T) {
+	f := New()
+	errBoom := errors.New("boom")
+	f.FailStart(errBoom)
+	if err := f.Start(); err != errBoom {
+		t.Errorf("Start() = %v, want %v", err, errBoom)
+	}
+	if err := f.Restart(); err != errBoom {
+		t.Errorf("Restart() = %v, want %v", err, errBoom)
+	}
+	if f.Stats().Running {
+		t.Error("stream running after a failed Start")
+	}
+	f.FailStart(nil)
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	if !f.Stats().Running {
+		t.Error("stream not running")
+	}
+}
+
+// The pipeline applies to the scripted events as to FSEvents' own.
+func TestFakeStreamPipeline(t *testing.T) {
+	f := New(
+		fsevents.WithBufferSize(10),
+		fsevents.WithExclusionPaths("/build"),
+		fsevents.WithKind(fsevents.DirsOnly),
+	)
+	f.ES.MaxBatchDelay = time.Hour
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	for i, path := range []string{"/src/a.go", "/build/a.o", "/src/b.go"} {
+		if err := f.Emit([]fsevents.Event{{Path: path, Flags: fsevents.ItemModified | fsevents.ItemIsFile, ID: uint64(i + 1)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Flush(true)
+	// One batch, merged by MaxBatchDelay, without the excluded path.
+	have := <-f.EventsChan()
+	want := []fsevents.Event{
+		{Path: "/src", Flags: fsevents.ItemModified | fsevents.ItemIsDir, ID: 1},
+		{Path: "/src", Flags: fsevents.ItemModified | fsevents.ItemIsDir, ID: 3},
+	}
+	if len(have) != len(want) || have[0] != want[0] || have[1] != want[1] {
+		t.Errorf("got %v, want %v", have, want)
+	}
+}
@@ -0,0 +1,89 @@
+package fseventstest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+)
+
+// WaitFor receives batches from s until one holds an event that match
+// accepts, and returns that event; the rest of its batch is dropped. A
+// nil match accepts any event. It fails t with the events seen so far if
+// timeout passes first or the Events channel is closed. It works with any
+// Stream, a real EventStream as well as a FakeStream, and recycles the
+// batches it receives. It waits on the calling goroutine, which like any
+// that fails t must be the test's own, and leaves nothing running.
+func WaitFor(t testing.TB, s fsevents.Stream, match func(fsevents.Event) bool, timeout time.Duration) fsevents.Event {
+	t.Helper()
+	w := waiter{match: match, timer: time.NewTimer(timeout)}
+	defer w.timer.Stop()
+	events := s.EventsChan()
+	for {
+		select {
+		case batch, ok := <-events:
+			if !ok {
+				w.fail(t, "Events closed")
+			}
+			e, found := w.scan(batch)
+			s.Recycle(batch)
+			if found {
+				return e
+			}
+		case <-w.timer.C:
+			w.fail(t, fmt.Sprintf("timed out after %v", timeout))
+		}
+	}
+}
+
+// WaitForEvent is WaitFor for a channel of single events, as a consumer
+// that flattens batches forwards them.
+func WaitForEvent(t testing.TB, events <-chan fsevents.Event, match func(fsevents.Event) bool, timeout time.Duration) fsevents.Event {
+	t.Helper()
+	w := waiter{match: match, timer: time.NewTimer(timeout)}
+	defer w.timer.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				w.fail(t, "channel closed")
+			}
+			if e, found := w.scan([]fsevents.Event{e}); found {
+				return e
+			}
+		case <-w.timer.C:
+			w.fail(t, fmt.Sprintf("timed out after %v", timeout))
+		}
+	}
+}
+
+// waiter is the state shared by WaitFor and WaitForEvent.
+type waiter struct {
+	match func(fsevents.Event) bool
+	timer *time.Timer
+	seen  []fsevents.Event
+}
+
+func (w *waiter) scan(batch []fsevents.Event) (fsevents.Event, bool) {
+	for _, e := range batch {
+		if w.match == nil || w.match(e) {
+			return e, true
+		}
+		w.seen = append(w.seen, e)
+	}
+	return fsevents.Event{}, false
+}
+
+func (w *waiter) fail(t testing.TB, why string) {
+	t.Helper()
+	if len(w.seen) == 0 {
+		t.Fatalf("fseventstest: %s waiting for an event; none seen", why)
+	}
+	var b strings.Builder
+	for _, e := range w.seen {
+		fmt.Fprintf(&b, "\n\t%s flags %#x ID %d", e.Path, uint32(e.Flags), e.ID)
+	}
+	t.Fatalf("fseventstest: %s waiting for an event; saw %d others:%s", why, len(w.seen), b.String())
+}
@@ -0,0 +1,91 @@
+package fseventstest
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+)
+
+func TestWaitFor(t *testing.T) {
+	f := New(fsevents.WithBufferSize(10))
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	f.Emit([]fsevents.Event{{Path: "/a", ID: 1}})
+	f.Emit([]fsevents.Event{{Path: "/b", ID: 2}, {Path: "/c", ID: 3}})
+	e := WaitFor(t, f, func(e fsevents.Event) bool { return e.Path == "/b" }, time.Second)
+	if e.ID != 2 {
+		t.Errorf("WaitFor returned %+v, want /b", e)
+	}
+
+	f.Emit([]fsevents.Event{{Path: "/d", ID: 4}})
+	if e := WaitFor(t, f, nil, time.Second); e.Path != "/d" {
+		t.Errorf("WaitFor(nil) returned %+v, want /d, the rest of /b's batch dropped", e)
+	}
+}
+
+func TestWaitForEvent(t *testing.T) {
+	events := make(chan fsevents.Event, 3)
+	events <- fsevents.Event{Path: "/a"}
+	events <- fsevents.Event{Path: "/b"}
+	if e := WaitForEvent(t, events, func(e fsevents.Event) bool { return e.Path == "/b" }, time.Second); e.Path != "/b" {
+		t.Errorf("WaitForEvent returned %+v, want /b", e)
+	}
+}
+
+// fatalRecorder records what's passed to Fatalf, and ends the goroutine
+// as testing.T does.
+type fatalRecorder struct {
+	testing.TB
+	msg string
+}
+
+func (r *fatalRecorder) Helper() {}
+
+func (r *fatalRecorder) Fatalf(format string, args ...interface{}) {
+	r.msg = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+func failure(fn func(t testing.TB)) string {
+	r := &fatalRecorder{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(r)
+	}()
+	<-done
+	return r.msg
+}
+
+func TestWaitForFailure(t *testing.T) {
+	f := New(fsevents.WithBufferSize(10))
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Emit([]fsevents.Event{{Path: "/seen", ID: 7}})
+
+	before := runtime.NumGoroutine()
+	msg := failure(func(t testing.TB) {
+		WaitFor(t, f, func(e fsevents.Event) bool { return e.Path == "/never" }, 10*time.Millisecond)
+	})
+	if !strings.Contains(msg, "timed out") || !strings.Contains(msg, "/seen") {
+		t.Errorf("timeout reported as %q, want the events seen", msg)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after WaitFor, %d before", n, before)
+	}
+
+	events := make(chan fsevents.Event)
+	close(events)
+	if msg := failure(func(t testing.TB) { WaitForEvent(t, events, nil, time.Second) }); !strings.Contains(msg, "closed") {
+		t.Errorf("closed channel reported as %q", msg)
+	}
+	f.Stop()
+}
@@ -0,0 +1,386 @@
+// Package fsnotifyadapter provides a Watcher shaped like fsnotify.Watcher on
+// top of an fsevents.EventStream, so code written against fsnotify can use
+// FSEvents without being rewritten.
+//
+// The types mirror fsnotify's rather than importing them: Op has the same
+// bit values and String output, and Watcher has the same channels and
+// methods, plus AddRecursive. Switching a consumer over is usually just a
+// change of import path.
+//
+// FSEvents watches whole trees, while fsnotify watches a directory and its
+// immediate children. Add keeps the fsnotify behaviour by discarding events
+// for deeper paths; AddRecursive reports everything below the path.
+package fsnotifyadapter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsevents"
+)
+
+// Op describes a set of file operations, with the same values as
+// fsnotify.Op.
+type Op uint32
+
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+)
+
+// Has reports whether o includes h.
+func (o Op) Has(h Op) bool { return o&h != 0 }
+
+func (o Op) String() string {
+	var b strings.Builder
+	for _, op := range []struct {
+		op   Op
+		name string
+	}{{Create, "CREATE"}, {Remove, "REMOVE"}, {Write, "WRITE"}, {Rename, "RENAME"}, {Chmod, "CHMOD"}} {
+		if o.Has(op.op) {
+			b.WriteString("|" + op.name)
+		}
+	}
+	if b.Len() == 0 {
+		return "[no events]"
+	}
+	return b.String()[1:]
+}
+
+// Event is a file system notification, as in fsnotify.Event.
+type Event struct {
+	// Name is the path of the file or directory, starting with the
+	// path that was passed to Add or AddRecursive.
+	Name string
+
+	// Op holds the operations that happened. FSEvents may coalesce
+	// several operations on a path into one event, so more than one
+	// bit can be set.
+	Op Op
+}
+
+// Has reports whether e.Op includes op.
+func (e Event) Has(op Op) bool { return e.Op.Has(op) }
+
+func (e Event) String() string { return fmt.Sprintf("%-13s %q", e.Op.String(), e.Name) }
+
+var (
+	// ErrEventOverflow is sent on Errors when FSEvents dropped events or
+	// asks for a directory to be rescanned.
+	ErrEventOverflow = errors.New("fsnotifyadapter: queue or buffer overflow")
+
+	// ErrNonExistentWatch is returned by Remove for a path that isn't
+	// watched.
+	ErrNonExistentWatch = errors.New("fsnotifyadapter: can't remove non-existent watch")
+
+	// ErrClosed is returned when the Watcher is used after Close.
+	ErrClosed = errors.New("fsnotifyadapter: watcher already closed")
+)
+
+// changeOps maps FSEvents item flags to the operations they report.
+var changeOps = []struct {
+	flag fsevents.EventFlags
+	op   Op
+}{
+	{fsevents.ItemCreated, Create},
+	{fsevents.ItemModified, Write},
+	{fsevents.ItemRemoved, Remove},
+	{fsevents.RootChanged, Remove},
+	{fsevents.ItemRenamed, Rename},
+	{fsevents.ItemInodeMetaMod, Chmod},
+	{fsevents.ItemChangeOwner, Chmod},
+	{fsevents.ItemXattrMod, Chmod},
+	{fsevents.ItemFinderInfoMod, Chmod},
+}
+
+// overflowFlags mark events after which the consumer has to rescan.
+const overflowFlags = fsevents.MustScanSubDirs | fsevents.KernelDropped | fsevents.UserDropped
+
+// toOp translates the flags of an event. FSEvents flags a rename on both
+// the old and the new path; fsnotify reports the new one as a Create, so
+// exists tells the two apart.
+func toOp(flags fsevents.EventFlags, exists bool) Op {
+	var op Op
+	for _, c := range changeOps {
+		if flags&c.flag != 0 {
+			op |= c.op
+		}
+	}
+	if op.Has(Rename) && exists {
+		op = op&^Rename | Create
+	}
+	return op
+}
+
+// watch is one path passed to Add or AddRecursive.
+type watch struct {
+	name      string // as given by the caller, cleaned
+	real      string // with symlinks resolved, as FSEvents reports it
+	recursive bool
+	since     uint64 // events up to this ID predate the watch
+}
+
+// match returns the name to report for an event on path p, if the watch
+// covers it.
+func (wt watch) match(p string, id uint64) (string, bool) {
+	if id != 0 && id <= wt.since {
+		return "", false
+	}
+	if p == wt.real {
+		return wt.name, true
+	}
+	if !strings.HasPrefix(p, wt.real) || p[len(wt.real)] != '/' && !strings.HasSuffix(wt.real, "/") {
+		return "", false
+	}
+	rest := strings.TrimPrefix(p[len(wt.real):], "/")
+	if !wt.recursive && strings.Contains(rest, "/") {
+		return "", false
+	}
+	return filepath.Join(wt.name, rest), true
+}
+
+// Watcher watches a set of paths, like fsnotify.Watcher. All paths share
+// one EventStream, which is recreated whenever the set changes. Events
+// that occur while that happens are replayed from the FSEvents history,
+// so none are lost.
+type Watcher struct {
+	// Events sends the file system events.
+	Events chan Event
+
+	// Errors sends ErrEventOverflow when events were lost.
+	Errors chan error
+
+	mu      sync.Mutex // serializes Add, Remove and Close
+	es      *fsevents.EventStream
+	watches atomic.Value // []watch; replaced, never modified
+	running bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewWatcher returns a Watcher with no paths.
+func NewWatcher() (*Watcher, error) {
+	w := &Watcher{
+		Events: make(chan Event),
+		Errors: make(chan error),
+		done:   make(chan struct{}),
+		es: &fsevents.EventStream{
+			Flags: fsevents.FileEvents | fsevents.NoDefer,
+			// The callback must never block: stopping the stream
+			// from Add or Remove while it waits on a consumer that
+			// is itself in Add or Remove would deadlock.
+			Events:   make(chan []fsevents.Event, 64),
+			Overflow: fsevents.DropNewest,
+		},
+	}
+	w.watches.Store([]watch(nil))
+	w.wg.Add(1)
+	go w.forward()
+	return w, nil
+}
+
+// Add starts watching name and, if it's a directory, its immediate
+// children.
+func (w *Watcher) Add(name string) error { return w.add(name, false) }
+
+// AddRecursive starts watching name and everything below it.
+func (w *Watcher) AddRecursive(name string) error { return w.add(name, true) }
+
+func (w *Watcher) add(name string, recursive bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed() {
+		return ErrClosed
+	}
+
+	name = filepath.Clean(name)
+	if _, err := os.Lstat(name); err != nil {
+		return err
+	}
+	real, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if r, err := filepath.EvalSymlinks(real); err == nil {
+		real = r
+	}
+
+	old := w.watches.Load().([]watch)
+	watches := make([]watch, 0, len(old)+1)
+	for _, wt := range old {
+		if wt.name != name {
+			watches = append(watches, wt)
+		}
+	}
+	watches = append(watches, watch{name: name, real: real, recursive: recursive, since: fsevents.CurrentEventID()})
+	if err := w.restart(watches); err != nil {
+		w.restart(old)
+		return err
+	}
+	return nil
+}
+
+// Remove stops watching name.
+func (w *Watcher) Remove(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed() {
+		return ErrClosed
+	}
+
+	name = filepath.Clean(name)
+	old := w.watches.Load().([]watch)
+	watches := make([]watch, 0, len(old))
+	for _, wt := range old {
+		if wt.name != name {
+			watches = append(watches, wt)
+		}
+	}
+	if len(watches) == len(old) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	return w.restart(watches)
+}
+
+// WatchList returns the watched paths, sorted.
+func (w *Watcher) WatchList() []string {
+	watches := w.watches.Load().([]watch)
+	names := make([]string, 0, len(watches))
+	for _, wt := range watches {
+		names = append(names, wt.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close stops watching and closes Events and Errors.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed() {
+		return nil
+	}
+
+	close(w.done)
+	if w.running {
+		w.es.Stop()
+		w.running = false
+	}
+	w.wg.Wait()
+	close(w.Events)
+	close(w.Errors)
+	return nil
+}
+
+func (w *Watcher) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// restart recreates the stream for watches. w.mu must be held.
+func (w *Watcher) restart(watches []watch) error {
+	es := w.es
+	if w.running {
+		es.Stop()
+		w.running = false
+		// Pick up where the old stream left off.
+		if atomic.LoadUint64(&es.EventID) == 0 {
+			es.EventID = fsevents.CurrentEventID()
+		}
+		es.Resume = true
+	}
+	w.watches.Store(watches)
+	if len(watches) == 0 {
+		return nil
+	}
+
+	es.Paths = es.Paths[:0]
+	for _, wt := range watches {
+		es.Paths = append(es.Paths, wt.real)
+	}
+	if err := es.Start(); err != nil {
+		return err
+	}
+	w.running = true
+	return nil
+}
+
+// forward translates batches from the stream until the Watcher is closed.
+func (w *Watcher) forward() {
+	defer w.wg.Done()
+
+	var dropped uint64
+	for {
+		select {
+		case batch := <-w.es.Events:
+			ok := w.forwardBatch(batch)
+			w.es.Recycle(batch)
+			if !ok {
+				return
+			}
+			if d := w.es.Stats().DroppedEvents; d != dropped {
+				dropped = d
+				if !w.sendError(ErrEventOverflow) {
+					return
+				}
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *Watcher) forwardBatch(batch []fsevents.Event) bool {
+	watches := w.watches.Load().([]watch)
+	for _, e := range batch {
+		if e.Flags&overflowFlags != 0 {
+			if !w.sendError(ErrEventOverflow) {
+				return false
+			}
+		}
+
+		var exists bool
+		if e.Flags&fsevents.ItemRenamed != 0 {
+			_, err := os.Lstat(e.Path)
+			exists = err == nil
+		}
+		op := toOp(e.Flags, exists)
+		if op == 0 {
+			continue
+		}
+		for _, wt := range watches {
+			name, ok := wt.match(e.Path, e.ID)
+			if !ok {
+				continue
+			}
+			select {
+			case w.Events <- Event{Name: name, Op: op}:
+			case <-w.done:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (w *Watcher) sendError(err error) bool {
+	select {
+	case w.Errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
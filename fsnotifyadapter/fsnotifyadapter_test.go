@@ -0,0 +1,138 @@
+package fsnotifyadapter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fsnotify/fsevents"
+)
+
+// allFlags lists every EventFlags bit with the operation it maps to on its
+// own, for a path that no longer exists.
+var allFlags = []struct {
+	flag fsevents.EventFlags
+	op   Op
+}{
+	{fsevents.MustScanSubDirs, 0},
+	{fsevents.KernelDropped, 0},
+	{fsevents.UserDropped, 0},
+	{fsevents.EventIDsWrapped, 0},
+	{fsevents.HistoryDone, 0},
+	{fsevents.RootChanged, Remove},
+	{fsevents.Mount, 0},
+	{fsevents.Unmount, 0},
+	{fsevents.ItemCreated, Create},
+	{fsevents.ItemRemoved, Remove},
+	{fsevents.ItemInodeMetaMod, Chmod},
+	{fsevents.ItemRenamed, Rename},
+	{fsevents.ItemModified, Write},
+	{fsevents.ItemFinderInfoMod, Chmod},
+	{fsevents.ItemChangeOwner, Chmod},
+	{fsevents.ItemXattrMod, Chmod},
+	{fsevents.ItemIsFile, 0},
+	{fsevents.ItemIsDir, 0},
+	{fsevents.ItemIsSymlink, 0},
+}
+
+func TestToOpSingleFlags(t *testing.T) {
+	for _, tc := range allFlags {
+		if have := toOp(tc.flag, false); have != tc.op {
+			t.Errorf("toOp(%#x) = %s, want %s", uint32(tc.flag), have, tc.op)
+		}
+	}
+}
+
+// TestToOpCombinations checks every combination of flags: the result is
+// the union of the individual mappings, with Rename turned into Create
+// when the path exists.
+func TestToOpCombinations(t *testing.T) {
+	for mask := 0; mask < 1<<len(allFlags); mask++ {
+		var flags fsevents.EventFlags
+		var want Op
+		for i, tc := range allFlags {
+			if mask&(1<<i) != 0 {
+				flags |= tc.flag
+				want |= tc.op
+			}
+		}
+
+		if have := toOp(flags, false); have != want {
+			t.Fatalf("toOp(%#x, false) = %s, want %s", uint32(flags), have, want)
+		}
+		if want.Has(Rename) {
+			want = want&^Rename | Create
+		}
+		if have := toOp(flags, true); have != want {
+			t.Fatalf("toOp(%#x, true) = %s, want %s", uint32(flags), have, want)
+		}
+	}
+}
+
+func TestOpString(t *testing.T) {
+	for _, tc := range []struct {
+		op   Op
+		want string
+	}{
+		{0, "[no events]"},
+		{Create, "CREATE"},
+		{Write | Chmod, "WRITE|CHMOD"},
+		{Create | Write | Remove | Rename | Chmod, "CREATE|REMOVE|WRITE|RENAME|CHMOD"},
+	} {
+		if have := tc.op.String(); have != tc.want {
+			t.Errorf("Op(%d).String() = %q, want %q", tc.op, have, tc.want)
+		}
+	}
+	if have, want := (Event{Name: "/a", Op: Create}).String(), `CREATE        "/a"`; have != want {
+		t.Errorf("Event.String() = %q, want %q", have, want)
+	}
+}
+
+func TestWatchMatch(t *testing.T) {
+	flat := watch{name: "dir", real: "/private/tmp/dir", since: 10}
+	deep := flat
+	deep.recursive = true
+
+	for _, tc := range []struct {
+		wt   watch
+		path string
+		id   uint64
+		want string
+		ok   bool
+	}{
+		{flat, "/private/tmp/dir", 11, "dir", true},
+		{flat, "/private/tmp/dir/a", 11, "dir/a", true},
+		{flat, "/private/tmp/dir/a/b", 11, "", false},
+		{flat, "/private/tmp/dirt", 11, "", false},
+		{flat, "/private/tmp/dir/a", 10, "", false},
+		{deep, "/private/tmp/dir/a/b", 11, "dir/a/b", true},
+		{deep, "/private/tmp/other", 11, "", false},
+		{watch{name: "/", real: "/", recursive: true}, "/a/b", 1, "/a/b", true},
+	} {
+		have, ok := tc.wt.match(tc.path, tc.id)
+		if have != tc.want || ok != tc.ok {
+			t.Errorf("%+v.match(%q, %d) = %q, %t; want %q, %t", tc.wt, tc.path, tc.id, have, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestRemoveNonExistent(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.Add(t.TempDir()); err != nil {
+		// Without FSEvents the path must not stay in the list.
+		if l := w.WatchList(); len(l) != 0 {
+			t.Errorf("WatchList after a failed Add = %q", l)
+		}
+	}
+	if err := w.Remove("/nonexistent"); !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("Remove of an unwatched path = %v, want ErrNonExistentWatch", err)
+	}
+	w.Close()
+	if err := w.Add(t.TempDir()); err != ErrClosed {
+		t.Errorf("Add after Close = %v, want ErrClosed", err)
+	}
+}
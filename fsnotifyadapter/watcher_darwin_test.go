@@ -0,0 +1,49 @@
+//go:build darwin
+
+package fsnotifyadapter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmp, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"sub/deep", "file"} {
+		if err := os.WriteFile(filepath.Join(tmp, p), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-w.Events:
+			if e.Name == filepath.Join(tmp, "sub", "deep") {
+				t.Fatalf("non-recursive watch reported %s", e)
+			}
+			if e.Name == filepath.Join(tmp, "file") && e.Has(Create) {
+				return
+			}
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("no Create event for file")
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package fsevents
+
+// checkGap reports whether events skip IDs past the highest seen before,
+// calling OnGap if so. IDs within a batch, and across batches when several
+// paths are watched, needn't be ascending, so only the lowest and highest
+// are compared.
+func (es *EventStream) checkGap(events []Event) bool {
+	var lo, hi uint64
+	reset := false
+	for _, e := range events {
+		if e.Flags&(HistoryDone|EventIDsWrapped) != 0 {
+			reset = true
+			continue
+		}
+		if e.ID == 0 {
+			continue
+		}
+		if lo == 0 || e.ID < lo {
+			lo = e.ID
+		}
+		if e.ID > hi {
+			hi = e.ID
+		}
+	}
+	if lo == 0 && !reset {
+		return false
+	}
+	gap := false
+	if last := es.gapLast; last != 0 && lo > last+1 {
+		gap = true
+		if es.conf().OnGap != nil {
+			es.conf().OnGap(last+1, lo-1)
+		}
+	}
+	if hi > es.gapLast {
+		es.gapLast = hi
+	}
+	if reset {
+		es.gapLast = 0
+	}
+	return gap
+}
@@ -0,0 +1,59 @@
+package fsevents
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOnGap(t *testing.T) {
+	var gaps [][2]uint64
+	es := &EventStream{OnGap: func(from, to uint64) { gaps = append(gaps, [2]uint64{from, to}) }, Handler: func([]Event) {}}
+
+	for _, tc := range []struct {
+		name  string
+		batch []Event
+		want  [][2]uint64
+	}{
+		{"first batch", []Event{{ID: 10}, {ID: 11}}, nil},
+		{"contiguous", []Event{{ID: 12}}, nil},
+		{"gap", []Event{{ID: 15}, {ID: 16}}, [][2]uint64{{13, 14}}},
+		{"out of order within a batch", []Event{{ID: 18}, {ID: 17}}, nil},
+		{"interleaved with the previous batch", []Event{{ID: 16}, {ID: 19}}, nil},
+		{"no IDs", []Event{{Flags: KernelDropped | MustScanSubDirs}}, nil},
+		{"gap after no IDs", []Event{{ID: 21}}, [][2]uint64{{20, 20}}},
+		{"IDs wrapped", []Event{{ID: 22}, {Flags: EventIDsWrapped}}, nil},
+		{"after the wrap", []Event{{ID: 3}}, nil},
+		{"history done", []Event{{ID: 4}, {Flags: HistoryDone, ID: 90}}, nil},
+		{"live after history", []Event{{ID: 100}}, nil},
+		{"live gap", []Event{{ID: 102}}, [][2]uint64{{101, 101}}},
+	} {
+		gaps = nil
+		es.deliver(append([]Event(nil), tc.batch...))
+		if !reflect.DeepEqual(gaps, tc.want) {
+			t.Errorf("%s: gaps %v, want %v", tc.name, gaps, tc.want)
+		}
+	}
+}
+
+func TestOnGapResume(t *testing.T) {
+	var gaps int
+	es := &EventStream{OnGap: func(from, to uint64) { gaps++ }, Handler: func([]Event) {}}
+	startPollStream(t, es)
+	es.deliver([]Event{{ID: 10}})
+
+	// A resumed stream replays from EventID, with IDs from other paths
+	// left out: its first batch isn't compared with the last stream's.
+	es.Stop()
+	es.Resume = true
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	es.deliver([]Event{{ID: 50}})
+	if gaps != 0 {
+		t.Errorf("%d gaps across Resume", gaps)
+	}
+	es.deliver([]Event{{ID: 52}})
+	if gaps != 1 {
+		t.Errorf("%d gaps after 50 and 52, want 1", gaps)
+	}
+}
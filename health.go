@@ -0,0 +1,260 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthProbe is how a HealthCheck tells that the stream is alive.
+type HealthProbe int
+
+const (
+	// ProbeEvent waits for the event on the probe file. It's the default.
+	ProbeEvent HealthProbe = iota
+
+	// ProbeEventID waits for any event with a higher ID than the stream
+	// had seen before the probe file was written, so the probe file's
+	// own event may be coalesced or reported under another path. It
+	// doesn't work where events carry no ID, as with PollNetwork and
+	// FallbackToPolling.
+	ProbeEventID
+)
+
+func (p HealthProbe) String() string {
+	switch p {
+	case ProbeEvent:
+		return "ProbeEvent"
+	case ProbeEventID:
+		return "ProbeEventID"
+	}
+	return fmt.Sprintf("HealthProbe(%d)", int(p))
+}
+
+// UnhealthyError is sent on Errors when a HealthCheck probe gets no sign
+// of life from the stream within its deadline.
+type UnhealthyError struct {
+	Path     string // the probe file
+	Deadline time.Duration
+}
+
+func (e *UnhealthyError) Error() string {
+	return fmt.Sprintf("fsevents: no event for probe %s within %v", e.Path, e.Deadline)
+}
+
+// HealthOption configures a HealthCheck.
+type HealthOption func(*healthCheck)
+
+// HealthProbePath sets the probe file, which must be in a writable
+// directory the stream watches. The default is ".fsevents-probe" in the
+// first of the stream's Paths.
+func HealthProbePath(path string) HealthOption {
+	return func(h *healthCheck) { h.path = path }
+}
+
+// HealthProbeMethod sets how a probe tells the stream is alive. The
+// default is ProbeEvent.
+func HealthProbeMethod(p HealthProbe) HealthOption {
+	return func(h *healthCheck) { h.probe = p }
+}
+
+// HealthDeadline sets how long a probe waits for a sign of life. The
+// default is ten seconds.
+func HealthDeadline(d time.Duration) HealthOption {
+	return func(h *healthCheck) { h.deadline = d }
+}
+
+// HealthRestart has a stream with AutoRestart restart its backend when a
+// probe fails, as if it had died. The UnhealthyError is then reported
+// wrapped in a RestartError.
+func HealthRestart() HealthOption {
+	return func(h *healthCheck) { h.restart = true }
+}
+
+// healthCheck is a running HealthCheck. deliver shows it every batch
+// first, through EventStream.health.
+type healthCheck struct {
+	// First, for 64-bit alignment.
+	hits   uint64        // events on match seen; atomic
+	lastID uint64        // highest event ID seen; atomic
+	seen   chan struct{} // signalled when either goes up
+
+	path     string
+	match    string // path as events report it
+	probe    HealthProbe
+	deadline time.Duration
+	restart  bool
+
+	quit chan struct{}
+	once sync.Once
+}
+
+// HealthCheck probes es every interval for streams that stop delivering
+// without an error, as can happen to those on external volumes across
+// sleep and wake. Each probe writes the probe file, flushes the stream
+// and waits for the event, reporting an UnhealthyError on Errors if none
+// comes within the deadline, or, with FallbackToPolling, polling the
+// watched path the probe file is in from then on, with a FallbackError.
+// Events on the probe file are left out of the stream's and count as
+// filtered. Probes are skipped while the stream isn't running or
+// AutoRestart is restarting it. The probe file is left in place. It
+// replaces any earlier HealthCheck, and runs until stop is called. It
+// doesn't apply to device-relative streams.
+func (es *EventStream) HealthCheck(interval time.Duration, opts ...HealthOption) (stop func(), err error) {
+	h := &healthCheck{
+		deadline: 10 * time.Second,
+		seen:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.path == "" {
+		if len(es.conf().Paths) == 0 {
+			return nil, errors.New("fsevents: HealthCheck needs a probe path")
+		}
+		h.path = filepath.Join(es.conf().Paths[0], ".fsevents-probe")
+	}
+	if h.path, err = filepath.Abs(h.path); err != nil {
+		return nil, err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(h.path))
+	if err != nil {
+		return nil, err
+	}
+	h.match = filepath.Join(dir, filepath.Base(h.path))
+	atomic.StoreUint64(&h.lastID, atomic.LoadUint64(&es.EventID))
+
+	if old, _ := es.health.Load().(*healthCheck); old != nil {
+		old.stop(es)
+	}
+	es.health.Store(h)
+	go h.run(es, interval)
+	return func() { h.stop(es) }, nil
+}
+
+func (h *healthCheck) stop(es *EventStream) {
+	h.once.Do(func() {
+		close(h.quit)
+		es.health.CompareAndSwap(h, (*healthCheck)(nil))
+	})
+}
+
+// see records the signs of life in a batch, returning it without the
+// events on the probe file.
+func (h *healthCheck) see(es *EventStream, events []Event) []Event {
+	var max uint64
+	kept := events[:0]
+	for _, e := range events {
+		if e.ID > max {
+			max = e.ID
+		}
+		if e.Path == h.match {
+			atomic.AddUint64(&h.hits, 1)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if n := len(events) - len(kept); n > 0 {
+		atomic.AddUint64(&es.stats.FilteredEvents, uint64(n))
+	}
+	for {
+		cur := atomic.LoadUint64(&h.lastID)
+		if max <= cur || atomic.CompareAndSwapUint64(&h.lastID, cur, max) {
+			break
+		}
+	}
+	select {
+	case h.seen <- struct{}{}:
+	default:
+	}
+	return kept
+}
+
+func (h *healthCheck) run(es *EventStream, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.quit:
+			return
+		case <-ticker.C:
+		}
+		if atomic.LoadInt32(&es.running) == 0 || RestartState(atomic.LoadInt32(&es.restartState)) != RestartIdle {
+			continue
+		}
+		if !h.check(es) {
+			h.unhealthy(es)
+		}
+	}
+}
+
+// check writes the probe file and reports whether the stream showed a
+// sign of life in time. A probe that can't be written is reported and
+// counts as a success, as it says nothing of the stream.
+func (h *healthCheck) check(es *EventStream) bool {
+	select {
+	case <-h.seen:
+	default:
+	}
+	hits, lastID := atomic.LoadUint64(&h.hits), atomic.LoadUint64(&h.lastID)
+	if err := os.WriteFile(h.path, []byte(time.Now().Format(time.RFC3339Nano)), 0o644); err != nil {
+		es.report(err)
+		return true
+	}
+	es.lifecycle.Lock()
+	if atomic.LoadInt32(&es.running) != 0 {
+		es.flushLocked(false)
+	}
+	es.lifecycle.Unlock()
+
+	timer := time.NewTimer(h.deadline)
+	defer timer.Stop()
+	for {
+		select {
+		case <-h.quit:
+			return true
+		case <-timer.C:
+			return false
+		case <-h.seen:
+		}
+		switch h.probe {
+		case ProbeEventID:
+			if atomic.LoadUint64(&h.lastID) > lastID {
+				return true
+			}
+		default:
+			if atomic.LoadUint64(&h.hits) > hits {
+				return true
+			}
+		}
+	}
+}
+
+// unhealthy reports a failed probe, or has FallbackToPolling poll its
+// path, and with HealthRestart has AutoRestart restart the backend.
+func (h *healthCheck) unhealthy(es *EventStream) {
+	err := &UnhealthyError{Path: h.path, Deadline: h.deadline}
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if atomic.LoadInt32(&es.running) != 0 && !es.restarting() && es.fallBack(h, err) {
+		return
+	}
+	if !h.restart || es.conf().AutoRestart == nil || atomic.LoadInt32(&es.running) == 0 || es.restarting() {
+		es.report(err)
+		return
+	}
+	// No callback of the old stream may overlap the new one's.
+	es.stopWait = true
+	es.stop()
+	es.stopWait = false
+	if es.source != nil {
+		es.source.stop()
+		es.source = nil
+	}
+	es.restartLater(err)
+}
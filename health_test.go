@@ -0,0 +1,115 @@
+package fsevents
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newHealthStream(t *testing.T, restart *RestartPolicy) *EventStream {
+	t.Helper()
+	es := &EventStream{
+		Paths:        []string{t.TempDir()},
+		Events:       make(chan []Event, 100),
+		Errors:       make(chan error, 10),
+		Backend:      Poll,
+		PollInterval: 5 * time.Millisecond,
+		AutoRestart:  restart,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(es.Stop)
+	return es
+}
+
+func TestHealthCheck(t *testing.T) {
+	for _, probe := range []HealthProbe{ProbeEvent, ProbeEventID} {
+		t.Run(probe.String(), func(t *testing.T) {
+			es := newHealthStream(t, nil)
+			stop, err := es.HealthCheck(10*time.Millisecond, HealthProbeMethod(probe), HealthDeadline(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stop()
+
+			probePath := filepath.Join(es.Paths[0], ".fsevents-probe")
+			timeout := time.After(200 * time.Millisecond)
+			for done := false; !done; {
+				select {
+				case err := <-es.ErrorsChan():
+					t.Fatalf("healthy stream reported %v", err)
+				case batch := <-es.EventsChan():
+					for _, e := range batch {
+						if e.Path == probePath {
+							t.Errorf("probe event %v was delivered", e)
+						}
+					}
+				case <-timeout:
+					done = true
+				}
+			}
+			if es.Stats().FilteredEvents == 0 {
+				t.Error("no probe event was seen")
+			}
+		})
+	}
+}
+
+func TestHealthCheckDead(t *testing.T) {
+	es := newHealthStream(t, nil)
+	stop, err := es.HealthCheck(10*time.Millisecond, HealthDeadline(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	// Detached, it sees nothing the stream delivers.
+	es.health.Store((*healthCheck)(nil))
+	select {
+	case err := <-es.ErrorsChan():
+		var uerr *UnhealthyError
+		if !errors.As(err, &uerr) || uerr.Deadline != 50*time.Millisecond {
+			t.Fatalf("got error %v, want an UnhealthyError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no UnhealthyError for a dead stream")
+	}
+	if !es.Stats().Running {
+		t.Error("stream stopped without HealthRestart")
+	}
+}
+
+func TestHealthCheckRestart(t *testing.T) {
+	es := newHealthStream(t, &RestartPolicy{MinDelay: time.Millisecond})
+	stop, err := es.HealthCheck(10*time.Millisecond, HealthDeadline(50*time.Millisecond), HealthRestart())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	h := es.health.Load().(*healthCheck)
+	es.health.Store((*healthCheck)(nil))
+	select {
+	case err := <-es.ErrorsChan():
+		var uerr *UnhealthyError
+		var rerr *RestartError
+		if !errors.As(err, &rerr) || !errors.As(err, &uerr) {
+			t.Fatalf("got error %v, want a RestartError for an UnhealthyError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error for a dead stream")
+	}
+	es.health.Store(h)
+	waitFor(t, es, es.Paths[0], MustScanSubDirs)
+	if st := es.Stats(); st.Restarts != 1 {
+		t.Errorf("Restarts = %d, want 1", st.Restarts)
+	}
+}
+
+func TestHealthCheckNoPath(t *testing.T) {
+	if _, err := (&EventStream{}).HealthCheck(time.Second); err == nil {
+		t.Error("HealthCheck without paths succeeded")
+	}
+}
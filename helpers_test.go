@@ -1,3 +1,5 @@
+//go:build darwin
+
 package fsevents
 
 import (
@@ -105,7 +107,7 @@ func (w *eventCollector) addWatch(t *testing.T, path ...string) {
 	}
 
 	go func() {
-		for msg := range es.Events {
+		for msg := range es.EventsChan() {
 			w.mu.Lock()
 			w.e = append(w.e, msg...)
 			w.mu.Unlock()
@@ -0,0 +1,75 @@
+package fsevents
+
+import (
+	"errors"
+	"testing"
+)
+
+// withFakeHistory makes every device report the FSEvents history uuid,
+// reaching up to event ID latest.
+func withFakeHistory(t *testing.T, uuid string, latest uint64) {
+	prevUUID, prevLatest := deviceUUID, latestEventID
+	deviceUUID = func(int32) string { return uuid }
+	latestEventID = func(int32) uint64 { return latest }
+	t.Cleanup(func() { deviceUUID, latestEventID = prevUUID, prevLatest })
+}
+
+func TestCheckHistoryIntegrity(t *testing.T) {
+	withFakeHistory(t, "NEW", 100)
+
+	for _, tc := range []struct {
+		uuid   string
+		id     uint64
+		status ResumeStatus
+	}{
+		{"NEW", 100, ResumeOK},
+		{"NEW", 0, ResumeOK},
+		{"OLD", 50, ResumeUUIDMismatch},
+		{"", 50, ResumeUUIDMismatch},
+		{"NEW", 101, ResumeIDInFuture},
+	} {
+		es := &EventStream{Device: 3, UUID: tc.uuid, EventID: tc.id}
+		err := es.CheckHistoryIntegrity()
+		if tc.status == ResumeOK {
+			if err != nil {
+				t.Errorf("UUID %q, EventID %d: %v", tc.uuid, tc.id, err)
+			}
+			continue
+		}
+		var herr *HistoryError
+		if !errors.As(err, &herr) || !errors.Is(err, ErrHistoryUnavailable) {
+			t.Errorf("UUID %q, EventID %d: got %v, want a HistoryError", tc.uuid, tc.id, err)
+			continue
+		}
+		if herr.Status != tc.status || herr.Device != 3 || herr.UUID != tc.uuid || herr.LiveUUID != "NEW" || herr.EventID != tc.id {
+			t.Errorf("UUID %q, EventID %d: got %+v", tc.uuid, tc.id, herr)
+		}
+		if s := ValidateResume(3, tc.uuid, tc.id); s != tc.status {
+			t.Errorf("ValidateResume(3, %q, %d) = %v, want %v", tc.uuid, tc.id, s, tc.status)
+		}
+	}
+}
+
+func TestStartHistoryPurged(t *testing.T) {
+	withFakeHistory(t, "NEW", 100)
+
+	es := &EventStream{Paths: []string{""}, Device: 3, Resume: true, UUID: "OLD", EventID: 50}
+	err := es.Start()
+	var herr *HistoryError
+	if !errors.As(err, &herr) || herr.Status != ResumeUUIDMismatch {
+		t.Fatalf("Start() = %v, want a HistoryError", err)
+	}
+	if n := len(registry.load()); n != 0 {
+		t.Errorf("registry holds %d streams after a failed Start", n)
+	}
+	if es.UUID != "OLD" {
+		t.Errorf("UUID = %q after a failed Start, want it kept", es.UUID)
+	}
+
+	// Backends without a history don't check it.
+	es = &EventStream{Paths: []string{t.TempDir()}, Backend: Poll, Resume: true, UUID: "OLD", EventID: 50}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	es.Stop()
+}
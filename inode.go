@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+
+package fsevents
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode returns the inode number of fi, if the platform has one.
+func inode(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Ino), true
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package fsevents
+
+import "os"
+
+// inode returns the inode number of fi, if the platform has one.
+func inode(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,46 @@
+package fsevents
+
+import (
+	"container/list"
+	"sync"
+)
+
+// interner maps path bytes to a previously allocated string, evicting the
+// least recently used entry beyond max.
+type interner struct {
+	mu  sync.Mutex
+	max int
+	lru *list.List // of string, most recently used first
+	m   map[string]*list.Element
+}
+
+func newInterner(max int) *interner {
+	return &interner{max: max, lru: list.New(), m: make(map[string]*list.Element, max)}
+}
+
+// intern returns a string equal to b, reusing an earlier one if cached.
+func (in *interner) intern(b []byte) string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if e, ok := in.m[string(b)]; ok {
+		in.lru.MoveToFront(e)
+		return e.Value.(string)
+	}
+
+	s := string(b)
+	in.m[s] = in.lru.PushFront(s)
+	if in.lru.Len() > in.max {
+		delete(in.m, in.lru.Remove(in.lru.Back()).(string))
+	}
+	return s
+}
+
+// reset drops every cached string.
+func (in *interner) reset() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.lru.Init()
+	in.m = make(map[string]*list.Element, in.max)
+}
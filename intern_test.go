@@ -0,0 +1,85 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"fmt"
+	"testing"
+	"unsafe"
+)
+
+func stringData(s string) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&s))
+}
+
+func TestInterner(t *testing.T) {
+	in := newInterner(2)
+
+	a := in.intern([]byte("/a"))
+	if stringData(in.intern([]byte("/a"))) != stringData(a) {
+		t.Error("repeated path was not interned")
+	}
+
+	in.intern([]byte("/b"))
+	in.intern([]byte("/c")) // evicts /a
+	if l := in.lru.Len(); l != 2 {
+		t.Errorf("interner holds %d entries, want 2", l)
+	}
+	if _, ok := in.m["/a"]; ok {
+		t.Error("least recently used entry was not evicted")
+	}
+
+	in.reset()
+	if l := in.lru.Len(); l != 0 {
+		t.Errorf("interner holds %d entries after reset, want 0", l)
+	}
+}
+
+func TestInternPathsCallback(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 2), interner: newInterner(10)}
+	info := registry.Add(es)
+	defer registry.Delete(info)
+
+	cb := newCBatchOf([]string{"/x", "/x"}, []EventFlags{ItemModified, ItemModified}, []uint64{1, 2})
+	cb.call(info)
+	cb.call(info)
+	first, second := <-es.EventsChan(), <-es.EventsChan()
+
+	if first[0].Path != "/x" || stringData(first[0].Path) != stringData(first[1].Path) ||
+		stringData(first[0].Path) != stringData(second[0].Path) {
+		t.Error("repeated paths did not share storage")
+	}
+}
+
+// newRepeatingCBatch returns n events cycling over unique distinct paths.
+func newRepeatingCBatch(n, unique int) *cBatch {
+	paths := make([]string, n)
+	flags := make([]EventFlags, n)
+	ids := make([]uint64, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/Users/someone/src/project/pkg-%d/file.go", i%unique)
+		flags[i] = ItemModified | ItemIsFile
+		ids[i] = uint64(i + 1)
+	}
+	return newCBatchOf(paths, flags, ids)
+}
+
+func BenchmarkInternPaths(b *testing.B) {
+	cb := newRepeatingCBatch(10000, 100)
+	for _, intern := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("intern=%d", intern), func(b *testing.B) {
+			es := &EventStream{Events: make(chan []Event, 1)}
+			if intern > 0 {
+				es.interner = newInterner(intern)
+			}
+			info := registry.Add(es)
+			defer registry.Delete(info)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cb.call(info)
+				es.Recycle(<-es.EventsChan())
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Kind selects which items' events an EventStream delivers.
+type Kind int
+
+const (
+	// All delivers every event. It's the zero value.
+	All Kind = iota
+
+	// FilesOnly delivers the events on files and symbolic links, leaving
+	// out those on directories. With the Native backend it needs the
+	// FileEvents flag, without which FSEvents only reports directories.
+	FilesOnly
+
+	// DirsOnly delivers the events on directories. An event on a file or
+	// symbolic link is delivered as ItemModified on its parent directory
+	// instead, merged with the batch's other events on that directory
+	// into one, with the flags of all and the latest ID. FileEvents may
+	// be left out, sparing FSEvents the work of reporting each file.
+	DirsOnly
+)
+
+func (k Kind) String() string {
+	switch k {
+	case All:
+		return "All"
+	case FilesOnly:
+		return "FilesOnly"
+	case DirsOnly:
+		return "DirsOnly"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// errFilesOnly is returned by Start for a Native FilesOnly stream without
+// FileEvents.
+var errFilesOnly = errors.New("fsevents: FilesOnly needs the FileEvents flag")
+
+// itemKinds are the flags that tell what kind of item an event is on.
+// Events without any, such as those about the stream itself or on
+// directories without FileEvents, pass every Kind.
+const itemKinds = ItemIsFile | ItemIsDir | ItemIsSymlink
+
+// checkKind reports whether the stream's Kind can be used with its other
+// settings.
+func (es *EventStream) checkKind() error {
+	if es.conf().Kind == FilesOnly && es.conf().Backend == Native && es.conf().Flags&FileEvents == 0 {
+		return errFilesOnly
+	}
+	return nil
+}
+
+// selectKind applies es.Kind to the batch, reusing its storage, and
+// counts the events it leaves out or merges as filtered.
+func (es *EventStream) selectKind(events []Event) []Event {
+	var kept []Event
+	switch es.conf().Kind {
+	case FilesOnly:
+		kept = events[:0]
+		for _, e := range events {
+			if e.Flags&itemKinds == 0 || e.Flags&(ItemIsFile|ItemIsSymlink) != 0 {
+				kept = append(kept, e)
+			}
+		}
+	case DirsOnly:
+		kept = events[:0]
+		var dirs map[string]int // index in kept of each directory's event
+		for _, e := range events {
+			if e.Flags&itemKinds == 0 {
+				kept = append(kept, e)
+				continue
+			}
+			if e.Flags&ItemIsDir == 0 {
+				e.Path = filepath.Dir(e.Path)
+				e.Flags = ItemIsDir | ItemModified
+			}
+			if i, ok := dirs[e.Path]; ok {
+				kept[i].Flags |= e.Flags
+				if e.ID > kept[i].ID {
+					kept[i].ID = e.ID
+				}
+				continue
+			}
+			if dirs == nil {
+				dirs = map[string]int{}
+			}
+			dirs[e.Path] = len(kept)
+			kept = append(kept, e)
+		}
+	default:
+		return events
+	}
+	if n := len(events) - len(kept); n > 0 {
+		atomic.AddUint64(&es.stats.FilteredEvents, uint64(n))
+		tail := events[len(kept):]
+		for i := range tail {
+			tail[i] = Event{}
+		}
+	}
+	return kept
+}
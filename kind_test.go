@@ -0,0 +1,55 @@
+package fsevents
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKind(t *testing.T) {
+	workload := []Event{
+		{Path: "/w", Flags: MustScanSubDirs, ID: 1},
+		{Path: "/w/a", Flags: ItemCreated | ItemIsDir, ID: 2},
+		{Path: "/w/a/f", Flags: ItemCreated | ItemIsFile, ID: 3},
+		{Path: "/w/a/g", Flags: ItemModified | ItemIsFile, ID: 4},
+		{Path: "/w/b/link", Flags: ItemCreated | ItemIsSymlink, ID: 5},
+		{Path: "/w/c", Flags: ItemRemoved, ID: 6}, // a directory, without FileEvents
+		{Path: "/w/b/h", Flags: ItemRemoved | ItemIsFile, ID: 7},
+	}
+	tests := []struct {
+		kind     Kind
+		want     []Event
+		filtered uint64
+	}{
+		{All, workload, 0},
+		{FilesOnly, []Event{workload[0], workload[2], workload[3], workload[4], workload[5], workload[6]}, 1},
+		{DirsOnly, []Event{
+			workload[0],
+			{Path: "/w/a", Flags: ItemCreated | ItemModified | ItemIsDir, ID: 4},
+			{Path: "/w/b", Flags: ItemModified | ItemIsDir, ID: 7},
+			workload[5],
+		}, 3},
+	}
+	for _, tt := range tests {
+		es := &EventStream{Events: make(chan []Event, 1), Kind: tt.kind}
+		es.deliver(append([]Event(nil), workload...))
+		if have := <-es.EventsChan(); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%v got %v, want %v", tt.kind, have, tt.want)
+		}
+		if st := es.Stats(); st.FilteredEvents != tt.filtered || st.DeliveredEvents != uint64(len(tt.want)) {
+			t.Errorf("%v stats %+v, want %d filtered", tt.kind, st, tt.filtered)
+		}
+	}
+}
+
+func TestFilesOnlyNeedsFileEvents(t *testing.T) {
+	es := &EventStream{Paths: []string{t.TempDir()}, Kind: FilesOnly}
+	if err := es.Start(); err != errFilesOnly {
+		es.Stop()
+		t.Fatalf("Start without FileEvents = %v, want %v", err, errFilesOnly)
+	}
+	es.Backend = Poll
+	if err := es.Start(); err != nil {
+		t.Fatalf("Start with Poll = %v", err)
+	}
+	es.Stop()
+}
@@ -0,0 +1,260 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// kqueueNotes maps kqueue vnode notes to the flags they're reported as.
+var kqueueNotes = []struct {
+	note uint32
+	flag EventFlags
+}{
+	{syscall.NOTE_DELETE, ItemRemoved},
+	{syscall.NOTE_REVOKE, ItemRemoved},
+	{syscall.NOTE_WRITE, ItemModified},
+	{syscall.NOTE_EXTEND, ItemModified},
+	{syscall.NOTE_ATTRIB, ItemInodeMetaMod},
+	{syscall.NOTE_LINK, ItemInodeMetaMod},
+	{syscall.NOTE_RENAME, ItemRenamed},
+}
+
+const kqueueAllNotes = syscall.NOTE_DELETE | syscall.NOTE_REVOKE | syscall.NOTE_WRITE |
+	syscall.NOTE_EXTEND | syscall.NOTE_ATTRIB | syscall.NOTE_LINK | syscall.NOTE_RENAME
+
+// kqueueSource implements the KQueue backend. Each watched file or
+// directory has a descriptor registered with the queue; a write to a
+// directory makes it diff its entries to find what was created or removed.
+type kqueueSource struct {
+	es   *EventStream
+	kq   int
+	wake [2]int // writing to wake[1] stops run
+	done chan struct{}
+
+	// Owned by run once it has started.
+	watches map[int]*kqueueWatch    // by descriptor
+	paths   map[string]*kqueueWatch // by path
+	lastID  uint64
+}
+
+type kqueueWatch struct {
+	fd       int
+	path     string
+	kind     EventFlags // ItemIsFile, ItemIsDir or ItemIsSymlink
+	root     bool
+	children map[string]bool // entry names, for directories in Paths
+}
+
+func startKQueue(es *EventStream) (source, error) {
+	kq, err := syscall.Kqueue()
+	if err != nil {
+		return nil, os.NewSyscallError("kqueue", err)
+	}
+	s := &kqueueSource{
+		es:      es,
+		kq:      kq,
+		done:    make(chan struct{}),
+		watches: map[int]*kqueueWatch{},
+		paths:   map[string]*kqueueWatch{},
+		lastID:  es.EventID,
+	}
+	if err := syscall.Pipe(s.wake[:]); err != nil {
+		syscall.Close(kq)
+		return nil, os.NewSyscallError("pipe", err)
+	}
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, s.wake[0], syscall.EVFILT_READ, syscall.EV_ADD)
+	if _, err := syscall.Kevent(kq, []syscall.Kevent_t{ev}, nil, nil); err != nil {
+		s.close()
+		return nil, os.NewSyscallError("kevent", err)
+	}
+
+	for _, p := range es.watched {
+		w, err := s.add(filepath.Clean(p), true)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		if w.kind == ItemIsDir {
+			s.scan(w, nil)
+		}
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// add opens path and registers it with the queue.
+func (s *kqueueSource) add(path string, root bool) (*kqueueWatch, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Open(path, syscall.O_EVTONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, fd, syscall.EVFILT_VNODE, syscall.EV_ADD|syscall.EV_CLEAR)
+	ev.Fflags = kqueueAllNotes
+	if _, err := syscall.Kevent(s.kq, []syscall.Kevent_t{ev}, nil, nil); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("kevent", err)
+	}
+
+	w := &kqueueWatch{fd: fd, path: path, kind: ItemIsFile, root: root}
+	switch {
+	case fi.IsDir():
+		w.kind = ItemIsDir
+	case fi.Mode()&os.ModeSymlink != 0:
+		w.kind = ItemIsSymlink
+	}
+	s.watches[fd] = w
+	s.paths[path] = w
+	return w, nil
+}
+
+// remove forgets w. Closing the descriptor also drops its registration.
+func (s *kqueueSource) remove(w *kqueueWatch) {
+	delete(s.watches, w.fd)
+	if s.paths[w.path] == w {
+		delete(s.paths, w.path)
+	}
+	if parent, ok := s.paths[filepath.Dir(w.path)]; ok && parent.children != nil {
+		delete(parent.children, filepath.Base(w.path))
+	}
+	syscall.Close(w.fd)
+}
+
+// scan diffs the entries of the watched directory w against the last scan,
+// watching new entries and appending events for the changes to batch. The
+// first scan of a directory only records its entries.
+func (s *kqueueSource) scan(w *kqueueWatch, batch []Event) []Event {
+	entries, err := os.ReadDir(w.path)
+	if err != nil {
+		return batch
+	}
+	first := w.children == nil
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		seen[name] = true
+		if w.children[name] {
+			continue
+		}
+		child, err := s.add(filepath.Join(w.path, name), false)
+		if err != nil {
+			continue
+		}
+		if !first {
+			batch = s.event(batch, child.path, ItemCreated|child.kind)
+		}
+	}
+	for name := range w.children {
+		if seen[name] {
+			continue
+		}
+		if child, ok := s.paths[filepath.Join(w.path, name)]; ok {
+			batch = s.event(batch, child.path, ItemRemoved|child.kind)
+			s.remove(child)
+		}
+	}
+	w.children = seen
+	return batch
+}
+
+func (s *kqueueSource) event(batch []Event, path string, flags EventFlags) []Event {
+	s.lastID++
+	return append(batch, Event{Path: path, Flags: flags, ID: s.lastID})
+}
+
+func (s *kqueueSource) run() {
+	defer close(s.done)
+
+	buf := make([]syscall.Kevent_t, 64)
+	for {
+		n, err := syscall.Kevent(s.kq, nil, buf, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			// sourceFailed stops s, which waits for run to return.
+			go s.es.sourceFailed(s, os.NewSyscallError("kevent", err))
+			return
+		}
+
+		batch := newBatch(0)
+		// Changes to entries are handled before directory rescans, so
+		// an entry that was renamed or removed is reported as such and
+		// not rediscovered as missing by its parent.
+		var rescan []*kqueueWatch
+		for _, ev := range buf[:n] {
+			if int(ev.Ident) == s.wake[0] {
+				recycle(batch)
+				return
+			}
+			w, ok := s.watches[int(ev.Ident)]
+			if !ok {
+				continue
+			}
+			if w.root && w.kind == ItemIsDir && ev.Fflags&(syscall.NOTE_WRITE|syscall.NOTE_EXTEND) != 0 {
+				rescan = append(rescan, w)
+			}
+
+			notes := ev.Fflags
+			if w.kind == ItemIsDir {
+				// Entry changes are reported for the entries.
+				notes &^= syscall.NOTE_WRITE | syscall.NOTE_EXTEND | syscall.NOTE_LINK
+			}
+			var flags EventFlags
+			for _, n := range kqueueNotes {
+				if notes&n.note != 0 {
+					flags |= n.flag
+				}
+			}
+			gone := flags&(ItemRemoved|ItemRenamed) != 0
+			if gone && w.root && s.es.conf().Flags&WatchRoot != 0 {
+				flags |= RootChanged
+			}
+			if flags != 0 {
+				batch = s.event(batch, w.path, flags|w.kind)
+			}
+			if gone {
+				s.remove(w)
+			}
+		}
+		for _, w := range rescan {
+			if s.watches[w.fd] == w {
+				batch = s.scan(w, batch)
+			}
+		}
+
+		if len(batch) == 0 {
+			recycle(batch)
+			continue
+		}
+		s.es.deliver(batch)
+	}
+}
+
+// flush does nothing: events are delivered as soon as kqueue reports them.
+func (s *kqueueSource) flush(sync bool) {}
+
+func (s *kqueueSource) stop() {
+	syscall.Write(s.wake[1], []byte{0})
+	<-s.done
+	s.close()
+}
+
+func (s *kqueueSource) close() {
+	for _, w := range s.watches {
+		syscall.Close(w.fd)
+	}
+	syscall.Close(s.wake[0])
+	syscall.Close(s.wake[1])
+	syscall.Close(s.kq)
+}
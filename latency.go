@@ -0,0 +1,134 @@
+package fsevents
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+var errNoBatchesMeta = errors.New("fsevents: ReceiveBatch needs BatchesMeta")
+
+// LatencyStats summarizes how long batches waited on BatchesMeta, from
+// the stream putting them there to ReceiveBatch returning them. The
+// percentiles are those of a histogram with four buckets to a doubling,
+// so within a fifth of the true value, and capped at Max.
+type LatencyStats struct {
+	Batches  uint64 // how many were received
+	P50, P95 time.Duration
+	Max      time.Duration
+}
+
+// latencyBuckets is how many buckets a latencyHistogram has: eight for
+// the nanoseconds under eight, and four for each doubling above.
+const latencyBuckets = 8 + 60*4
+
+// latencyHistogram counts durations into buckets of latencyBucket,
+// atomically, for a fixed cost per duration.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+	max    int64
+}
+
+// latencyBucket returns the bucket of ns nanoseconds: its own under
+// eight, and above, its doubling and which quarter of it.
+func latencyBucket(ns int64) int {
+	if ns < 8 {
+		if ns < 0 {
+			return 0
+		}
+		return int(ns)
+	}
+	o := bits.Len64(uint64(ns))
+	return 8 + (o-4)*4 + int(ns>>(o-3))&3
+}
+
+// latencyBound returns the nanoseconds just above bucket i.
+func latencyBound(i int) int64 {
+	if i < 8 {
+		return int64(i) + 1
+	}
+	o, quarter := (i-8)/4+4, (i-8)%4
+	return int64(5+quarter) << (o - 3)
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	ns := int64(d)
+	atomic.AddUint64(&h.counts[latencyBucket(ns)], 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if ns <= max || atomic.CompareAndSwapInt64(&h.max, max, ns) {
+			return
+		}
+	}
+}
+
+func (h *latencyHistogram) snapshot() LatencyStats {
+	var counts [latencyBuckets]uint64
+	var st LatencyStats
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		st.Batches += counts[i]
+	}
+	st.Max = time.Duration(atomic.LoadInt64(&h.max))
+	st.P50 = percentile(&counts, st.Batches, 50, st.Max)
+	st.P95 = percentile(&counts, st.Batches, 95, st.Max)
+	return st
+}
+
+// percentile returns the bound of the bucket holding the p-th percentile
+// of the total durations counted, or max if that's lower.
+func percentile(counts *[latencyBuckets]uint64, total uint64, p uint64, max time.Duration) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	rank := (total*p + 99) / 100
+	var seen uint64
+	for i, n := range counts {
+		if seen += n; seen >= rank {
+			if d := time.Duration(latencyBound(i) - 1); d < max {
+				return d
+			}
+			break
+		}
+	}
+	return max
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.max, 0)
+}
+
+// ReceiveBatch receives the next batch from BatchesMeta, as a receive
+// from the channel does, recording how long it waited there in
+// Stats.QueueLatency. It fails with ctx's error, with io.EOF once the
+// stream closed BatchesMeta, its volume gone, and at once if BatchesMeta
+// isn't set.
+func (es *EventStream) ReceiveBatch(ctx context.Context) (Batch, error) {
+	metas := es.BatchesMeta
+	if metas == nil {
+		return Batch{}, errNoBatchesMeta
+	}
+	select {
+	case b, ok := <-metas:
+		if !ok {
+			return Batch{}, io.EOF
+		}
+		if !b.EnqueuedAt.IsZero() {
+			es.latency.observe(time.Since(b.EnqueuedAt))
+		}
+		return b, nil
+	case <-ctx.Done():
+		return Batch{}, ctx.Err()
+	}
+}
+
+// ResetQueueLatency starts Stats.QueueLatency afresh.
+func (es *EventStream) ResetQueueLatency() {
+	es.latency.reset()
+}
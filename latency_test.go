@@ -0,0 +1,95 @@
+package fsevents
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	for _, ns := range []int64{0, 1, 7, 8, 9, 10, 11, 12, 100, 1e6, 1e9, 1 << 62} {
+		i := latencyBucket(ns)
+		if ns >= latencyBound(i) || i > 0 && ns < latencyBound(i-1) {
+			t.Errorf("%dns in bucket %d, up to %d", ns, i, latencyBound(i))
+		}
+	}
+
+	var h latencyHistogram
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	st := h.snapshot()
+	near := func(d, want time.Duration) bool { return d >= want && d <= want*5/4 }
+	if st.Batches != 100 || !near(st.P50, 50*time.Millisecond) || !near(st.P95, 95*time.Millisecond) || st.Max != 100*time.Millisecond {
+		t.Errorf("snapshot() = %+v", st)
+	}
+	h.reset()
+	if st := h.snapshot(); st != (LatencyStats{}) {
+		t.Errorf("after reset, snapshot() = %+v", st)
+	}
+}
+
+func TestQueueLatency(t *testing.T) {
+	es := &EventStream{Paths: []string{"/d"}, Backend: Manual, BatchesMeta: make(chan Batch, 20)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	ctx := context.Background()
+	var id uint64
+	inject := func() {
+		t.Helper()
+		id++
+		if err := es.Inject([]Event{{Path: "/d/f", ID: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() {
+		t.Helper()
+		b, err := es.ReceiveBatch(ctx)
+		if err != nil || len(b.Events) != 1 || b.EnqueuedAt.IsZero() {
+			t.Fatalf("ReceiveBatch() = %+v, %v", b, err)
+		}
+		es.Recycle(b.Events)
+	}
+
+	// A consumer keeping up.
+	for i := 0; i < 10; i++ {
+		inject()
+		receive()
+	}
+	fast := es.Stats().QueueLatency
+	if fast.Batches != 10 || fast.P95 > fast.Max || fast.Max > 50*time.Millisecond {
+		t.Errorf("with a consumer keeping up, QueueLatency = %+v", fast)
+	}
+
+	// A slow one: the batches wait in the channel.
+	es.ResetQueueLatency()
+	const stall = 30 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		inject()
+	}
+	time.Sleep(stall)
+	for i := 0; i < 10; i++ {
+		receive()
+	}
+	slow := es.Stats().QueueLatency
+	if slow.Batches != 10 || slow.P50 < stall || slow.P95 < slow.P50 || slow.Max < slow.P95 || slow.P50 <= fast.P95 {
+		t.Errorf("with a slow consumer, QueueLatency = %+v, after %+v", slow, fast)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := es.ReceiveBatch(canceled); err != context.Canceled {
+		t.Errorf("ReceiveBatch() with nothing to receive = %v", err)
+	}
+	es.Stop()
+	close(es.BatchesMeta)
+	if _, err := es.ReceiveBatch(ctx); err != io.EOF {
+		t.Errorf("ReceiveBatch() on a closed BatchesMeta = %v", err)
+	}
+	if _, err := (&EventStream{}).ReceiveBatch(ctx); err != errNoBatchesMeta {
+		t.Errorf("ReceiveBatch() without BatchesMeta = %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package fsevents
+
+import "sync"
+
+// Leak tracking counts the CoreFoundation objects, FSEvents streams and
+// dispatch queues the package creates and releases, and the purego
+// callbacks it creates, which can never be freed. It's compiled in with
+// the fseventsleaks build tag; without it, leakTracking is false and the
+// track functions compile away to nothing.
+
+// leaks holds the objects created and not yet released, by reference:
+// CF hands out the same reference for equal constant strings, so each
+// counts its owners.
+var leaks = struct {
+	sync.Mutex
+	refs      map[uintptr]*leakRef
+	callbacks int
+}{refs: map[uintptr]*leakRef{}}
+
+type leakRef struct {
+	kind string
+	n    int
+}
+
+// trackCreate records that ref, an object of the given kind, was created,
+// copied or retained. A zero ref, a failed create, isn't counted.
+func trackCreate(kind string, ref uintptr) {
+	if !leakTracking || ref == 0 {
+		return
+	}
+	trackRef(kind, ref, 1)
+}
+
+// trackRelease records that ref was released. Releasing a ref that isn't
+// held is counted as a negative leak of kind "overreleased".
+func trackRelease(ref uintptr) {
+	if !leakTracking || ref == 0 {
+		return
+	}
+	trackRef("overreleased", ref, -1)
+}
+
+// trackRef adds n to the count of ref, of the given kind if it isn't held
+// yet.
+func trackRef(kind string, ref uintptr, n int) {
+	leaks.Lock()
+	defer leaks.Unlock()
+	r := leaks.refs[ref]
+	if r == nil {
+		r = &leakRef{kind: kind}
+		leaks.refs[ref] = r
+	}
+	if r.n += n; r.n == 0 {
+		delete(leaks.refs, ref)
+	}
+}
+
+// trackCallback records a purego callback.
+func trackCallback() {
+	if !leakTracking {
+		return
+	}
+	leaks.Lock()
+	defer leaks.Unlock()
+	leaks.callbacks++
+}
+
+// LeakReport returns the number of objects the package holds, by kind:
+// "CFString", "CFArray", "CFURL", "CFUUID", "FSEventStream" and
+// "dispatch_queue" count those created and not released yet, and
+// "callback" the purego callbacks created, which are never released and
+// whose number is limited. A negative count under "overreleased" means an
+// object was released more often than it was created. Cached path strings
+// are held until released by the cache, which is bounded.
+//
+// Counting needs the fseventsleaks build tag, for debugging and tests, as
+// in go test -tags fseventsleaks; without it, LeakReport returns nil.
+func LeakReport() map[string]int {
+	if !leakTracking {
+		return nil
+	}
+	leaks.Lock()
+	defer leaks.Unlock()
+	report := map[string]int{}
+	for _, r := range leaks.refs {
+		report[r.kind] += r.n
+	}
+	if leaks.callbacks > 0 {
+		report["callback"] = leaks.callbacks
+	}
+	return report
+}
@@ -0,0 +1,5 @@
+//go:build fseventsleaks
+
+package fsevents
+
+const leakTracking = true
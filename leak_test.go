@@ -0,0 +1,69 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"reflect"
+	"testing"
+)
+
+// leakCheck returns a function that fails t unless the objects the
+// package holds, as counted with the fseventsleaks tag, are the same as
+// when leakCheck was called, and no more than the two purego callbacks
+// the package shares between streams were created. Cached path strings
+// are released first both times. Without the tag it checks nothing.
+func leakCheck(t *testing.T) func() {
+	pathStrings.purge()
+	before := LeakReport()
+	delete(before, "callback")
+	return func() {
+		t.Helper()
+		pathStrings.purge()
+		after := LeakReport()
+		if n := after["callback"]; n > 2 {
+			t.Errorf("%d purego callbacks created, want at most 2", n)
+		}
+		delete(after, "callback")
+		if !reflect.DeepEqual(after, before) {
+			t.Errorf("objects held: %v, want %v as before", after, before)
+		}
+	}
+}
+
+func TestLeakReport(t *testing.T) {
+	if !leakTracking {
+		if LeakReport() != nil {
+			t.Error("LeakReport() != nil without the fseventsleaks tag")
+		}
+		t.Skip("leak tracking needs -tags fseventsleaks")
+	}
+	f := withFakeStreams(t, 0)
+	f.uuids[0] = "UUID"
+	check := leakCheck(t)
+
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1), ExclusionPaths: []string{fakePaths[0] + "/x"}}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if st := LeakReport(); st["FSEventStream"] != 1 || st["dispatch_queue"] != 1 {
+		t.Errorf("running stream holds %v", st)
+	}
+	es.Debug()
+	getStreamRefPaths(es.stream)
+	GetDeviceUUID(0)
+	es.Stop()
+	check()
+
+	// An object that isn't released shows.
+	held := LeakReport()["CFString"]
+	ref := goStringToCFString("leaked")
+	if n := LeakReport()["CFString"]; n != held+1 {
+		t.Errorf("%d CFStrings held, want the %d before and the leaked one", n, held)
+	}
+	releaseCF(uintptr(ref))
+	releaseCF(uintptr(ref))
+	if n := LeakReport()["overreleased"]; n != -1 {
+		t.Errorf("overreleased = %d, want -1", n)
+	}
+	trackCreate("CFString", uintptr(ref))
+}
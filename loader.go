@@ -0,0 +1,190 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"fmt"
+
+	"github.com/ebitengine/purego"
+)
+
+// Locations of the libraries the package binds to. They are variables so
+// unusual environments can override them at link time, e.g.
+//
+//	go build -ldflags "-X github.com/fsnotify/fsevents.coreServicesPath=/path/to/CoreServices"
+var (
+	coreServicesPath = "/System/Library/Frameworks/CoreServices.framework/CoreServices"
+	dispatchPath     = "/usr/lib/system/libdispatch.dylib"
+)
+
+// loader holds the function pointers resolved from CoreServices and
+// libdispatch. Every call into the system goes through the active loader,
+// lib, so tests can substitute a fake symbol table.
+type loader struct {
+	// CoreServices function pointers
+	fseventsCreateRelativeToDevice            uintptr
+	fseventsCreate                            uintptr
+	fseventsStart                             uintptr
+	fseventsStop                              uintptr
+	fseventsInvalidate                        uintptr
+	fseventsRelease                           uintptr
+	fseventsGetLatestEventID                  uintptr
+	fseventsGetDeviceBeingWatched             uintptr
+	fseventsCopyDescription                   uintptr
+	fseventsCopyPaths                         uintptr
+	fseventsFlushAsync                        uintptr
+	fseventsFlushSync                         uintptr
+	fseventsSetDispatchQueue                  uintptr
+	fseventsCopyUUIDForDevice                 uintptr
+	fseventsGetCurrentEventID                 uintptr
+	fseventsGetLastEventIDForDeviceBeforeTime uintptr
+	fseventsScheduleWithRunLoop               uintptr
+	fseventsUnscheduleFromRunLoop             uintptr
+	fseventsSetExclusionPaths                 uintptr
+
+	// CoreFoundation function pointers
+	cfRelease                         uintptr
+	cfStringCreateWithCString         uintptr
+	cfURLCreateWithString             uintptr
+	cfStringGetCStringPtr             uintptr
+	cfURLGetString                    uintptr
+	cfStringGetLength                 uintptr
+	cfStringGetCString                uintptr
+	cfStringGetBytes                  uintptr
+	cfStringGetMaximumSizeForEncoding uintptr
+	cfArrayGetCount                   uintptr
+	cfArrayGetValueAtIndex            uintptr
+	cfArrayCreateMutable              uintptr
+	cfArrayAppendValue                uintptr
+	cfUUIDCreateString                uintptr
+	cfGetRetainCount                  uintptr
+	cfTypeArrayCallBacks              uintptr // address of kCFTypeArrayCallBacks
+	cfRunLoopGetCurrent               uintptr
+	cfRunLoopRun                      uintptr
+	cfRunLoopStop                     uintptr
+
+	// Dispatch function pointers
+	dispatchQueueCreate          uintptr
+	dispatchRelease              uintptr
+	dispatchQueueAttrMakeWithQoS uintptr
+	dispatchQueueGetQoSClass     uintptr
+	dispatchRetain               uintptr
+	dispatchSyncF                uintptr
+	dispatchQueueSetSpecific     uintptr
+	dispatchGetSpecific          uintptr
+}
+
+// symbol names a function pointer in a loader.
+type symbol struct {
+	ptr  *uintptr
+	name string
+}
+
+func (l *loader) coreServicesSymbols() []symbol {
+	return []symbol{
+		{&l.fseventsCreateRelativeToDevice, "FSEventStreamCreateRelativeToDevice"},
+		{&l.fseventsCreate, "FSEventStreamCreate"},
+		{&l.fseventsStart, "FSEventStreamStart"},
+		{&l.fseventsStop, "FSEventStreamStop"},
+		{&l.fseventsInvalidate, "FSEventStreamInvalidate"},
+		{&l.fseventsRelease, "FSEventStreamRelease"},
+		{&l.fseventsGetLatestEventID, "FSEventStreamGetLatestEventId"},
+		{&l.fseventsGetDeviceBeingWatched, "FSEventStreamGetDeviceBeingWatched"},
+		{&l.fseventsCopyDescription, "FSEventStreamCopyDescription"},
+		{&l.fseventsCopyPaths, "FSEventStreamCopyPathsBeingWatched"},
+		{&l.fseventsFlushAsync, "FSEventStreamFlushAsync"},
+		{&l.fseventsFlushSync, "FSEventStreamFlushSync"},
+		{&l.fseventsSetDispatchQueue, "FSEventStreamSetDispatchQueue"},
+		{&l.fseventsCopyUUIDForDevice, "FSEventsCopyUUIDForDevice"},
+		{&l.fseventsGetCurrentEventID, "FSEventsGetCurrentEventId"},
+		{&l.fseventsGetLastEventIDForDeviceBeforeTime, "FSEventsGetLastEventIDForDeviceBeforeTime"},
+		{&l.fseventsScheduleWithRunLoop, "FSEventStreamScheduleWithRunLoop"},
+		{&l.fseventsUnscheduleFromRunLoop, "FSEventStreamUnscheduleFromRunLoop"},
+		{&l.fseventsSetExclusionPaths, "FSEventStreamSetExclusionPaths"},
+
+		{&l.cfRelease, "CFRelease"},
+		{&l.cfStringCreateWithCString, "CFStringCreateWithCString"},
+		{&l.cfURLCreateWithString, "CFURLCreateWithString"},
+		{&l.cfStringGetCStringPtr, "CFStringGetCStringPtr"},
+		{&l.cfURLGetString, "CFURLGetString"},
+		{&l.cfStringGetLength, "CFStringGetLength"},
+		{&l.cfStringGetCString, "CFStringGetCString"},
+		{&l.cfStringGetBytes, "CFStringGetBytes"},
+		{&l.cfStringGetMaximumSizeForEncoding, "CFStringGetMaximumSizeForEncoding"},
+		{&l.cfArrayGetCount, "CFArrayGetCount"},
+		{&l.cfArrayGetValueAtIndex, "CFArrayGetValueAtIndex"},
+		{&l.cfArrayCreateMutable, "CFArrayCreateMutable"},
+		{&l.cfArrayAppendValue, "CFArrayAppendValue"},
+		{&l.cfUUIDCreateString, "CFUUIDCreateString"},
+		{&l.cfGetRetainCount, "CFGetRetainCount"},
+		{&l.cfTypeArrayCallBacks, "kCFTypeArrayCallBacks"},
+		{&l.cfRunLoopGetCurrent, "CFRunLoopGetCurrent"},
+		{&l.cfRunLoopRun, "CFRunLoopRun"},
+		{&l.cfRunLoopStop, "CFRunLoopStop"},
+	}
+}
+
+func (l *loader) dispatchSymbols() []symbol {
+	return []symbol{
+		{&l.dispatchQueueCreate, "dispatch_queue_create"},
+		{&l.dispatchRelease, "dispatch_release"},
+		{&l.dispatchQueueAttrMakeWithQoS, "dispatch_queue_attr_make_with_qos_class"},
+		{&l.dispatchQueueGetQoSClass, "dispatch_queue_get_qos_class"},
+		{&l.dispatchRetain, "dispatch_retain"},
+		{&l.dispatchSyncF, "dispatch_sync_f"},
+		{&l.dispatchQueueSetSpecific, "dispatch_queue_set_specific"},
+		{&l.dispatchGetSpecific, "dispatch_get_specific"},
+	}
+}
+
+// newLoader opens the CoreServices framework and libdispatch at the given
+// paths and resolves every symbol the package uses.
+func newLoader(coreServicesPath, dispatchPath string) (*loader, error) {
+	l := &loader{}
+
+	coreServices, err := purego.Dlopen(coreServicesPath, purego.RTLD_LAZY)
+	if err != nil {
+		return nil, fmt.Errorf("fsevents: loading %s: %w", coreServicesPath, err)
+	}
+	for _, s := range l.coreServicesSymbols() {
+		*s.ptr, _ = purego.Dlsym(coreServices, s.name)
+	}
+
+	dispatch, err := purego.Dlopen(dispatchPath, purego.RTLD_LAZY)
+	if err != nil {
+		return nil, fmt.Errorf("fsevents: loading %s: %w", dispatchPath, err)
+	}
+	for _, s := range l.dispatchSymbols() {
+		*s.ptr, _ = purego.Dlsym(dispatch, s.name)
+	}
+
+	return l, nil
+}
+
+// lib is the active loader. Tests replace it to run against a fake
+// symbol table.
+var lib *loader
+
+// loadErr records why the libraries couldn't be loaded. lib then has no
+// symbols and everything that needs one reports an UnsupportedError.
+var loadErr error
+
+func init() {
+	l, err := newLoader(coreServicesPath, dispatchPath)
+	if err != nil {
+		l, loadErr = &loader{}, err
+	}
+	lib = l
+}
+
+// missing returns an UnsupportedError for the first of fns that wasn't
+// resolved. Symbols differ between macOS and the iOS-derived platforms,
+// so anything beyond CoreFoundation is checked before it's called.
+func missing(fns ...symbol) error {
+	for _, fn := range fns {
+		if *fn.ptr == 0 {
+			return &UnsupportedError{Func: fn.name, Err: loadErr}
+		}
+	}
+	return nil
+}
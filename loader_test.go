@@ -0,0 +1,249 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+	"unsafe"
+
+	"github.com/ebitengine/purego"
+)
+
+// fakeCF is an in-memory stand-in for the CoreFoundation objects the
+// package creates. Refs are small integers handed out by newRef.
+type fakeCF struct {
+	mu       sync.Mutex
+	next     uintptr
+	strs     map[uintptr]string
+	arrays   map[uintptr][]uintptr
+	released int
+}
+
+func (f *fakeCF) newRef() uintptr {
+	f.next++
+	return f.next
+}
+
+// fakePointer converts a callback argument back to a pointer. The direct
+// unsafe.Pointer(u) conversion trips checkptr under -race when u points
+// into the Go heap, which it does for buffers the package passes to CF.
+func fakePointer(u uintptr) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&u))
+}
+
+// fakeCString reads a NUL-terminated string passed to a fake CF function.
+func fakeCString(u uintptr) string {
+	p := fakePointer(u)
+	n := 0
+	for *(*byte)(unsafe.Add(p, n)) != 0 {
+		n++
+	}
+	return string(unsafe.Slice((*byte)(p), n))
+}
+
+var (
+	fakeOnce   sync.Once
+	fake       = &fakeCF{}
+	fakeLoader *loader
+)
+
+// withFakeLoader installs a loader backed by fakeCF for the duration of
+// the test. purego callbacks can't be freed, so the symbol table is built
+// once and shared.
+func withFakeLoader(t *testing.T) *fakeCF {
+	t.Helper()
+
+	fakeOnce.Do(func() {
+		f := fake
+		fakeLoader = &loader{
+			cfStringCreateWithCString: purego.NewCallback(func(alloc, cstr, enc uintptr) uintptr {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				r := f.newRef()
+				f.strs[r] = fakeCString(cstr)
+				return r
+			}),
+			cfStringGetLength: purego.NewCallback(func(ref uintptr) uintptr {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				return uintptr(len(utf16.Encode([]rune(f.strs[ref]))))
+			}),
+			cfStringGetCString: purego.NewCallback(func(ref, buf, size, enc uintptr) uintptr {
+				f.mu.Lock()
+				s := f.strs[ref]
+				f.mu.Unlock()
+				if uintptr(len(s))+1 > size {
+					return 0
+				}
+				b := unsafe.Slice((*byte)(fakePointer(buf)), size)
+				b[copy(b, s)] = 0
+				return 1
+			}),
+			cfStringGetMaximumSizeForEncoding: purego.NewCallback(func(length, enc uintptr) uintptr {
+				return 3 * length
+			}),
+			cfStringGetBytes: purego.NewCallback(func(ref, loc, length, enc, loss, ext, buf, max, used uintptr) uintptr {
+				f.mu.Lock()
+				s := f.strs[ref]
+				f.mu.Unlock()
+				if uintptr(len(s)) > max {
+					return 0
+				}
+				copy(unsafe.Slice((*byte)(fakePointer(buf)), max), s)
+				*(*uintptr)(fakePointer(used)) = uintptr(len(s))
+				return length
+			}),
+			cfURLCreateWithString: purego.NewCallback(func(alloc, str, base uintptr) uintptr {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				r := f.newRef()
+				f.strs[r] = f.strs[str]
+				return r
+			}),
+			cfURLGetString: purego.NewCallback(func(url uintptr) uintptr {
+				return url
+			}),
+			cfArrayCreateMutable: purego.NewCallback(func(alloc, capacity, callbacks uintptr) uintptr {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				r := f.newRef()
+				f.arrays[r] = make([]uintptr, 0, capacity)
+				return r
+			}),
+			cfArrayAppendValue: purego.NewCallback(func(arr, v uintptr) uintptr {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				f.arrays[arr] = append(f.arrays[arr], v)
+				return 0
+			}),
+			cfArrayGetCount: purego.NewCallback(func(arr uintptr) uintptr {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				return uintptr(len(f.arrays[arr]))
+			}),
+			cfArrayGetValueAtIndex: purego.NewCallback(func(arr, i uintptr) uintptr {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				return f.arrays[arr][i]
+			}),
+			cfRelease: purego.NewCallback(func(ref uintptr) uintptr {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				delete(f.strs, ref)
+				delete(f.arrays, ref)
+				f.released++
+				return 0
+			}),
+		}
+	})
+
+	fake.mu.Lock()
+	fake.strs = map[uintptr]string{}
+	fake.arrays = map[uintptr][]uintptr{}
+	fake.released = 0
+	fake.mu.Unlock()
+
+	prev, prevPaths := lib, pathStrings
+	lib, pathStrings = fakeLoader, newPathCache(maxCachedPaths)
+	t.Cleanup(func() { lib, pathStrings = prev, prevPaths })
+	return fake
+}
+
+func TestFakeLoaderStringConversion(t *testing.T) {
+	withFakeLoader(t)
+
+	for _, s := range []string{"", "/tmp/a", "/tmp/日本語", "/tmp/😀"} {
+		ref := goStringToCFString(s)
+		if have := cfStringToGoString(ref); have != s {
+			t.Errorf("cfStringToGoString(goStringToCFString(%q)) = %q", s, have)
+		}
+		cfReleaseCall(uintptr(ref))
+	}
+
+	url := goStringToCFURL("file:///tmp/a")
+	if have := cfURLToGoString(url); have != "file:///tmp/a" {
+		t.Errorf("cfURLToGoString = %q", have)
+	}
+}
+
+func TestFakeLoaderCreatePaths(t *testing.T) {
+	f := withFakeLoader(t)
+
+	ref, err := createPaths([]string{"/a", "/b", "/c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := CFArrayLen(ref); l != 3 {
+		t.Fatalf("CFArrayLen = %d, want 3", l)
+	}
+
+	f.mu.Lock()
+	first := f.strs[f.arrays[uintptr(ref)][0]]
+	f.mu.Unlock()
+	if first != "/a" {
+		t.Errorf("first path = %q, want %q", first, "/a")
+	}
+}
+
+func TestCallback(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 1)}
+	info := registry.Add(es)
+	defer registry.Delete(info)
+
+	newCBatchOf(
+		[]string{"/a", "/b/c"},
+		[]EventFlags{ItemCreated | ItemIsFile, ItemRemoved | ItemIsDir},
+		[]uint64{20, 10},
+	).call(info)
+
+	have := <-es.EventsChan()
+	want := []Event{
+		{Path: "/a", Flags: ItemCreated | ItemIsFile, ID: 20},
+		{Path: "/b/c", Flags: ItemRemoved | ItemIsDir, ID: 10},
+	}
+	if len(have) != len(want) {
+		t.Fatalf("got %d events, want %d", len(have), len(want))
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("event %d: got %#v, want %#v", i, have[i], want[i])
+		}
+	}
+	if es.EventID != 20 {
+		t.Errorf("EventID = %d, want 20", es.EventID)
+	}
+}
+
+// The fake loader has no FSEvents symbols, like an iOS-derived system
+// without them: everything that needs one must degrade instead of calling
+// through a nil pointer.
+func TestMissingSymbols(t *testing.T) {
+	withFakeLoader(t)
+
+	es := &EventStream{Paths: []string{"/tmp"}}
+	err := es.Start()
+	var uerr *UnsupportedError
+	if !errors.As(err, &uerr) || uerr.Func != "FSEventStreamCreate" {
+		t.Fatalf("Start() = %v, want an UnsupportedError for FSEventStreamCreate", err)
+	}
+	if !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("%v doesn't match ErrUnsupportedPlatform", err)
+	}
+	if n := len(registry.load()); n != 0 {
+		t.Errorf("registry holds %d streams after a failed Start", n)
+	}
+
+	if uuid := GetDeviceUUID(0); uuid != "" {
+		t.Errorf("GetDeviceUUID = %q, want empty", uuid)
+	}
+	if id := CurrentEventID(); id != 0 {
+		t.Errorf("CurrentEventID = %d, want 0", id)
+	}
+	if id := EventIDForDeviceBeforeTime(0, time.Now()); id != 0 {
+		t.Errorf("EventIDForDeviceBeforeTime = %d, want 0", id)
+	}
+}
@@ -0,0 +1,26 @@
+package metrics_test
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/fsnotify/fsevents"
+	"github.com/fsnotify/fsevents/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func ExampleCollector() {
+	es := &fsevents.EventStream{Paths: []string{"/tmp"}, Flags: fsevents.FileEvents}
+	if err := es.Start(); err != nil {
+		log.Fatal(err)
+	}
+	defer es.Stop()
+
+	c := metrics.NewCollector("")
+	c.Add("tmp", es)
+	prometheus.MustRegister(c)
+
+	http.Handle("/metrics", promhttp.Handler())
+	log.Fatal(http.ListenAndServe("localhost:9100", nil))
+}
@@ -0,0 +1,112 @@
+// Package metrics exports the counters of fsevents streams as Prometheus
+// metrics.
+//
+// A Collector reads each stream's Stats when it's scraped, so it costs
+// nothing between scrapes and the fsevents package itself doesn't depend
+// on Prometheus. Every metric has a "stream" label with the name the
+// stream was added under:
+//
+//	fsevents_events_total       events received from the backend
+//	fsevents_batches_total      batches received from the backend
+//	fsevents_dropped_total      events not delivered, by kind: "overflow"
+//	                            for the Overflow policy, "filter" for Filter
+//	fsevents_channel_depth      batches waiting on the Events channel
+//	fsevents_last_event_id      the stream's EventID
+//	fsevents_stream_up          1 while the stream is running, else 0
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsevents"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector for a set of EventStreams. Streams
+// may be added and removed at any time, including while it's registered.
+type Collector struct {
+	mu      sync.Mutex
+	streams map[string]*fsevents.EventStream
+
+	events  *prometheus.Desc
+	batches *prometheus.Desc
+	dropped *prometheus.Desc
+	depth   *prometheus.Desc
+	lastID  *prometheus.Desc
+	up      *prometheus.Desc
+}
+
+// NewCollector returns a Collector without streams. The metric names
+// start with namespace, or with "fsevents" if it's empty.
+func NewCollector(namespace string) *Collector {
+	if namespace == "" {
+		namespace = "fsevents"
+	}
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, append([]string{"stream"}, labels...), nil)
+	}
+	return &Collector{
+		streams: map[string]*fsevents.EventStream{},
+		events:  desc("events_total", "Events received from the backend."),
+		batches: desc("batches_total", "Batches received from the backend."),
+		dropped: desc("dropped_total", "Events not delivered, by kind: overflow or filter.", "kind"),
+		depth:   desc("channel_depth", "Batches waiting on the Events channel."),
+		lastID:  desc("last_event_id", "Highest event ID delivered by the stream."),
+		up:      desc("stream_up", "Whether the stream is running."),
+	}
+}
+
+// Add collects the metrics of es under name, replacing any stream
+// previously added under the same name.
+func (c *Collector) Add(name string, es *fsevents.EventStream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.streams[name] = es
+}
+
+// Remove stops collecting the metrics of the stream added under name.
+func (c *Collector) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streams, name)
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.events, c.batches, c.dropped, c.depth, c.lastID, c.up} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	names := make([]string, 0, len(c.streams))
+	for name := range c.streams {
+		names = append(names, name)
+	}
+	streams := make([]*fsevents.EventStream, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		streams[i] = c.streams[name]
+	}
+	c.mu.Unlock()
+
+	for i, es := range streams {
+		name := names[i]
+		st := es.Stats()
+		up := 0.0
+		if st.Running {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.events, prometheus.CounterValue, float64(st.ReceivedEvents), name)
+		ch <- prometheus.MustNewConstMetric(c.batches, prometheus.CounterValue, float64(st.ReceivedBatches), name)
+		ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(st.DroppedEvents), name, "overflow")
+		ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(st.FilteredEvents), name, "filter")
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(st.QueuedBatches), name)
+		ch <- prometheus.MustNewConstMetric(c.lastID, prometheus.GaugeValue, float64(atomic.LoadUint64(&es.EventID)), name)
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up, name)
+	}
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeAndFlush creates name in dir and has the Poll stream es pick it up.
+func writeAndFlush(t *testing.T, es *fsevents.EventStream, dir, name string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+}
+
+func TestCollector(t *testing.T) {
+	tmp := t.TempDir()
+	es := &fsevents.EventStream{
+		Paths:        []string{tmp},
+		Backend:      fsevents.Poll,
+		PollInterval: time.Hour,
+		BufferSize:   1,
+		Overflow:     fsevents.DropNewest,
+		Filter:       func(e *fsevents.Event) bool { return !strings.HasSuffix(e.Path, ".skip") },
+	}
+	c := NewCollector("")
+	c.Add("tmp", es)
+	c.Add("idle", &fsevents.EventStream{})
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	writeAndFlush(t, es, tmp, "a")
+	<-es.Events
+	writeAndFlush(t, es, tmp, "b.skip")
+	writeAndFlush(t, es, tmp, "c") // queued
+	writeAndFlush(t, es, tmp, "d") // dropped
+
+	want := `
+# HELP fsevents_batches_total Batches received from the backend.
+# TYPE fsevents_batches_total counter
+fsevents_batches_total{stream="idle"} 0
+fsevents_batches_total{stream="tmp"} 4
+# HELP fsevents_channel_depth Batches waiting on the Events channel.
+# TYPE fsevents_channel_depth gauge
+fsevents_channel_depth{stream="idle"} 0
+fsevents_channel_depth{stream="tmp"} 1
+# HELP fsevents_dropped_total Events not delivered, by kind: overflow or filter.
+# TYPE fsevents_dropped_total counter
+fsevents_dropped_total{kind="filter",stream="idle"} 0
+fsevents_dropped_total{kind="filter",stream="tmp"} 1
+fsevents_dropped_total{kind="overflow",stream="idle"} 0
+fsevents_dropped_total{kind="overflow",stream="tmp"} 1
+# HELP fsevents_events_total Events received from the backend.
+# TYPE fsevents_events_total counter
+fsevents_events_total{stream="idle"} 0
+fsevents_events_total{stream="tmp"} 4
+# HELP fsevents_last_event_id Highest event ID delivered by the stream.
+# TYPE fsevents_last_event_id gauge
+fsevents_last_event_id{stream="idle"} 0
+fsevents_last_event_id{stream="tmp"} 4
+# HELP fsevents_stream_up Whether the stream is running.
+# TYPE fsevents_stream_up gauge
+fsevents_stream_up{stream="idle"} 0
+fsevents_stream_up{stream="tmp"} 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+	if problems, err := testutil.CollectAndLint(c); err != nil || len(problems) != 0 {
+		t.Errorf("lint: %v %v", problems, err)
+	}
+
+	es.Stop()
+	want = `
+# HELP fsevents_stream_up Whether the stream is running.
+# TYPE fsevents_stream_up gauge
+fsevents_stream_up{stream="idle"} 0
+fsevents_stream_up{stream="tmp"} 0
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want), "fsevents_stream_up"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectorRemove(t *testing.T) {
+	c := NewCollector("watcher")
+	c.Add("a", &fsevents.EventStream{})
+	c.Add("b", &fsevents.EventStream{})
+	if n := testutil.CollectAndCount(c, "watcher_stream_up"); n != 2 {
+		t.Fatalf("%d streams collected, want 2", n)
+	}
+
+	c.Remove("a")
+	want := `
+# HELP watcher_stream_up Whether the stream is running.
+# TYPE watcher_stream_up gauge
+watcher_stream_up{stream="b"} 0
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want), "watcher_stream_up"); err != nil {
+		t.Error(err)
+	}
+}
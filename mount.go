@@ -0,0 +1,100 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mntNoWait makes getfsstat return cached statistics instead of asking
+// every file system, which can hang on an unresponsive network mount.
+const mntNoWait = 2
+
+// mntLocal flags a file system stored locally.
+const mntLocal = 0x1000
+
+// mounts returns the mount table.
+func mounts() ([]syscall.Statfs_t, error) {
+	for {
+		n, err := syscall.Getfsstat(nil, mntNoWait)
+		if err != nil {
+			return nil, os.NewSyscallError("getfsstat", err)
+		}
+		// Room for a volume mounted between the two calls.
+		buf := make([]syscall.Statfs_t, n+1)
+		m, err := syscall.Getfsstat(buf, mntNoWait)
+		if err != nil {
+			return nil, os.NewSyscallError("getfsstat", err)
+		}
+		if m < len(buf) {
+			return buf[:m], nil
+		}
+	}
+}
+
+// ListDevices returns the mounted volumes.
+func ListDevices() ([]DeviceInfo, error) {
+	table, err := mounts()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]DeviceInfo, len(table))
+	for i := range table {
+		st := &table[i]
+		dev := st.Fsid.Val[0]
+		devices[i] = DeviceInfo{
+			Dev:        dev,
+			MountPoint: int8String(st.Mntonname[:]),
+			FSType:     int8String(st.Fstypename[:]),
+			Local:      st.Flags&mntLocal != 0,
+			UUID:       GetDeviceUUID(dev),
+		}
+	}
+	return devices, nil
+}
+
+// MountPointForDevice returns where the volume with device ID dev is
+// mounted, for making the paths of a device-relative stream absolute. The
+// mount table is cached; a running EventStream that reports a Mount or
+// Unmount event clears the cache, and a device the cache doesn't know
+// reloads it, so without such a stream only an ejected volume can linger.
+func MountPointForDevice(dev int32) (string, error) {
+	p, ok, err := mountPoints.lookup(dev, func() (map[int32]string, error) {
+		table, err := mounts()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[int32]string, len(table))
+		for i := range table {
+			m[table[i].Fsid.Val[0]] = int8String(table[i].Mntonname[:])
+		}
+		return m, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("fsevents: device %d: %w", dev, os.ErrNotExist)
+	}
+	return p, nil
+}
+
+func fsType(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	return int8String(st.Fstypename[:]), nil
+}
+
+// int8String converts a NUL-terminated C char array.
+func int8String(b []int8) string {
+	n := 0
+	for n < len(b) && b[n] != 0 {
+		n++
+	}
+	return string(unsafe.Slice((*byte)(unsafe.Pointer(&b[0])), n))
+}
@@ -0,0 +1,210 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListDevices(t *testing.T) {
+	devices, err := ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := DeviceForPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range devices {
+		if d.MountPoint != "/" {
+			continue
+		}
+		if d.Dev != dev {
+			t.Errorf("Dev = %d, want %d", d.Dev, dev)
+		}
+		if d.FSType == "" {
+			t.Error("FSType is empty")
+		}
+		if d.UUID == "" {
+			t.Error("UUID is empty")
+		}
+		return
+	}
+	t.Fatalf("no root volume in %+v", devices)
+}
+
+func TestMountPointForDevice(t *testing.T) {
+	dev, err := DeviceForPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := MountPointForDevice(dev); err != nil || p != "/" {
+		t.Errorf("MountPointForDevice(%d) = %q, %v, want /", dev, p, err)
+	}
+	if _, err := MountPointForDevice(-1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("MountPointForDevice(-1) = %v, want os.ErrNotExist", err)
+	}
+}
+
+// attachRAMDisk attaches and mounts a small RAM disk, detached when the
+// test ends, returning its device and mount point. It skips the test
+// where hdiutil isn't available or fails.
+func attachRAMDisk(t *testing.T) (disk, mount string) {
+	t.Helper()
+	if _, err := exec.LookPath("hdiutil"); err != nil {
+		t.Skip(err)
+	}
+	out, err := exec.Command("hdiutil", "attach", "-nomount", "ram://8192").Output()
+	if err != nil {
+		t.Skip("hdiutil attach:", err)
+	}
+	disk = strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("hdiutil", "detach", "-force", disk).Run() })
+	name := fmt.Sprintf("fsevents-test-%d", os.Getpid())
+	if out, err := exec.Command("diskutil", "erasevolume", "HFS+", name, disk).CombinedOutput(); err != nil {
+		t.Skipf("diskutil erasevolume: %v\n%s", err, out)
+	}
+	return disk, filepath.Join("/Volumes", name)
+}
+
+// TestWatchAllVolumesRAMDisk attaches and ejects a RAM disk, where hdiutil
+// is available, and checks the Watcher follows.
+func TestWatchAllVolumesRAMDisk(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates a RAM disk")
+	}
+	w, err := WatchAllVolumes(WithFlags(FileEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	disk, mount := attachRAMDisk(t)
+
+	// Keep writing until the new volume's stream reports it.
+	file := filepath.Join(mount, "file")
+	timeout := time.After(30 * time.Second)
+wait:
+	for {
+		if err := os.WriteFile(file, []byte(time.Now().String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case batch := <-w.EventsChan():
+			for _, e := range batch {
+				if e.Path == file && e.Device != 0 {
+					break wait
+				}
+			}
+		case <-time.After(500 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("no event for %s", file)
+		}
+	}
+	dev, err := DeviceForPath(mount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid := GetDeviceUUID(dev)
+
+	go func() {
+		for range w.EventsChan() {
+		}
+	}()
+	if out, err := exec.Command("hdiutil", "detach", disk).CombinedOutput(); err != nil {
+		t.Fatalf("hdiutil detach: %v\n%s", err, out)
+	}
+	for deadline := time.Now().Add(30 * time.Second); w.volume(dev) != nil; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("ejected volume still watched")
+		}
+	}
+	if w.EventIDs()[uuid] == 0 {
+		t.Error("no event ID kept for the ejected volume")
+	}
+}
+
+// TestWatchDevicesRAMDisk watches a directory on the root volume and one
+// on a RAM disk with one Watcher, and checks both are reported with
+// absolute paths and resumed from their own event IDs.
+func TestWatchDevicesRAMDisk(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates a RAM disk")
+	}
+	_, mount := attachRAMDisk(t)
+	home, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	away := filepath.Join(mount, "dir")
+	if err := os.Mkdir(away, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := WatchDevices([]string{home, away}, nil, WithFlags(FileEvents), WithLatency(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if len(w.volumes) != 2 {
+		t.Fatalf("%d streams for two volumes", len(w.volumes))
+	}
+
+	// Keep writing until both streams report their file.
+	files := map[string]bool{filepath.Join(home, "file"): false, filepath.Join(away, "file"): false}
+	timeout := time.After(30 * time.Second)
+	for seen := 0; seen < len(files); {
+		for file := range files {
+			if err := os.WriteFile(file, []byte(time.Now().String()), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case batch := <-w.EventsChan():
+			for _, e := range batch {
+				if done, ok := files[e.Path]; ok && !done && e.Device != 0 {
+					files[e.Path] = true
+					seen++
+				}
+			}
+		case <-time.After(500 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("events seen: %v", files)
+		}
+	}
+
+	s := NewStateStore(filepath.Join(t.TempDir(), "state"))
+	if err := w.SaveState(s); err != nil {
+		t.Fatal(err)
+	}
+	states, err := s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("saved %+v, want a state for each volume", states)
+	}
+	go func() {
+		for range w.EventsChan() {
+		}
+	}()
+	w.Close()
+
+	w, err = WatchDevices([]string{home, away}, states, WithFlags(FileEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, v := range w.volumes {
+		if !v.es.Resume || v.es.EventID == 0 {
+			t.Errorf("stream on %s: Resume=%v EventID=%d", v.info.MountPoint, v.es.Resume, v.es.EventID)
+		}
+	}
+}
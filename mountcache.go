@@ -0,0 +1,37 @@
+package fsevents
+
+import "sync"
+
+// mountCache remembers the mount point of each device, so translating
+// device-relative paths doesn't read the mount table every time.
+type mountCache struct {
+	mu sync.Mutex
+	m  map[int32]string // nil until loaded
+}
+
+// mountPoints is used by MountPointForDevice. Streams drop it when they
+// see a Mount or Unmount event.
+var mountPoints mountCache
+
+// lookup returns the mount point of dev, calling load to read the mount
+// table if the cache is empty or doesn't know dev.
+func (c *mountCache) lookup(dev int32, load func() (map[int32]string, error)) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.m[dev]; ok {
+		return p, true, nil
+	}
+	m, err := load()
+	if err != nil {
+		return "", false, err
+	}
+	c.m = m
+	p, ok := m[dev]
+	return p, ok, nil
+}
+
+func (c *mountCache) invalidate() {
+	c.mu.Lock()
+	c.m = nil
+	c.mu.Unlock()
+}
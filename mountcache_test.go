@@ -0,0 +1,43 @@
+package fsevents
+
+import "testing"
+
+func TestMountCache(t *testing.T) {
+	c := &mountPoints
+	c.invalidate()
+	defer c.invalidate()
+	loads := 0
+	table := map[int32]string{1: "/", 2: "/Volumes/Disk"}
+	load := func() (map[int32]string, error) {
+		loads++
+		m := make(map[int32]string, len(table))
+		for dev, p := range table {
+			m[dev] = p
+		}
+		return m, nil
+	}
+
+	lookup := func(dev int32, want string, wantLoads int) {
+		t.Helper()
+		p, ok, err := c.lookup(dev, load)
+		if err != nil || p != want || ok != (want != "") {
+			t.Errorf("lookup(%d) = %q, %v, %v, want %q", dev, p, ok, err, want)
+		}
+		if loads != wantLoads {
+			t.Errorf("lookup(%d): %d loads, want %d", dev, loads, wantLoads)
+		}
+	}
+	lookup(1, "/", 1)
+	lookup(2, "/Volumes/Disk", 1)
+
+	// A device that isn't known yet reloads the table.
+	table[3] = "/Volumes/New"
+	lookup(3, "/Volumes/New", 2)
+	lookup(4, "", 3)
+
+	// A stream reporting a mount change drops the table.
+	es := &EventStream{Handler: func([]Event) {}}
+	es.deliver([]Event{{Path: "/Volumes/Disk", Flags: Unmount}})
+	table[2] = "/Volumes/Disk 1"
+	lookup(2, "/Volumes/Disk 1", 4)
+}
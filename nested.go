@@ -0,0 +1,118 @@
+package fsevents
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+// pathRoot is one of the forms of one of a stream's Paths, which the
+// events below it are attributed to.
+type pathRoot struct {
+	anchor
+	root string // the path as given
+}
+
+// rootForms returns the forms events on path may come in: absolute and,
+// if it exists, with its symbolic links resolved, as FSEvents reports
+// them. A path relative to a device's root is only cleaned.
+func rootForms(path string, device int32) []anchor {
+	if device != 0 {
+		return []anchor{{path: filepath.Clean(path)}}
+	}
+	abs := path
+	if p, err := filepath.Abs(path); err == nil {
+		abs = p
+	}
+	forms := []anchor{newAnchor(abs)}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil && resolved != forms[0].path {
+		forms = append(forms, newAnchor(resolved))
+	}
+	return forms
+}
+
+// groupNested groups paths by the outermost of them each is, once
+// resolved, the same as or below, keeping their order: each group starts
+// with an outer path, followed by those nested in it.
+func groupNested(paths []string, device int32) [][]string {
+	resolved := make([]anchor, len(paths))
+	for i, path := range paths {
+		forms := rootForms(path, device)
+		resolved[i] = forms[len(forms)-1]
+	}
+	// The shortest path a path is below, if any, isn't below another.
+	outer := make([]int, len(paths))
+	for i := range paths {
+		outer[i] = i
+		for j := range paths {
+			a, o := resolved[j], resolved[outer[i]]
+			if a.covers(resolved[i].path) && (len(a.path) < len(o.path) || len(a.path) == len(o.path) && j < outer[i]) {
+				outer[i] = j
+			}
+		}
+	}
+	var groups [][]string
+	group := map[int]int{} // index in groups by outer path
+	for i, path := range paths {
+		if outer[i] == i {
+			group[i] = len(groups)
+			groups = append(groups, []string{path})
+		}
+	}
+	for i, path := range paths {
+		if o := outer[i]; o != i {
+			groups[group[o]] = append(groups[group[o]], path)
+		}
+	}
+	return groups
+}
+
+// watchedPaths returns the paths the backend watches: all of Paths with
+// KeepNestedPaths set, and otherwise only the outermost.
+func (es *EventStream) watchedPaths() []string {
+	if es.conf().KeepNestedPaths {
+		return es.conf().Paths
+	}
+	groups := groupNested(es.conf().Paths, es.conf().Device)
+	if len(groups) == len(es.conf().Paths) {
+		return es.conf().Paths
+	}
+	watched := make([]string, len(groups))
+	for i, g := range groups {
+		watched[i] = g[0]
+	}
+	return watched
+}
+
+// newRootIndex returns the forms of paths, the innermost first, for
+// events to be attributed to.
+func newRootIndex(paths []string, device int32) []pathRoot {
+	var index []pathRoot
+	for _, path := range paths {
+		for _, form := range rootForms(path, device) {
+			index = append(index, pathRoot{anchor: form, root: path})
+		}
+	}
+	sort.SliceStable(index, func(i, j int) bool { return len(index[i].path) > len(index[j].path) })
+	return index
+}
+
+// attribute sets the Root and UserData of events.
+func (es *EventStream) attribute(events []Event) {
+	if len(es.rootIndex) == 0 && es.conf().UserData == nil {
+		return
+	}
+	for i := range events {
+		e := &events[i]
+		e.UserData = es.conf().UserData
+		if len(es.rootIndex) == 0 {
+			continue
+		}
+		e.Root = ""
+		for _, r := range es.rootIndex {
+			if r.covers(e.Path) {
+				e.Root = r.root
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroupNested(t *testing.T) {
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y, z := filepath.Join(tmp, "x"), filepath.Join(tmp, "x", "y"), filepath.Join(tmp, "z")
+	if err := os.MkdirAll(y, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(tmp, "link")
+	if err := os.Symlink(x, link); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		paths []string
+		want  [][]string
+	}{
+		{[]string{x, z}, [][]string{{x}, {z}}},
+		{[]string{y, x, z}, [][]string{{x, y}, {z}}},
+		{[]string{x, x + "/"}, [][]string{{x, x + "/"}}},
+		{[]string{filepath.Join(link, "y"), x}, [][]string{{x, filepath.Join(link, "y")}}},
+		{[]string{tmp + "/x0", x}, [][]string{{tmp + "/x0"}, {x}}},
+		{[]string{filepath.Join(y, "missing"), tmp}, [][]string{{tmp, filepath.Join(y, "missing")}}},
+	} {
+		if have := groupNested(tt.paths, 0); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("groupNested(%q) = %q, want %q", tt.paths, have, tt.want)
+		}
+	}
+	if have, want := groupNested([]string{"a/b", "a"}, 1), [][]string{{"a", "a/b"}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("groupNested relative to a device = %q, want %q", have, want)
+	}
+}
+
+// TestNestedPaths has a stream on a directory and one below it, then
+// writes below both.
+func TestNestedPaths(t *testing.T) {
+	tmp := t.TempDir()
+	x, y := filepath.Join(tmp, "x"), filepath.Join(tmp, "x", "y")
+	if err := os.MkdirAll(y, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keep := range []bool{false, true} {
+		es := New([]string{x, y + "/"}, WithBackend(Poll), WithPollInterval(time.Hour), WithKeepNestedPaths(keep), WithBufferSize(10))
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if len(es.watched) == 1 == keep {
+			t.Errorf("KeepNestedPaths %v: watching %q", keep, es.watched)
+		}
+		for _, path := range []string{filepath.Join(x, "a"), filepath.Join(y, "b")} {
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		es.Flush(true)
+		es.Stop()
+
+		roots := map[string][]string{}
+		for len(es.EventsChan()) > 0 {
+			for _, e := range <-es.EventsChan() {
+				if e.Flags&ItemIsFile != 0 {
+					roots[filepath.Base(e.Path)] = append(roots[filepath.Base(e.Path)], e.Root)
+				}
+			}
+		}
+		if want := map[string][]string{"a": {x}, "b": {y + "/"}}; !reflect.DeepEqual(roots, want) {
+			t.Errorf("KeepNestedPaths %v: got the files with roots %q, want %q", keep, roots, want)
+		}
+		for _, name := range []string{"a", "b"} {
+			os.Remove(filepath.Join(x, name))
+			os.Remove(filepath.Join(y, name))
+		}
+	}
+}
+
+func TestAttribute(t *testing.T) {
+	es := &EventStream{rootIndex: newRootIndex([]string{"/w/a/", "/w/a/b", "/w/c"}, 0)}
+	events := []Event{
+		{Path: "/w/a/f"},
+		{Path: "/w/a/b/f"},
+		{Path: "/w/a/bf"},
+		{Path: "/w/c"},
+		{Path: "/w/d", Root: "stale"},
+		{Path: ""},
+	}
+	es.attribute(events)
+	var have []string
+	for _, e := range events {
+		have = append(have, e.Root)
+	}
+	if want := []string{"/w/a/", "/w/a/b", "/w/a/", "/w/c", "", ""}; !reflect.DeepEqual(have, want) {
+		t.Errorf("roots %q, want %q", have, want)
+	}
+}
+
+func TestWatchPathsNested(t *testing.T) {
+	tmp := t.TempDir()
+	a, b, c, d := filepath.Join(tmp, "a"), filepath.Join(tmp, "b"), filepath.Join(tmp, "a", "c"), filepath.Join(tmp, "d")
+	for _, dir := range []string{b, c, d} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := WatchPaths([]string{a, b, c, d}, WithBackend(Poll), WithPollInterval(time.Hour), WithMaxPaths(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var shards [][]string
+	for _, es := range w.shards {
+		shards = append(shards, es.Paths)
+	}
+	if want := [][]string{{a, c, b}, {d}}; !reflect.DeepEqual(shards, want) {
+		t.Errorf("sharded into %q, want %q", shards, want)
+	}
+}
+
+// TestUserData merges the batches of two streams into one channel and
+// tells them apart by their UserData.
+func TestUserData(t *testing.T) {
+	type tenant struct{ name string }
+	a, b := &tenant{"a"}, &tenant{"b"}
+	merged := make(chan []Event, 4)
+	var streams []*EventStream
+	for _, data := range []*tenant{a, b} {
+		es := New([]string{"/w/" + data.name}, WithBackend(Manual), WithUserData(data))
+		es.Handler = func(batch []Event) { merged <- append([]Event(nil), batch...) }
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer es.Stop()
+		streams = append(streams, es)
+	}
+	for i, es := range streams {
+		if err := es.Inject([]Event{{Path: es.Paths[0] + "/f", ID: uint64(i + 1)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		e := (<-merged)[0]
+		if want := []*tenant{a, b}[e.ID-1]; e.UserData != want || e.Root != "/w/"+want.name {
+			t.Errorf("event %d from %v under %q, want %v", e.ID, e.UserData, e.Root, want)
+		}
+	}
+	if c, _ := streams[0].Clone(); c.UserData != a {
+		t.Errorf("Clone has UserData %v", c.UserData)
+	}
+}
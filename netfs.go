@@ -0,0 +1,167 @@
+package fsevents
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// NetworkFSError is sent on Errors by Start for each path on a network
+// file system, where FSEvents doesn't report changes made by other
+// machines.
+type NetworkFSError struct {
+	Path   string
+	FSType string // such as "smbfs" or "nfs"
+	Polled bool   // watched with Poll instead, as PollNetwork is set
+}
+
+func (e *NetworkFSError) Error() string {
+	msg := fmt.Sprintf("fsevents: %s is on a network file system (%s), where remote changes aren't reported", e.Path, e.FSType)
+	if e.Polled {
+		msg += "; polling it instead"
+	}
+	return msg
+}
+
+// networkFSTypes are the f_fstypename values of the network file systems
+// macOS mounts.
+var networkFSTypes = map[string]bool{
+	"afpfs":  true,
+	"ftp":    true,
+	"nfs":    true,
+	"smbfs":  true,
+	"webdav": true,
+}
+
+// fsTypeOf returns the type of the file system path is on. A seam for
+// the tests.
+var fsTypeOf = fsType
+
+// silentFSTypes are the f_fstypename values of the local file systems
+// whose changes FSEvents doesn't hear of, as they're made behind the
+// kernel's back: by a FUSE daemon, or by the host of a virtual machine.
+var silentFSTypes = map[string]bool{
+	"macfuse": true,
+	"osxfuse": true,
+	"prl_fs":  true,
+	"vboxsf":  true,
+	"vmhgfs":  true,
+}
+
+// FallbackError is sent on Errors for each path FallbackToPolling has
+// polled instead of watched with FSEvents, but for those on network file
+// systems, which have a NetworkFSError.
+type FallbackError struct {
+	Path   string
+	FSType string // the file system's, if it's one FSEvents stays silent on
+	Err    error  // the UnhealthyError, if a HealthCheck probe failed
+}
+
+func (e *FallbackError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("fsevents: polling %s from now on: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("fsevents: polling %s, as FSEvents doesn't report changes on %s file systems", e.Path, e.FSType)
+}
+
+func (e *FallbackError) Unwrap() error { return e.Err }
+
+// polls reports whether the stream polls some of its paths alongside
+// FSEvents, or may come to.
+func (es *EventStream) polls() bool {
+	return es.conf().PollNetwork || es.conf().FallbackToPolling
+}
+
+// startNative starts FSEvents on the stream's paths, polling those on a
+// network file system with PollNetwork, and with FallbackToPolling those
+// FSEvents stays silent on as well.
+func (es *EventStream) startNative(cbInfo uintptr) error {
+	if es.conf().Device != 0 {
+		return es.start(es.watched, cbInfo)
+	}
+	var local, polled []string
+	for _, path := range es.watched {
+		if isRoot(path, es.fallback) {
+			polled = append(polled, path)
+			continue
+		}
+		typ, err := fsTypeOf(path)
+		switch {
+		case err != nil:
+			local = append(local, path)
+		case networkFSTypes[typ]:
+			es.report(&NetworkFSError{Path: path, FSType: typ, Polled: es.polls()})
+			if es.polls() {
+				polled = append(polled, path)
+			} else {
+				local = append(local, path)
+			}
+		case silentFSTypes[typ] && es.conf().FallbackToPolling:
+			es.report(&FallbackError{Path: path, FSType: typ})
+			polled = append(polled, path)
+		default:
+			local = append(local, path)
+		}
+	}
+	if len(polled) == 0 {
+		return es.start(es.watched, cbInfo)
+	}
+	es.source = startPollPaths(es, polled, true)
+	if len(local) == 0 {
+		return nil
+	}
+	return es.start(local, cbInfo)
+}
+
+// fallBack has FallbackToPolling poll the watched path the probe file of
+// h is in from now on, as the probe failed with err, starting the backend
+// afresh without it. It reports whether it did: not if the probe file is
+// outside the watched paths, or in one polled already. Callers hold
+// lifecycle.
+func (es *EventStream) fallBack(h *healthCheck, err error) bool {
+	if !es.conf().FallbackToPolling || es.conf().Backend != Native || es.conf().Device != 0 {
+		return false
+	}
+	var root string
+	for _, path := range es.watched {
+		abs, aerr := filepath.Abs(path)
+		if aerr != nil || len(path) <= len(root) {
+			continue
+		}
+		// The probe file's directory has its symbolic links resolved
+		// in h.match, where the watched path may have them.
+		if underAny(h.path, []string{abs}) || underAny(h.match, []string{abs}) {
+			root = path
+		}
+	}
+	if root == "" || isRoot(root, es.fallback) {
+		return false
+	}
+	if s, ok := es.source.(*pollSource); ok && isRoot(root, s.paths) {
+		return false
+	}
+	es.fallback = append(es.fallback, root)
+	es.report(&FallbackError{Path: root, Err: err})
+
+	// No callback of the old stream may overlap the new one's.
+	es.stopWait = true
+	es.stop()
+	es.stopWait = false
+	if es.source != nil {
+		es.source.stop()
+		es.source = nil
+	}
+	// What FSEvents missed there is out of reach: have it scanned.
+	batch := newBatch(1)
+	batch[0] = Event{Path: root, Flags: MustScanSubDirs, Synthetic: true}
+	es.deliver(batch)
+
+	if atomic.LoadUint64(&es.EventID) != 0 {
+		es.Resume = true
+	}
+	if err := es.startBackend(es.registryID); err != nil && !es.restartLater(err) {
+		es.report(err)
+		es.stopLocked()
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package fsevents
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withFakeShare makes paths under share look like they're on an SMB mount.
+func withFakeShare(t *testing.T, share string) {
+	withFakeFSTypes(t, map[string]string{share: "smbfs"})
+}
+
+// withFakeFSTypes makes paths under each of mounts look like they're on a
+// file system of its type, and the others on APFS.
+func withFakeFSTypes(t *testing.T, mounts map[string]string) {
+	prev := fsTypeOf
+	fsTypeOf = func(path string) (string, error) {
+		for dir, typ := range mounts {
+			if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+				return typ, nil
+			}
+		}
+		return "apfs", nil
+	}
+	t.Cleanup(func() { fsTypeOf = prev })
+}
+
+func TestNetworkFSPolled(t *testing.T) {
+	share := t.TempDir()
+	withFakeShare(t, share)
+
+	es := &EventStream{
+		Paths:        []string{share},
+		Events:       make(chan []Event, 1),
+		Errors:       make(chan error, 1),
+		PollNetwork:  true,
+		PollInterval: time.Hour,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	var nerr *NetworkFSError
+	if err := <-es.ErrorsChan(); !errors.As(err, &nerr) || nerr.Path != share || nerr.FSType != "smbfs" || !nerr.Polled {
+		t.Errorf("Errors got %v, want a NetworkFSError for %s", err, share)
+	}
+
+	path := filepath.Join(share, "remote.txt")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+	select {
+	case batch := <-es.EventsChan():
+		want := Event{Path: path, Flags: ItemCreated | ItemIsFile, Root: share, Synthetic: true}
+		if len(batch) != 1 || batch[0] != want {
+			t.Errorf("got %v, want [%v]", batch, want)
+		}
+	default:
+		t.Fatal("the share wasn't polled")
+	}
+	if id := atomic.LoadUint64(&es.EventID); id != 0 {
+		t.Errorf("EventID = %d, want polled events not to move it", id)
+	}
+}
+
+func TestFallbackToPolling(t *testing.T) {
+	share, fuse := t.TempDir(), t.TempDir()
+	withFakeFSTypes(t, map[string]string{share: "smbfs", fuse: "macfuse"})
+
+	es := &EventStream{
+		Paths:             []string{share, fuse},
+		Events:            make(chan []Event, 1),
+		Errors:            make(chan error, 2),
+		FallbackToPolling: true,
+		PollInterval:      time.Hour,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	var nerr *NetworkFSError
+	if err := <-es.ErrorsChan(); !errors.As(err, &nerr) || nerr.Path != share || !nerr.Polled {
+		t.Errorf("Errors got %v, want a polled NetworkFSError for %s", err, share)
+	}
+	var ferr *FallbackError
+	if err := <-es.ErrorsChan(); !errors.As(err, &ferr) || ferr.Path != fuse || ferr.FSType != "macfuse" || ferr.Err != nil {
+		t.Errorf("Errors got %v, want a FallbackError for %s", err, fuse)
+	}
+
+	path := filepath.Join(fuse, "f")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+	select {
+	case batch := <-es.EventsChan():
+		want := Event{Path: path, Flags: ItemCreated | ItemIsFile, Root: fuse, Synthetic: true}
+		if len(batch) != 1 || batch[0] != want {
+			t.Errorf("got %v, want [%v]", batch, want)
+		}
+	default:
+		t.Fatal("the FUSE mount wasn't polled")
+	}
+}
+
+func TestNetworkFSWarning(t *testing.T) {
+	share := t.TempDir()
+	withFakeShare(t, share)
+
+	es := &EventStream{Paths: []string{share, t.TempDir()}, Errors: make(chan error, 2), Handler: func([]Event) {}}
+	err := es.Start()
+	if runtime.GOOS != "darwin" && !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Fatalf("Start() = %v, want ErrUnsupportedPlatform", err)
+	}
+	es.Stop()
+	var nerr *NetworkFSError
+	if err := <-es.ErrorsChan(); !errors.As(err, &nerr) || nerr.Path != share || nerr.Polled {
+		t.Errorf("Errors got %v, want an unpolled NetworkFSError for %s", err, share)
+	}
+	if len(es.ErrorsChan()) != 0 {
+		t.Errorf("local path reported: %v", <-es.ErrorsChan())
+	}
+
+	// Polling the share alongside FSEvents doesn't outlive a failed start.
+	es.PollNetwork = true
+	if err := es.Start(); err != nil {
+		if es.source != nil {
+			t.Error("poll source left running after a failed Start")
+		}
+		return
+	}
+	es.Stop()
+}
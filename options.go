@@ -0,0 +1,221 @@
+package fsevents
+
+import "time"
+
+// Option configures an EventStream created with New.
+type Option func(*EventStream)
+
+// New returns an unstarted EventStream watching paths, configured by opts.
+// It's equivalent to filling in the EventStream fields directly.
+func New(paths []string, opts ...Option) *EventStream {
+	es := &EventStream{Paths: paths}
+	for _, opt := range opts {
+		opt(es)
+	}
+	return es
+}
+
+// NewStream is New returning the stream as a Stream, for code that only
+// consumes it and may be handed a fake instead.
+func NewStream(paths []string, opts ...Option) Stream {
+	return New(paths, opts...)
+}
+
+// WithFlags sets EventStream.Flags.
+func WithFlags(flags CreateFlags) Option {
+	return func(es *EventStream) { es.Flags = flags }
+}
+
+// WithLatency sets EventStream.Latency.
+func WithLatency(d time.Duration) Option {
+	return func(es *EventStream) { es.Latency = d }
+}
+
+// WithDevice sets EventStream.Device.
+func WithDevice(dev int32) Option {
+	return func(es *EventStream) { es.Device = dev }
+}
+
+// WithBufferSize sets EventStream.BufferSize.
+func WithBufferSize(n int) Option {
+	return func(es *EventStream) { es.BufferSize = n }
+}
+
+// WithOverflow sets EventStream.Overflow.
+func WithOverflow(p OverflowPolicy) Option {
+	return func(es *EventStream) { es.Overflow = p }
+}
+
+// WithFilter sets EventStream.Filter.
+func WithFilter(f func(*Event) bool) Option {
+	return func(es *EventStream) { es.Filter = f }
+}
+
+// WorkerCount sets EventStream.Workers.
+func WorkerCount(n int) Option {
+	return func(es *EventStream) { es.Workers = n }
+}
+
+// WithBackend sets EventStream.Backend.
+func WithBackend(b Backend) Option {
+	return func(es *EventStream) { es.Backend = b }
+}
+
+// WithPollInterval sets EventStream.PollInterval.
+func WithPollInterval(d time.Duration) Option {
+	return func(es *EventStream) { es.PollInterval = d }
+}
+
+// WithExclusionPaths sets EventStream.ExclusionPaths.
+func WithExclusionPaths(paths ...string) Option {
+	return func(es *EventStream) { es.ExclusionPaths = paths }
+}
+
+// WithExclusionPatterns sets EventStream.ExclusionPatterns.
+func WithExclusionPatterns(patterns ...string) Option {
+	return func(es *EventStream) { es.ExclusionPatterns = patterns }
+}
+
+// WithKind sets EventStream.Kind.
+func WithKind(k Kind) Option {
+	return func(es *EventStream) { es.Kind = k }
+}
+
+// WithChanges sets EventStream.Changes.
+func WithChanges(c Changes) Option {
+	return func(es *EventStream) { es.Changes = c }
+}
+
+// WithIgnoreMetadataOnly sets EventStream.IgnoreMetadataOnly.
+func WithIgnoreMetadataOnly(ignore bool) Option {
+	return func(es *EventStream) { es.IgnoreMetadataOnly = ignore }
+}
+
+// WithDeliveryMode sets EventStream.DeliveryMode.
+func WithDeliveryMode(m DeliveryMode) Option {
+	return func(es *EventStream) { es.DeliveryMode = m }
+}
+
+// WithPaths sets EventStream.Paths.
+func WithPaths(paths ...string) Option {
+	return func(es *EventStream) { es.Paths = paths }
+}
+
+// WithKeepNestedPaths sets EventStream.KeepNestedPaths.
+func WithKeepNestedPaths(keep bool) Option {
+	return func(es *EventStream) { es.KeepNestedPaths = keep }
+}
+
+// WithRawPaths sets EventStream.RawPaths.
+func WithRawPaths(raw bool) Option {
+	return func(es *EventStream) { es.RawPaths = raw }
+}
+
+// WithUserData sets EventStream.UserData.
+func WithUserData(data interface{}) Option {
+	return func(es *EventStream) { es.UserData = data }
+}
+
+// WithSymlinks sets EventStream.Symlinks.
+func WithSymlinks(m SymlinkMode) Option {
+	return func(es *EventStream) { es.Symlinks = m }
+}
+
+// WithMaxPaths sets EventStream.MaxPaths.
+func WithMaxPaths(n int) Option {
+	return func(es *EventStream) { es.MaxPaths = n }
+}
+
+// WithSharedQueue sets EventStream.SharedQueue. Passed to WatchAllVolumes
+// or WatchPaths, it has all the Watcher's streams share q.
+func WithSharedQueue(q *SharedQueue) Option {
+	return func(es *EventStream) { es.SharedQueue = q }
+}
+
+// Clone returns an unstarted EventStream with es's configuration, changed
+// by overrides, for example another stream on different Paths. Only the
+// configuration is copied, as of the call, so es may be running: not
+// Events, BatchesMeta, Errors or RootChanges, which the clone needs of its
+// own, nor EventID, UUID and Resume, nor a Rescanner, whose snapshot is of
+// es's roots. Clone fails if the result couldn't be started, as Start would.
+func (es *EventStream) Clone(overrides ...Option) (*EventStream, error) {
+	c := &EventStream{
+		Handler:            es.Handler,
+		DeliveryMode:       es.DeliveryMode,
+		RawHandler:         es.RawHandler,
+		Paths:              append([]string(nil), es.Paths...),
+		KeepNestedPaths:    es.KeepNestedPaths,
+		RawPaths:           es.RawPaths,
+		Symlinks:           es.Symlinks,
+		UserData:           es.UserData,
+		MaxPaths:           es.MaxPaths,
+		Flags:              es.Flags,
+		Latency:            es.Latency,
+		Device:             es.Device,
+		MaxBatchDelay:      es.MaxBatchDelay,
+		DeliveryInterval:   es.DeliveryInterval,
+		MaxBatchSize:       es.MaxBatchSize,
+		SortBatches:        es.SortBatches,
+		ReorderWindow:      es.ReorderWindow,
+		TransientWindow:    es.TransientWindow,
+		MaxDeliveredBatch:  es.MaxDeliveredBatch,
+		InternPaths:        es.InternPaths,
+		Filter:             es.Filter,
+		ExclusionPaths:     append([]string(nil), es.ExclusionPaths...),
+		ExclusionPatterns:  append([]string(nil), es.ExclusionPatterns...),
+		Kind:               es.Kind,
+		Changes:            es.Changes,
+		IgnoreMetadataOnly: es.IgnoreMetadataOnly,
+		RateLimit:          es.RateLimit,
+		OnGap:              es.OnGap,
+		AutoFlushOnDrop:    es.AutoFlushOnDrop,
+		StatRenames:        es.StatRenames,
+		Enrich:             es.Enrich,
+		Workers:            es.Workers,
+		BufferSize:         es.BufferSize,
+		Overflow:           es.Overflow,
+		DispatchQueue:      es.DispatchQueue,
+		SharedQueue:        es.SharedQueue,
+		QoS:                es.QoS,
+		Backend:            es.Backend,
+		PollInterval:       es.PollInterval,
+		PollNetwork:        es.PollNetwork,
+		FallbackToPolling:  es.FallbackToPolling,
+		WaitForRoot:        es.WaitForRoot,
+		runLoop:            es.runLoop,
+		runLoopMode:        es.runLoopMode,
+	}
+	if es.AutoRestart != nil {
+		p := *es.AutoRestart
+		c.AutoRestart = &p
+	}
+	if es.AtomicSaves != nil {
+		a := *es.AtomicSaves
+		if a.TempNames != nil {
+			a.TempNames = append([]TempName{}, a.TempNames...)
+		}
+		c.AtomicSaves = &a
+	}
+	for _, opt := range overrides {
+		opt(c)
+	}
+	if err := c.checkPaths(c.watchedPaths()); err != nil {
+		return nil, err
+	}
+	if err := c.checkKind(); err != nil {
+		return nil, err
+	}
+	if err := c.checkDelivery(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRawPaths(); err != nil {
+		return nil, err
+	}
+	if err := c.checkSymlinks(); err != nil {
+		return nil, err
+	}
+	if err := c.checkPatterns(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
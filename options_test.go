@@ -0,0 +1,99 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewStream(t *testing.T) {
+	s := NewStream([]string{"/d"}, WithLatency(time.Second), WithBackend(Manual))
+	es, ok := s.(*EventStream)
+	if !ok || !reflect.DeepEqual(es.Paths, []string{"/d"}) || es.Latency != time.Second || es.Backend != Manual {
+		t.Fatalf("NewStream() = %#v, want an EventStream configured by the options", s)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	go es.Inject([]Event{{Path: "/d/a", ID: 1}})
+	if batch := <-s.EventsChan(); len(batch) != 1 || batch[0].Path != "/d/a" {
+		t.Errorf("got %v, want the injected event", batch)
+	}
+}
+
+func TestClone(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	es := New([]string{a},
+		WithBackend(Poll),
+		WithPollInterval(time.Hour),
+		WithLatency(time.Second),
+		WithBufferSize(3),
+		WithExclusionPaths(filepath.Join(a, "skip")),
+		WithFilter(func(e *Event) bool { return filepath.Base(e.Path) != "ignored" }),
+	)
+	es.AutoRestart = &RestartPolicy{MaxAttempts: 2}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	c, err := es.Clone(WithPaths(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Paths, []string{b}) || c.Latency != time.Second || c.BufferSize != 3 || c.Backend != Poll || c.Filter == nil {
+		t.Errorf("clone configured as %+v", c)
+	}
+	if c.Events != nil || c.Stats().Running || c.AutoRestart == es.AutoRestart || *c.AutoRestart != *es.AutoRestart {
+		t.Error("clone shares the original's state")
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{a, b} {
+		for _, name := range []string{"f", "ignored"} {
+			if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, s := range []struct {
+		es  *EventStream
+		dir string
+	}{{es, a}, {c, b}} {
+		s.es.Flush(true)
+		if have := <-s.es.Events; len(have) != 1 || have[0].Path != filepath.Join(s.dir, "f") {
+			t.Errorf("stream on %s got %v", s.dir, have)
+		}
+	}
+
+	// Stopping the clone leaves the original running.
+	c.Stop()
+	if err := os.WriteFile(filepath.Join(a, "g"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+	if have := <-es.EventsChan(); len(have) != 1 || have[0].Path != filepath.Join(a, "g") {
+		t.Errorf("original got %v after the clone stopped", have)
+	}
+	if !es.Stats().Running || c.Stats().Running {
+		t.Error("Stop on the clone stopped the original")
+	}
+
+	// Nor does it share BatchesMeta.
+	m := New([]string{a}, func(es *EventStream) { es.BatchesMeta = make(chan Batch, 1) })
+	if c, err := m.Clone(); err != nil || c.BatchesMeta != nil {
+		t.Errorf("clone of a BatchesMeta stream: %v, BatchesMeta %v, want none", err, c.BatchesMeta)
+	}
+}
+
+func TestCloneInvalid(t *testing.T) {
+	es := New(nil, WithDeliveryMode(DispatchThread))
+	if _, err := es.Clone(func(es *EventStream) { es.RateLimit = 10 }); err != errDispatchThread {
+		t.Errorf("Clone() = %v, want errDispatchThread", err)
+	}
+}
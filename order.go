@@ -0,0 +1,51 @@
+package fsevents
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// idOrder sorts the events of a batch that have an ID by it, stably,
+// leaving those without one where they are.
+type idOrder struct {
+	events []Event
+	at     []int // indexes in events of those with an ID
+}
+
+func (o idOrder) Len() int           { return len(o.at) }
+func (o idOrder) Less(i, j int) bool { return o.events[o.at[i]].ID < o.events[o.at[j]].ID }
+func (o idOrder) Swap(i, j int) {
+	o.events[o.at[i]], o.events[o.at[j]] = o.events[o.at[j]], o.events[o.at[i]]
+}
+
+// order sorts events by ID for SortBatches and raises the IDs below the
+// highest delivered since Start to it. es.orderMu must be held until the
+// batch is handed over, so that no other gets in between.
+func (es *EventStream) order(events []Event) {
+	var o idOrder
+	sorted := true
+	var prev uint64
+	for i := range events {
+		if id := events[i].ID; id != 0 {
+			sorted = sorted && id >= prev
+			prev = id
+			o.at = append(o.at, i)
+		}
+	}
+	if !sorted {
+		o.events = events
+		sort.Stable(o)
+	}
+	late := 0
+	for _, i := range o.at {
+		e := &events[i]
+		if e.ID < es.orderMax {
+			e.ID = es.orderMax
+			late++
+		}
+		es.orderMax = e.ID
+	}
+	if late > 0 {
+		atomic.AddUint64(&es.stats.LateEvents, uint64(late))
+	}
+}
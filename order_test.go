@@ -0,0 +1,95 @@
+package fsevents
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSortBatches(t *testing.T) {
+	es := &EventStream{Backend: Manual, SortBatches: true, BufferSize: 2}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	if err := es.Inject([]Event{{Path: "/e", ID: 5}, {Path: "/c", ID: 3}, {Path: "/made-up"}, {Path: "/d", ID: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Inject([]Event{{Path: "/b", ID: 2}, {Path: "/f", ID: 6}}); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]Event{
+		{{Path: "/c", ID: 3}, {Path: "/d", ID: 4}, {Path: "/made-up"}, {Path: "/e", ID: 5}},
+		{{Path: "/b", ID: 5}, {Path: "/f", ID: 6}},
+	}
+	for i, w := range want {
+		if have := <-es.EventsChan(); !reflect.DeepEqual(have, w) {
+			t.Errorf("batch %d: got %v, want %v", i, have, w)
+		}
+	}
+	if n := es.Stats().LateEvents; n != 1 {
+		t.Errorf("LateEvents = %d, want 1", n)
+	}
+
+	// Start begins afresh.
+	es.Stop()
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Inject([]Event{{Path: "/a", ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if have := <-es.EventsChan(); have[0].ID != 1 {
+		t.Errorf("after Start, got %v", have)
+	}
+}
+
+// TestReorderWindow injects shuffled IDs in batches within the window
+// and expects them all back in order, none of them late.
+func TestReorderWindow(t *testing.T) {
+	es := &EventStream{Backend: Manual, SortBatches: true, ReorderWindow: time.Hour, BufferSize: 10}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	ids := rand.New(rand.NewSource(1)).Perm(1000)
+	for len(ids) > 0 {
+		n := 50
+		batch := make([]Event, n)
+		for i := range batch {
+			batch[i] = Event{Path: "/f", ID: uint64(ids[i] + 1)}
+		}
+		ids = ids[n:]
+		if err := es.Inject(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	es.Flush(true)
+
+	have := <-es.EventsChan()
+	if len(have) != 1000 {
+		t.Fatalf("got %d events, want 1000", len(have))
+	}
+	for i, e := range have {
+		if e.ID != uint64(i+1) {
+			t.Fatalf("event %d has ID %d", i, e.ID)
+		}
+	}
+	if n := es.Stats().LateEvents; n != 0 {
+		t.Errorf("LateEvents = %d, want 0", n)
+	}
+
+	es.Stop()
+	es.SortBatches = false
+	es.DeliveryMode = DispatchThread
+	if err := es.checkDelivery(); err != nil {
+		t.Errorf("ReorderWindow without SortBatches rules out DispatchThread: %v", err)
+	}
+	es.SortBatches = true
+	if err := es.checkDelivery(); err != errDispatchThread {
+		t.Errorf("checkDelivery() = %v, want errDispatchThread", err)
+	}
+}
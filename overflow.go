@@ -0,0 +1,425 @@
+package fsevents
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a batch when the Events channel
+// is full.
+type OverflowPolicy struct {
+	kind    overflowKind
+	dir     string // for Spill
+	maxSize int64
+	timeout time.Duration // for BlockWithTimeout
+}
+
+type overflowKind int
+
+const (
+	overflowBlock overflowKind = iota
+	overflowDropNewest
+	overflowDropOldest
+	overflowSpill
+	overflowBlockTimeout
+)
+
+var (
+	// Block waits for the consumer, holding up further callbacks. This
+	// is the default.
+	Block = OverflowPolicy{kind: overflowBlock}
+
+	// DropNewest discards the batch that doesn't fit.
+	DropNewest = OverflowPolicy{kind: overflowDropNewest}
+
+	// DropOldest discards the oldest buffered batch to make room.
+	DropOldest = OverflowPolicy{kind: overflowDropOldest}
+)
+
+// BlockWithTimeout waits up to d for the consumer, as Block does, and
+// then discards the batch, counting it in Stats as timed out as well as
+// dropped, and sending a SendTimeoutError on Errors if it's set. The wait
+// is on a goroutine of the stream's, not the dispatch thread; the
+// callbacks hand it each batch in turn.
+func BlockWithTimeout(d time.Duration) OverflowPolicy {
+	return OverflowPolicy{kind: overflowBlockTimeout, timeout: d}
+}
+
+// SendTimeoutError is sent on Errors when BlockWithTimeout discards a
+// batch of Events events that waited Timeout for the consumer.
+type SendTimeoutError struct {
+	Events  int
+	Timeout time.Duration
+}
+
+func (e *SendTimeoutError) Error() string {
+	return fmt.Sprintf("fsevents: dropped %d events after waiting %v for the consumer", e.Events, e.Timeout)
+}
+
+func (p OverflowPolicy) String() string {
+	switch p.kind {
+	case overflowDropNewest:
+		return "DropNewest"
+	case overflowDropOldest:
+		return "DropOldest"
+	case overflowSpill:
+		return fmt.Sprintf("Spill(%q, %d)", p.dir, p.maxSize)
+	case overflowBlockTimeout:
+		return fmt.Sprintf("BlockWithTimeout(%v)", p.timeout)
+	default:
+		return "Block"
+	}
+}
+
+// Stats holds a stream's delivery counters. They accumulate over the
+// lifetime of the EventStream, across Stop and Restart.
+//
+// Every event received from FSEvents is eventually delivered, filtered
+// out or dropped, so once the stream is stopped and flushed
+// ReceivedEvents == DeliveredEvents + FilteredEvents + DroppedEvents +
+// RateLimitedEvents, leaving aside the batches of a Spill policy that are
+// on disk.
+type Stats struct {
+	// ReceivedEvents and ReceivedBatches count what FSEvents reported.
+	ReceivedEvents  uint64
+	ReceivedBatches uint64
+
+	// DeliveredEvents and DeliveredBatches count what reached the
+	// Handler or is on, or was taken from, the Events channel.
+	DeliveredEvents  uint64
+	DeliveredBatches uint64
+
+	// FilteredEvents counts events rejected by Filter, left out by
+	// ExclusionPaths, Kind, AtomicSaves or TransientWindow, or merged by
+	// DirsOnly.
+	FilteredEvents uint64
+
+	// DroppedEvents and DroppedBatches count what the OverflowPolicy
+	// discarded.
+	DroppedEvents  uint64
+	DroppedBatches uint64
+
+	// TimedOutEvents and TimedOutBatches count those of the dropped that
+	// BlockWithTimeout discarded once the timeout ran out.
+	TimedOutEvents  uint64
+	TimedOutBatches uint64
+
+	// RateLimitedEvents counts events RateLimit merged into another
+	// event on the same path.
+	RateLimitedEvents uint64
+
+	// LateEvents counts events SortBatches delivered with their ID
+	// raised to one already delivered.
+	LateEvents uint64
+
+	// SpilledEvents and SpilledBatches count what a Spill policy wrote
+	// to disk, and RestoredEvents and RestoredBatches what it sent on
+	// Events from there, including batches left by an earlier stream.
+	// Restored batches also count as delivered.
+	SpilledEvents   uint64
+	SpilledBatches  uint64
+	RestoredEvents  uint64
+	RestoredBatches uint64
+
+	// RestartAttempts counts AutoRestart's retries of the backend, and
+	// Restarts those that succeeded.
+	RestartAttempts uint64
+	Restarts        uint64
+
+	// QueuedBatches and QueueCapacity describe the Events channel, or
+	// BatchesMeta, at the time of the call.
+	QueuedBatches int
+	QueueCapacity int
+
+	// QueueLatency is how long the batches ReceiveBatch returned waited
+	// on BatchesMeta, since ResetQueueLatency if it was called.
+	QueueLatency LatencyStats
+
+	// OutstandingBatches counts batches sent on Events that haven't been
+	// passed to Recycle yet. It's only meaningful for consumers that
+	// recycle their batches.
+	OutstandingBatches int64
+
+	// PendingEvents counts events held back by MaxBatchDelay,
+	// DeliveryInterval, ReorderWindow, TransientWindow or RateLimit.
+	PendingEvents int64
+
+	// Running reports whether the stream has been started and not yet
+	// stopped.
+	Running bool
+
+	// Suspended reports whether the stream is suspended by Suspend.
+	Suspended bool
+
+	// Restart is where an AutoRestart stream is in getting its backend
+	// back.
+	Restart RestartState
+}
+
+// Stats returns a snapshot of the stream's counters. It's safe to call
+// at any time.
+func (es *EventStream) Stats() Stats {
+	queued, capacity := len(es.Events), cap(es.Events)
+	if metas := es.BatchesMeta; metas != nil {
+		queued, capacity = len(metas), cap(metas)
+	}
+	return Stats{
+		ReceivedEvents:    atomic.LoadUint64(&es.stats.ReceivedEvents),
+		ReceivedBatches:   atomic.LoadUint64(&es.stats.ReceivedBatches),
+		DeliveredEvents:   atomic.LoadUint64(&es.stats.DeliveredEvents),
+		DeliveredBatches:  atomic.LoadUint64(&es.stats.DeliveredBatches),
+		FilteredEvents:    atomic.LoadUint64(&es.stats.FilteredEvents),
+		DroppedEvents:     atomic.LoadUint64(&es.stats.DroppedEvents),
+		DroppedBatches:    atomic.LoadUint64(&es.stats.DroppedBatches),
+		TimedOutEvents:    atomic.LoadUint64(&es.stats.TimedOutEvents),
+		TimedOutBatches:   atomic.LoadUint64(&es.stats.TimedOutBatches),
+		RateLimitedEvents: atomic.LoadUint64(&es.stats.RateLimitedEvents),
+		LateEvents:        atomic.LoadUint64(&es.stats.LateEvents),
+		SpilledEvents:     atomic.LoadUint64(&es.stats.SpilledEvents),
+		SpilledBatches:    atomic.LoadUint64(&es.stats.SpilledBatches),
+		RestoredEvents:    atomic.LoadUint64(&es.stats.RestoredEvents),
+		RestoredBatches:   atomic.LoadUint64(&es.stats.RestoredBatches),
+		RestartAttempts:   atomic.LoadUint64(&es.stats.RestartAttempts),
+		Restarts:          atomic.LoadUint64(&es.stats.Restarts),
+
+		QueuedBatches:      queued,
+		QueueCapacity:      capacity,
+		OutstandingBatches: atomic.LoadInt64(&es.outstanding),
+		QueueLatency:       es.latency.snapshot(),
+		PendingEvents:      atomic.LoadInt64(&es.pending),
+		Running:            atomic.LoadInt32(&es.running) != 0,
+		Suspended:          atomic.LoadInt32(&es.suspended) != 0,
+		Restart:            RestartState(atomic.LoadInt32(&es.restartState)),
+	}
+}
+
+// Debug renders the stream's configuration, counters and gauges together
+// with FSEvents' own description of the stream, for troubleshooting.
+func (es *EventStream) Debug() string {
+	st, c := es.Stats(), es.conf()
+	s := fmt.Sprintf("fsevents.EventStream paths=%q device=%d flags=%#x latency=%s overflow=%s\n"+
+		"  received=%d/%d delivered=%d/%d dropped=%d/%d (events/batches) filtered=%d\n"+
+		"  queued=%d/%d outstanding=%d pending=%d",
+		c.Paths, c.Device, uint32(c.Flags), c.Latency, c.Overflow,
+		st.ReceivedEvents, st.ReceivedBatches, st.DeliveredEvents, st.DeliveredBatches,
+		st.DroppedEvents, st.DroppedBatches, st.FilteredEvents,
+		st.QueuedBatches, st.QueueCapacity, st.OutstandingBatches, st.PendingEvents)
+	if es.stream != 0 {
+		s += "\n" + getStreamRefDescription(es.stream)
+	}
+	return s
+}
+
+// streamState is where a stream is in its life, for String.
+type streamState int32
+
+const (
+	stateIdle    streamState = iota // never started
+	stateRunning                    // started and not stopped since
+	stateStopped                    // stopped by Stop, Restart or the like
+	stateFailed                     // failed to start, or stopped itself
+)
+
+func (s streamState) String() string {
+	switch s {
+	case stateIdle:
+		return "idle"
+	case stateRunning:
+		return "running"
+	case stateStopped:
+		return "stopped"
+	case stateFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("streamState(%d)", int32(s))
+}
+
+// String summarizes the stream in one line, for logs and error messages:
+// where it is in its life, idle until first started, then running,
+// suspended, stopped, or failed, if it didn't start or stopped itself;
+// how many paths it watches, on which device, with which latency and
+// backend; and its last event ID. Like DebugDump, it's safe to call at
+// any time from any goroutine, and as it doesn't ask FSEvents, it works
+// however broken the stream is.
+func (es *EventStream) String() string {
+	if es == nil {
+		return "fsevents.EventStream(nil)"
+	}
+	c := es.conf()
+	state := streamState(atomic.LoadInt32(&es.state)).String()
+	switch {
+	case atomic.LoadInt32(&es.poisoned) != 0:
+		state = stateFailed.String()
+	case state == "running" && atomic.LoadInt32(&es.suspended) != 0:
+		state = "suspended"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "fsevents.EventStream{state=%s paths=%d dev=%d latency=%v", state, len(c.Paths), c.Device, es.EffectiveLatency())
+	if c.Backend != Native {
+		fmt.Fprintf(&b, " backend=%v", c.Backend)
+	}
+	if r := RestartState(atomic.LoadInt32(&es.restartState)); r != RestartIdle {
+		fmt.Fprintf(&b, " restart=%v", r)
+	}
+	fmt.Fprintf(&b, " lastID=%d}", atomic.LoadUint64(&es.EventID))
+	return b.String()
+}
+
+// DebugDump renders everything Debug does and more, for a report of a
+// stream that gets no events: whether it's running or suspended, its
+// paths as given, those it watches and those FSEvents says it watches,
+// its device and UUID, backend, flags and effective latency, registry
+// handle, every counter in Stats, the depth of Events and Errors, and
+// FSEvents' own description. It's safe in any state of the stream, from
+// any goroutine, including its Handler, as it doesn't wait for Start or
+// Stop; the copies it gets from FSEvents are released.
+func (es *EventStream) DebugDump() string {
+	st, c := es.Stats(), es.conf()
+	state := "stopped"
+	switch {
+	case st.Suspended:
+		state = "suspended"
+	case st.Running:
+		state = "running"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "fsevents.EventStream %s, restart %v\n", state, st.Restart)
+	fmt.Fprintf(&b, "  paths: %q\n", c.Paths)
+
+	es.dumpMu.Lock()
+	fmt.Fprintf(&b, "  watched: %q\n", es.watched)
+	fmt.Fprintf(&b, "  device: %d, uuid: %q\n", c.Device, es.UUID)
+	fmt.Fprintf(&b, "  backend: %v, flags: %#x, latency: %v (Latency %v)\n", c.Backend, uint32(c.Flags), es.EffectiveLatency(), c.Latency)
+	fmt.Fprintf(&b, "  registry: %d, stream: %#x\n", es.registryID, uintptr(es.stream))
+	var desc string
+	if es.stream != 0 {
+		fmt.Fprintf(&b, "  FSEvents paths: %q, device: %d\n", getStreamRefPaths(es.stream), getStreamRefDeviceID(es.stream))
+		desc = getStreamRefDescription(es.stream)
+	}
+	es.dumpMu.Unlock()
+
+	fmt.Fprintf(&b, "  events: %d/%d queued, %d outstanding, %d pending; errors: %d/%d queued\n",
+		st.QueuedBatches, st.QueueCapacity, st.OutstandingBatches, st.PendingEvents, len(es.Errors), cap(es.Errors))
+	fmt.Fprintf(&b, "  received: %d/%d, delivered: %d/%d, dropped: %d/%d (events/batches)\n",
+		st.ReceivedEvents, st.ReceivedBatches, st.DeliveredEvents, st.DeliveredBatches, st.DroppedEvents, st.DroppedBatches)
+	fmt.Fprintf(&b, "  timed out: %d/%d, filtered: %d, rate limited: %d, late: %d\n",
+		st.TimedOutEvents, st.TimedOutBatches, st.FilteredEvents, st.RateLimitedEvents, st.LateEvents)
+	fmt.Fprintf(&b, "  spilled: %d/%d, restored: %d/%d, restarts: %d of %d attempts",
+		st.SpilledEvents, st.SpilledBatches, st.RestoredEvents, st.RestoredBatches, st.Restarts, st.RestartAttempts)
+	if desc != "" {
+		b.WriteString("\n" + desc)
+	}
+	return b.String()
+}
+
+func (es *EventStream) countReceived(n int) {
+	atomic.AddUint64(&es.stats.ReceivedEvents, uint64(n))
+	atomic.AddUint64(&es.stats.ReceivedBatches, 1)
+}
+
+func (es *EventStream) countDelivered(n int) {
+	atomic.AddUint64(&es.stats.DeliveredEvents, uint64(n))
+	atomic.AddUint64(&es.stats.DeliveredBatches, 1)
+}
+
+func (es *EventStream) countDropped(n int) {
+	atomic.AddUint64(&es.stats.DroppedEvents, uint64(n))
+	atomic.AddUint64(&es.stats.DroppedBatches, 1)
+}
+
+func (es *EventStream) countTimedOut(n int) {
+	es.countDropped(n)
+	atomic.AddUint64(&es.stats.TimedOutEvents, uint64(n))
+	atomic.AddUint64(&es.stats.TimedOutBatches, 1)
+}
+
+// countSent counts a batch put on the Events channel.
+func (es *EventStream) countSent(n int) {
+	es.countDelivered(n)
+	atomic.AddInt64(&es.outstanding, 1)
+}
+
+// send puts a batch on es.Events, or as b on es.BatchesMeta, according to
+// es.Overflow. Of the two channels, that not in use is nil, so that it's
+// never chosen.
+func (es *EventStream) send(b Batch) {
+	events, out, metas := b.Events, es.Events, es.BatchesMeta
+	if metas != nil {
+		out = nil
+		b.EnqueuedAt = time.Now()
+	}
+	switch es.conf().Overflow.kind {
+	case overflowDropNewest:
+		select {
+		case out <- events:
+			es.countSent(len(events))
+		case metas <- b:
+			es.countSent(len(events))
+		default:
+			es.countDropped(len(events))
+			recycle(events)
+		}
+	case overflowDropOldest:
+		for {
+			select {
+			case out <- events:
+				es.countSent(len(events))
+				return
+			case metas <- b:
+				es.countSent(len(events))
+				return
+			default:
+			}
+			var old []Event
+			select {
+			case old = <-out:
+			case ob := <-metas:
+				old = ob.Events
+			default:
+				continue
+			}
+			// It was counted as delivered when it was sent.
+			atomic.AddUint64(&es.stats.DeliveredEvents, ^uint64(len(old)-1))
+			atomic.AddUint64(&es.stats.DeliveredBatches, ^uint64(0))
+			atomic.AddInt64(&es.outstanding, -1)
+			es.countDropped(len(old))
+			recycle(old)
+		}
+	case overflowBlockTimeout:
+		select {
+		case out <- events:
+			es.countSent(len(events))
+			return
+		case metas <- b:
+			es.countSent(len(events))
+			return
+		default:
+		}
+		t := time.NewTimer(es.conf().Overflow.timeout)
+		defer t.Stop()
+		select {
+		case out <- events:
+			es.countSent(len(events))
+		case metas <- b:
+			es.countSent(len(events))
+		case <-t.C:
+			es.countTimedOut(len(events))
+			es.report(&SendTimeoutError{Events: len(events), Timeout: es.conf().Overflow.timeout})
+			recycle(events)
+		}
+	case overflowSpill:
+		if es.spill != nil {
+			es.spill.send(events)
+			return
+		}
+		fallthrough
+	default:
+		select {
+		case out <- events:
+		case metas <- b:
+		}
+		es.countSent(len(events))
+	}
+}
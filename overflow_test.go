@@ -0,0 +1,163 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverflowPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy   OverflowPolicy
+		wantIDs  []uint64 // first event ID of each buffered batch
+		wantDrop uint64
+	}{
+		{DropNewest, []uint64{1, 2}, 3},
+		{DropOldest, []uint64{4, 5}, 3},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			es := &EventStream{Events: make(chan []Event, 2), Overflow: tc.policy}
+			for id := uint64(1); id <= 5; id++ {
+				inject(t, es, Event{ID: id})
+			}
+
+			close(es.Events)
+			var ids []uint64
+			for batch := range es.EventsChan() {
+				ids = append(ids, batch[0].ID)
+			}
+			if len(ids) != len(tc.wantIDs) || ids[0] != tc.wantIDs[0] || ids[1] != tc.wantIDs[1] {
+				t.Errorf("buffered batches start at IDs %v, want %v", ids, tc.wantIDs)
+			}
+
+			st := es.Stats()
+			if st.ReceivedEvents != 5 || st.DeliveredEvents != 2 || st.DroppedEvents != tc.wantDrop {
+				t.Errorf("stats = %+v", st)
+			}
+			if st.DroppedBatches != tc.wantDrop || st.DeliveredBatches != 2 || st.ReceivedBatches != 5 {
+				t.Errorf("batch stats = %+v", st)
+			}
+		})
+	}
+}
+
+func TestOverflowHandlerCounts(t *testing.T) {
+	es := &EventStream{Handler: func([]Event) {}}
+	inject(t, es, Event{ID: 1}, Event{ID: 2})
+
+	if st := es.Stats(); st.ReceivedEvents != 2 || st.DeliveredEvents != 2 || st.DeliveredBatches != 1 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestGaugesSlowConsumer(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 4)}
+	for id := uint64(1); id <= 3; id++ {
+		inject(t, es, Event{ID: id})
+	}
+
+	st := es.Stats()
+	if st.QueuedBatches != 3 || st.QueueCapacity != 4 || st.OutstandingBatches != 3 {
+		t.Errorf("after 3 sends: %+v", st)
+	}
+
+	es.Recycle(<-es.EventsChan())
+	es.Recycle(<-es.EventsChan())
+	st = es.Stats()
+	if st.QueuedBatches != 1 || st.OutstandingBatches != 1 {
+		t.Errorf("after consuming 2: %+v", st)
+	}
+}
+
+func TestGaugesPending(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 1), MaxBatchDelay: time.Minute}
+	es.startDelivery()
+	defer es.stopDelivery()
+
+	inject(t, es, make([]Event, 10)...)
+	deadline := time.Now().Add(time.Second)
+	for es.Stats().PendingEvents != 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("PendingEvents = %d, want 10", es.Stats().PendingEvents)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	es.Flush(true)
+	if st := es.Stats(); st.PendingEvents != 0 || st.QueuedBatches != 1 {
+		t.Errorf("after Flush: %+v", st)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	es := &EventStream{Paths: []string{"/tmp"}, Events: make(chan []Event, 2)}
+	inject(t, es, Event{ID: 1})
+
+	s := es.Debug()
+	for _, want := range []string{`paths=["/tmp"]`, "queued=1/2", "outstanding=1", "received=1/1"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Debug() = %q, missing %q", s, want)
+		}
+	}
+}
+
+// TestBlockWithTimeout holds the consumer back while batches wait for
+// room, first longer than the callbacks do, then past the timeout.
+func TestBlockWithTimeout(t *testing.T) {
+	// The callback hands the batch on and returns while it waits.
+	es := &EventStream{Events: make(chan []Event, 1), Overflow: BlockWithTimeout(time.Minute)}
+	es.startDelivery()
+	inject(t, es, Event{ID: 1})
+	handed := make(chan struct{})
+	go func() {
+		inject(t, es, Event{ID: 2})
+		close(handed)
+	}()
+	select {
+	case <-handed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback waited for the consumer")
+	}
+	for _, want := range []uint64{1, 2} {
+		if batch := <-es.Events; batch[0].ID != want {
+			t.Errorf("got batch %d, want %d", batch[0].ID, want)
+		}
+	}
+	es.stopDelivery()
+	if st := es.Stats(); st.TimedOutBatches != 0 || st.DeliveredBatches != 2 {
+		t.Errorf("stats = %+v", st)
+	}
+
+	const timeout = 20 * time.Millisecond
+	es = &EventStream{Events: make(chan []Event, 1), Errors: make(chan error, 10), Overflow: BlockWithTimeout(timeout)}
+	es.startDelivery()
+	defer es.stopDelivery()
+	inject(t, es, Event{ID: 1})
+	inject(t, es, Event{ID: 2}, Event{ID: 2})
+	inject(t, es, Event{ID: 3}, Event{ID: 3})
+	es.Flush(true)
+	if batch := <-es.Events; batch[0].ID != 1 {
+		t.Errorf("got batch %d, want 1", batch[0].ID)
+	}
+	inject(t, es, Event{ID: 4})
+	if batch := <-es.Events; batch[0].ID != 4 {
+		t.Errorf("got batch %d, want 4", batch[0].ID)
+	}
+
+	st := es.Stats()
+	if st.TimedOutEvents != 4 || st.TimedOutBatches != 2 || st.DroppedEvents != 4 || st.DroppedBatches != 2 || st.DeliveredBatches != 2 {
+		t.Errorf("stats = %+v", st)
+	}
+	for i := 0; i < 2; i++ {
+		var terr *SendTimeoutError
+		if err := <-es.Errors; !errors.As(err, &terr) || terr.Events != 2 || terr.Timeout != timeout {
+			t.Errorf("got error %v, want a SendTimeoutError for 2 events", err)
+		}
+	}
+	if s := BlockWithTimeout(timeout).String(); s != "BlockWithTimeout(20ms)" {
+		t.Errorf("String() = %q", s)
+	}
+}
@@ -0,0 +1,105 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/ebitengine/purego"
+)
+
+// maxCachedPaths bounds the path cache. It matches the number of paths a
+// single FSEvents stream accepts.
+const maxCachedPaths = 4096
+
+// pathCache keeps CFStrings for watched paths so recreating a stream
+// (Restart and friends) doesn't convert every path again.
+//
+// The cache owns exactly one reference to each CFString it holds and
+// releases it on eviction, or when the last stream is stopped. Arrays built from cached strings are created
+// with kCFTypeArrayCallBacks, so they take their own references and an
+// eviction never invalidates an array that's still in use.
+type pathCache struct {
+	mu  sync.Mutex
+	max int
+	lru *list.List // of *pathCacheEntry, most recently used first
+	m   map[string]*list.Element
+}
+
+type pathCacheEntry struct {
+	path string
+	ref  CFStringRef
+}
+
+func newPathCache(max int) *pathCache {
+	return &pathCache{max: max, lru: list.New(), m: map[string]*list.Element{}}
+}
+
+// pathStrings is the cache used by createPaths.
+var pathStrings = newPathCache(maxCachedPaths)
+
+// releasePathStrings releases the cached strings once Stop leaves no
+// stream registered. Restart and the backend's own restarts keep them,
+// which is what they're cached for; an array made of them meanwhile
+// holds its own references, so a stream starting as they go is safe.
+func releasePathStrings() {
+	if registry.Len() == 0 {
+		pathStrings.purge()
+	}
+}
+
+// get returns the cached CFString for path, creating it on a miss. The
+// returned reference is owned by the cache, and a concurrent get may
+// evict and release it: use appendTo to keep it.
+func (c *pathCache) get(path string) CFStringRef {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookup(path)
+}
+
+// appendTo appends the cached CFString for path to the CFArray array,
+// which retains it before the cache lets go of c.mu, so that no eviction
+// can release it in between.
+func (c *pathCache) appendTo(array uintptr, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purego.SyscallN(lib.cfArrayAppendValue, array, uintptr(c.lookup(path)))
+}
+
+// lookup is get for callers holding c.mu.
+func (c *pathCache) lookup(path string) CFStringRef {
+	if e, ok := c.m[path]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*pathCacheEntry).ref
+	}
+
+	ref := goStringToCFString(path)
+	c.m[path] = c.lru.PushFront(&pathCacheEntry{path: path, ref: ref})
+	for c.lru.Len() > c.max {
+		c.evict(c.lru.Back())
+	}
+	return ref
+}
+
+func (c *pathCache) evict(e *list.Element) {
+	entry := c.lru.Remove(e).(*pathCacheEntry)
+	delete(c.m, entry.path)
+	releaseCF(uintptr(entry.ref))
+}
+
+// len returns the number of cached strings.
+func (c *pathCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// purge releases every cached string.
+func (c *pathCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
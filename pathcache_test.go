@@ -0,0 +1,123 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ebitengine/purego"
+)
+
+func TestPathCacheEviction(t *testing.T) {
+	f := withFakeLoader(t)
+	c := newPathCache(2)
+
+	a := c.get("/a")
+	c.get("/b")
+	if c.get("/a") != a {
+		t.Error("cache miss for /a")
+	}
+	c.get("/c") // evicts /b, the least recently used
+
+	if l := c.len(); l != 2 {
+		t.Errorf("len = %d, want 2", l)
+	}
+	f.mu.Lock()
+	released := f.released
+	f.mu.Unlock()
+	if released != 1 {
+		t.Errorf("released %d strings, want 1", released)
+	}
+
+	c.purge()
+	if l := c.len(); l != 0 {
+		t.Errorf("len after purge = %d, want 0", l)
+	}
+}
+
+func TestPathCacheRecreateStream(t *testing.T) {
+	paths := make([]string, 1000)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/fsevents-cache-test/%d", i)
+	}
+
+	retainCounts := func() []uintptr {
+		var counts []uintptr
+		for _, p := range []string{paths[0], paths[500], paths[999]} {
+			n, _, _ := purego.SyscallN(lib.cfGetRetainCount, uintptr(pathStrings.get(p)))
+			counts = append(counts, n)
+		}
+		return counts
+	}
+
+	var first []uintptr
+	for i := 0; i < 100; i++ {
+		ref := setupStream(paths, 0, 0, eventIDSinceNow, 0, 0)
+		purego.SyscallN(lib.fseventsRelease, uintptr(ref))
+
+		if i == 0 {
+			first = retainCounts()
+		}
+	}
+
+	if have := retainCounts(); fmt.Sprint(have) != fmt.Sprint(first) {
+		t.Errorf("retain counts drifted: first %v, after 100 recreations %v", first, have)
+	}
+	if l := pathStrings.len(); l < len(paths) || l > maxCachedPaths {
+		t.Errorf("cache holds %d strings, want between %d and %d", l, len(paths), maxCachedPaths)
+	}
+}
+
+func TestUnitPathCacheStop(t *testing.T) {
+	withFakeStreams(t, 0)
+	held := func() int {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.strs)
+	}
+
+	es := &EventStream{Paths: fakePaths, Events: make(chan []Event, 1)}
+	other := &EventStream{Paths: fakePaths[:1], Events: make(chan []Event, 1)}
+	for _, s := range []*EventStream{es, other} {
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := es.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	es.Stop()
+	if l, n := pathStrings.len(), held(); l != len(fakePaths) || n != len(fakePaths) {
+		t.Errorf("with a stream left, %d strings cached and %d held, want %d", l, n, len(fakePaths))
+	}
+	other.Stop()
+	if l, n := pathStrings.len(), held(); l != 0 || n != 0 {
+		t.Errorf("after the last Stop, %d strings cached and %d held, want none", l, n)
+	}
+}
+
+func TestPathCacheStop(t *testing.T) {
+	dir := t.TempDir()
+	// An array of its own keeps the cached string alive to be counted.
+	held, _ := createPaths([]string{dir})
+	defer releaseCF(uintptr(held))
+	ref := pathStrings.get(dir)
+	retainCount := func() uintptr {
+		n, _, _ := purego.SyscallN(lib.cfGetRetainCount, uintptr(ref))
+		return n
+	}
+
+	es := &EventStream{Paths: []string{dir}, Events: make(chan []Event, 1)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	running := retainCount()
+	es.Stop()
+	if l := pathStrings.len(); l != 0 {
+		t.Errorf("%d strings cached after Stop, want 0", l)
+	}
+	if n := retainCount(); n >= running {
+		t.Errorf("retain count %d after Stop, want less than the %d while running", n, running)
+	}
+}
@@ -0,0 +1,232 @@
+package fsevents
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// defaultPollInterval is used when PollInterval is zero.
+const defaultPollInterval = time.Second
+
+// pollEntry is what the Poll backend remembers about a path.
+type pollEntry struct {
+	kind  EventFlags // ItemIsFile, ItemIsDir or ItemIsSymlink
+	size  int64
+	mtime int64 // in nanoseconds since the Unix epoch
+	mode  fs.FileMode
+	ino   uint64
+}
+
+// pollSource implements the Poll backend: it walks the paths every
+// PollInterval and derives events from the differences between walks.
+type pollSource struct {
+	es       *EventStream
+	paths    []string
+	snapshot map[string]pollEntry
+	lastID   uint64
+	noIDs    bool // next to FSEvents, whose IDs the sequence would mix with
+
+	flushReq chan chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+func startPoll(es *EventStream) (source, error) {
+	return startPollPaths(es, es.watched, false), nil
+}
+
+// startPollPaths polls paths, which needn't be all of the stream's,
+// leaving the event IDs zero and marking the events Synthetic if noIDs
+// is set.
+func startPollPaths(es *EventStream, paths []string, noIDs bool) *pollSource {
+	interval := es.conf().PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	s := &pollSource{
+		es:       es,
+		paths:    paths,
+		lastID:   es.EventID,
+		noIDs:    noIDs,
+		flushReq: make(chan chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.snapshot = s.walk()
+	go s.run(interval)
+	return s
+}
+
+func (s *pollSource) run(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.poll()
+		case ack := <-s.flushReq:
+			s.poll()
+			close(ack)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// walk records every path below the stream's paths.
+func (s *pollSource) walk() map[string]pollEntry {
+	return walkTree(s.paths, len(s.snapshot))
+}
+
+// walkTree records every path below roots, for about hint of them. Paths
+// that can't be read are left out, as if they didn't exist.
+func walkTree(roots []string, hint int) map[string]pollEntry {
+	snapshot := make(map[string]pollEntry, hint)
+	for _, root := range roots {
+		filepath.WalkDir(filepath.Clean(root), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			snapshot[path] = newPollEntry(fi)
+			return nil
+		})
+	}
+	return snapshot
+}
+
+// newPollEntry returns what a walk records of the item fi describes.
+func newPollEntry(fi fs.FileInfo) pollEntry {
+	e := pollEntry{kind: ItemIsFile, size: fi.Size(), mtime: fi.ModTime().UnixNano(), mode: fi.Mode()}
+	switch {
+	case fi.IsDir():
+		e.kind = ItemIsDir
+	case fi.Mode()&fs.ModeSymlink != 0:
+		e.kind = ItemIsSymlink
+	}
+	e.ino, _ = inode(fi)
+	return e
+}
+
+// poll walks the paths again and delivers the changes since the last walk.
+func (s *pollSource) poll() {
+	prev, cur := s.snapshot, s.walk()
+	s.snapshot = cur
+
+	batch := diffTrees(prev, cur)
+	if len(batch) == 0 {
+		return
+	}
+	for i := range batch {
+		if s.noIDs {
+			batch[i].Synthetic = true
+			continue
+		}
+		s.lastID++
+		batch[i].ID = s.lastID
+	}
+	s.es.deliver(batch)
+}
+
+// diffTrees returns the events that turn the snapshot prev into cur,
+// sorted by path and without IDs, or nil if there are none.
+func diffTrees(prev, cur map[string]pollEntry) []Event {
+	changes := map[string]EventFlags{}
+	var removed, created []string
+	for path, old := range prev {
+		e, ok := cur[path]
+		switch {
+		case !ok:
+			removed = append(removed, path)
+		case e.kind != old.kind || e.ino != old.ino:
+			changes[path] = ItemRemoved | ItemCreated | e.kind
+		default:
+			var flags EventFlags
+			// A directory's size and mtime change with its entries,
+			// which are reported themselves.
+			if e.kind != ItemIsDir && (e.size != old.size || e.mtime != old.mtime) {
+				flags |= ItemModified
+			}
+			if e.mode != old.mode {
+				flags |= ItemInodeMetaMod
+			}
+			if flags != 0 {
+				changes[path] = flags | e.kind
+			}
+		}
+	}
+	for path := range cur {
+		if _, ok := prev[path]; !ok {
+			created = append(created, path)
+		}
+	}
+
+	// A path that disappeared and one that appeared with the same inode
+	// were renamed. Like FSEvents, report the rename on both.
+	byIno := map[uint64]string{}
+	for _, path := range removed {
+		if e := prev[path]; e.ino != 0 {
+			byIno[e.ino] = path
+		}
+	}
+	for _, path := range created {
+		e := cur[path]
+		if old, ok := byIno[e.ino]; ok && e.ino != 0 && prev[old].kind == e.kind {
+			delete(byIno, e.ino)
+			changes[old] = ItemRenamed | e.kind
+			changes[path] = ItemRenamed | e.kind
+			continue
+		}
+		changes[path] = ItemCreated | e.kind
+	}
+	for _, path := range removed {
+		if _, ok := changes[path]; !ok {
+			changes[path] = ItemRemoved | prev[path].kind
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(changes))
+	for path := range changes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	batch := newBatch(len(paths))
+	for i, path := range paths {
+		batch[i] = Event{Path: path, Flags: changes[path]}
+	}
+	return batch
+}
+
+// flush polls right away. With sync set it waits for the changes to be
+// delivered; otherwise it doesn't wait for a poll that's already running.
+func (s *pollSource) flush(sync bool) {
+	ack := make(chan struct{})
+	if !sync {
+		select {
+		case s.flushReq <- ack:
+		default:
+		}
+		return
+	}
+	select {
+	case s.flushReq <- ack:
+	case <-s.done:
+		return
+	}
+	<-ack
+}
+
+func (s *pollSource) stop() {
+	close(s.quit)
+	<-s.done
+}
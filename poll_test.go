@@ -0,0 +1,111 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startPollStream starts a Poll stream on a fresh temp dir that only
+// polls when flushed.
+func startPollStream(t *testing.T, es *EventStream) string {
+	t.Helper()
+	tmp := t.TempDir()
+	es.Paths = []string{tmp}
+	es.Backend = Poll
+	es.PollInterval = time.Hour
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(es.Stop)
+	return tmp
+}
+
+func TestPollRename(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 1)}
+	tmp := startPollStream(t, es)
+
+	old, renamed := filepath.Join(tmp, "old"), filepath.Join(tmp, "new")
+	if err := os.WriteFile(old, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+	if have := <-es.EventsChan(); len(have) != 1 || have[0].Path != old || have[0].Flags != ItemCreated|ItemIsFile {
+		t.Fatalf("after create: %v", have)
+	}
+
+	if err := os.Rename(old, renamed); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+	have := <-es.EventsChan()
+	want := []Event{
+		{Path: renamed, Flags: ItemRenamed | ItemIsFile, Root: tmp, ID: 2},
+		{Path: old, Flags: ItemRenamed | ItemIsFile, Root: tmp, ID: 3},
+	}
+	if _, ok := inode(mustStat(t, renamed)); !ok {
+		want = []Event{
+			{Path: renamed, Flags: ItemCreated | ItemIsFile, Root: tmp, ID: 2},
+			{Path: old, Flags: ItemRemoved | ItemIsFile, Root: tmp, ID: 3},
+		}
+	}
+	if len(have) != len(want) {
+		t.Fatalf("after rename: %v", have)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("event %d: got %#v, want %#v", i, have[i], want[i])
+		}
+	}
+	if es.EventID != 3 {
+		t.Errorf("EventID = %d, want 3", es.EventID)
+	}
+}
+
+func TestPollFilter(t *testing.T) {
+	es := &EventStream{
+		Events: make(chan []Event, 1),
+		Filter: func(e *Event) bool { return filepath.Ext(e.Path) == ".go" },
+	}
+	tmp := startPollStream(t, es)
+
+	for _, name := range []string{"a.go", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(tmp, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	es.Flush(true)
+	if have := <-es.EventsChan(); len(have) != 1 || filepath.Base(have[0].Path) != "a.go" {
+		t.Errorf("got %v, want only a.go", have)
+	}
+	if st := es.Stats(); st.FilteredEvents != 1 {
+		t.Errorf("FilteredEvents = %d, want 1", st.FilteredEvents)
+	}
+}
+
+func TestPollNoChanges(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 1)}
+	tmp := startPollStream(t, es)
+	if err := os.Mkdir(filepath.Join(tmp, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	es.Flush(true)
+	<-es.EventsChan()
+
+	es.Flush(true)
+	select {
+	case have := <-es.EventsChan():
+		t.Errorf("unchanged tree reported %v", have)
+	default:
+	}
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
@@ -0,0 +1,45 @@
+package fsevents
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// eventPool holds *[]Event slices returned through Recycle. Pointers are
+// stored so that Put doesn't allocate.
+var eventPool sync.Pool
+
+// newBatch returns a batch of length n, reusing pooled storage when it's
+// large enough.
+func newBatch(n int) []Event {
+	if p, ok := eventPool.Get().(*[]Event); ok {
+		if cap(*p) >= n {
+			return (*p)[:n]
+		}
+		eventPool.Put(p)
+	}
+	return make([]Event, n)
+}
+
+// Recycle returns a batch received from Events to the pool so a later
+// callback can reuse its storage. The caller must not use batch, or any
+// slice sharing its storage, after calling Recycle. Recycling is optional;
+// batches that are never recycled are garbage collected as usual.
+func (es *EventStream) Recycle(batch []Event) {
+	atomic.AddInt64(&es.outstanding, -1)
+	recycle(batch)
+}
+
+// recycle returns a batch to the pool without touching any stream's
+// gauges, for batches that never reached a consumer.
+func recycle(batch []Event) {
+	if cap(batch) == 0 {
+		return
+	}
+	batch = batch[:cap(batch)]
+	for i := range batch {
+		batch[i] = Event{}
+	}
+	batch = batch[:0]
+	eventPool.Put(&batch)
+}
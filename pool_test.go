@@ -0,0 +1,161 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// cBatch is a batch laid out the way FSEvents hands it to the callback.
+// It lives in an anonymous mapping rather than the Go heap: under -race,
+// checkptr rejects converting callback arguments that point into Go
+// memory back to pointers, which real FSEvents data never does.
+type cBatch struct {
+	mem               []byte
+	n                 int
+	paths, flags, ids uintptr
+}
+
+// newCBatch returns a batch of n file modifications with IDs 1 to n.
+func newCBatch(n int) *cBatch {
+	paths := make([]string, n)
+	flags := make([]EventFlags, n)
+	ids := make([]uint64, n)
+	for i := 0; i < n; i++ {
+		paths[i] = fmt.Sprintf("/tmp/dir-%d/file-%d", i%10, i)
+		flags[i] = ItemModified | ItemIsFile
+		ids[i] = uint64(i + 1)
+	}
+	return newCBatchOf(paths, flags, ids)
+}
+
+// newCBatchOf lays out the given events in C memory.
+func newCBatchOf(paths []string, flags []EventFlags, ids []uint64) *cBatch {
+	n := len(paths)
+	size := n * (8 + 8 + 4)
+	for _, p := range paths {
+		size += len(p) + 1
+	}
+	mem, err := syscall.Mmap(-1, 0, size+1, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		panic(err)
+	}
+	b := &cBatch{mem: mem, n: n}
+	runtime.SetFinalizer(b, func(b *cBatch) { syscall.Munmap(b.mem) })
+
+	base := uintptr(unsafe.Pointer(&mem[0]))
+	b.paths, b.ids, b.flags = base, base+uintptr(8*n), base+uintptr(16*n)
+	off := 20 * n
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(mem[8*i:], uint64(base)+uint64(off))
+		binary.LittleEndian.PutUint64(mem[8*n+8*i:], ids[i])
+		binary.LittleEndian.PutUint32(mem[16*n+4*i:], uint32(flags[i]))
+		off += copy(mem[off:], paths[i]) + 1
+	}
+	return b
+}
+
+// call runs the FSEvents callback with the batch for the given registry ID.
+func (b *cBatch) call(info uintptr) {
+	callback(0, info, b.n, b.paths, b.flags, b.ids)
+	runtime.KeepAlive(b)
+}
+
+// inject passes events to es through es.inject, down the path of a
+// callback from FSEvents, registering es for the rest of the test unless
+// it's already registered. Events take their Device from es, as the
+// callback's do.
+func inject(t testing.TB, es *EventStream, events ...Event) {
+	t.Helper()
+	if es.registryID == 0 {
+		id := registry.Add(es)
+		es.registryID = id
+		t.Cleanup(func() { registry.Delete(id) })
+	}
+	paths := make([]string, len(events))
+	flags := make([]EventFlags, len(events))
+	ids := make([]uint64, len(events))
+	for i, e := range events {
+		paths[i], flags[i], ids[i] = e.Path, e.Flags, e.ID
+	}
+	b := newCBatchOf(paths, flags, ids)
+	es.inject(b.n, b.paths, b.flags, b.ids)
+	runtime.KeepAlive(b)
+}
+
+func TestRecycleClearsBatch(t *testing.T) {
+	es := &EventStream{}
+	batch := []Event{{Path: "/a", ID: 1}, {Path: "/b", ID: 2}}
+	es.Recycle(batch)
+
+	for i, e := range batch {
+		if e != (Event{}) {
+			t.Errorf("event %d not cleared after Recycle: %#v", i, e)
+		}
+	}
+}
+
+func TestHandlerRecyclesBatch(t *testing.T) {
+	var seen []Event
+	es := &EventStream{Handler: func(batch []Event) {
+		seen = batch
+		if len(batch) != 3 || batch[2].Path != "/tmp/dir-2/file-2" {
+			t.Errorf("unexpected batch: %#v", batch)
+		}
+	}}
+	info := registry.Add(es)
+	defer registry.Delete(info)
+
+	newCBatch(3).call(info)
+
+	if seen == nil {
+		t.Fatal("Handler was not called")
+	}
+	if seen[0] != (Event{}) {
+		t.Errorf("batch was not recycled after Handler returned: %#v", seen[0])
+	}
+}
+
+func BenchmarkCallback1k(b *testing.B) {
+	cb := newCBatch(1000)
+
+	b.Run("channel", func(b *testing.B) {
+		es := &EventStream{Events: make(chan []Event, 1)}
+		info := registry.Add(es)
+		defer registry.Delete(info)
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cb.call(info)
+			<-es.EventsChan()
+		}
+	})
+
+	b.Run("channel-recycle", func(b *testing.B) {
+		es := &EventStream{Events: make(chan []Event, 1)}
+		info := registry.Add(es)
+		defer registry.Delete(info)
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cb.call(info)
+			es.Recycle(<-es.EventsChan())
+		}
+	})
+
+	b.Run("handler", func(b *testing.B) {
+		es := &EventStream{Handler: func([]Event) {}}
+		info := registry.Add(es)
+		defer registry.Delete(info)
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cb.call(info)
+		}
+	})
+}
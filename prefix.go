@@ -0,0 +1,218 @@
+package fsevents
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SubscribePrefix subscribes to the events on prefix and below, like
+// Subscribe with opts. The prefix is made absolute and, if it exists, has
+// its symbolic links resolved to match the paths FSEvents reports; events
+// on either form match, and if its volume isn't case-sensitive, whatever
+// the case of their names. For a device-relative stream it's taken
+// relative to the device's root as given. Subscribers are kept in a tree of path
+// components, so routing an event costs the same however many there are.
+// The returned func cancels the subscription and closes the channel.
+func (es *EventStream) SubscribePrefix(prefix string, opts ...SubscribeOption) (<-chan []Event, func()) {
+	s := newSubscription(opts)
+	prefixes := []anchor{{path: filepath.Clean(prefix)}}
+	if es.conf().Device == 0 {
+		if abs, err := filepath.Abs(prefix); err == nil {
+			prefixes[0] = newAnchor(abs)
+		}
+		if resolved, err := filepath.EvalSymlinks(prefixes[0].path); err == nil && resolved != prefixes[0].path {
+			prefixes = append(prefixes, newAnchor(resolved))
+		}
+	}
+
+	es.subMu.Lock()
+	s.matchers = es.matchers.acquire(s.patterns)
+	r, _ := es.prefixes.Load().(*prefixRouter)
+	if r == nil {
+		r = &prefixRouter{}
+		es.prefixes.Store(r)
+	}
+	es.subMu.Unlock()
+	for _, p := range prefixes {
+		r.add(p, s)
+	}
+
+	var once sync.Once
+	return s.Events, func() {
+		once.Do(func() {
+			for _, p := range prefixes {
+				r.remove(p, s)
+			}
+			es.subMu.Lock()
+			es.matchers.release(s.matchers)
+			es.subMu.Unlock()
+			s.close()
+		})
+	}
+}
+
+// prefixRouter dispatches events to the subscriptions of SubscribePrefix.
+// The prefixes on volumes that aren't case-sensitive are in a tree of
+// their own, of lower-cased components.
+type prefixRouter struct {
+	mu     sync.RWMutex
+	root   prefixNode
+	folded prefixNode
+}
+
+// tree returns the tree holding a, and a's path as it's kept there.
+func (r *prefixRouter) tree(a anchor) (*prefixNode, string) {
+	if a.fold {
+		return &r.folded, strings.ToLower(a.path)
+	}
+	return &r.root, a.path
+}
+
+// prefixNode is a path component in a prefixRouter's tree, holding the
+// subscriptions to its path.
+type prefixNode struct {
+	children map[string]*prefixNode
+	subs     []*Subscription
+}
+
+// components calls f with each component of path in turn, stopping when
+// f returns false.
+func components(path string, f func(string) bool) {
+	for path != "" {
+		i := strings.IndexByte(path, '/')
+		if i < 0 {
+			f(path)
+			return
+		}
+		if i > 0 && !f(path[:i]) {
+			return
+		}
+		path = path[i+1:]
+	}
+}
+
+func (r *prefixRouter) add(a anchor, s *Subscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, prefix := r.tree(a)
+	components(prefix, func(c string) bool {
+		child := n.children[c]
+		if child == nil {
+			if n.children == nil {
+				n.children = map[string]*prefixNode{}
+			}
+			child = &prefixNode{}
+			n.children[c] = child
+		}
+		n = child
+		return true
+	})
+	n.subs = append(n.subs, s)
+}
+
+// remove takes s off a and prunes the nodes left empty.
+func (r *prefixRouter) remove(a anchor, s *Subscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	root, prefix := r.tree(a)
+	path := []*prefixNode{root}
+	var names []string
+	found := true
+	components(prefix, func(c string) bool {
+		child := path[len(path)-1].children[c]
+		if child == nil {
+			found = false
+			return false
+		}
+		path = append(path, child)
+		names = append(names, c)
+		return true
+	})
+	if !found {
+		return
+	}
+	n := path[len(path)-1]
+	for i, sub := range n.subs {
+		if sub == s {
+			n.subs = append(n.subs[:i:i], n.subs[i+1:]...)
+			break
+		}
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		if len(path[i].subs) > 0 || len(path[i].children) > 0 {
+			break
+		}
+		delete(path[i-1].children, names[i-1])
+	}
+}
+
+// route sends each subscription the events on its prefix, in a batch of
+// its own, matching its patterns in pass.
+func (r *prefixRouter) route(events []Event, pass *matchPass) {
+	type routed struct {
+		batch []Event
+		last  int // index in events of the last event matched
+	}
+	var (
+		batches map[*Subscription]*routed
+		order   []*Subscription
+	)
+	visit := func(n *prefixNode, e *Event, i int) {
+		for _, s := range n.subs {
+			b := batches[s]
+			if b != nil && b.last == i {
+				// Already matched on another form of the prefix.
+				continue
+			}
+			if b == nil {
+				if batches == nil {
+					batches = map[*Subscription]*routed{}
+				}
+				b = &routed{last: -1}
+				batches[s] = b
+			}
+			b.last = i
+			ev := *e
+			if !s.keeps(pass, i, &ev) {
+				atomic.AddUint64(&s.stats.FilteredEvents, 1)
+				continue
+			}
+			if b.batch == nil {
+				b.batch = newBatch(len(events) - i)[:0]
+				order = append(order, s)
+			}
+			b.batch = append(b.batch, ev)
+		}
+	}
+
+	walk := func(n *prefixNode, e *Event, i int, fold bool) {
+		visit(n, e, i)
+		components(e.Path, func(c string) bool {
+			if fold {
+				c = strings.ToLower(c)
+			}
+			if n = n.children[c]; n == nil {
+				return false
+			}
+			visit(n, e, i)
+			return true
+		})
+	}
+
+	r.mu.RLock()
+	folded := len(r.folded.subs) > 0 || len(r.folded.children) > 0
+	for i := range events {
+		e := &events[i]
+		walk(&r.root, e, i, false)
+		if folded {
+			walk(&r.folded, e, i, true)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, s := range order {
+		s.send(batches[s].batch)
+	}
+}
@@ -0,0 +1,116 @@
+package fsevents
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSubscribePrefix(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 1000)}
+	subs := make([]<-chan []Event, 100)
+	cancels := make([]func(), 100)
+	for i := range subs {
+		subs[i], cancels[i] = es.SubscribePrefix(fmt.Sprintf("/w/p%02d", i), SubscribeBuffer(1000))
+	}
+	all, cancelAll := es.SubscribePrefix("/w", SubscribeBuffer(1000))
+	odd, cancelOdd := es.SubscribePrefix("/w/p01/", SubscribeBuffer(1000), SubscribeFilter(func(e *Event) bool {
+		return e.ID%2 == 1
+	}))
+
+	var id uint64
+	for round := 0; round < 3; round++ {
+		batch := make([]Event, 0, 100)
+		for i := 0; i < 100; i++ {
+			id++
+			batch = append(batch, Event{Path: fmt.Sprintf("/w/p%02d/f%d", i, round), ID: id})
+		}
+		es.deliver(batch)
+	}
+	id++
+	es.deliver([]Event{{Path: "/w/p01", ID: id}, {Path: "/w/p010", ID: id + 1}, {Path: "/x/p01/f", ID: id + 2}})
+
+	for i, c := range subs {
+		want := []uint64{uint64(i + 1), uint64(i + 101), uint64(i + 201)}
+		if i == 1 {
+			want = append(want, id)
+		}
+		if have := drain(c); !reflect.DeepEqual(have, want) {
+			t.Errorf("/w/p%02d got %v, want %v", i, have, want)
+		}
+	}
+	if have := drain(all); len(have) != 302 {
+		t.Errorf("/w got %d events, want 302", len(have))
+	}
+	if have, want := drain(odd), []uint64{id}; !reflect.DeepEqual(have, want) {
+		t.Errorf("filtered /w/p01 got %v, want %v", have, want)
+	}
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+	cancelAll()
+	cancelOdd()
+	cancelOdd()
+	for i, c := range subs {
+		if _, ok := <-c; ok {
+			t.Fatalf("/w/p%02d still open after cancel", i)
+		}
+	}
+	r := es.prefixes.Load().(*prefixRouter)
+	if len(r.root.children) != 0 {
+		t.Errorf("router not pruned after cancel: %v", r.root.children)
+	}
+	es.deliver([]Event{{Path: "/w/p00/f", ID: 1000}})
+}
+
+func TestSubscribePrefixSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip(err)
+	}
+	target, _ = filepath.EvalSymlinks(target)
+
+	es := &EventStream{Events: make(chan []Event, 10)}
+	c, cancel := es.SubscribePrefix(link)
+	defer cancel()
+	es.deliver([]Event{
+		{Path: filepath.Join(target, "a"), ID: 1},
+		{Path: filepath.Join(link, "b"), ID: 2},
+		{Path: filepath.Join(dir, "c"), ID: 3},
+	})
+	if have, want := drain(c), []uint64{1, 2}; !reflect.DeepEqual(have, want) {
+		t.Errorf("got %v, want %v", have, want)
+	}
+}
+
+func BenchmarkSubscribePrefix(b *testing.B) {
+	for _, n := range []int{1, 100, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			es := &EventStream{Device: 1}
+			for i := 0; i < n; i++ {
+				c, cancel := es.SubscribePrefix(fmt.Sprintf("/w/p%04d", i), SubscribeBuffer(1))
+				defer cancel()
+				go func() {
+					for batch := range c {
+						recycle(batch)
+					}
+				}()
+			}
+			batch := []Event{{Path: "/w/p0000/a/b/c", ID: 1}, {Path: "/w/other/a", ID: 2}}
+			r := es.prefixes.Load().(*prefixRouter)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.route(batch, &matchPass{events: batch})
+			}
+		})
+	}
+}
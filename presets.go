@@ -0,0 +1,123 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExclusionPreset is a list of paths to leave out, for
+// WithExclusionPresets: absolute paths, those starting with "~/" for the
+// user's home directory, and patterns as ExclusionPatterns takes them.
+// The presets are plain slices, to be extended with append or trimmed
+// with Without.
+type ExclusionPreset []string
+
+// PresetDeveloper leaves out what build tools, package managers and
+// version control rewrite below a project: dependencies, caches, object
+// stores and editors' swap files.
+var PresetDeveloper = ExclusionPreset{
+	"node_modules",
+	".git/objects",
+	".git/logs",
+	".hg/store",
+	".svn/pristine",
+	"__pycache__",
+	".mypy_cache",
+	".pytest_cache",
+	".tox",
+	".venv",
+	".gradle",
+	".build",
+	".next",
+	".*.swp",
+	"~/Library/Developer/Xcode/DerivedData",
+	"~/go/pkg/mod",
+	"~/.npm",
+	"~/.cargo/registry",
+}
+
+// PresetMacOSSystem leaves out what the system writes by itself: the
+// SystemRootExclusions, and the stores macOS keeps on every volume and
+// the .DS_Store files Finder leaves in every directory.
+var PresetMacOSSystem = append(ExclusionPreset(append([]string(nil), SystemRootExclusions...)),
+	".Spotlight-V100",
+	".fseventsd",
+	".Trashes",
+	".TemporaryItems",
+	".DocumentRevisions-V100",
+	".DS_Store",
+)
+
+// PresetUserLibraryNoise leaves out the caches, logs and saved state
+// applications keep in the user's Library, sandboxed or not, and the
+// Trash.
+var PresetUserLibraryNoise = ExclusionPreset{
+	"~/Library/Caches",
+	"~/Library/Logs",
+	"~/Library/Saved Application State",
+	"~/Library/Metadata/CoreSpotlight",
+	"~/Library/Containers/*/Data/Library/Caches",
+	"~/Library/Group Containers/*/Library/Caches",
+	"~/.Trash",
+}
+
+// Without returns a copy of p without entries.
+func (p ExclusionPreset) Without(entries ...string) ExclusionPreset {
+	kept := ExclusionPreset{}
+	for _, entry := range p {
+		if !containsString(entries, entry) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// Split returns p's entries as ExclusionPaths and ExclusionPatterns take
+// them, with "~/" replaced by the user's home directory: the absolute
+// paths without a pattern's special characters, which FSEvents can leave
+// out itself, and the rest. The entries below the home directory are left
+// out if it isn't known.
+func (p ExclusionPreset) Split() (paths, patterns []string) {
+	home, _ := os.UserHomeDir()
+	for _, entry := range p {
+		if strings.HasPrefix(entry, "~/") {
+			if home == "" {
+				continue
+			}
+			entry = filepath.Join(home, entry[2:])
+		}
+		if filepath.IsAbs(entry) && !strings.ContainsAny(entry, `*?[\`) {
+			paths = append(paths, entry)
+		} else {
+			patterns = append(patterns, entry)
+		}
+	}
+	return paths, patterns
+}
+
+// WithExclusionPresets adds the entries of presets to
+// EventStream.ExclusionPaths and ExclusionPatterns, as Split returns
+// them, leaving out those already there. The paths come after those set
+// before and in the order of presets: FSEvents leaves out the first
+// eight itself, and the stream the rest, so pass the noisiest first.
+func WithExclusionPresets(presets ...ExclusionPreset) Option {
+	return func(es *EventStream) {
+		// Copies, not to write to the caller's arrays.
+		es.ExclusionPaths = append([]string(nil), es.ExclusionPaths...)
+		es.ExclusionPatterns = append([]string(nil), es.ExclusionPatterns...)
+		for _, p := range presets {
+			paths, patterns := p.Split()
+			for _, path := range paths {
+				if !containsString(es.ExclusionPaths, path) {
+					es.ExclusionPaths = append(es.ExclusionPaths, path)
+				}
+			}
+			for _, pattern := range patterns {
+				if !containsString(es.ExclusionPatterns, pattern) {
+					es.ExclusionPatterns = append(es.ExclusionPatterns, pattern)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package fsevents
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExclusionPresets(t *testing.T) {
+	t.Setenv("HOME", "/Users/me")
+	all := []ExclusionPreset{PresetMacOSSystem, PresetUserLibraryNoise, PresetDeveloper}
+	es := New([]string{"/"}, WithExclusionPaths("/mine"), WithExclusionPresets(all...), WithExclusionPresets(PresetDeveloper))
+	if es.ExclusionPaths[0] != "/mine" {
+		t.Errorf("ExclusionPaths = %q, want /mine first", es.ExclusionPaths)
+	}
+	seen := map[string]bool{}
+	for _, list := range [][]string{es.ExclusionPaths, es.ExclusionPatterns} {
+		for _, s := range list {
+			if seen[s] {
+				t.Errorf("%q added twice", s)
+			}
+			seen[s] = true
+		}
+	}
+	kernel, _ := es.splitExclusions()
+	if want := append([]string{"/mine"}, SystemRootExclusions[:maxKernelExclusions-1]...); !reflect.DeepEqual(kernel, want) {
+		t.Errorf("FSEvents leaves out %q, want %q", kernel, want)
+	}
+	if err := es.checkPatterns(); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := compilePatterns(es.ExclusionPatterns)
+	excluded := func(path string) bool {
+		return underAny(path, es.ExclusionPaths) || matchAny(path, patterns)
+	}
+	for _, path := range []string{
+		"/Users/me/src/app/node_modules/react/index.js",
+		"/Users/me/src/app/.git/objects/0a/1b2c",
+		"/Users/me/src/tool/__pycache__/main.cpython-312.pyc",
+		"/Users/me/src/app/.main.go.swp",
+		"/Users/me/Library/Developer/Xcode/DerivedData/App-abc/Build",
+		"/Users/me/go/pkg/mod/golang.org/x/sys@v0.1.0/go.mod",
+		"/private/var/folders/xy/T/tmpfile",
+		"/.Spotlight-V100/Store-V2",
+		"/Volumes/USB/.Spotlight-V100/Store-V2",
+		"/Volumes/USB/.Trashes/501/old",
+		"/Users/me/Documents/.DS_Store",
+		"/Users/me/Library/Caches/com.apple.Safari/Cache.db",
+		"/Users/me/Library/Logs/DiagnosticReports/x.ips",
+		"/Users/me/Library/Containers/com.apple.mail/Data/Library/Caches/x",
+		"/Users/me/.Trash/old.txt",
+	} {
+		if !excluded(path) {
+			t.Errorf("%s isn't left out", path)
+		}
+	}
+	for _, path := range []string{
+		"/Users/me/src/app/main.go",
+		"/Users/me/src/app/.git/HEAD",
+		"/Users/me/src/app/modules/node_modules.md",
+		"/Users/me/Documents/report.pdf",
+		"/Users/me/Library/Preferences/com.apple.finder.plist",
+		"/Users/me/Library/Containers/com.apple.mail/Data/Library/Mail/V10",
+		"/Users/other/Library/Caches/x",
+		"/Applications/Safari.app/Contents/Info.plist",
+	} {
+		if excluded(path) {
+			t.Errorf("%s is left out", path)
+		}
+	}
+}
+
+func TestExclusionPresetWithout(t *testing.T) {
+	p := PresetDeveloper.Without(".venv", "node_modules", "not in it")
+	if len(p) != len(PresetDeveloper)-2 || containsString(p, "node_modules") || containsString(p, ".venv") {
+		t.Errorf("Without = %q", p)
+	}
+	if !containsString(PresetDeveloper, "node_modules") {
+		t.Error("Without changed the preset")
+	}
+
+	t.Setenv("HOME", "/Users/me")
+	paths, patterns := ExclusionPreset{"~/Library/Caches", "~/Library/Containers/*/Data", "/Library/Caches", "*.tmp"}.Split()
+	if want := []string{"/Users/me/Library/Caches", "/Library/Caches"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths %q, want %q", paths, want)
+	}
+	if want := []string{"/Users/me/Library/Containers/*/Data", "*.tmp"}; !reflect.DeepEqual(patterns, want) {
+		t.Errorf("patterns %q, want %q", patterns, want)
+	}
+}
@@ -0,0 +1,48 @@
+package fsevents
+
+import "fmt"
+
+// QoS is the quality-of-service class of the dispatch queue a stream's
+// callbacks run on. It tells the scheduler how urgent event handling is
+// relative to the rest of the system.
+type QoS int
+
+const (
+	// QoSDefault leaves the queue at the system's default class.
+	QoSDefault QoS = iota
+	QoSUserInteractive
+	QoSUserInitiated
+	QoSUtility
+	QoSBackground
+)
+
+// class returns the qos_class_t value from <sys/qos.h>.
+func (q QoS) class() uint32 {
+	switch q {
+	case QoSUserInteractive:
+		return 0x21
+	case QoSUserInitiated:
+		return 0x19
+	case QoSUtility:
+		return 0x11
+	case QoSBackground:
+		return 0x09
+	}
+	return 0 // QOS_CLASS_UNSPECIFIED
+}
+
+func (q QoS) String() string {
+	switch q {
+	case QoSDefault:
+		return "Default"
+	case QoSUserInteractive:
+		return "UserInteractive"
+	case QoSUserInitiated:
+		return "UserInitiated"
+	case QoSUtility:
+		return "Utility"
+	case QoSBackground:
+		return "Background"
+	}
+	return fmt.Sprintf("QoS(%d)", int(q))
+}
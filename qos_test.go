@@ -0,0 +1,212 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ebitengine/purego"
+)
+
+func TestQoS(t *testing.T) {
+	for _, q := range []QoS{QoSDefault, QoSUserInteractive, QoSUserInitiated, QoSUtility, QoSBackground} {
+		q := q
+		t.Run(q.String(), func(t *testing.T) {
+			tmp, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			es := &EventStream{Paths: []string{tmp}, Flags: FileEvents, QoS: q}
+			if err := es.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer es.Stop()
+
+			if q != QoSDefault {
+				have, _, _ := purego.SyscallN(lib.dispatchQueueGetQoSClass, uintptr(es.qref), 0)
+				if uint32(have) != q.class() {
+					t.Errorf("queue QoS class = %#x, want %#x", have, q.class())
+				}
+			}
+
+			file := filepath.Join(tmp, "file")
+			if err := os.WriteFile(file, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case batch := <-es.EventsChan():
+					for _, e := range batch {
+						if e.Path == file {
+							return
+						}
+					}
+				case <-timeout:
+					t.Fatal("no event delivered")
+				}
+			}
+		})
+	}
+}
+
+func TestDispatchQueue(t *testing.T) {
+	q, _, _ := purego.SyscallN(lib.dispatchQueueCreate, 0, 0)
+	defer purego.SyscallN(lib.dispatchRelease, q)
+
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(tmp, "file")
+
+	stopped := make(chan struct{})
+	es := &EventStream{Paths: []string{tmp}, Flags: FileEvents, DispatchQueue: q}
+	es.RawHandler = func(b *RawBatch) {
+		for i := 0; i < b.Len(); i++ {
+			if b.Path(i) == file {
+				// Stopping from a callback on the queue must not
+				// wait for itself.
+				es.Stop()
+				close(stopped)
+				return
+			}
+		}
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := es.RawQueue(); have != q {
+		t.Errorf("RawQueue() = %#x, want the supplied queue %#x", have, q)
+	}
+
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+	}
+
+	// The queue is still ours and still usable.
+	purego.SyscallN(lib.dispatchSyncF, q, 0, noopFunction())
+}
+
+func TestSharedQueue(t *testing.T) {
+	q := NewSharedQueue(QoSUtility)
+	var streams []*EventStream
+	var files []string
+	for i := 0; i < 3; i++ {
+		tmp, err := filepath.EvalSymlinks(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		es := New([]string{tmp}, WithFlags(FileEvents), WithSharedQueue(q), WithBufferSize(10))
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer es.Stop()
+		streams = append(streams, es)
+		files = append(files, filepath.Join(tmp, "file"))
+	}
+	queue, _ := streams[0].RawQueue()
+	for i, es := range streams {
+		if have, _ := es.RawQueue(); have != queue {
+			t.Errorf("stream %d on queue %#x, want %#x", i, have, queue)
+		}
+	}
+
+	for _, file := range files {
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeout := time.After(5 * time.Second)
+	for i, es := range streams {
+	wait:
+		for {
+			select {
+			case batch := <-es.EventsChan():
+				for _, e := range batch {
+					if e.Path == files[i] {
+						break wait
+					}
+				}
+			case <-timeout:
+				t.Fatalf("no event delivered to stream %d", i)
+			}
+		}
+	}
+}
+
+func TestScheduleOnRunLoop(t *testing.T) {
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(tmp, "file")
+
+	loops := make(chan uintptr)
+	scheduled := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		defer close(exited)
+
+		rl, _, _ := purego.SyscallN(lib.cfRunLoopGetCurrent)
+		loops <- rl
+		<-scheduled
+		// Returns once the stream's source is gone or the loop is
+		// stopped.
+		purego.SyscallN(lib.cfRunLoopRun)
+	}()
+	rl := <-loops
+
+	delivered := make(chan uintptr, 1)
+	es := &EventStream{Paths: []string{tmp}, Flags: FileEvents, DeliveryMode: DispatchThread}
+	es.Handler = func(batch []Event) {
+		for _, e := range batch {
+			if e.Path == file {
+				cur, _, _ := purego.SyscallN(lib.cfRunLoopGetCurrent)
+				select {
+				case delivered <- cur:
+				default:
+				}
+			}
+		}
+	}
+	es.ScheduleOnRunLoop(rl, "")
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	close(scheduled)
+	if _, err := es.RawQueue(); err == nil {
+		t.Error("RawQueue succeeded for a run loop stream")
+	}
+
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cur := <-delivered:
+		if cur != rl {
+			t.Errorf("Handler ran on run loop %#x, want %#x", cur, rl)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+	}
+
+	es.Stop()
+	purego.SyscallN(lib.cfRunLoopStop, rl)
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run loop didn't exit")
+	}
+}
@@ -0,0 +1,122 @@
+package fsevents
+
+import (
+	"sync"
+	"time"
+)
+
+// OnQuiet calls fn once the stream has delivered no events for d after
+// delivering some, with the highest event ID delivered so far, as a build
+// trigger wants once a burst of changes has settled. Only the events that
+// reach the consumer count: those Filter, ExclusionPaths and the like
+// leave out don't, and those MaxBatchDelay or the other windows hold back
+// count once they're delivered. It's called once for each quiet spell, on
+// a goroutine of its own, and not for the time before the first events.
+// It lasts across Stop and Start, the timer left off while the stream is
+// stopped, until the returned func cancels it.
+func (es *EventStream) OnQuiet(d time.Duration, fn func(lastID uint64)) func() {
+	q := &quietWatch{d: d, fn: fn}
+	es.subMu.Lock()
+	watches := es.quietWatches()
+	es.quiets.Store(append(watches[:len(watches):len(watches)], q))
+	es.subMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			es.subMu.Lock()
+			watches := es.quietWatches()
+			kept := make([]*quietWatch, 0, len(watches))
+			for _, w := range watches {
+				if w != q {
+					kept = append(kept, w)
+				}
+			}
+			es.quiets.Store(kept)
+			es.subMu.Unlock()
+			q.pause()
+		})
+	}
+}
+
+// quietWatch is an OnQuiet callback and its timer.
+type quietWatch struct {
+	d  time.Duration
+	fn func(lastID uint64)
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	armed  bool      // events were delivered since the last call
+	last   time.Time // when the latest were
+	lastID uint64
+}
+
+func (es *EventStream) quietWatches() []*quietWatch {
+	watches, _ := es.quiets.Load().([]*quietWatch)
+	return watches
+}
+
+// noteDelivered restarts the OnQuiet timers of watches for a batch
+// delivered, whose highest event ID was id.
+func noteDelivered(watches []*quietWatch, id uint64) {
+	now := time.Now()
+	for _, q := range watches {
+		q.activity(now, id)
+	}
+}
+
+// maxID returns the highest ID of events.
+func maxID(events []Event) uint64 {
+	var max uint64
+	for i := range events {
+		if events[i].ID > max {
+			max = events[i].ID
+		}
+	}
+	return max
+}
+
+func (q *quietWatch) activity(now time.Time, id uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if id > q.lastID {
+		q.lastID = id
+	}
+	q.last, q.armed = now, true
+	if q.timer == nil {
+		q.timer = time.AfterFunc(q.d, q.fire)
+		return
+	}
+	q.timer.Reset(q.d)
+}
+
+// fire calls fn, unless events came since the timer was set, which
+// reset it, or the watch was paused.
+func (q *quietWatch) fire() {
+	q.mu.Lock()
+	if !q.armed || time.Since(q.last) < q.d {
+		q.mu.Unlock()
+		return
+	}
+	q.armed = false
+	id := q.lastID
+	q.mu.Unlock()
+	q.fn(id)
+}
+
+// pause stops the timer until events are delivered again.
+func (q *quietWatch) pause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	q.armed = false
+}
+
+// pauseQuiet stops the OnQuiet timers as the stream stops.
+func (es *EventStream) pauseQuiet() {
+	for _, q := range es.quietWatches() {
+		q.pause()
+	}
+}
@@ -0,0 +1,86 @@
+package fsevents
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOnQuiet(t *testing.T) {
+	es := &EventStream{
+		Paths:   []string{"/d"},
+		Backend: Manual,
+		Filter:  func(e *Event) bool { return !strings.HasSuffix(e.Path, ".skip") },
+		Handler: func([]Event) {},
+	}
+	const quiet = 50 * time.Millisecond
+	fired := make(chan uint64, 10)
+	cancel := es.OnQuiet(quiet, func(id uint64) { fired <- id })
+	defer cancel()
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	noFiring := func(when string) {
+		t.Helper()
+		select {
+		case id := <-fired:
+			t.Errorf("fired %s, with %d", when, id)
+		case <-time.After(3 * quiet):
+		}
+	}
+	var id uint64
+	// burst injects n events, a fifth of quiet apart, and returns when
+	// it started injecting the last.
+	burst := func(n int, suffix string) time.Time {
+		t.Helper()
+		var last time.Time
+		for i := 0; i < n; i++ {
+			id++
+			last = time.Now()
+			if err := es.Inject([]Event{{Path: "/d/f" + suffix, ID: id}}); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(quiet / 5)
+		}
+		return last
+	}
+	firing := func(want uint64, since time.Time) {
+		t.Helper()
+		select {
+		case have := <-fired:
+			if have != want {
+				t.Errorf("fired with %d, want %d", have, want)
+			}
+			if waited := time.Since(since); waited < quiet {
+				t.Errorf("fired %v after the burst", waited)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't fire")
+		}
+	}
+
+	noFiring("at startup")
+
+	// The timer starts over with each event delivered, not with those
+	// filtered out.
+	end := burst(10, "")
+	burst(2, ".skip")
+	firing(10, end)
+	noFiring("twice for a burst")
+
+	firing(17, burst(5, ""))
+	noFiring("twice for the second burst")
+
+	// Nothing once stopped, or canceled.
+	burst(1, "")
+	es.Stop()
+	noFiring("once stopped")
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	burst(1, "")
+	noFiring("once canceled")
+}
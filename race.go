@@ -0,0 +1,5 @@
+//go:build race
+
+package fsevents
+
+const raceEnabled = true
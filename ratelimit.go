@@ -0,0 +1,169 @@
+package fsevents
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamFlags are the flags of events about the stream rather than an
+// item, which RateLimit always lets through.
+const streamFlags = MustScanSubDirs | KernelDropped | UserDropped | EventIDsWrapped | HistoryDone | RootChanged | Mount | Unmount
+
+// rateLimiter holds back events on paths that exceed RateLimit, merging
+// them until the path's token bucket lets one through again.
+type rateLimiter struct {
+	es    *EventStream
+	rate  float64 // tokens per second
+	burst float64
+
+	mu    sync.Mutex // guards paths
+	paths map[string]*pathBucket
+
+	emitMu sync.Mutex // serializes delivery with the callbacks
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// pathBucket is a path's token bucket and the event held back on it.
+type pathBucket struct {
+	tokens  float64
+	last    time.Time
+	pending *Event
+}
+
+// startRateLimit starts the rate limiter if the stream has RateLimit set.
+func (es *EventStream) startRateLimit() {
+	if es.conf().RateLimit <= 0 || es.limiter != nil {
+		return
+	}
+	burst := es.conf().RateLimit
+	if burst < 1 {
+		burst = 1
+	}
+	l := &rateLimiter{
+		es:    es,
+		rate:  es.conf().RateLimit,
+		burst: burst,
+		paths: map[string]*pathBucket{},
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	es.limiter = l
+	interval := time.Duration(float64(time.Second) / l.rate)
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	} else if interval > 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	go l.run(interval)
+}
+
+// stopRateLimit delivers the events still held back and stops the rate
+// limiter. Like stopDelivery, it must only be called once callbacks can
+// no longer reach the stream, and before stopDelivery.
+func (es *EventStream) stopRateLimit() {
+	l := es.limiter
+	if l == nil {
+		return
+	}
+	close(l.quit)
+	<-l.done
+	es.limiter = nil
+}
+
+// limit returns the events of the batch that are within their path's
+// budget, holding the others back. It reuses the batch's storage.
+func (l *rateLimiter) limit(events []Event) []Event {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := events[:0]
+	for _, e := range events {
+		if e.Flags&streamFlags != 0 {
+			kept = append(kept, e)
+			continue
+		}
+		b := l.paths[e.Path]
+		if b == nil {
+			b = &pathBucket{tokens: l.burst, last: now}
+			l.paths[e.Path] = b
+		}
+		b.refill(now, l.rate, l.burst)
+		switch {
+		case b.pending != nil:
+			b.pending.Flags |= e.Flags
+			if e.ID > b.pending.ID {
+				b.pending.ID = e.ID
+			}
+			atomic.AddUint64(&l.es.stats.RateLimitedEvents, 1)
+		case b.tokens >= 1:
+			b.tokens--
+			kept = append(kept, e)
+		default:
+			held := e
+			b.pending = &held
+			atomic.AddInt64(&l.es.pending, 1)
+		}
+	}
+	tail := events[len(kept):]
+	for i := range tail {
+		tail[i] = Event{}
+	}
+	return kept
+}
+
+func (b *pathBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+func (l *rateLimiter) run(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.release(false)
+		case <-l.quit:
+			l.release(true)
+			return
+		}
+	}
+}
+
+// release delivers the held-back events whose paths have a token again,
+// or all of them if all is set, and forgets the paths that are idle.
+func (l *rateLimiter) release(all bool) {
+	now := time.Now()
+	var batch []Event
+	l.mu.Lock()
+	for path, b := range l.paths {
+		b.refill(now, l.rate, l.burst)
+		if b.pending != nil && (all || b.tokens >= 1) {
+			if batch == nil {
+				batch = newBatch(len(l.paths))[:0]
+			}
+			batch = append(batch, *b.pending)
+			b.pending = nil
+			b.tokens--
+		}
+		if b.pending == nil && b.tokens >= l.burst {
+			delete(l.paths, path)
+		}
+	}
+	l.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].ID < batch[j].ID })
+	atomic.AddInt64(&l.es.pending, -int64(len(batch)))
+	l.emitMu.Lock()
+	defer l.emitMu.Unlock()
+	l.es.handOff(batch)
+}
@@ -0,0 +1,99 @@
+package fsevents
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []Event
+	)
+	es := &EventStream{RateLimit: 20, Handler: func(batch []Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, batch...)
+	}}
+	startPollStream(t, es)
+
+	start := time.Now()
+	for i := 1; i <= 1000; i++ {
+		batch := []Event{{Path: "/noisy", Flags: ItemModified | ItemIsFile, ID: uint64(2 * i)}}
+		if i%100 == 0 {
+			batch = append(batch, Event{Path: "/quiet", Flags: ItemCreated | ItemIsFile, ID: uint64(2*i + 1)})
+		}
+		if i == 1000 {
+			batch[0].Flags |= ItemXattrMod
+			batch = append(batch, Event{Flags: MustScanSubDirs})
+		}
+		es.deliver(batch)
+	}
+	elapsed := time.Since(start)
+	es.Flush(true)
+
+	count := func() (noisy, quiet, stream int, last Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range got {
+			switch e.Path {
+			case "/noisy":
+				noisy++
+				last = e
+			case "/quiet":
+				quiet++
+			default:
+				stream++
+			}
+		}
+		return
+	}
+	noisy, quiet, stream, _ := count()
+	if quiet != 10 || stream != 1 {
+		t.Errorf("got %d of 10 quiet events and %d of 1 stream events", quiet, stream)
+	}
+	if max := 20 + int(20*elapsed.Seconds()) + 1; noisy > max {
+		t.Errorf("%d noisy events delivered in %s, want at most %d", noisy, elapsed, max)
+	}
+
+	// Nothing is lost: the rest is merged and delivered.
+	es.Stop()
+	noisy, _, _, last := count()
+	if last.ID != 2000 || last.Flags != ItemModified|ItemIsFile|ItemXattrMod {
+		t.Errorf("last noisy event %v, want ID 2000 with the flags of all", last)
+	}
+	st := es.Stats()
+	if st.ReceivedEvents != st.DeliveredEvents+st.RateLimitedEvents || st.PendingEvents != 0 {
+		t.Errorf("received %d, delivered %d, rate limited %d, pending %d", st.ReceivedEvents, st.DeliveredEvents, st.RateLimitedEvents, st.PendingEvents)
+	}
+	if int(st.RateLimitedEvents) != 1000-noisy {
+		t.Errorf("RateLimitedEvents = %d, with %d of 1000 noisy events delivered", st.RateLimitedEvents, noisy)
+	}
+}
+
+func TestRateLimitRelease(t *testing.T) {
+	released := make(chan Event, 100)
+	es := &EventStream{RateLimit: 50, Handler: func(batch []Event) {
+		for _, e := range batch {
+			released <- e
+		}
+	}}
+	startPollStream(t, es)
+
+	for i := 1; i <= 60; i++ {
+		es.deliver([]Event{{Path: "/a", Flags: ItemModified, ID: uint64(i)}})
+	}
+	for i := 0; i < 50; i++ {
+		<-released
+	}
+	// The held-back event comes once a token is free again.
+	select {
+	case e := <-released:
+		if e.ID != 60 {
+			t.Errorf("released %v, want the merged event with ID 60", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("held-back event not released")
+	}
+}
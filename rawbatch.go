@@ -0,0 +1,160 @@
+package fsevents
+
+import "sync"
+
+// RawBatch is a read-only view of one callback's events for consumers that
+// want to filter on path bytes before paying for string conversion.
+//
+// A RawBatch and every slice returned by PathBytes are only valid until
+// the RawHandler it was passed to returns: the bytes live in an arena that
+// the next callback overwrites. Copy anything that must outlive the call,
+// for example with Path(i). Using the batch after the handler returns
+// panics; when built with -race the arena is also poisoned on release, so
+// retained PathBytes slices read as 0xff and race with the next callback.
+type RawBatch struct {
+	arena    *rawArena
+	released bool
+}
+
+// rawArena holds the copied batch data. It's owned by the stream and
+// reused across callbacks, under mu: FSEvents serializes its own on the
+// stream's queue, but those of a Poll stream next to it, as with
+// PollNetwork, come from another goroutine.
+type rawArena struct {
+	mu    sync.Mutex
+	buf   []byte
+	ends  []int // ends[i] is the end offset of path i in buf
+	flags []EventFlags
+	ids   []uint64
+}
+
+func (a *rawArena) reset() {
+	a.buf = a.buf[:0]
+	a.ends = a.ends[:0]
+	a.flags = a.flags[:0]
+	a.ids = a.ids[:0]
+}
+
+// add records the flags and ID of the path just appended to buf.
+func (a *rawArena) add(flags EventFlags, id uint64) {
+	a.ends = append(a.ends, len(a.buf))
+	a.flags = append(a.flags, flags)
+	a.ids = append(a.ids, id)
+}
+
+// deliverRawEvents is deliverRaw for the batches of the backends other
+// than Native, which come as Events, recycling them.
+func (es *EventStream) deliverRawEvents(events []Event) {
+	a := &es.raw
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reset()
+	for i := range events {
+		a.buf = append(a.buf, events[i].Path...)
+		a.add(events[i].Flags, events[i].ID)
+	}
+	recycle(events)
+	es.handRaw(a)
+}
+
+// handRaw passes the batch in a to es.RawHandler. Callers hold a.mu.
+func (es *EventStream) handRaw(a *rawArena) {
+	n := len(a.ends)
+	es.countReceived(n)
+	var max uint64
+	for _, id := range a.ids {
+		if id > max {
+			max = id
+		}
+	}
+	es.storeEventID(max)
+	if max != 0 {
+		// Once RawHandler has returned, as deliver does for the others.
+		defer es.markHanded(max)
+	}
+
+	b := &RawBatch{arena: a}
+	es.conf().RawHandler(b)
+	b.released = true
+	es.countDelivered(n)
+	es.checkRaw(a)
+
+	if raceEnabled {
+		buf := a.buf[:cap(a.buf)]
+		for i := range buf {
+			buf[i] = 0xff
+		}
+	}
+}
+
+// checkRaw has the stream's watches on its roots and its volume look at
+// the batch in a, as deliver has them look at the others.
+func (es *EventStream) checkRaw(a *rawArena) {
+	var roots []Event
+	mounts := false
+	for i, flags := range a.flags {
+		if flags&(Mount|Unmount) != 0 {
+			mounts = true
+		}
+		if flags&(RootChanged|ItemRemoved) != 0 && es.rootCheck != nil {
+			start := 0
+			if i > 0 {
+				start = a.ends[i-1]
+			}
+			roots = append(roots, Event{Path: string(a.buf[start:a.ends[i]]), Flags: flags})
+		}
+	}
+	if roots != nil {
+		es.checkRoots(roots)
+	}
+	if mounts {
+		mountPoints.invalidate()
+		es.checkMount()
+	}
+}
+
+func (b *RawBatch) check() {
+	if b.released {
+		panic("fsevents: RawBatch used after its handler returned")
+	}
+}
+
+// Len returns the number of events in the batch.
+func (b *RawBatch) Len() int {
+	b.check()
+	return len(b.arena.ends)
+}
+
+// PathBytes returns the path of event i. The slice must not be modified
+// or retained after the handler returns.
+func (b *RawBatch) PathBytes(i int) []byte {
+	b.check()
+	start := 0
+	if i > 0 {
+		start = b.arena.ends[i-1]
+	}
+	end := b.arena.ends[i]
+	return b.arena.buf[start:end:end]
+}
+
+// Path returns a copy of the path of event i.
+func (b *RawBatch) Path(i int) string {
+	return string(b.PathBytes(i))
+}
+
+// Flags returns the flags of event i.
+func (b *RawBatch) Flags(i int) EventFlags {
+	b.check()
+	return b.arena.flags[i]
+}
+
+// ID returns the event ID of event i.
+func (b *RawBatch) ID(i int) uint64 {
+	b.check()
+	return b.arena.ids[i]
+}
+
+// Event returns event i as an Event, copying its path.
+func (b *RawBatch) Event(i int) Event {
+	return Event{Path: b.Path(i), Flags: b.Flags(i), ID: b.ID(i)}
+}
@@ -0,0 +1,132 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRawBatch(t *testing.T) {
+	var have []Event
+	es := &EventStream{RawHandler: func(b *RawBatch) {
+		for i := 0; i < b.Len(); i++ {
+			if bytes.HasPrefix(b.PathBytes(i), []byte("/tmp/dir-1/")) {
+				have = append(have, b.Event(i))
+			}
+		}
+	}}
+	info := registry.Add(es)
+	defer registry.Delete(info)
+
+	newCBatch(25).call(info)
+
+	if len(have) != 3 {
+		t.Fatalf("got %d events, want 3: %v", len(have), have)
+	}
+	want := Event{Path: "/tmp/dir-1/file-11", Flags: ItemModified | ItemIsFile, ID: 12}
+	if have[1] != want {
+		t.Errorf("got %#v, want %#v", have[1], want)
+	}
+	if es.EventID != 25 {
+		t.Errorf("EventID = %d, want 25", es.EventID)
+	}
+}
+
+func TestRawBatchUseAfterReturn(t *testing.T) {
+	var kept *RawBatch
+	es := &EventStream{RawHandler: func(b *RawBatch) { kept = b }}
+	info := registry.Add(es)
+	defer registry.Delete(info)
+
+	newCBatch(2).call(info)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("using a RawBatch after its handler returned did not panic")
+		}
+	}()
+	kept.PathBytes(0)
+}
+
+func TestRawBatchRetainedSlicePoisoned(t *testing.T) {
+	if !raceEnabled {
+		t.Skip("arena poisoning is only enabled with -race")
+	}
+
+	var kept []byte
+	es := &EventStream{RawHandler: func(b *RawBatch) { kept = b.PathBytes(0) }}
+	info := registry.Add(es)
+	defer registry.Delete(info)
+
+	newCBatch(1).call(info)
+
+	for _, c := range kept {
+		if c != 0xff {
+			t.Fatalf("retained PathBytes slice still readable after release: %q", kept)
+		}
+	}
+}
+
+func TestRawHandlerBackends(t *testing.T) {
+	for _, backend := range []Backend{Poll, KQueue, Manual} {
+		t.Run(backend.String(), func(t *testing.T) {
+			dir, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths := make(chan string, 100)
+			es := &EventStream{
+				Paths:        []string{dir},
+				Backend:      backend,
+				PollInterval: 10 * time.Millisecond,
+				RawHandler: func(b *RawBatch) {
+					for i := 0; i < b.Len(); i++ {
+						select {
+						case paths <- b.Path(i):
+						default:
+						}
+					}
+				},
+			}
+			if err := es.Start(); errors.Is(err, ErrUnsupportedPlatform) {
+				t.Skip(err)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			file := filepath.Join(dir, "f")
+			if backend == Manual {
+				if err := es.Inject([]Event{{Path: file, Flags: ItemCreated | ItemIsFile}}); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.WriteFile(file, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case path := <-paths:
+				if !strings.HasPrefix(path, dir) {
+					t.Errorf("RawHandler got %s, want a path in %s", path, dir)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("RawHandler not called")
+			}
+
+			stopped := make(chan struct{})
+			go func() {
+				es.Stop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Stop hung")
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package fsevents
+
+import "errors"
+
+// errRawPaths is returned by Start for a RawPaths stream with settings
+// that put other paths in events than those FSEvents reported.
+var errRawPaths = errors.New("fsevents: RawPaths needs the Native or Manual backend, without PollNetwork, FallbackToPolling or DirsOnly")
+
+// checkRawPaths reports whether the stream's RawPaths can be used with
+// its other settings.
+func (es *EventStream) checkRawPaths() error {
+	if !es.conf().RawPaths {
+		return nil
+	}
+	if es.conf().Backend != Native && es.conf().Backend != Manual || es.polls() || es.conf().Kind == DirsOnly {
+		return errRawPaths
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package fsevents
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRawPathsSettings(t *testing.T) {
+	for i, tt := range []struct {
+		opts []Option
+		ok   bool
+	}{
+		{[]Option{WithBackend(Manual)}, true},
+		{[]Option{WithBackend(Manual), WithKind(FilesOnly)}, true},
+		{[]Option{WithBackend(Poll), WithPollInterval(time.Hour)}, false},
+		{[]Option{WithBackend(KQueue)}, false},
+		{[]Option{WithBackend(Manual), WithKind(DirsOnly)}, false},
+		{[]Option{func(es *EventStream) { es.PollNetwork = true }}, false},
+	} {
+		es := New([]string{t.TempDir()}, append(tt.opts, WithRawPaths(true))...)
+		if err := es.checkRawPaths(); (err == nil) != tt.ok {
+			t.Errorf("%d: checkRawPaths() = %v", i, err)
+		}
+		if tt.ok {
+			continue
+		}
+		if err := es.Start(); err != errRawPaths {
+			es.Stop()
+			t.Errorf("%d: Start() = %v, want errRawPaths", i, err)
+		}
+		es.RawPaths = false
+		if _, err := es.Clone(WithRawPaths(true)); err != errRawPaths {
+			t.Errorf("%d: Clone() = %v, want errRawPaths", i, err)
+		}
+	}
+}
+
+func TestRawPathsWatcher(t *testing.T) {
+	withFakeVolumes(t, DeviceInfo{Dev: 2, MountPoint: "/Volumes/Disk", FSType: "apfs", Local: true, UUID: "DISK"})
+	w, err := WatchAllVolumes(WithRawPaths(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	go w.volume(2).es.deliver([]Event{{Path: "a/b", ID: 7}})
+	if have := <-w.EventsChan(); len(have) != 1 || have[0].Path != "a/b" || have[0].Device != 2 {
+		t.Errorf("got %v, want a/b on device 2 as reported", have)
+	}
+}
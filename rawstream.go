@@ -0,0 +1,37 @@
+package fsevents
+
+import "errors"
+
+// ErrNotStarted is returned for operations that need a running stream.
+var ErrNotStarted = errors.New("fsevents: stream not started")
+
+// RawStream returns the stream's FSEventStreamRef, for passing to other
+// code that works with FSEvents directly. It returns ErrNotStarted unless
+// the stream was started with the Native backend and not yet stopped.
+//
+// This is unsafe in the way any raw pointer is. The reference is only
+// valid until Stop, and RawStream must not be called concurrently with
+// Start, Stop or Restart. The stream is owned by the EventStream: callers
+// may query it (FSEventStreamCopyDescription, FSEventStreamGetLatestEventId
+// and the like) or flush it, but must not stop, invalidate or release it,
+// schedule it elsewhere or change its context. A caller that keeps the
+// reference past Stop must take its own retain beforehand.
+func (es *EventStream) RawStream() (uintptr, error) {
+	if es.stream == 0 {
+		return 0, ErrNotStarted
+	}
+	return uintptr(es.stream), nil
+}
+
+// RawQueue returns the dispatch_queue_t the stream's callbacks run on,
+// under the same conditions as RawStream. A stream scheduled with
+// ScheduleOnRunLoop has no queue, so RawQueue returns ErrNotStarted. Work submitted to the queue runs
+// serially with the callbacks, which is safe; the queue must not be
+// suspended for long, since that stalls delivery, and must not be
+// released without a matching dispatch_retain.
+func (es *EventStream) RawQueue() (uintptr, error) {
+	if es.qref == 0 {
+		return 0, ErrNotStarted
+	}
+	return uintptr(es.qref), nil
+}
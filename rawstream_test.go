@@ -0,0 +1,23 @@
+package fsevents
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRawStreamNotStarted(t *testing.T) {
+	for _, es := range []*EventStream{{}, {Backend: Poll, Paths: []string{t.TempDir()}}} {
+		if es.Backend == Poll {
+			if err := es.Start(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ref, err := es.RawStream(); ref != 0 || !errors.Is(err, ErrNotStarted) {
+			t.Errorf("%v: RawStream() = %#x, %v; want 0, ErrNotStarted", es.Backend, ref, err)
+		}
+		if ref, err := es.RawQueue(); ref != 0 || !errors.Is(err, ErrNotStarted) {
+			t.Errorf("%v: RawQueue() = %#x, %v; want 0, ErrNotStarted", es.Backend, ref, err)
+		}
+		es.Stop()
+	}
+}
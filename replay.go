@@ -0,0 +1,136 @@
+package fsevents
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReplayResult describes a finished or aborted Replay.
+type ReplayResult struct {
+	Events  int           // events passed to the handler
+	Batches int           // batches they arrived in
+	LastID  uint64        // the highest event ID passed to the handler
+	Elapsed time.Duration // from the start of the replay to its end
+	Done    bool          // HistoryDone was reached
+
+	doneID uint64 // the ID of the HistoryDone event
+}
+
+// Replay passes the recorded events on the stream's paths since the event
+// ID from to handler, one at a time, until FSEvents reports HistoryDone.
+// It uses a stream of its own, with es's Paths, Flags, Device, UUID,
+// ExclusionPaths, ExclusionPatterns and Kind but not its Filter, so es
+// itself is left as it is, whether running or not. Handler runs on the
+// calling goroutine and can count the events to show progress; an error
+// from it aborts the replay and is returned. Only the Native backend has
+// a history.
+func (es *EventStream) Replay(from uint64, handler func(Event) error) (ReplayResult, error) {
+	return es.replay(context.Background(), from, handler)
+}
+
+// ChangedSince returns the events recorded on root and below since the
+// event ID sinceID, up to HistoryDone, and the ID to pass the next time
+// to go on from there: a query for tools that run now and then, with no
+// stream to keep running. A non-zero device makes root relative to its
+// root, as EventStream.Device does. The events are those of the
+// FileEvents flag, one for each item. It uses a stream of its own, which
+// it stops and releases before returning, and fails with ctx's error if
+// ctx is done before HistoryDone.
+func ChangedSince(ctx context.Context, root string, device int32, sinceID uint64) ([]Event, uint64, error) {
+	tmp := &EventStream{Paths: []string{root}, Flags: FileEvents, Device: device}
+	var events []Event
+	res, err := tmp.replay(ctx, sinceID, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	next := sinceID
+	for _, id := range []uint64{res.LastID, res.doneID} {
+		if id > next {
+			next = id
+		}
+	}
+	return events, next, nil
+}
+
+// replay is Replay, giving up once ctx is done.
+func (es *EventStream) replay(ctx context.Context, from uint64, handler func(Event) error) (ReplayResult, error) {
+	var res ReplayResult
+	c := es.conf()
+	if c.Backend != Native {
+		return res, fmt.Errorf("fsevents: the %v backend has no history to replay", c.Backend)
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	start := time.Now()
+	tmp := &EventStream{
+		Paths:             c.Paths,
+		KeepNestedPaths:   c.KeepNestedPaths,
+		Flags:             c.Flags,
+		Device:            c.Device,
+		UUID:              es.UUID,
+		ExclusionPaths:    c.ExclusionPaths,
+		ExclusionPatterns: c.ExclusionPatterns,
+		Kind:              c.Kind,
+		Resume:            true,
+		EventID:           from,
+		BufferSize:        16,
+	}
+	if err := tmp.Start(); err != nil {
+		return res, err
+	}
+	events := tmp.Events
+
+	var err error
+loop:
+	for {
+		select {
+		case batch, ok := <-events:
+			if !ok {
+				// The volume went away.
+				err = &UnmountedError{Device: tmp.Device}
+				break loop
+			}
+			err = res.add(batch, handler)
+			tmp.Recycle(batch)
+			if res.Done || err != nil {
+				break loop
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		}
+	}
+	tmp.stopDraining(events)
+	res.Elapsed = time.Since(start)
+	return res, err
+}
+
+// add passes the events of batch up to HistoryDone to handler.
+func (res *ReplayResult) add(batch []Event, handler func(Event) error) error {
+	n := res.Events
+	defer func() {
+		if res.Events > n {
+			res.Batches++
+		}
+	}()
+	for _, e := range batch {
+		if e.Flags&HistoryDone != 0 {
+			res.Done = true
+			res.doneID = e.ID
+			return nil
+		}
+		if err := handler(e); err != nil {
+			return err
+		}
+		res.Events++
+		if e.ID > res.LastID {
+			res.LastID = e.ID
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package fsevents
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplayResultAdd(t *testing.T) {
+	var res ReplayResult
+	var seen []uint64
+	handler := func(e Event) error {
+		if e.Path == "fail" {
+			return errors.New("fail")
+		}
+		seen = append(seen, e.ID)
+		return nil
+	}
+
+	if err := res.add([]Event{{ID: 3}, {ID: 2}}, handler); err != nil {
+		t.Fatal(err)
+	}
+	if err := res.add([]Event{{ID: 4}, {Flags: HistoryDone, ID: 9}, {ID: 10}}, handler); err != nil {
+		t.Fatal(err)
+	}
+	want := ReplayResult{Events: 3, Batches: 2, LastID: 4, Done: true, doneID: 9}
+	if res != want || len(seen) != 3 {
+		t.Errorf("got %+v after %v, want %+v", res, seen, want)
+	}
+
+	res = ReplayResult{}
+	if err := res.add([]Event{{ID: 5}, {Path: "fail", ID: 6}}, handler); err == nil {
+		t.Error("handler error not returned")
+	}
+	if res.Events != 1 || res.LastID != 5 || res.Done {
+		t.Errorf("got %+v after a handler error", res)
+	}
+	res = ReplayResult{}
+	res.add([]Event{{Flags: HistoryDone}}, handler)
+	if res.Batches != 0 {
+		t.Errorf("a batch without events counted: %+v", res)
+	}
+}
+
+func TestReplayNoHistory(t *testing.T) {
+	es := &EventStream{Paths: []string{t.TempDir()}, Backend: Poll}
+	if _, err := es.Replay(0, func(Event) error { return nil }); err == nil {
+		t.Error("Replay() on the Poll backend succeeded")
+	}
+}
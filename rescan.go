@@ -0,0 +1,241 @@
+package fsevents
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Rescanner keeps a snapshot of the trees below its roots, recording each
+// item's kind, size, modification time, mode and inode, to recover from
+// lost events: all that's left to do when FSEvents drops them, skips IDs
+// or a stream is started without resuming is to walk the trees again and
+// compare. Set as EventStream.Rescanner it does so by itself; Rescan does
+// it on demand. Its roots should be real paths, like the event paths.
+type Rescanner struct {
+	// Gaps makes a stream rescan all the roots after a gap in the event
+	// IDs too. See EventStream.OnGap for when gaps are meaningful.
+	Gaps bool
+
+	roots []string
+
+	mu       sync.Mutex
+	snapshot map[string]pollEntry
+}
+
+// ErrBadSnapshot is returned by LoadRescanner for a file that isn't a
+// snapshot saved by Rescanner.Save, or that's been corrupted.
+var ErrBadSnapshot = errors.New("fsevents: bad rescanner snapshot")
+
+// snapshotMagic starts the files written by Rescanner.Save.
+const snapshotMagic = "fsevents snapshot 1\n"
+
+// NewRescanner returns a Rescanner with a snapshot of the trees below
+// roots as they are now.
+func NewRescanner(roots ...string) *Rescanner {
+	r := &Rescanner{roots: make([]string, len(roots))}
+	for i, root := range roots {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		r.roots[i] = filepath.Clean(root)
+	}
+	r.snapshot = walkTree(r.roots, 0)
+	return r
+}
+
+// Roots returns the Rescanner's roots.
+func (r *Rescanner) Roots() []string {
+	return append([]string(nil), r.roots...)
+}
+
+// Rescan walks path, which must be one of the roots or below one, and
+// returns events for the differences from the snapshot: ItemCreated,
+// ItemRemoved, ItemModified, ItemInodeMetaMod and ItemRenamed, with the
+// item's kind, as the Poll backend reports them. The events are sorted by
+// path and carry no ID. The snapshot is updated to match, so the same
+// change isn't reported twice; one delivered live in the meantime is
+// reported again. It returns nil for a path outside the roots.
+func (r *Rescanner) Rescan(path string) []Event {
+	path = filepath.Clean(path)
+	if !underAny(path, r.roots) {
+		return nil
+	}
+	cur := walkTree([]string{path}, 0)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := map[string]pollEntry{}
+	dirs := []string{path}
+	for p, e := range r.snapshot {
+		if underAny(p, dirs) {
+			prev[p] = e
+			delete(r.snapshot, p)
+		}
+	}
+	for p, e := range cur {
+		r.snapshot[p] = e
+	}
+	return diffTrees(prev, cur)
+}
+
+// rescanTargets returns the paths to rescan for a batch: every root after
+// lost events, or else the directories of MustScanSubDirs events.
+func (r *Rescanner) rescanTargets(events []Event, gap bool) []string {
+	var dirs []string
+	for _, e := range events {
+		if gap && r.Gaps || e.Flags&(KernelDropped|UserDropped) != 0 {
+			return r.roots
+		}
+		if e.Flags&MustScanSubDirs != 0 && !underAny(filepath.Clean(e.Path), dirs) {
+			dirs = append(dirs, filepath.Clean(e.Path))
+		}
+	}
+	return dirs
+}
+
+// rescan delivers the differences the Rescanner finds below dirs.
+func (es *EventStream) rescan(dirs []string) {
+	for _, dir := range dirs {
+		if events := es.conf().Rescanner.Rescan(dir); len(events) > 0 {
+			es.deliver(events)
+		}
+	}
+}
+
+// Save writes the snapshot to file, for LoadRescanner to pick up later,
+// such as the next time the program starts. The file is replaced
+// atomically.
+func (r *Rescanner) Save(file string) error {
+	r.mu.Lock()
+	paths := make([]string, 0, len(r.snapshot))
+	for p := range r.snapshot {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	// Sorted paths share most of their prefix with the one before, so
+	// only the rest is written.
+	b := append([]byte(snapshotMagic), make([]byte, 4)...)
+	b = appendUvarint(b, uint64(len(r.roots)))
+	for _, root := range r.roots {
+		b = appendUvarint(b, uint64(len(root)))
+		b = append(b, root...)
+	}
+	b = appendUvarint(b, uint64(len(paths)))
+	prev := ""
+	for _, p := range paths {
+		e := r.snapshot[p]
+		n := 0
+		for n < len(prev) && n < len(p) && prev[n] == p[n] {
+			n++
+		}
+		b = appendUvarint(b, uint64(n))
+		b = appendUvarint(b, uint64(len(p)-n))
+		b = append(b, p[n:]...)
+		b = appendUvarint(b, uint64(e.kind))
+		b = appendUvarint(b, uint64(e.size))
+		b = appendUvarint(b, uint64(e.mtime))
+		b = appendUvarint(b, uint64(e.mode))
+		b = appendUvarint(b, e.ino)
+		prev = p
+	}
+	r.mu.Unlock()
+	binary.LittleEndian.PutUint32(b[len(snapshotMagic):], crc32.ChecksumIEEE(b[len(snapshotMagic)+4:]))
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// LoadRescanner returns a Rescanner with the roots and snapshot saved to
+// file by Rescanner.Save. Rescanning its roots then reports what changed
+// since the snapshot was taken.
+func LoadRescanner(file string) (*Rescanner, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	hdr := len(snapshotMagic) + 4
+	if len(b) < hdr || !bytes.HasPrefix(b, []byte(snapshotMagic)) ||
+		crc32.ChecksumIEEE(b[hdr:]) != binary.LittleEndian.Uint32(b[len(snapshotMagic):]) {
+		return nil, fmt.Errorf("%w: %s", ErrBadSnapshot, file)
+	}
+	br := bufio.NewReader(bytes.NewReader(b[hdr:]))
+	readString := func(prefix string) (string, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return "", err
+		}
+		s := make([]byte, len(prefix), len(prefix)+int(n))
+		copy(s, prefix)
+		if _, err := io.ReadFull(br, s[len(prefix):cap(s)]); err != nil {
+			return "", err
+		}
+		return string(s[:cap(s)]), nil
+	}
+	readUvarints := func(v ...*uint64) error {
+		for _, p := range v {
+			var err error
+			if *p, err = binary.ReadUvarint(br); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	r := &Rescanner{}
+	var roots, count uint64
+	if err := readUvarints(&roots); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrBadSnapshot, file, err)
+	}
+	for i := uint64(0); i < roots; i++ {
+		root, err := readString("")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrBadSnapshot, file, err)
+		}
+		r.roots = append(r.roots, root)
+	}
+	if err := readUvarints(&count); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrBadSnapshot, file, err)
+	}
+	r.snapshot = make(map[string]pollEntry, count)
+	prev := ""
+	for i := uint64(0); i < count; i++ {
+		var shared, kind, size, mtime, mode, ino uint64
+		err := readUvarints(&shared)
+		if err == nil && shared > uint64(len(prev)) {
+			err = errors.New("bad path prefix")
+		}
+		var p string
+		if err == nil {
+			p, err = readString(prev[:shared])
+		}
+		if err == nil {
+			err = readUvarints(&kind, &size, &mtime, &mode, &ino)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrBadSnapshot, file, err)
+		}
+		r.snapshot[p] = pollEntry{
+			kind:  EventFlags(kind),
+			size:  int64(size),
+			mtime: int64(mtime),
+			mode:  fs.FileMode(mode),
+			ino:   ino,
+		}
+		prev = p
+	}
+	return r, nil
+}
@@ -0,0 +1,150 @@
+package fsevents
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// rescanTree returns a directory with a few files, as a real path.
+func rescanTree(t *testing.T) string {
+	t.Helper()
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"sub", "gone"} {
+		if err := os.Mkdir(filepath.Join(tmp, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a", "b", "c", "sub/d", "gone/e"} {
+		if err := os.WriteFile(filepath.Join(tmp, file), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tmp
+}
+
+// mutate changes the tree made by rescanTree, returning the events a
+// rescan should report for it.
+func mutate(t *testing.T, tmp string) []Event {
+	t.Helper()
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Created first, so it can't reuse a removed file's inode and look
+	// like a rename.
+	must(os.WriteFile(filepath.Join(tmp, "sub/new"), nil, 0o644))
+	must(os.WriteFile(filepath.Join(tmp, "a"), []byte("longer"), 0o644))
+	must(os.Remove(filepath.Join(tmp, "b")))
+	must(os.Chmod(filepath.Join(tmp, "c"), 0o600))
+	must(os.Rename(filepath.Join(tmp, "sub/d"), filepath.Join(tmp, "sub/renamed")))
+	must(os.RemoveAll(filepath.Join(tmp, "gone")))
+	return []Event{
+		{Path: filepath.Join(tmp, "a"), Flags: ItemModified | ItemIsFile},
+		{Path: filepath.Join(tmp, "b"), Flags: ItemRemoved | ItemIsFile},
+		{Path: filepath.Join(tmp, "c"), Flags: ItemInodeMetaMod | ItemIsFile},
+		{Path: filepath.Join(tmp, "gone"), Flags: ItemRemoved | ItemIsDir},
+		{Path: filepath.Join(tmp, "gone/e"), Flags: ItemRemoved | ItemIsFile},
+		{Path: filepath.Join(tmp, "sub/d"), Flags: ItemRenamed | ItemIsFile},
+		{Path: filepath.Join(tmp, "sub/new"), Flags: ItemCreated | ItemIsFile},
+		{Path: filepath.Join(tmp, "sub/renamed"), Flags: ItemRenamed | ItemIsFile},
+	}
+}
+
+func TestRescan(t *testing.T) {
+	tmp := rescanTree(t)
+	r := NewRescanner(tmp)
+	if events := r.Rescan(tmp); len(events) != 0 {
+		t.Fatalf("rescan of an unchanged tree: %v", events)
+	}
+
+	want := mutate(t, tmp)
+	if have := r.Rescan(filepath.Join(tmp, "sub")); !reflect.DeepEqual(have, want[5:]) {
+		t.Errorf("rescan of sub got %v, want %v", have, want[5:])
+	}
+	if have := r.Rescan(tmp); !reflect.DeepEqual(have, want[:5]) {
+		t.Errorf("rescan got %v, want %v", have, want[:5])
+	}
+	if events := r.Rescan(tmp); len(events) != 0 {
+		t.Errorf("second rescan reported %v again", events)
+	}
+	if events := r.Rescan(filepath.Dir(tmp)); events != nil {
+		t.Errorf("rescan outside the roots: %v", events)
+	}
+}
+
+func TestRescannerSave(t *testing.T) {
+	tmp := rescanTree(t)
+	file := filepath.Join(t.TempDir(), "snapshot")
+	if err := NewRescanner(tmp).Save(file); err != nil {
+		t.Fatal(err)
+	}
+	want := mutate(t, tmp)
+
+	r, err := LoadRescanner(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roots := r.Roots(); !reflect.DeepEqual(roots, []string{tmp}) {
+		t.Errorf("loaded roots %v, want %v", roots, []string{tmp})
+	}
+	if have := r.Rescan(tmp); !reflect.DeepEqual(have, want) {
+		t.Errorf("rescan after loading got %v, want %v", have, want)
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 1
+	if err := os.WriteFile(file, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRescanner(file); !errors.Is(err, ErrBadSnapshot) {
+		t.Errorf("loading a corrupted snapshot = %v, want ErrBadSnapshot", err)
+	}
+}
+
+func TestRescannerStream(t *testing.T) {
+	tmp := rescanTree(t)
+	es := &EventStream{Events: make(chan []Event, 10), Rescanner: NewRescanner(tmp)}
+	want := mutate(t, tmp)
+
+	scan := Event{Path: filepath.Join(tmp, "sub"), Flags: MustScanSubDirs, ID: 10}
+	es.deliver([]Event{scan})
+	if have := <-es.EventsChan(); !reflect.DeepEqual(have, []Event{scan}) {
+		t.Errorf("got %v, want the MustScanSubDirs event first", have)
+	}
+	if have := <-es.EventsChan(); !reflect.DeepEqual(have, want[5:]) {
+		t.Errorf("after MustScanSubDirs got %v, want %v", have, want[5:])
+	}
+
+	es.deliver([]Event{{Path: tmp, Flags: KernelDropped, ID: 11}})
+	<-es.EventsChan()
+	if have := <-es.EventsChan(); !reflect.DeepEqual(have, want[:5]) {
+		t.Errorf("after KernelDropped got %v, want %v", have, want[:5])
+	}
+
+	// Gaps only count with Gaps set.
+	if err := os.WriteFile(filepath.Join(tmp, "f"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	es.deliver([]Event{{Path: tmp, ID: 20}})
+	<-es.EventsChan()
+	if batch := drain(es.Events); len(batch) != 0 {
+		t.Errorf("gap rescanned without Gaps: %v", batch)
+	}
+	es.Rescanner.Gaps = true
+	es.deliver([]Event{{Path: tmp, ID: 30}})
+	<-es.EventsChan()
+	want = []Event{{Path: filepath.Join(tmp, "f"), Flags: ItemCreated | ItemIsFile}}
+	if have := <-es.EventsChan(); !reflect.DeepEqual(have, want) {
+		t.Errorf("after a gap got %v, want %v", have, want)
+	}
+}
@@ -0,0 +1,187 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// RestartPolicy says how an AutoRestart stream retries starting its
+// backend after FSEvents, or kqueue, failed to start or the backend died.
+type RestartPolicy struct {
+	// MinDelay is the wait before the first retry, doubling after each
+	// failure up to MaxDelay. Zero means a tenth of a second, and a zero
+	// MaxDelay thirty seconds.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// MaxAttempts is how many retries fail before the stream gives up.
+	// Zero means it never does. The count starts over once a retry
+	// succeeds.
+	MaxAttempts int
+}
+
+func (p RestartPolicy) delays() (min, max time.Duration) {
+	min, max = p.MinDelay, p.MaxDelay
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// RestartState is where an AutoRestart stream is in getting its backend
+// back, as reported by Stats.
+type RestartState int32
+
+const (
+	// RestartIdle means the backend is running, or the stream isn't.
+	RestartIdle RestartState = iota
+
+	// RestartWaiting means the backend failed and the stream is waiting
+	// to retry. It's still running, and delivers nothing meanwhile.
+	RestartWaiting
+
+	// RestartGaveUp means MaxAttempts retries failed and the stream
+	// stopped itself. Start resets it.
+	RestartGaveUp
+)
+
+func (s RestartState) String() string {
+	switch s {
+	case RestartIdle:
+		return "Idle"
+	case RestartWaiting:
+		return "Waiting"
+	case RestartGaveUp:
+		return "GaveUp"
+	}
+	return fmt.Sprintf("RestartState(%d)", int32(s))
+}
+
+// RestartError is sent on Errors each time an AutoRestart stream's
+// backend fails to start or dies. If Final is set, the stream gave up: it
+// has stopped itself, and closed Events if it delivers on it, as when
+// its volume goes away.
+type RestartError struct {
+	Failures int // failed starts in a row, counting the one that started it off
+	Err      error
+	Final    bool
+}
+
+func (e *RestartError) Error() string {
+	if e.Final {
+		return fmt.Sprintf("fsevents: giving up restarting after %d failures: %v", e.Failures, e.Err)
+	}
+	return fmt.Sprintf("fsevents: restart failed %d times: %v", e.Failures, e.Err)
+}
+
+func (e *RestartError) Unwrap() error { return e.Err }
+
+// restartLater has restartBackend retry after the backend failed with
+// err, if AutoRestart allows, and reports whether it does. Errors that no
+// retry can fix, such as an unsupported platform, aren't retried. Callers
+// hold lifecycle.
+func (es *EventStream) restartLater(err error) bool {
+	if es.conf().AutoRestart == nil || errors.Is(err, ErrUnsupportedPlatform) {
+		return false
+	}
+	if es.restartQuit != nil {
+		return true
+	}
+	atomic.StoreInt32(&es.restartState, int32(RestartWaiting))
+	es.report(&RestartError{Failures: 1, Err: err})
+	es.restartQuit = make(chan struct{})
+	go es.restartBackend(es.restartQuit, *es.conf().AutoRestart)
+	return true
+}
+
+// restarting reports whether restartBackend is yet to bring the backend
+// back. Callers hold lifecycle.
+func (es *EventStream) restarting() bool {
+	return es.restartQuit != nil
+}
+
+// restartBackend retries starting the backend according to p, resuming
+// from the last event ID delivered, until it succeeds or p gives up. It
+// returns early when quit is closed.
+func (es *EventStream) restartBackend(quit chan struct{}, p RestartPolicy) {
+	delay, max := p.delays()
+	for retry := 1; ; retry++ {
+		timer := time.NewTimer(delay)
+		select {
+		case <-quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !es.retryBackend(quit, retry, p.MaxAttempts) {
+			return
+		}
+		if delay *= 2; delay > max {
+			delay = max
+		}
+	}
+}
+
+// retryBackend makes the retry'th attempt at starting the backend, unless
+// the stream was stopped since restartBackend was started with quit. It
+// reports whether to go on trying.
+func (es *EventStream) retryBackend(quit chan struct{}, retry, maxAttempts int) bool {
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if es.restartQuit != quit {
+		return false
+	}
+	atomic.AddUint64(&es.stats.RestartAttempts, 1)
+	if atomic.LoadUint64(&es.EventID) != 0 {
+		es.Resume = true
+	}
+	err := es.startBackend(es.registryID)
+	if err == nil {
+		es.restartQuit = nil
+		atomic.StoreInt32(&es.restartState, int32(RestartIdle))
+		atomic.AddUint64(&es.stats.Restarts, 1)
+		if es.conf().Backend != Native {
+			// Without a history, what happened while it was down is
+			// lost.
+			batch := newBatch(len(es.conf().Paths))
+			for i, path := range es.conf().Paths {
+				batch[i] = Event{Path: path, Flags: MustScanSubDirs}
+			}
+			es.deliver(batch)
+		}
+		return false
+	}
+	if maxAttempts > 0 && retry >= maxAttempts {
+		es.end(&RestartError{Failures: retry + 1, Err: err, Final: true})
+		atomic.StoreInt32(&es.restartState, int32(RestartGaveUp))
+		return false
+	}
+	es.report(&RestartError{Failures: retry + 1, Err: err})
+	return true
+}
+
+// sourceFailed is called by a backend other than Native whose goroutine
+// stopped with err. Unless AutoRestart brings it back, the stream ends
+// as if s's volume went away: it's stopped, err is reported, and Events
+// is closed.
+func (es *EventStream) sourceFailed(s source, err error) {
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if es.source != s {
+		return
+	}
+	s.stop()
+	es.source = nil
+	err = fmt.Errorf("fsevents: %v: %v backend failed: %w", es, es.conf().Backend, err)
+	if !es.restartLater(err) {
+		es.end(err)
+	}
+}
@@ -0,0 +1,97 @@
+package fsevents
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// killSource has the running backend of es fail as if its goroutine hit
+// an error.
+func killSource(t *testing.T, es *EventStream) error {
+	t.Helper()
+	es.lifecycle.Lock()
+	s := es.source
+	es.lifecycle.Unlock()
+	if s == nil {
+		t.Fatal("no backend running")
+	}
+	err := errors.New("injected")
+	es.sourceFailed(s, err)
+	return err
+}
+
+func TestAutoRestartDeadSource(t *testing.T) {
+	dir := t.TempDir()
+	es := &EventStream{
+		Paths:        []string{dir},
+		Events:       make(chan []Event, 100),
+		Errors:       make(chan error, 10),
+		Backend:      Poll,
+		PollInterval: 10 * time.Millisecond,
+		AutoRestart:  &RestartPolicy{MinDelay: time.Millisecond},
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	injected := killSource(t, es)
+	var rerr *RestartError
+	if err := <-es.ErrorsChan(); !errors.As(err, &rerr) || rerr.Failures != 1 || rerr.Final || !errors.Is(err, injected) {
+		t.Fatalf("got error %v, want a RestartError for the injected failure", err)
+	}
+	waitFor(t, es, dir, MustScanSubDirs)
+	st := es.Stats()
+	if st.Restarts != 1 || st.RestartAttempts != 1 || st.Restart != RestartIdle || !st.Running {
+		t.Errorf("Stats: Restarts %d, RestartAttempts %d, Restart %v, Running %v; want 1, 1, Idle, true",
+			st.Restarts, st.RestartAttempts, st.Restart, st.Running)
+	}
+
+	file := filepath.Join(dir, "f")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, es, file, ItemCreated)
+}
+
+func TestDeadSourceWithoutAutoRestart(t *testing.T) {
+	es := &EventStream{
+		Paths:        []string{t.TempDir()},
+		Events:       make(chan []Event, 100),
+		Errors:       make(chan error, 10),
+		Backend:      Poll,
+		PollInterval: 10 * time.Millisecond,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	injected := killSource(t, es)
+	if err := <-es.ErrorsChan(); !errors.Is(err, injected) {
+		t.Fatalf("got error %v, want the injected failure", err)
+	}
+	for range es.EventsChan() {
+	}
+	if es.Stats().Running {
+		t.Error("stream still running after its backend died")
+	}
+}
+
+func TestRestartPolicyDelays(t *testing.T) {
+	for _, tt := range []struct {
+		p        RestartPolicy
+		min, max time.Duration
+	}{
+		{RestartPolicy{}, 100 * time.Millisecond, 30 * time.Second},
+		{RestartPolicy{MinDelay: time.Second, MaxDelay: time.Minute}, time.Second, time.Minute},
+		{RestartPolicy{MinDelay: time.Minute, MaxDelay: time.Second}, time.Minute, time.Minute},
+	} {
+		if min, max := tt.p.delays(); min != tt.min || max != tt.max {
+			t.Errorf("%+v: delays() = %v, %v; want %v, %v", tt.p, min, max, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHistoryUnavailable is matched by a HistoryError with errors.Is.
+var ErrHistoryUnavailable = errors.New("fsevents: event history unavailable")
+
+// HistoryError reports that a stream can't resume from its EventID, as
+// the FSEvents history it belongs to is gone. Whatever changed since has
+// to be found with a full rescan; the stream then starts afresh, without
+// Resume.
+type HistoryError struct {
+	Device   int32
+	Status   ResumeStatus
+	UUID     string // the history EventID belongs to
+	LiveUUID string // the device's history now
+	EventID  uint64
+	LatestID uint64 // the device's latest event ID
+}
+
+func (e *HistoryError) Error() string {
+	if e.Status == ResumeIDInFuture {
+		return fmt.Sprintf("fsevents: device %d: event ID %d is past the latest, %d", e.Device, e.EventID, e.LatestID)
+	}
+	return fmt.Sprintf("fsevents: device %d: history %q is gone, now %q", e.Device, e.UUID, e.LiveUUID)
+}
+
+func (e *HistoryError) Is(target error) bool { return target == ErrHistoryUnavailable }
+
+// Seams for the tests.
+var (
+	deviceUUID    = GetDeviceUUID
+	latestEventID = func(dev int32) uint64 { return EventIDForDeviceBeforeTime(dev, time.Now()) }
+)
+
+// ResumeStatus says whether saved resume state can still be replayed.
+type ResumeStatus int
+
+const (
+	// ResumeOK means the history since the event ID is available.
+	ResumeOK ResumeStatus = iota
+
+	// ResumeUUIDMismatch means the device's FSEvents history isn't the
+	// one the state was saved against: it was purged, the volume was
+	// reformatted, or it has no history. The IDs mean nothing now.
+	ResumeUUIDMismatch
+
+	// ResumeIDInFuture means the event ID is later than the latest on
+	// the device, so the IDs were reset or wrapped since.
+	ResumeIDInFuture
+)
+
+func (s ResumeStatus) String() string {
+	switch s {
+	case ResumeOK:
+		return "ResumeOK"
+	case ResumeUUIDMismatch:
+		return "ResumeUUIDMismatch"
+	case ResumeIDInFuture:
+		return "ResumeIDInFuture"
+	}
+	return fmt.Sprintf("ResumeStatus(%d)", int(s))
+}
+
+// ValidateResume checks saved state, the device's UUID and the last event
+// ID seen on it, before it's used to resume a stream on that device.
+// Anything but ResumeOK calls for a full rescan instead.
+func ValidateResume(dev int32, uuid string, eventID uint64) ResumeStatus {
+	if err := checkHistory(dev, uuid, eventID); err != nil {
+		return err.Status
+	}
+	return ResumeOK
+}
+
+// checkHistory returns a HistoryError if eventID can't be resumed from on
+// dev, and nil if it can.
+func checkHistory(dev int32, uuid string, eventID uint64) *HistoryError {
+	e := &HistoryError{Device: dev, UUID: uuid, LiveUUID: deviceUUID(dev), EventID: eventID}
+	if e.LiveUUID == "" || e.LiveUUID != uuid {
+		e.Status = ResumeUUIDMismatch
+		return e
+	}
+	if e.LatestID = latestEventID(dev); eventID > e.LatestID {
+		e.Status = ResumeIDInFuture
+		return e
+	}
+	return nil
+}
+
+// CheckHistoryIntegrity reports, with a *HistoryError, whether the history
+// UUID names is gone or no longer reaches EventID, as after the FSEvents
+// database was deleted. Start makes the same check before resuming a
+// stream; a running stream can call it at any time.
+func (es *EventStream) CheckHistoryIntegrity() error {
+	if err := checkHistory(es.historyDevice(), es.UUID, atomic.LoadUint64(&es.EventID)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// historyDevice returns the device whose history the stream's event IDs
+// come from: Device, or else that of the first path.
+func (es *EventStream) historyDevice() int32 {
+	if es.conf().Device != 0 || len(es.conf().Paths) == 0 {
+		return es.conf().Device
+	}
+	dev, err := DeviceForPath(es.conf().Paths[0])
+	if err != nil {
+		return 0
+	}
+	return dev
+}
@@ -0,0 +1,33 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateResume(t *testing.T) {
+	dev, err := DeviceForPath("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid := GetDeviceUUID(dev)
+	latest := EventIDForDeviceBeforeTime(dev, time.Now())
+
+	for _, tc := range []struct {
+		uuid string
+		id   uint64
+		want ResumeStatus
+	}{
+		{uuid, latest, ResumeOK},
+		{uuid, latest / 2, ResumeOK},
+		{"00000000-0000-0000-0000-000000000000", latest, ResumeUUIDMismatch},
+		{"", latest, ResumeUUIDMismatch},
+		{uuid, latest + 1<<40, ResumeIDInFuture},
+	} {
+		if have := ValidateResume(dev, tc.uuid, tc.id); have != tc.want {
+			t.Errorf("ValidateResume(%d, %q, %d) = %v, want %v", dev, tc.uuid, tc.id, have, tc.want)
+		}
+	}
+}
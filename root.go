@@ -0,0 +1,196 @@
+package fsevents
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RootError is sent on Errors when a path that a WaitForRoot stream waits
+// for comes back as a file instead of a directory, or the other way
+// round. The stream goes on waiting for the path to be what it was.
+type RootError struct {
+	Path string
+	Dir  bool // whether the stream waits for a directory
+}
+
+func (e *RootError) Error() string {
+	if e.Dir {
+		return fmt.Sprintf("fsevents: %s is back, but not as a directory", e.Path)
+	}
+	return fmt.Sprintf("fsevents: %s is back, but as a directory", e.Path)
+}
+
+// How long a WaitForRoot stream waits between looks for a missing path,
+// doubling from rootRetryMin, and between looks once they're all there,
+// when no event prompts it to.
+var (
+	rootRetryMin = 100 * time.Millisecond
+	rootRetryMax = 5 * time.Second
+)
+
+// rootState is what watchRoots knows of one of the stream's paths.
+type rootState struct {
+	path     string
+	dir      bool        // expected to be a directory
+	fi       os.FileInfo // nil while missing
+	reported bool        // a RootError was sent since it went missing
+}
+
+// rootStates returns the stream's paths as they are now. A missing path
+// is expected to come back as a directory.
+func (es *EventStream) rootStates() []rootState {
+	roots := make([]rootState, len(es.conf().Paths))
+	for i, path := range es.conf().Paths {
+		roots[i] = rootState{path: filepath.Clean(path), dir: true}
+		if fi, err := os.Stat(path); err == nil {
+			roots[i].dir = fi.IsDir()
+			roots[i].fi = fi
+		}
+	}
+	return roots
+}
+
+// watchRoots restarts the backend when any of roots comes back, or is
+// replaced, looking for them every min, doubling up to max, while one is
+// missing, and otherwise every max and whenever check is signalled after
+// an event on a root. It returns when quit is closed.
+func (es *EventStream) watchRoots(quit, check chan struct{}, roots []rootState, min, max time.Duration) {
+	delay := min
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-timer.C:
+		case <-check:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		es.rootMu.Lock()
+		removed := es.rootsRemoved
+		es.rootsRemoved = nil
+		es.rootMu.Unlock()
+
+		var back []string
+		missing, gone := false, false
+		for i := range roots {
+			r := &roots[i]
+			fi, err := os.Stat(r.path)
+			ok := err == nil && fi.IsDir() == r.dir
+			switch {
+			case err == nil && !ok && !r.reported:
+				es.report(&RootError{Path: r.path, Dir: r.dir})
+				r.reported = true
+			case ok && (r.fi == nil || !os.SameFile(r.fi, fi) || isRoot(r.path, removed)):
+				// Back, or replaced since it was last seen.
+				back = append(back, r.path)
+			case !ok && r.fi != nil:
+				gone = true
+			}
+			if ok {
+				r.fi = fi
+				r.reported = false
+			} else {
+				r.fi = nil
+				missing = true
+			}
+		}
+		if len(back) > 0 && !es.reattach(quit, back) {
+			return
+		}
+
+		switch {
+		case !missing:
+			delay = max
+		case gone:
+			delay = min
+		default:
+			if delay *= 2; delay > max {
+				delay = max
+			}
+		}
+		timer.Reset(delay)
+	}
+}
+
+// checkRoots has watchRoots look now if an event says a root was removed.
+func (es *EventStream) checkRoots(events []Event) {
+	var removed []string
+	for _, e := range events {
+		if e.Flags&(RootChanged|ItemRemoved) != 0 && isRoot(e.Path, es.conf().Paths) {
+			removed = append(removed, e.Path)
+		}
+	}
+	if removed == nil {
+		return
+	}
+	es.rootMu.Lock()
+	es.rootsRemoved = append(es.rootsRemoved, removed...)
+	es.rootMu.Unlock()
+	select {
+	case es.rootCheck <- struct{}{}:
+	default:
+	}
+}
+
+// isRoot reports whether path is one of roots, but for a trailing slash,
+// or for the case of its names where the volume isn't case-sensitive.
+func isRoot(path string, roots []string) bool {
+	path = filepath.Clean(path)
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if root == path || strings.EqualFold(root, path) && !caseSensitive(root) {
+			return true
+		}
+	}
+	return false
+}
+
+// reattach starts the backend afresh now that paths are back, delivering
+// an event on each to say so first, unless the stream was stopped or
+// restarted since watchRoots was started with quit. It reports whether
+// the stream is still running.
+func (es *EventStream) reattach(quit chan struct{}, paths []string) bool {
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if es.rootQuit != quit {
+		return false
+	}
+	// No callback of the old stream may overlap the new one's.
+	es.stopWait = true
+	es.stop()
+	es.stopWait = false
+	if es.source != nil {
+		es.source.stop()
+		es.source = nil
+	}
+
+	batch := newBatch(len(paths))
+	for i, path := range paths {
+		batch[i] = Event{Path: path, Flags: RootChanged | MustScanSubDirs}
+	}
+	es.deliver(batch)
+	es.rootMu.Lock()
+	es.rootsRemoved = nil // the batch doesn't count itself
+	es.rootMu.Unlock()
+
+	if es.restarting() {
+		// restartBackend starts it when it can.
+		return true
+	}
+	if err := es.startBackend(es.registryID); err != nil && !es.restartLater(err) {
+		es.report(err)
+		es.stopLocked()
+		return false
+	}
+	return true
+}
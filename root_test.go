@@ -0,0 +1,87 @@
+package fsevents
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor receives from es.Events until an event on path with all of
+// flags arrives.
+func waitFor(t *testing.T, es *EventStream, path string, flags EventFlags) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case batch := <-es.EventsChan():
+			for _, e := range batch {
+				if e.Path == path && e.Flags&flags == flags {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatalf("no event on %s with %v", path, flags)
+		}
+	}
+}
+
+func TestWaitForRoot(t *testing.T) {
+	defer func(min, max time.Duration) { rootRetryMin, rootRetryMax = min, max }(rootRetryMin, rootRetryMax)
+	rootRetryMin, rootRetryMax = 5*time.Millisecond, 50*time.Millisecond
+
+	root := filepath.Join(t.TempDir(), "out")
+	es := &EventStream{
+		Paths:        []string{root},
+		Events:       make(chan []Event, 100),
+		Errors:       make(chan error, 10),
+		Backend:      Poll,
+		PollInterval: 10 * time.Millisecond,
+		WaitForRoot:  true,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	for i := 0; i < 3; i++ {
+		if err := os.Mkdir(root, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, es, root, RootChanged|MustScanSubDirs)
+		file := filepath.Join(root, "f")
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, es, file, ItemCreated)
+		if err := os.RemoveAll(root); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, es, root, ItemRemoved)
+	}
+
+	// Coming back as a file doesn't count.
+	if err := os.WriteFile(root, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-es.ErrorsChan():
+		var rerr *RootError
+		if !errors.As(err, &rerr) || rerr.Path != root || !rerr.Dir {
+			t.Errorf("got error %v, want a RootError for %s", err, root)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no RootError for a file in place of the root")
+	}
+	if err := os.Remove(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, es, root, RootChanged|MustScanSubDirs)
+	if !es.Stats().Running {
+		t.Error("stream stopped")
+	}
+}
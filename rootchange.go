@@ -0,0 +1,144 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// RootChangedEvent tells what happened to one of the Paths of a WatchRoot
+// stream that an event reported with RootChanged.
+type RootChangedEvent struct {
+	// OldPath is the path as given in Paths.
+	OldPath string
+
+	// NewPath is where the item that was at OldPath is now, symbolic
+	// links resolved: OldPath's if it's still there, the path it was
+	// renamed to within its parent directory or moved to in a sibling
+	// of its parent, or for a path missing since Start, OldPath if it's
+	// there now. It's empty if Gone.
+	NewPath string
+
+	// Gone reports that the item couldn't be found: it was removed, or
+	// moved further than NewPath says the search goes.
+	Gone bool
+
+	// Replaced reports that another item is at OldPath now.
+	Replaced bool
+}
+
+// rootID is what a stream with RootChanges knows of one of its Paths.
+type rootID struct {
+	path     string // as given
+	names    []string
+	resolved string // with symbolic links resolved
+	fi       os.FileInfo
+}
+
+// rootIDs returns the stream's paths as they are now, for
+// resolveRootChanges.
+func (es *EventStream) rootIDs() []rootID {
+	ids := make([]rootID, len(es.conf().Paths))
+	for i, path := range es.conf().Paths {
+		ids[i] = rootID{path: path}
+		for _, form := range rootForms(path, es.conf().Device) {
+			ids[i].names = append(ids[i].names, form.path)
+			ids[i].resolved = form.path
+		}
+		if fi, err := os.Stat(path); err == nil {
+			ids[i].fi = fi
+		}
+	}
+	return ids
+}
+
+// resolveRootChanges sends a RootChangedEvent on RootChanges for each of
+// the stream's paths an event of the batch says changed.
+func (es *EventStream) resolveRootChanges(events []Event) {
+	es.rootMu.Lock()
+	defer es.rootMu.Unlock()
+	for _, e := range events {
+		if e.Flags&RootChanged == 0 {
+			continue
+		}
+		for i := range es.rootInfo {
+			if r := &es.rootInfo[i]; isRoot(e.Path, r.names) {
+				es.sendRootChange(r.resolve())
+			}
+		}
+	}
+}
+
+// resolve looks for the item r was, and takes what's at its path now as
+// what it is from here on.
+func (r *rootID) resolve() RootChangedEvent {
+	ev := RootChangedEvent{OldPath: r.path}
+	cur, err := os.Stat(r.path)
+	if err != nil {
+		cur = nil
+	}
+	switch {
+	case r.fi == nil:
+		if cur != nil {
+			ev.NewPath = r.resolved
+		} else {
+			ev.Gone = true
+		}
+	case cur != nil && os.SameFile(r.fi, cur):
+		ev.NewPath = r.resolved
+	default:
+		ev.Replaced = cur != nil
+		if ev.NewPath = findMoved(r.fi, r.resolved); ev.NewPath == "" {
+			ev.Gone = true
+		}
+	}
+	if cur != nil {
+		r.fi = cur
+	}
+	return ev
+}
+
+// findMoved returns the path of the item fi is of, looking in the
+// directory old was in and in its siblings, or "" if it's in neither.
+func findMoved(fi os.FileInfo, old string) string {
+	parent := filepath.Dir(old)
+	if p := findIn(fi, parent); p != "" {
+		return p
+	}
+	grand := filepath.Dir(parent)
+	entries, err := os.ReadDir(grand)
+	if err != nil {
+		return ""
+	}
+	for _, d := range entries {
+		dir := filepath.Join(grand, d.Name())
+		if !d.IsDir() || dir == parent {
+			continue
+		}
+		if p := findIn(fi, dir); p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+// findIn returns the path of the entry of dir that's the item fi is of,
+// or "".
+func findIn(fi os.FileInfo, dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, d := range entries {
+		if info, err := d.Info(); err == nil && os.SameFile(fi, info) {
+			return filepath.Join(dir, d.Name())
+		}
+	}
+	return ""
+}
+
+func (es *EventStream) sendRootChange(ev RootChangedEvent) {
+	select {
+	case es.RootChanges <- ev:
+	default:
+	}
+}
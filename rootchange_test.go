@@ -0,0 +1,82 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRootChanges(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// change moves or removes the root at tmp/a/root.
+		change func(t *testing.T, tmp, root string)
+		want   RootChangedEvent // with paths relative to tmp
+	}{
+		{"rename in place", func(t *testing.T, tmp, root string) {
+			mustRename(t, root, filepath.Join(tmp, "a", "renamed"))
+		}, RootChangedEvent{NewPath: "a/renamed"}},
+		{"move to sibling", func(t *testing.T, tmp, root string) {
+			mustRename(t, root, filepath.Join(tmp, "b", "root"))
+		}, RootChangedEvent{NewPath: "b/root"}},
+		{"parent renamed", func(t *testing.T, tmp, root string) {
+			mustRename(t, filepath.Join(tmp, "a"), filepath.Join(tmp, "c"))
+		}, RootChangedEvent{NewPath: "c/root"}},
+		{"replaced", func(t *testing.T, tmp, root string) {
+			mustRename(t, root, filepath.Join(tmp, "b", "old"))
+			if err := os.Mkdir(root, 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}, RootChangedEvent{NewPath: "b/old", Replaced: true}},
+		{"deleted", func(t *testing.T, tmp, root string) {
+			if err := os.RemoveAll(root); err != nil {
+				t.Fatal(err)
+			}
+		}, RootChangedEvent{Gone: true}},
+		{"unchanged", func(t *testing.T, tmp, root string) {}, RootChangedEvent{NewPath: "a/root"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			root := filepath.Join(tmp, "a", "root")
+			for _, dir := range []string{root, filepath.Join(tmp, "b")} {
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			es := New([]string{root + "/"}, WithBackend(Manual), WithFlags(WatchRoot), WithBufferSize(1))
+			es.RootChanges = make(chan RootChangedEvent, 1)
+			if err := es.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer es.Stop()
+
+			tt.change(t, tmp, root)
+			if err := es.Inject([]Event{{Path: root, Flags: RootChanged}}); err != nil {
+				t.Fatal(err)
+			}
+			want := tt.want
+			want.OldPath = root + "/"
+			if want.NewPath != "" {
+				want.NewPath = filepath.Join(tmp, want.NewPath)
+			}
+			select {
+			case have := <-es.RootChanges:
+				if have != want {
+					t.Errorf("got %+v, want %+v", have, want)
+				}
+			default:
+				t.Fatal("no RootChangedEvent")
+			}
+		})
+	}
+}
+
+func mustRename(t *testing.T, from, to string) {
+	t.Helper()
+	if err := os.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package fsevents
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Run starts es, passes each batch from es.Events to handler and stops the
+// stream once ctx is done or handler returns an error. It returns the
+// error from Start, the error from handler, ctx.Err(), or an
+// UnmountedError if the stream stopped itself, and only after the stream
+// has been stopped completely, so it fits an errgroup.Group member:
+//
+//	g.Go(func() error { return fsevents.Run(ctx, es, handle) })
+//
+// es must not have a Handler or RawHandler. handler runs on the calling
+// goroutine; the batch is recycled when it returns and must not be
+// retained. Batches still queued when Run stops are discarded.
+//
+// When the Overflow policy drops batches, handler is next called with a
+// batch that holds one event per path in es.Paths with the
+// MustScanSubDirs and UserDropped flags and a zero ID, the way FSEvents
+// reports its own drops, before it sees any later events.
+func Run(ctx context.Context, es *EventStream, handler func(context.Context, []Event) error) error {
+	if es.conf().Handler != nil || es.conf().RawHandler != nil || es.BatchesMeta != nil {
+		return errors.New("fsevents: Run needs the Events channel, but Handler, RawHandler or BatchesMeta is set")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := es.Start(); err != nil {
+		return err
+	}
+	events := es.Events
+
+	var err error
+	dropped := atomic.LoadUint64(&es.stats.DroppedEvents)
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		case batch, ok := <-events:
+			if !ok {
+				// The stream stopped itself as its volume went away.
+				return &UnmountedError{Device: es.conf().Device}
+			}
+			if d := atomic.LoadUint64(&es.stats.DroppedEvents); d != dropped {
+				dropped = d
+				err = handler(ctx, droppedBatch(es.conf().Paths))
+			}
+			if err == nil {
+				err = handler(ctx, batch)
+			}
+			es.Recycle(batch)
+			if err != nil {
+				break loop
+			}
+		}
+	}
+
+	es.stopDraining(events)
+	return err
+}
+
+// stopDraining stops es, discarding the batches on events meanwhile:
+// stopping can wait for a callback that is blocked sending on Events.
+func (es *EventStream) stopDraining(events chan []Event) {
+	stopped := make(chan struct{})
+	go func() {
+		es.Stop()
+		close(stopped)
+	}()
+	for {
+		select {
+		case batch, ok := <-events:
+			if !ok {
+				<-stopped
+				return
+			}
+			es.Recycle(batch)
+		case <-stopped:
+			for {
+				select {
+				case batch, ok := <-events:
+					if !ok {
+						return
+					}
+					es.Recycle(batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// droppedBatch reports lost events on each of paths.
+func droppedBatch(paths []string) []Event {
+	batch := make([]Event, len(paths))
+	for i, p := range paths {
+		batch[i] = Event{Path: p, Flags: MustScanSubDirs | UserDropped}
+	}
+	return batch
+}
@@ -0,0 +1,155 @@
+package fsevents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runPoll runs a Poll stream on a fresh temp dir in the background. Until
+// started is closed it keeps creating files, so the first batch arrives
+// however long Start takes.
+func runPoll(t *testing.T, ctx context.Context, es *EventStream, started chan struct{}, handler func(context.Context, []Event) error) (string, chan error) {
+	t.Helper()
+	tmp := t.TempDir()
+	es.Paths = []string{tmp}
+	es.Backend = Poll
+	es.PollInterval = 10 * time.Millisecond
+
+	errc := make(chan error, 1)
+	go func() { errc <- Run(ctx, es, handler) }()
+	for i := 0; ; i++ {
+		if err := os.WriteFile(filepath.Join(tmp, fmt.Sprint("start-", i)), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-started:
+			return tmp, errc
+		case err := <-errc:
+			select {
+			case <-started:
+				errc <- err
+				return tmp, errc
+			default:
+				t.Fatalf("Run returned early: %v", err)
+			}
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// waitRun returns the result of Run, failing the test if it doesn't stop.
+func waitRun(t *testing.T, es *EventStream, errc chan error) error {
+	t.Helper()
+	select {
+	case err := <-errc:
+		if es.Stats().Running || es.source != nil || es.registryID != 0 {
+			t.Error("Run returned before the stream was stopped")
+		}
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return")
+		return nil
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	es := &EventStream{}
+	started := make(chan struct{})
+	_, errc := runPoll(t, ctx, es, started, func(_ context.Context, batch []Event) error {
+		select {
+		case <-started:
+		default:
+			close(started)
+		}
+		return nil
+	})
+
+	if !es.Stats().Running {
+		t.Error("Stats().Running = false while Run is watching")
+	}
+	cancel()
+	if err := waitRun(t, es, errc); err != context.Canceled {
+		t.Errorf("Run() = %v, want context.Canceled", err)
+	}
+}
+
+func TestRunHandlerError(t *testing.T) {
+	errStop := errors.New("stop")
+	es := &EventStream{}
+	started := make(chan struct{})
+	calls := 0
+	_, errc := runPoll(t, context.Background(), es, started, func(_ context.Context, batch []Event) error {
+		calls++
+		close(started)
+		// Leave the poller blocked on the unbuffered Events channel,
+		// which Run must drain to stop it.
+		if err := os.WriteFile(filepath.Join(es.Paths[0], "blocked"), nil, 0o644); err != nil {
+			return err
+		}
+		es.Flush(false)
+		return errStop
+	})
+
+	if err := waitRun(t, es, errc); err != errStop {
+		t.Errorf("Run() = %v, want %v", err, errStop)
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times after returning an error", calls)
+	}
+}
+
+func TestRunDropped(t *testing.T) {
+	errStop := errors.New("stop")
+	es := &EventStream{BufferSize: 1, Overflow: DropNewest}
+	started := make(chan struct{})
+	var batches [][]Event
+	tmp, errc := runPoll(t, context.Background(), es, started, func(_ context.Context, batch []Event) error {
+		batches = append(batches, append([]Event(nil), batch...))
+		if len(batches) > 1 {
+			return errStop
+		}
+		close(started)
+		// Fill the buffer, then overflow it.
+		for _, name := range []string{"queued", "dropped"} {
+			if err := os.WriteFile(filepath.Join(es.Paths[0], name), nil, 0o644); err != nil {
+				return err
+			}
+			es.Flush(true)
+		}
+		return nil
+	})
+
+	if err := waitRun(t, es, errc); err != errStop {
+		t.Fatalf("Run() = %v, want %v", err, errStop)
+	}
+	if len(batches) != 2 {
+		t.Fatalf("handler got %d batches, want 2", len(batches))
+	}
+	want := Event{Path: tmp, Flags: MustScanSubDirs | UserDropped}
+	if have := batches[1]; len(have) != 1 || have[0] != want {
+		t.Errorf("batch after the drop = %v, want [%v]", have, want)
+	}
+}
+
+func TestRunStartError(t *testing.T) {
+	es := &EventStream{Paths: []string{t.TempDir()}, Backend: Backend(-1)}
+	if err := Run(context.Background(), es, nil); err == nil {
+		t.Error("Run() with an unknown backend succeeded")
+	}
+	if es.registryID != 0 {
+		t.Error("stream left registered after a failed Start")
+	}
+
+	es = &EventStream{Paths: []string{t.TempDir()}, Backend: Poll, Handler: func([]Event) {}}
+	if err := Run(context.Background(), es, nil); err == nil {
+		t.Error("Run() with a Handler succeeded")
+	}
+}
@@ -0,0 +1,91 @@
+package fsevents
+
+import "sync"
+
+// SharedQueue is a serial dispatch queue for the callbacks of several
+// streams, set through EventStream.SharedQueue, so that a program with
+// many streams, such as a Watcher's, doesn't have a queue and a thread
+// for each. The queue is created when the first stream starts on it and
+// released once the last one using it stops; a SharedQueue may be
+// started on again after that. The callbacks of the streams on it run
+// one at a time, so one stream blocked on its Events channel holds up
+// the others.
+type SharedQueue struct {
+	qos QoS
+
+	mu    sync.Mutex
+	ref   fsDispatchQueueRef
+	users int
+}
+
+// NewSharedQueue returns a SharedQueue whose queue, once created, has the
+// quality-of-service class qos.
+func NewSharedQueue(qos QoS) *SharedQueue {
+	return &SharedQueue{qos: qos}
+}
+
+// attach returns the queue for another stream, creating it for the
+// first.
+func (q *SharedQueue) attach() fsDispatchQueueRef {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.users == 0 {
+		q.ref = newSharedDispatchQueue(q.qos)
+	}
+	q.users++
+	return q.ref
+}
+
+// detach is called by a stream that attached once it's done with the
+// queue, and releases the queue after the last.
+func (q *SharedQueue) detach() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.users--
+	if q.users == 0 {
+		releaseDispatchQueue(q.ref)
+		q.ref = 0
+	}
+}
+
+// enterCallback marks a callback of a stream on a SharedQueue as
+// running, unless stop has detached the stream, in which case the
+// callback must deliver nothing.
+func (es *EventStream) enterCallback() bool {
+	if es.shared == nil {
+		return true
+	}
+	es.cbMu.Lock()
+	defer es.cbMu.Unlock()
+	if es.cbDetached {
+		return false
+	}
+	es.cbActive++
+	return true
+}
+
+// exitCallback undoes a successful enterCallback.
+func (es *EventStream) exitCallback() {
+	if es.shared == nil {
+		return
+	}
+	es.cbMu.Lock()
+	defer es.cbMu.Unlock()
+	es.cbActive--
+	if es.cbActive == 0 {
+		es.cbIdle.Broadcast()
+	}
+}
+
+// detachCallbacks stops the callbacks of a stream on a SharedQueue from
+// delivering anything more and, with wait, waits for any still running.
+// It's the stream's own barrier: dispatch_sync on the queue would also
+// wait for the other streams' callbacks.
+func (es *EventStream) detachCallbacks(wait bool) {
+	es.cbMu.Lock()
+	defer es.cbMu.Unlock()
+	es.cbDetached = true
+	for wait && es.cbActive > 0 {
+		es.cbIdle.Wait()
+	}
+}
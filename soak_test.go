@@ -0,0 +1,216 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// soakSample is what TestSoak measures after a GC.
+type soakSample struct {
+	heap       uint64 // bytes of live heap
+	objects    uint64 // live heap objects
+	maxRSS     int64  // peak resident set size so far, in bytes
+	goroutines int
+	held       int // objects in LeakReport, but for callbacks
+}
+
+func takeSoakSample() soakSample {
+	runtime.GC()
+	debug.FreeOSMemory()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	s := soakSample{heap: m.HeapAlloc, objects: m.HeapObjects, maxRSS: ru.Maxrss, goroutines: runtime.NumGoroutine()}
+	for kind, n := range LeakReport() {
+		if kind != "callback" {
+			s.held += n
+		}
+	}
+	return s
+}
+
+// grewFrom reports what grew beyond the soak test's tolerance since
+// before: the heap and its objects by half and then some, peak RSS to
+// twice its size and then some, goroutines and held objects by a few, as
+// streams may be between a Stop and a Start when sampled.
+func (s soakSample) grewFrom(before soakSample) []string {
+	var grew []string
+	if s.heap > before.heap*3/2+4<<20 {
+		grew = append(grew, fmt.Sprintf("heap %d → %d bytes", before.heap, s.heap))
+	}
+	if s.objects > before.objects*3/2+10000 {
+		grew = append(grew, fmt.Sprintf("heap objects %d → %d", before.objects, s.objects))
+	}
+	if s.maxRSS > before.maxRSS*2+64<<20 {
+		grew = append(grew, fmt.Sprintf("peak RSS %d → %d bytes", before.maxRSS, s.maxRSS))
+	}
+	if s.goroutines > before.goroutines+10 {
+		grew = append(grew, fmt.Sprintf("goroutines %d → %d", before.goroutines, s.goroutines))
+	}
+	if s.held > before.held+10 {
+		grew = append(grew, fmt.Sprintf("held CF objects %d → %d", before.held, s.held))
+	}
+	return grew
+}
+
+// TestSoak runs streams on several roots for as long as FSEVENTS_SOAK
+// says, as in FSEVENTS_SOAK=30m, while files are created, renamed and
+// deleted under them and the streams are stopped and restarted now and
+// then. It samples the heap, peak RSS, goroutines and, built with
+// -tags fseventsleaks, the CF objects held, and fails if they grew past
+// the first sample taken after a warm-up, or if anything is still held
+// once the streams are stopped.
+func TestSoak(t *testing.T) {
+	env := os.Getenv("FSEVENTS_SOAK")
+	if env == "" {
+		t.Skip("set FSEVENTS_SOAK to a duration, as in FSEVENTS_SOAK=30m, to run")
+	}
+	d, err := time.ParseDuration(env)
+	if err != nil {
+		t.Fatalf("FSEVENTS_SOAK: %v", err)
+	}
+	interval := d / 20
+	if interval < time.Second {
+		interval = time.Second
+	}
+	checkLeaks := leakCheck(t)
+
+	const roots = 3
+	var (
+		streams []*EventStream
+		wg      sync.WaitGroup
+		done    = make(chan struct{})
+	)
+	for i := 0; i < roots; i++ {
+		root, err := filepath.EvalSymlinks(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		es := &EventStream{
+			Paths:   []string{root},
+			Flags:   FileEvents | NoDefer,
+			Latency: 10 * time.Millisecond,
+			Errors:  make(chan error, 100),
+		}
+		if i == 0 {
+			es.Handler = func([]Event) {}
+		} else {
+			events := make(chan []Event, 16)
+			es.Events = events
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case batch := <-events:
+						es.Recycle(batch)
+					case <-done:
+						return
+					}
+				}
+			}()
+		}
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, es)
+
+		// The names cycle, so the directory stays small.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				path := filepath.Join(root, fmt.Sprint("f", n%100))
+				if err := os.WriteFile(path, []byte(path), 0o644); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := os.Rename(path, path+".renamed"); err != nil {
+					t.Error(err)
+					return
+				}
+				if n%2 == 0 {
+					os.Remove(path + ".renamed")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	restart := time.NewTicker(5 * time.Second)
+	defer restart.Stop()
+	sample := time.NewTicker(interval)
+	defer sample.Stop()
+	warmup := time.After(d / 10)
+	end := time.After(d)
+	var baseline *soakSample
+loop:
+	for {
+		select {
+		case <-restart.C:
+			es := streams[rng.Intn(len(streams))]
+			var err error
+			if rng.Intn(2) == 0 {
+				err = es.Restart()
+			} else {
+				es.Stop()
+				err = es.Start()
+			}
+			if err != nil {
+				t.Errorf("restarting %v: %v", es.Paths, err)
+				break loop
+			}
+		case <-warmup:
+			s := takeSoakSample()
+			baseline = &s
+			t.Logf("baseline: %+v", s)
+		case <-sample.C:
+			if baseline == nil {
+				continue
+			}
+			s := takeSoakSample()
+			t.Logf("sample: %+v", s)
+			if grew := s.grewFrom(*baseline); len(grew) > 0 {
+				t.Errorf("grew since the baseline: %q", grew)
+				break loop
+			}
+		case <-end:
+			break loop
+		}
+	}
+
+	for _, es := range streams {
+		es.Stop()
+	}
+	close(done)
+	wg.Wait()
+	for _, es := range streams {
+		close(es.Errors)
+		for err := range es.Errors {
+			t.Errorf("%v: %v", es.Paths, err)
+		}
+		st := es.Stats()
+		t.Logf("%v: %+v", es.Paths, st)
+		if st.ReceivedEvents == 0 {
+			t.Errorf("%v: no events received", es.Paths)
+		}
+	}
+	checkLeaks()
+}
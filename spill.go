@@ -0,0 +1,454 @@
+package fsevents
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Spill keeps the batches that don't fit in the Events channel in files
+// in dir, up to maxSize bytes, and sends them on Events in order once
+// the consumer catches up. Batches that arrive meanwhile join them on
+// disk, so the order is kept; those that would take the files past
+// maxSize are dropped. Batches still on disk when the stream stops are
+// sent after the next Start, even by another process, so dir should be
+// the stream's own. A record cut short by a crash ends its file, and the
+// batches before it are kept. Spill needs the Events channel: with a
+// Handler it's the same as Block.
+func Spill(dir string, maxSize int64) OverflowPolicy {
+	return OverflowPolicy{kind: overflowSpill, dir: dir, maxSize: maxSize}
+}
+
+// spillSuffix names the files a spill keeps its batches in, each named
+// by a sequence number so they sort oldest first.
+const spillSuffix = ".spill"
+
+// spillSegments is how many files a spill spreads maxSize over, so that
+// the oldest can be removed once sent while the newest is appended to.
+const spillSegments = 8
+
+// spillFile is one of the files of a spill.
+type spillFile struct {
+	path    string
+	size    int64
+	batches int // not yet sent
+}
+
+// spill implements the Spill policy for a running stream.
+type spill struct {
+	es      *EventStream
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex // guards the fields below; held for disk I/O
+	files   []spillFile
+	size    int64         // of files together
+	next    uint64        // sequence number of the next file
+	w       *os.File      // appends to the last of files, if not nil
+	r       *os.File      // reads files[0], if not nil
+	rbuf    *bufio.Reader // buffers r
+	readOff int64         // offset in files[0] after the last record read
+	sentOff int64         // offset in files[0] after the last record sent
+	pending int           // batches on disk and not yet sent
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// startSpill starts the Spill policy if es uses it, taking up the batches
+// left in its directory.
+func (es *EventStream) startSpill() error {
+	p := es.conf().Overflow
+	if p.kind != overflowSpill || es.conf().Handler != nil || es.conf().RawHandler != nil {
+		return nil
+	}
+	if es.BatchesMeta != nil {
+		return errSpillBatchesMeta
+	}
+	s := &spill{
+		es:      es,
+		dir:     p.dir,
+		maxSize: p.maxSize,
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		return err
+	}
+	es.spill = s
+	go s.run()
+	return nil
+}
+
+// stopSpill stops sending spilled batches, leaving the rest on disk.
+func (es *EventStream) stopSpill() {
+	s := es.spill
+	if s == nil {
+		return
+	}
+	close(s.quit)
+	<-s.done
+	s.close()
+	es.spill = nil
+}
+
+// recover finds the files left in the directory and counts the batches
+// in them.
+func (s *spill) recover() error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, spillSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spillSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		path := s.path(seq)
+		n, size, err := countSpilled(path)
+		if err != nil {
+			return err
+		}
+		s.next = seq + 1
+		if n == 0 {
+			os.Remove(path)
+			continue
+		}
+		s.files = append(s.files, spillFile{path: path, size: size, batches: n})
+		s.size += size
+		s.pending += n
+	}
+	if s.pending > 0 {
+		s.wake <- struct{}{}
+	}
+	return nil
+}
+
+func (s *spill) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spillSuffix))
+}
+
+// send sends events on Events if nothing is waiting on disk and there's
+// room, and spills them otherwise.
+func (s *spill) send(events []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == 0 {
+		select {
+		case s.es.Events <- events:
+			s.es.countSent(len(events))
+			return
+		default:
+		}
+	}
+	if err := s.append(events); err != nil {
+		if !errors.Is(err, errSpillFull) {
+			s.es.report(err)
+		}
+		s.es.countDropped(len(events))
+	} else {
+		atomic.AddUint64(&s.es.stats.SpilledEvents, uint64(len(events)))
+		atomic.AddUint64(&s.es.stats.SpilledBatches, 1)
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	recycle(events)
+}
+
+var errSpillFull = errors.New("fsevents: spill is full")
+
+// append writes events to the newest file, starting another when it has
+// its share of maxSize. s.mu must be held.
+func (s *spill) append(events []Event) error {
+	rec := encodeSpilled(events)
+	if s.size+int64(len(rec)) > s.maxSize {
+		return errSpillFull
+	}
+	if s.w == nil || s.files[len(s.files)-1].size >= s.maxSize/spillSegments {
+		if s.w != nil {
+			s.w.Close()
+		}
+		path := s.path(s.next)
+		w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o600)
+		if err != nil {
+			s.w = nil
+			return err
+		}
+		s.next++
+		s.w = w
+		s.files = append(s.files, spillFile{path: path})
+	}
+	n, err := s.w.Write(rec)
+	s.files[len(s.files)-1].size += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		// The partial record ends the file.
+		s.w.Close()
+		s.w = nil
+		return err
+	}
+	s.files[len(s.files)-1].batches++
+	s.pending++
+	return nil
+}
+
+// run sends the spilled batches on Events, oldest first.
+func (s *spill) run() {
+	defer close(s.done)
+	for {
+		batch, ok := s.read()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.quit:
+				return
+			}
+		}
+		select {
+		case s.es.Events <- batch:
+		case <-s.quit:
+			recycle(batch)
+			return
+		}
+		s.es.countSent(len(batch))
+		atomic.AddUint64(&s.es.stats.RestoredEvents, uint64(len(batch)))
+		atomic.AddUint64(&s.es.stats.RestoredBatches, 1)
+		s.sent()
+	}
+}
+
+// read returns the oldest batch not yet sent, removing the files it's
+// done with.
+func (s *spill) read() ([]Event, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.files) > 0 {
+		if s.r == nil {
+			r, err := os.Open(s.files[0].path)
+			if err != nil {
+				s.es.report(err)
+				s.dropFirst()
+				continue
+			}
+			s.r, s.rbuf = r, bufio.NewReader(r)
+			s.readOff, s.sentOff = 0, 0
+		}
+		batch, n, err := decodeSpilled(s.rbuf)
+		if err == nil {
+			s.readOff += n
+			s.es.attribute(batch)
+			return batch, true
+		}
+		if s.w != nil && len(s.files) == 1 {
+			// Caught up with the writes.
+			return nil, false
+		}
+		if err != io.EOF {
+			s.es.report(fmt.Errorf("fsevents: %v: %s: %w", s.es, s.files[0].path, err))
+		}
+		s.dropFirst()
+	}
+	return nil, false
+}
+
+// sent records that the batch last read was sent. Once all were, the
+// files are removed.
+func (s *spill) sent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	s.files[0].batches--
+	s.sentOff = s.readOff
+	if s.pending > 0 {
+		return
+	}
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	for len(s.files) > 0 {
+		s.dropFirst()
+	}
+}
+
+// dropFirst removes the oldest file. s.mu must be held.
+func (s *spill) dropFirst() {
+	if s.r != nil {
+		s.r.Close()
+		s.r, s.rbuf = nil, nil
+	}
+	os.Remove(s.files[0].path)
+	s.size -= s.files[0].size
+	s.pending -= s.files[0].batches
+	s.files = s.files[1:]
+}
+
+// close closes the files, cutting what was sent off the oldest so it
+// isn't sent again after the next Start.
+func (s *spill) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	if s.r == nil {
+		return
+	}
+	s.r.Close()
+	s.r, s.rbuf = nil, nil
+	if s.sentOff > 0 {
+		if err := cutFile(s.files[0].path, s.sentOff); err != nil {
+			s.es.report(err)
+		}
+	}
+}
+
+// cutFile removes the first off bytes of the file at path.
+func cutFile(path string, off int64) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if off > int64(len(b)) {
+		off = int64(len(b))
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b[off:], 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// countSpilled returns the number of intact batches at the start of the
+// file at path, and its size.
+func countSpilled(path string) (n int, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		batch, _, err := decodeSpilled(r)
+		if err != nil {
+			return n, fi.Size(), nil
+		}
+		recycle(batch)
+		n++
+	}
+}
+
+// A spilled batch is a record of its length and CRC-32 as little-endian
+// uint32s, followed by the event count and, for each event, the path's
+// length and the path, all as uvarints, and the flags, device and ID as
+// little-endian integers.
+
+// encodeSpilled returns the record for events.
+func encodeSpilled(events []Event) []byte {
+	rec := make([]byte, 8, 8+binary.MaxVarintLen64+len(events)*(binary.MaxVarintLen64+16+32))
+	rec = appendUvarint(rec, uint64(len(events)))
+	for _, e := range events {
+		rec = appendUvarint(rec, uint64(len(e.Path)))
+		rec = append(rec, e.Path...)
+		var b [16]byte
+		binary.LittleEndian.PutUint32(b[0:], uint32(e.Flags))
+		binary.LittleEndian.PutUint32(b[4:], uint32(e.Device))
+		binary.LittleEndian.PutUint64(b[8:], e.ID)
+		rec = append(rec, b[:]...)
+	}
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(rec)-8))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(rec[8:]))
+	return rec
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+var errSpillCorrupt = errors.New("corrupt spill record")
+
+// decodeSpilled reads a record, returning its batch and length. It
+// returns io.EOF at the end of the file and another error for a record
+// that's cut short or corrupt.
+func decodeSpilled(r *bufio.Reader) ([]Event, int64, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:])
+	if size > 1<<30 {
+		return nil, 0, errSpillCorrupt
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return nil, 0, errSpillCorrupt
+	}
+
+	p := payload
+	count, n := binary.Uvarint(p)
+	if n <= 0 || count > uint64(len(p)) {
+		return nil, 0, errSpillCorrupt
+	}
+	p = p[n:]
+	batch := newBatch(int(count))
+	for i := range batch {
+		l, n := binary.Uvarint(p)
+		if n <= 0 {
+			recycle(batch)
+			return nil, 0, errSpillCorrupt
+		}
+		// Kept clear of l+16, which a huge l wraps around.
+		if rest := uint64(len(p) - n); rest < 16 || l > rest-16 {
+			recycle(batch)
+			return nil, 0, errSpillCorrupt
+		}
+		p = p[n:]
+		batch[i] = Event{
+			Path:   string(p[:l]),
+			Flags:  EventFlags(binary.LittleEndian.Uint32(p[l:])),
+			Device: int32(binary.LittleEndian.Uint32(p[l+4:])),
+			ID:     binary.LittleEndian.Uint64(p[l+8:]),
+		}
+		p = p[l+16:]
+	}
+	return batch, int64(len(hdr)) + int64(size), nil
+}
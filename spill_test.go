@@ -0,0 +1,186 @@
+package fsevents
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func startSpillStream(t *testing.T, dir string, maxSize int64) *EventStream {
+	t.Helper()
+	es := &EventStream{Events: make(chan []Event, 1), Overflow: Spill(dir, maxSize)}
+	startPollStream(t, es)
+	return es
+}
+
+// receive takes n batches from es, failing on a timeout, and returns
+// their IDs.
+func receive(t *testing.T, es *EventStream, n int) []uint64 {
+	t.Helper()
+	var ids []uint64
+	for i := 0; i < n; i++ {
+		select {
+		case batch := <-es.EventsChan():
+			for _, e := range batch {
+				ids = append(ids, e.ID)
+			}
+			es.Recycle(batch)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v, then nothing", ids)
+		}
+	}
+	return ids
+}
+
+func spillFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spillSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpill(t *testing.T) {
+	dir := t.TempDir()
+	es := startSpillStream(t, dir, 1<<20)
+	for id := uint64(1); id <= 10; id++ {
+		es.deliver([]Event{{Path: "/a", Flags: ItemModified, ID: id}})
+	}
+	st := es.Stats()
+	if st.SpilledBatches != 9 || st.SpilledEvents != 9 || st.DroppedEvents != 0 {
+		t.Errorf("spilled %d batches, %d events, dropped %d; want 9, 9, 0", st.SpilledBatches, st.SpilledEvents, st.DroppedEvents)
+	}
+	if len(spillFiles(t, dir)) == 0 {
+		t.Error("nothing on disk")
+	}
+
+	if ids, want := receive(t, es, 10), []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+	// Once drained, the files are removed and batches sent directly.
+	for deadline := time.Now().Add(5 * time.Second); len(spillFiles(t, dir)) != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v left once drained", spillFiles(t, dir))
+		}
+	}
+	es.deliver([]Event{{ID: 11}})
+	if ids := receive(t, es, 1); ids[0] != 11 {
+		t.Errorf("got %v after catching up", ids)
+	}
+	st = es.Stats()
+	if st.RestoredBatches != 9 || st.RestoredEvents != 9 || st.DeliveredBatches != 11 {
+		t.Errorf("restored %d batches, %d events, delivered %d; want 9, 9, 11", st.RestoredBatches, st.RestoredEvents, st.DeliveredBatches)
+	}
+}
+
+func TestSpillFull(t *testing.T) {
+	rec := int64(len(encodeSpilled([]Event{{ID: 1}})))
+	es := startSpillStream(t, t.TempDir(), 3*rec)
+	for id := uint64(1); id <= 6; id++ {
+		es.deliver([]Event{{ID: id}})
+	}
+	if st := es.Stats(); st.SpilledBatches != 3 || st.DroppedBatches != 2 {
+		t.Errorf("spilled %d, dropped %d; want 3, 2", st.SpilledBatches, st.DroppedBatches)
+	}
+	if ids, want := receive(t, es, 4), []uint64{1, 2, 3, 4}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
+
+func TestSpillRecovery(t *testing.T) {
+	dir := t.TempDir()
+	es := startSpillStream(t, dir, 1<<20)
+	for id := uint64(1); id <= 10; id++ {
+		es.deliver([]Event{{Path: "/a", ID: id}})
+	}
+	if ids, want := receive(t, es, 3), []uint64{1, 2, 3}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got %v, want %v", ids, want)
+	}
+	// The drainer may be holding batch 5 and blocked sending it.
+	es.Stop()
+	if ids, want := receive(t, es, 1), []uint64{4}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got %v, want %v", ids, want)
+	}
+
+	// A crash cut the last record short.
+	files := spillFiles(t, dir)
+	last := files[len(files)-1]
+	fi, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	es = startSpillStream(t, dir, 1<<20)
+	if ids, want := receive(t, es, 5), []uint64{5, 6, 7, 8, 9}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+	select {
+	case batch := <-es.EventsChan():
+		t.Errorf("got %v from the truncated record", batch)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if st := es.Stats(); st.RestoredBatches != 5 {
+		t.Errorf("restored %d batches, want 5", st.RestoredBatches)
+	}
+}
+
+func TestSpillEncoding(t *testing.T) {
+	batch := []Event{
+		{Path: "/a/b", Flags: ItemCreated | ItemIsFile, Device: 3, ID: 1 << 40},
+		{Path: "", Flags: HistoryDone},
+		{Path: "/日本語", Flags: ItemRemoved, Device: -1, ID: 7},
+	}
+	rec := encodeSpilled(batch)
+	have, n, err := decodeSpilled(bufio.NewReader(bytes.NewReader(rec)))
+	if err != nil || n != int64(len(rec)) || !reflect.DeepEqual(have, batch) {
+		t.Errorf("decoded %v, %d, %v; want %v, %d", have, n, err, batch, len(rec))
+	}
+
+	corrupt := append([]byte(nil), rec...)
+	corrupt[len(corrupt)-1] ^= 1
+	if _, _, err := decodeSpilled(bufio.NewReader(bytes.NewReader(corrupt))); err == nil {
+		t.Error("corrupt record decoded")
+	}
+	if _, _, err := decodeSpilled(bufio.NewReader(bytes.NewReader(rec[:5]))); err == nil {
+		t.Error("truncated header decoded")
+	}
+}
+
+// TestSpillCorruptLengths decodes records whose CRC holds but whose
+// lengths don't fit their payload.
+func TestSpillCorruptLengths(t *testing.T) {
+	tail := make([]byte, 16)
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"no count", nil},
+		{"count past the payload", appendUvarint(nil, 100)},
+		{"no path length", appendUvarint(nil, 1)},
+		{"path past the payload", append(appendUvarint(appendUvarint(nil, 1), 17), tail...)},
+		{"no room for the fields", append(appendUvarint(appendUvarint(nil, 1), 0), tail[:15]...)},
+		{"huge path length", append(appendUvarint(appendUvarint(nil, 1), math.MaxUint64), tail...)},
+		{"path length wrapping to 0", append(appendUvarint(appendUvarint(nil, 1), math.MaxUint64-15), tail...)},
+		{"path length wrapping to the payload", append(appendUvarint(appendUvarint(nil, 1), math.MaxUint64-7), tail...)},
+	}
+	for _, tt := range tests {
+		rec := make([]byte, 8, 8+len(tt.payload))
+		rec = append(rec, tt.payload...)
+		binary.LittleEndian.PutUint32(rec[0:], uint32(len(tt.payload)))
+		binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(tt.payload))
+		if batch, _, err := decodeSpilled(bufio.NewReader(bytes.NewReader(rec))); err != errSpillCorrupt {
+			t.Errorf("%s: decoded %v, %v; want errSpillCorrupt", tt.name, batch, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package fsevents
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMaxDeliveredBatch(t *testing.T) {
+	const n, max = 50000, 7000
+	batch := make([]Event, n)
+	for i := range batch {
+		batch[i] = Event{Path: fmt.Sprint("/d/", i), Flags: ItemCreated | ItemIsFile, ID: uint64(i + 1)}
+	}
+	for _, es := range []*EventStream{
+		{Events: make(chan []Event, 20)},
+		// Split once merged.
+		{MaxBatchDelay: time.Hour, Events: make(chan []Event, 20)},
+	} {
+		es.Paths, es.Backend, es.MaxDeliveredBatch = []string{"/d"}, Manual, max
+		sub := es.Subscribe(SubscribeBuffer(cap(es.Events)))
+		if err := es.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := es.Inject(batch); err != nil {
+			t.Fatal(err)
+		}
+		if err := es.Inject(batch[:10]); err != nil {
+			t.Fatal(err)
+		}
+		es.Flush(true)
+		es.Stop()
+
+		want := n + 10
+		if es.MaxBatchDelay == 0 {
+			want = n
+		}
+		for _, c := range []<-chan []Event{es.Events, sub.Events} {
+			var whole []Event
+			for len(whole) < want {
+				part := <-c
+				if len(part) > max {
+					t.Fatalf("delivered %d events in one batch", len(part))
+				}
+				for i, e := range part {
+					if more := len(whole)+i+1 < want; e.Continued != (i == len(part)-1 && more) {
+						t.Fatalf("event %d of a batch of %d: Continued = %v", i, len(part), e.Continued)
+					}
+				}
+				whole = append(whole, part...)
+			}
+			for i, e := range whole {
+				if wantID := uint64(i%n + 1); e.ID != wantID || e.Path != fmt.Sprint("/d/", wantID-1) {
+					t.Fatalf("event %d is %s with ID %d", i, e.Path, e.ID)
+				}
+			}
+			if es.MaxBatchDelay == 0 {
+				// The small batch comes on its own.
+				if part := <-c; len(part) != 10 || part[9].Continued {
+					t.Errorf("after the split batch, got %d events", len(part))
+				}
+			}
+		}
+	}
+}
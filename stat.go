@@ -0,0 +1,136 @@
+package fsevents
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// statter looks up the paths of a StatRenames stream's renames and
+// removes, or an Enrich stream's events, on a goroutine of its own, so
+// the callbacks don't wait on the disk, and passes each batch on in turn.
+type statter struct {
+	es       *EventStream
+	in       chan []Event
+	flushReq chan chan struct{}
+	done     chan struct{}
+}
+
+// startStats starts the statter if the stream is configured for one.
+func (es *EventStream) startStats() {
+	if es.conf().StatRenames <= 0 && !es.conf().Enrich || es.conf().Device != 0 || es.statter != nil {
+		return
+	}
+	s := &statter{
+		es:       es,
+		in:       make(chan []Event),
+		flushReq: make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	es.statter = s
+	go s.run()
+}
+
+// stopStats passes on the batch the statter holds, if any, and stops it.
+// Like stopDelivery, it must only be called once nothing else can hand
+// batches off.
+func (es *EventStream) stopStats() {
+	s := es.statter
+	if s == nil {
+		return
+	}
+	close(s.in)
+	<-s.done
+	es.statter = nil
+}
+
+func (s *statter) run() {
+	defer close(s.done)
+	for {
+		select {
+		case events, ok := <-s.in:
+			if !ok {
+				return
+			}
+			s.es.statEvents(events)
+			s.es.merge(events)
+		case reply := <-s.flushReq:
+			close(reply)
+		}
+	}
+}
+
+// flush waits for the batches handed over so far to be passed on.
+func (s *statter) flush() {
+	reply := make(chan struct{})
+	select {
+	case s.flushReq <- reply:
+		<-reply
+	case <-s.done:
+	}
+}
+
+// statEvents sets Exists and Inode on the batch's ItemRenamed and
+// ItemRemoved events, and with Enrich, Info on all those about items,
+// with an lstat of each path once, up to StatRenames or Workers at a
+// time, whichever is more.
+func (es *EventStream) statEvents(events []Event) {
+	var (
+		paths []string
+		todo  = map[string][]int{} // the events on each of paths
+	)
+	for i, e := range events {
+		if e.Flags&streamFlags != 0 || !es.conf().Enrich && e.Flags&(ItemRenamed|ItemRemoved) == 0 {
+			continue
+		}
+		if _, ok := todo[e.Path]; !ok {
+			paths = append(paths, e.Path)
+		}
+		todo[e.Path] = append(todo[e.Path], i)
+	}
+	stat := func(path string) {
+		fi, err := os.Lstat(path)
+		for _, i := range todo[path] {
+			e := &events[i]
+			if es.conf().Enrich && err == nil {
+				e.Info = fi
+			}
+			if es.conf().StatRenames > 0 && e.Flags&(ItemRenamed|ItemRemoved) != 0 && err == nil {
+				e.Exists = true
+				e.Inode, _ = inode(fi)
+			}
+		}
+	}
+
+	workers := es.conf().StatRenames
+	if es.conf().Enrich && es.conf().Workers > workers {
+		workers = es.conf().Workers
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	if workers <= 1 {
+		for _, path := range paths {
+			stat(path)
+		}
+		return
+	}
+	var (
+		next int64
+		wg   sync.WaitGroup
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				n := int(atomic.AddInt64(&next, 1)) - 1
+				if n >= len(paths) {
+					return
+				}
+				stat(paths[n])
+			}
+		}()
+	}
+	wg.Wait()
+}
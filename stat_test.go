@@ -0,0 +1,170 @@
+package fsevents
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestStatRenames(t *testing.T) {
+	root, ext := realTempDir(t), realTempDir(t)
+	write := func(path string) {
+		t.Helper()
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in, out, gone, kept := filepath.Join(root, "in"), filepath.Join(root, "out"), filepath.Join(root, "gone"), filepath.Join(root, "kept")
+	write(filepath.Join(ext, "in"))
+	write(out)
+	write(gone)
+	write(kept)
+	mustRename(t, filepath.Join(ext, "in"), in)
+	mustRename(t, out, filepath.Join(ext, "out"))
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	ino, hasInodes := inode(mustStat(t, in))
+
+	es := &EventStream{Paths: []string{root}, Backend: Manual, StatRenames: 2, Events: make(chan []Event, 10)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	// Batches of one and of several events keep their order.
+	batches := [][]Event{
+		{{Path: in, Flags: ItemRenamed | ItemIsFile, ID: 1}},
+		{
+			{Path: out, Flags: ItemCreated | ItemRenamed | ItemIsFile, ID: 2},
+			{Path: gone, Flags: ItemCreated | ItemRemoved | ItemIsFile, ID: 3},
+			{Path: kept, Flags: ItemModified | ItemIsFile, ID: 4},
+			{Path: root, Flags: ItemRenamed | ItemIsDir, ID: 5},
+			{Path: in, Flags: ItemRenamed | ItemIsFile, ID: 6},
+			{Path: root, Flags: RootChanged, ID: 7},
+		},
+	}
+	for _, batch := range batches {
+		if err := es.Inject(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	es.Flush(true)
+	exists := map[uint64]bool{1: true, 5: true, 6: true}
+	var id uint64
+	for _, batch := range batches {
+		have := <-es.EventsChan()
+		if len(have) != len(batch) {
+			t.Fatalf("got %v, want %d events", have, len(batch))
+		}
+		for _, e := range have {
+			id++
+			if e.ID != id {
+				t.Fatalf("got ID %d, want %d", e.ID, id)
+			}
+			if e.Exists != exists[e.ID] {
+				t.Errorf("%s (ID %d): Exists = %v", e.Path, e.ID, e.Exists)
+			}
+			if e.Path == in && hasInodes && e.Inode != ino {
+				t.Errorf("%s: Inode = %d, want %d", e.Path, e.Inode, ino)
+			}
+			if !e.Exists && e.Inode != 0 {
+				t.Errorf("%s: Inode = %d without Exists", e.Path, e.Inode)
+			}
+		}
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	root := realTempDir(t)
+	file, gone, locked := filepath.Join(root, "file"), filepath.Join(root, "gone"), filepath.Join(root, "locked")
+	if err := os.WriteFile(file, []byte("content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(locked, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(locked, "f"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0o755)
+	_, err := os.Lstat(filepath.Join(locked, "f"))
+	denied := os.IsPermission(err)
+
+	es := &EventStream{Paths: []string{root}, Backend: Manual, Enrich: true, Workers: 4, Events: make(chan []Event, 1)}
+	sub := es.Subscribe(SubscribeBuffer(1))
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+	in := []Event{
+		{Path: file, Flags: ItemCreated | ItemIsFile, ID: 1},
+		{Path: gone, Flags: ItemRemoved | ItemIsFile, ID: 2},
+		{Path: filepath.Join(locked, "f"), Flags: ItemModified | ItemIsFile, ID: 3},
+		{Path: file, Flags: ItemModified | ItemIsFile, ID: 4},
+		{Path: root, Flags: MustScanSubDirs, ID: 5},
+	}
+	if err := es.Inject(in); err != nil {
+		t.Fatal(err)
+	}
+	have, shared := <-es.EventsChan(), <-sub.Events
+	if len(have) != len(in) || len(shared) != len(in) {
+		t.Fatalf("got %v and %v", have, shared)
+	}
+	if fi := have[0].Info; fi == nil || fi.Size() != 7 || fi.Mode().Perm() != 0o600 || fi.IsDir() {
+		t.Errorf("Info of %s = %v", file, fi)
+	}
+	if have[1].Info != nil {
+		t.Errorf("Info of a vanished path = %v", have[1].Info)
+	}
+	if denied && have[2].Info != nil {
+		t.Errorf("Info of a path out of reach = %v", have[2].Info)
+	}
+	if have[4].Info != nil {
+		t.Errorf("Info of a MustScanSubDirs = %v", have[4].Info)
+	}
+	// One lstat for each path, shared with the subscribers.
+	if have[0].Info != have[3].Info || shared[0].Info != have[0].Info {
+		t.Error("the events on a path don't share their Info")
+	}
+	if have[0].Exists {
+		t.Error("Exists set without StatRenames")
+	}
+}
+
+// BenchmarkEnrich measures what Enrich costs: it delivers batches of
+// events on 256 files without it, and with it on one worker or several.
+func BenchmarkEnrich(b *testing.B) {
+	root := b.TempDir()
+	batch := make([]Event, 256)
+	for i := range batch {
+		path := filepath.Join(root, fmt.Sprint(i))
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			b.Fatal(err)
+		}
+		batch[i] = Event{Path: path, Flags: ItemModified | ItemIsFile}
+	}
+	for _, tc := range []struct {
+		name    string
+		enrich  bool
+		workers int
+	}{{"off", false, 0}, {"1", true, 1}, {"4", true, 4}, {fmt.Sprint(runtime.NumCPU()), true, runtime.NumCPU()}} {
+		b.Run(tc.name, func(b *testing.B) {
+			es := &EventStream{Paths: []string{root}, Backend: Manual, Enrich: tc.enrich, Workers: tc.workers, Handler: func([]Event) {}}
+			if err := es.Start(); err != nil {
+				b.Fatal(err)
+			}
+			defer es.Stop()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				es.Inject(batch)
+			}
+			es.Flush(true)
+		})
+	}
+}
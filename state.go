@@ -0,0 +1,200 @@
+package fsevents
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// ErrBadState is returned by StateStore.Load for a file that holds no
+// state it can read: one that's been corrupted or cut short, or was saved
+// in a later version of the format.
+var ErrBadState = errors.New("fsevents: bad state file")
+
+// stateMagic starts the files written by StateStore.Save; the number is
+// the version of the format.
+const stateMagic = "fsevents state 1\n"
+
+// ResumeState is what a stream needs to resume where it left off. A
+// Watcher has one for each volume.
+type ResumeState struct {
+	EventID uint64
+	UUID    string // see EventStream.UUID
+}
+
+// StateStore keeps a ResumeState in a file, such as from one run of a
+// program to the next. Saves are serialized with a lock on the file's
+// path with ".lock" appended, even across processes, and replace the
+// file atomically, so that a reader sees one whole state or another; the
+// last save wins. A checksum tells a damaged file apart. A file holds one
+// state, or one for each volume of a Watcher. Besides its own format,
+// Load reads files holding just an event ID in decimal, and the JSON ones
+// of the fsevents command's -resume-file; Save replaces them with its
+// own.
+type StateStore struct {
+	path string
+}
+
+// NewStateStore returns a StateStore keeping its state in file.
+func NewStateStore(file string) *StateStore {
+	return &StateStore{path: file}
+}
+
+// Path returns the file the state is kept in.
+func (s *StateStore) Path() string {
+	return s.path
+}
+
+// Load returns the saved state, the first if there are several. The error
+// matches os.ErrNotExist if nothing was saved yet, and ErrBadState if the
+// file can't be read as a state.
+func (s *StateStore) Load() (ResumeState, error) {
+	states, err := s.LoadAll()
+	if err != nil {
+		return ResumeState{}, err
+	}
+	return states[0], nil
+}
+
+// LoadAll is like Load but returns all the saved states, of which there's
+// at least one.
+func (s *StateStore) LoadAll() ([]ResumeState, error) {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	states, ok := parseState(b)
+	if !ok || len(states) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrBadState, s.path)
+	}
+	return states, nil
+}
+
+// parseState reads the states in any of the formats Load knows.
+func parseState(b []byte) ([]ResumeState, bool) {
+	hdr := len(stateMagic) + 4
+	if bytes.HasPrefix(b, []byte(stateMagic)) {
+		if len(b) < hdr || crc32.ChecksumIEEE(b[hdr:]) != binary.LittleEndian.Uint32(b[len(stateMagic):]) {
+			return nil, false
+		}
+		var states []ResumeState
+		for b = b[hdr:]; len(b) > 0; {
+			id, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, false
+			}
+			b = b[n:]
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, false
+			}
+			b = b[n:]
+			states = append(states, ResumeState{EventID: id, UUID: string(b[:size])})
+			b = b[size:]
+		}
+		return states, true
+	}
+
+	// The formats from before: a bare event ID, or the fsevents
+	// command's JSON.
+	var st ResumeState
+	b = bytes.TrimSpace(b)
+	if bytes.HasPrefix(b, []byte("{")) {
+		var old struct {
+			EventID *uint64 `json:"event_id"`
+			UUID    string  `json:"uuid"`
+		}
+		if err := json.Unmarshal(b, &old); err != nil || old.EventID == nil {
+			return nil, false
+		}
+		st.EventID, st.UUID = *old.EventID, old.UUID
+		return []ResumeState{st}, true
+	}
+	id, err := strconv.ParseUint(string(b), 10, 64)
+	st.EventID = id
+	return []ResumeState{st}, err == nil
+}
+
+// Save replaces the saved state with st.
+func (s *StateStore) Save(st ResumeState) error {
+	return s.SaveAll([]ResumeState{st})
+}
+
+// SaveAll replaces the saved states with states, which mustn't be empty.
+func (s *StateStore) SaveAll(states []ResumeState) error {
+	if len(states) == 0 {
+		return errors.New("fsevents: no state to save")
+	}
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	b := append([]byte(stateMagic), make([]byte, 4)...)
+	for _, st := range states {
+		b = appendUvarint(b, st.EventID)
+		b = appendUvarint(b, uint64(len(st.UUID)))
+		b = append(b, st.UUID...)
+	}
+	binary.LittleEndian.PutUint32(b[len(stateMagic):], crc32.ChecksumIEEE(b[len(stateMagic)+4:]))
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// SaveState saves the stream's EventID and UUID to s, for LoadState to
+// resume from.
+func (es *EventStream) SaveState(s *StateStore) error {
+	es.dumpMu.Lock()
+	uuid := es.UUID
+	es.dumpMu.Unlock()
+	return s.Save(ResumeState{EventID: atomic.LoadUint64(&es.EventID), UUID: uuid})
+}
+
+// LoadState sets the stream up to resume from the state saved in s, if
+// there is one with an event ID. It's to be called before Start. A file
+// that can't be read as a state doesn't stop the stream: the error,
+// matching ErrBadState, is sent on Errors as a warning and the stream
+// starts afresh, from SinceNow. Other errors are returned.
+func (es *EventStream) LoadState(s *StateStore) error {
+	st, err := s.Load()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case errors.Is(err, ErrBadState):
+		es.Resume, es.EventID, es.UUID = false, 0, ""
+		es.report(err)
+		return nil
+	case err != nil:
+		return err
+	case st.EventID == 0:
+		// Resuming from 0 would replay all of the history.
+		return nil
+	}
+	es.Resume, es.EventID, es.UUID = true, st.EventID, st.UUID
+	return nil
+}
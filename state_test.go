@@ -0,0 +1,186 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStateStore(t *testing.T) {
+	s := NewStateStore(filepath.Join(t.TempDir(), "state"))
+	if _, err := s.Load(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Load() before Save: %v", err)
+	}
+	want := ResumeState{EventID: 1234, UUID: "5A4C2E33-8E5B-4A1D-9C8B-3E1F0B6D7A21"}
+	if err := s.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := s.Load(); err != nil || have != want {
+		t.Errorf("Load() = %+v, %v, want %+v", have, err, want)
+	}
+	entries, err := os.ReadDir(filepath.Dir(s.Path()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range entries {
+		if name := d.Name(); name != "state" && name != "state.lock" {
+			t.Errorf("%s left behind", name)
+		}
+	}
+
+	es := &EventStream{}
+	if err := es.LoadState(s); err != nil {
+		t.Fatal(err)
+	}
+	if !es.Resume || es.EventID != want.EventID || es.UUID != want.UUID {
+		t.Errorf("after LoadState: Resume %v, EventID %d, UUID %q", es.Resume, es.EventID, es.UUID)
+	}
+	es.EventID = 5678
+	if err := es.SaveState(s); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := s.Load(); have.EventID != 5678 {
+		t.Errorf("after SaveState, Load() = %+v", have)
+	}
+
+	// Nothing saved, or saved before any event: start from now.
+	for _, st := range []*StateStore{NewStateStore(filepath.Join(t.TempDir(), "none")), s} {
+		if st == s {
+			st.Save(ResumeState{UUID: want.UUID})
+		}
+		es := &EventStream{}
+		if err := es.LoadState(st); err != nil || es.Resume {
+			t.Errorf("LoadState(%s) = %v, Resume %v", st.Path(), err, es.Resume)
+		}
+	}
+}
+
+// TestStateStoreTorn cuts a saved state short at every length, as a
+// write interrupted without the atomic rename would.
+func TestStateStoreTorn(t *testing.T) {
+	s := NewStateStore(filepath.Join(t.TempDir(), "state"))
+	if err := s.Save(ResumeState{EventID: 1 << 40, UUID: "uuid"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(s.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := len(b) - 1; n >= 0; n-- {
+		if err := os.Truncate(s.Path(), int64(n)); err != nil {
+			t.Fatal(err)
+		}
+		if st, err := s.Load(); !errors.Is(err, ErrBadState) {
+			t.Errorf("cut to %d bytes, Load() = %+v, %v", n, st, err)
+		}
+	}
+	flipped := append([]byte(nil), b...)
+	flipped[len(flipped)-1] ^= 1
+	if err := os.WriteFile(s.Path(), flipped, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(); !errors.Is(err, ErrBadState) {
+		t.Errorf("with a flipped bit, Load() = %v", err)
+	}
+
+	// LoadState warns and starts afresh.
+	es := &EventStream{Errors: make(chan error, 1), Resume: true, EventID: 7, UUID: "old"}
+	if err := es.LoadState(s); err != nil {
+		t.Fatal(err)
+	}
+	if es.Resume || es.EventID != 0 || es.UUID != "" {
+		t.Errorf("after LoadState: Resume %v, EventID %d, UUID %q", es.Resume, es.EventID, es.UUID)
+	}
+	select {
+	case err := <-es.ErrorsChan():
+		if !errors.Is(err, ErrBadState) {
+			t.Errorf("warned with %v", err)
+		}
+	default:
+		t.Error("no warning on Errors")
+	}
+}
+
+func TestStateStoreVersions(t *testing.T) {
+	s := NewStateStore(filepath.Join(t.TempDir(), "state"))
+	for _, tt := range []struct {
+		file string
+		want ResumeState
+		ok   bool
+	}{
+		{"12345\n", ResumeState{EventID: 12345}, true},
+		{"  987", ResumeState{EventID: 987}, true},
+		{`{"event_id":42,"uuid":"u"}` + "\n", ResumeState{EventID: 42, UUID: "u"}, true},
+		{"", ResumeState{}, false},
+		{"12a", ResumeState{}, false},
+		{`{"uuid":"u"}`, ResumeState{}, false},
+		{"fsevents state 2\n\x00\x00\x00\x00\x01\x00", ResumeState{}, false},
+	} {
+		if err := os.WriteFile(s.Path(), []byte(tt.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		have, err := s.Load()
+		if tt.ok && (err != nil || have != tt.want) || !tt.ok && !errors.Is(err, ErrBadState) {
+			t.Errorf("Load() of %q = %+v, %v", tt.file, have, err)
+		}
+		if !tt.ok {
+			continue
+		}
+		// Saving upgrades the file.
+		if err := s.Save(have); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := os.ReadFile(s.Path()); string(b[:len(stateMagic)]) != stateMagic {
+			t.Errorf("saved %q", b)
+		}
+		if again, err := s.Load(); err != nil || again != tt.want {
+			t.Errorf("Load() after upgrading %q = %+v, %v", tt.file, again, err)
+		}
+	}
+}
+
+// TestStateStoreConcurrent has writers, each with a StateStore and so a
+// lock of its own as another process would, save over each other while
+// readers load.
+func TestStateStoreConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	if err := NewStateStore(path).Save(ResumeState{EventID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			s := NewStateStore(path)
+			for i := 1; i <= 50; i++ {
+				if err := s.Save(ResumeState{EventID: uint64(w*1000 + i), UUID: fmt.Sprint("writer ", w)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			s := NewStateStore(path)
+			for i := 0; i < 50; i++ {
+				st, err := s.Load()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if w := st.EventID / 1000; st.EventID != 1 && st.UUID != fmt.Sprint("writer ", w) {
+					t.Errorf("torn state %+v", st)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 2 {
+		t.Errorf("left behind: %v", entries)
+	}
+}
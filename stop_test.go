@@ -0,0 +1,95 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStopWithTimeout(t *testing.T) {
+	tmp := t.TempDir()
+	es := &EventStream{
+		Paths:        []string{tmp},
+		Events:       make(chan []Event, 10),
+		Backend:      Poll,
+		PollInterval: time.Hour,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "a"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.StopWithTimeout(5 * time.Second); err != nil {
+		t.Fatalf("StopWithTimeout = %v", err)
+	}
+	select {
+	case batch := <-es.EventsChan():
+		if len(batch) != 1 || batch[0].Path != filepath.Join(tmp, "a") {
+			t.Errorf("flushed %v, want the new file", batch)
+		}
+	default:
+		t.Error("StopWithTimeout didn't flush the pending event")
+	}
+	if es.Stats().Running {
+		t.Error("stream still running")
+	}
+	if err := es.Start(); err != nil {
+		t.Fatalf("Start after a graceful stop = %v", err)
+	}
+	es.Stop()
+}
+
+func TestStopWithTimeoutWedged(t *testing.T) {
+	tmp := t.TempDir()
+	es := &EventStream{
+		Paths:        []string{tmp},
+		Events:       make(chan []Event),
+		Backend:      Poll,
+		PollInterval: 10 * time.Millisecond,
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "a"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing receives, so the poller blocks sending the event.
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	err := es.StopWithTimeout(200 * time.Millisecond)
+	elapsed := time.Since(start)
+	if err != ErrStopTimeout {
+		t.Fatalf("StopWithTimeout = %v, want ErrStopTimeout", err)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("StopWithTimeout returned after %v, want about 200ms", elapsed)
+	}
+
+	if err := es.Start(); err != ErrStopTimeout {
+		t.Errorf("Start on a poisoned stream = %v, want ErrStopTimeout", err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		es.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Stop blocked on a poisoned stream")
+	}
+	if err := es.StopWithTimeout(time.Hour); err != ErrStopTimeout {
+		t.Errorf("StopWithTimeout again = %v, want ErrStopTimeout", err)
+	}
+
+	// Unwedge the consumer so the abandoned stop can finish.
+	for es.Stats().Running {
+		select {
+		case <-es.EventsChan():
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
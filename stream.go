@@ -0,0 +1,87 @@
+package fsevents
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Stream is what a consumer needs of an EventStream, so that code taking
+// one can be tested without a real file system, for example with
+// fseventstest.FakeStream. *EventStream implements it.
+//
+// Events and Errors stay fields of EventStream, for compatibility, so
+// their accessors are named EventsChan and ErrorsChan. For the same
+// reason New and WatchSystemRoot keep returning *EventStream, whose
+// fields may be set before Start; NewStream and WatchSystemRootStream
+// return the same streams as a Stream:
+//
+//	s := fsevents.NewStream(paths, fsevents.WithLatency(time.Second))
+//	go consume(s) // func consume(s fsevents.Stream)
+type Stream interface {
+	Start() error
+	Stop()
+	Restart() error
+	Flush(sync bool)
+
+	// EventsChan and ErrorsChan return the stream's Events and Errors
+	// channels. Events may be created by Start, so EventsChan is only
+	// meaningful once it has been called.
+	EventsChan() <-chan []Event
+	ErrorsChan() <-chan error
+
+	Recycle(batch []Event)
+	Stats() Stats
+
+	// LastEventID returns EventID, read atomically.
+	LastEventID() uint64
+}
+
+var _ Stream = (*EventStream)(nil)
+
+// EventsChan returns es.Events.
+func (es *EventStream) EventsChan() <-chan []Event { return es.Events }
+
+// ErrorsChan returns es.Errors.
+func (es *EventStream) ErrorsChan() <-chan error { return es.Errors }
+
+// LastEventID returns es.EventID, read atomically.
+func (es *EventStream) LastEventID() uint64 { return atomic.LoadUint64(&es.EventID) }
+
+// LatestEventID returns what FSEvents says is the ID of the latest event
+// it passed to the stream: the ID it was started since until then, so it
+// only advances as events are delivered, unlike CurrentEventID. It
+// reports this from FSEvents itself, unlike LastEventID, and returns 0
+// unless the stream is running with the Native backend. It may be called
+// at any time.
+func (es *EventStream) LatestEventID() uint64 {
+	es.dumpMu.Lock()
+	defer es.dumpMu.Unlock()
+	if es.stream == 0 {
+		return 0
+	}
+	return getStreamRefEventID(es.stream)
+}
+
+var (
+	errInjectBackend = errors.New("fsevents: Inject needs the Manual backend")
+	errNotRunning    = errors.New("fsevents: stream isn't running")
+)
+
+// Inject runs a copy of batch through the pipeline of a running Manual
+// stream, as if FSEvents had reported it, and returns once the stream is
+// done with it, as the callback would. Like a callback, it holds up Stop
+// while it waits for the consumer.
+func (es *EventStream) Inject(batch []Event) error {
+	if es.conf().Backend != Manual {
+		return errInjectBackend
+	}
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if atomic.LoadInt32(&es.running) == 0 {
+		return errNotRunning
+	}
+	events := newBatch(len(batch))
+	copy(events, batch)
+	es.deliver(events)
+	return nil
+}
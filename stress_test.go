@@ -0,0 +1,262 @@
+//go:build darwin
+
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStressBackpressure floods a stream with a small buffer and a slow
+// consumer, in the spirit of a large git checkout, and checks that
+// nothing deadlocks and every event is accounted for.
+func TestStressBackpressure(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test skipped in -short mode")
+	}
+
+	for _, policy := range []OverflowPolicy{DropNewest, DropOldest, Block} {
+		policy := policy
+		t.Run(policy.String(), func(t *testing.T) {
+			tmp, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkLeaks := leakCheck(t)
+
+			es := &EventStream{
+				Paths:      []string{tmp},
+				Flags:      FileEvents | NoDefer,
+				BufferSize: 4,
+				Overflow:   policy,
+			}
+			if err := es.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				received int
+				done     = make(chan struct{})
+				finished = make(chan struct{})
+			)
+			go func() {
+				defer close(finished)
+				for {
+					select {
+					case batch := <-es.EventsChan():
+						received += len(batch)
+						time.Sleep(time.Millisecond)
+					case <-done:
+						for {
+							select {
+							case batch := <-es.EventsChan():
+								received += len(batch)
+							default:
+								return
+							}
+						}
+					}
+				}
+			}()
+
+			const workers, files = 16, 1250
+			var wg sync.WaitGroup
+			wg.Add(workers)
+			for w := 0; w < workers; w++ {
+				w := w
+				go func() {
+					defer wg.Done()
+					dir := filepath.Join(tmp, fmt.Sprint("w", w))
+					if err := os.Mkdir(dir, 0o755); err != nil {
+						t.Error(err)
+						return
+					}
+					for i := 0; i < files; i++ {
+						if err := os.WriteFile(filepath.Join(dir, fmt.Sprint(i)), nil, 0o644); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			stopped := make(chan struct{})
+			go func() {
+				es.Flush(true)
+				es.Stop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(30 * time.Second):
+				t.Fatal("Flush and Stop did not complete within 30s")
+			}
+			close(done)
+			<-finished
+			checkLeaks()
+
+			st := es.Stats()
+			t.Logf("%s: %+v, consumer saw %d events", policy, st, received)
+			if st.ReceivedEvents == 0 {
+				t.Fatal("no events received")
+			}
+			if st.ReceivedEvents != st.DeliveredEvents+st.DroppedEvents {
+				t.Errorf("received %d != delivered %d + dropped %d",
+					st.ReceivedEvents, st.DeliveredEvents, st.DroppedEvents)
+			}
+			if uint64(received) != st.DeliveredEvents {
+				t.Errorf("consumer saw %d events, stats report %d delivered", received, st.DeliveredEvents)
+			}
+			if policy == Block && st.DroppedEvents != 0 {
+				t.Errorf("Block dropped %d events", st.DroppedEvents)
+			}
+		})
+	}
+}
+
+// TestLifecycleRace runs Start, Stop, Restart and Flush on a few streams
+// from several goroutines at once, for a while, while their directory
+// changes under them. Run with -race, it checks the registry, EventID and
+// the streams' channels and goroutines against concurrent use; at the end
+// no goroutine of theirs may be left.
+func TestLifecycleRace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test skipped in -short mode")
+	}
+
+	for _, backend := range []Backend{Native, Poll} {
+		backend := backend
+		t.Run(backend.String(), func(t *testing.T) {
+			tmp, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := runtime.NumGoroutine()
+			checkLeaks := leakCheck(t)
+
+			var (
+				streams  []*EventStream
+				handled  uint64
+				done     = make(chan struct{})
+				draining sync.WaitGroup
+			)
+			for i := 0; i < 4; i++ {
+				es := &EventStream{
+					Paths:        []string{tmp},
+					Flags:        FileEvents | NoDefer,
+					Latency:      time.Millisecond,
+					Backend:      backend,
+					PollInterval: 5 * time.Millisecond,
+					Errors:       make(chan error, 100),
+				}
+				switch i % 3 {
+				case 0:
+					events := make(chan []Event, 2)
+					es.Events = events
+					draining.Add(1)
+					go func() {
+						defer draining.Done()
+						for {
+							select {
+							case batch := <-events:
+								es.Recycle(batch)
+							case <-done:
+								return
+							}
+						}
+					}()
+				case 1:
+					es.Handler = func(batch []Event) { atomic.AddUint64(&handled, uint64(len(batch))) }
+				case 2:
+					es.Handler = func(batch []Event) { atomic.AddUint64(&handled, uint64(len(batch))) }
+					es.DeliveryMode = DispatchThread
+				}
+				streams = append(streams, es)
+			}
+
+			var wg sync.WaitGroup
+			deadline := time.Now().Add(2 * time.Second)
+			// The file system changes throughout.
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; time.Now().Before(deadline); i++ {
+					path := filepath.Join(tmp, fmt.Sprint(i%50))
+					if i%3 == 2 {
+						os.Remove(path)
+					} else if err := os.WriteFile(path, []byte{byte(i)}, 0o644); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			const workers = 8
+			wg.Add(workers)
+			for w := 0; w < workers; w++ {
+				rng := rand.New(rand.NewSource(int64(w)))
+				go func() {
+					defer wg.Done()
+					for time.Now().Before(deadline) {
+						es := streams[rng.Intn(len(streams))]
+						var err error
+						switch rng.Intn(6) {
+						case 0:
+							err = es.Start()
+						case 1:
+							es.Stop()
+						case 2:
+							err = es.Restart()
+						case 3:
+							es.Flush(false)
+						case 4:
+							es.Flush(true)
+						case 5:
+							es.Stats()
+							es.LastEventID()
+						}
+						if err != nil && !errors.Is(err, ErrAlreadyStarted) {
+							t.Errorf("lifecycle operation failed: %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			for _, es := range streams {
+				es.Stop()
+			}
+			close(done)
+			draining.Wait()
+			for _, es := range streams {
+				close(es.Errors)
+				for err := range es.Errors {
+					t.Errorf("stream reported %v", err)
+				}
+			}
+			if n := len(registry.load()); n != 0 {
+				t.Errorf("registry holds %d streams once all are stopped", n)
+			}
+			checkLeaks()
+			t.Logf("%d events handled", atomic.LoadUint64(&handled))
+
+			end := time.Now().Add(5 * time.Second)
+			for runtime.NumGoroutine() > before {
+				if time.Now().After(end) {
+					buf := make([]byte, 1<<20)
+					t.Fatalf("%d goroutines left over, %d before:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package fsevents
+
+import "sync/atomic"
+
+// SubscribePatterns makes the subscription receive only the events on
+// the paths that match one of patterns, or are below one that does, as
+// with EventStream.ExclusionPatterns. A pattern filepath.Match can't take
+// matches nothing. With SubscribeFilter as well, an event must pass both,
+// the patterns first. The stream compiles a pattern once for all its
+// subscriptions, and matches it once for each event however many of them
+// use it.
+func SubscribePatterns(patterns ...string) SubscribeOption {
+	return func(s *Subscription) { s.patterns = append([]string(nil), patterns...) }
+}
+
+// sharedMatcher is a pattern of SubscribePatterns, shared by the
+// subscriptions of a stream using it.
+type sharedMatcher struct {
+	matched uint64 // how many events it was matched against; first, for alignment
+
+	text     string
+	patterns []pattern
+	slot     int // its index in matcherSet.slots
+	refs     int // the subscriptions using it, guarded by es.subMu
+}
+
+// matcherSet holds the sharedMatchers of a stream's subscriptions. It's
+// guarded by es.subMu.
+type matcherSet struct {
+	byText map[string]*sharedMatcher
+	slots  []*sharedMatcher // nil where free
+}
+
+// acquire returns the matchers of patterns, compiling those no
+// subscription uses yet.
+func (ms *matcherSet) acquire(patterns []string) []*sharedMatcher {
+	var matchers []*sharedMatcher
+	for _, text := range patterns {
+		m := ms.byText[text]
+		if m == nil {
+			m = &sharedMatcher{text: text, patterns: compilePatterns([]string{text}), slot: len(ms.slots)}
+			for i, free := range ms.slots {
+				if free == nil {
+					m.slot = i
+					break
+				}
+			}
+			if m.slot == len(ms.slots) {
+				ms.slots = append(ms.slots, m)
+			} else {
+				ms.slots[m.slot] = m
+			}
+			if ms.byText == nil {
+				ms.byText = map[string]*sharedMatcher{}
+			}
+			ms.byText[text] = m
+		}
+		if !containsMatcher(matchers, m) {
+			m.refs++
+			matchers = append(matchers, m)
+		}
+	}
+	return matchers
+}
+
+// release gives up matchers, as acquire returned them, dropping those no
+// subscription uses any more.
+func (ms *matcherSet) release(matchers []*sharedMatcher) {
+	for _, m := range matchers {
+		if m.refs--; m.refs == 0 {
+			delete(ms.byText, m.text)
+			ms.slots[m.slot] = nil
+		}
+	}
+}
+
+func containsMatcher(matchers []*sharedMatcher, m *sharedMatcher) bool {
+	for _, have := range matchers {
+		if have == m {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPass matches the events of a batch against the subscriptions'
+// matchers, remembering each result for the others using the matcher.
+type matchPass struct {
+	events []Event
+	elems  [][]string // the events' paths split, as needed
+	slots  []passSlot // by sharedMatcher.slot
+}
+
+// passSlot holds the results of a matcher, 0 for events not matched yet,
+// 1 for those that match and 2 for the others. A slot taken over by
+// another matcher, in between a subscription going and another coming,
+// starts afresh.
+type passSlot struct {
+	m       *sharedMatcher
+	results []uint8
+}
+
+// match reports whether events[i] matches one of matchers.
+func (p *matchPass) match(matchers []*sharedMatcher, i int) bool {
+	for _, m := range matchers {
+		for len(p.slots) <= m.slot {
+			p.slots = append(p.slots, passSlot{})
+		}
+		sl := &p.slots[m.slot]
+		if sl.m != m {
+			sl.m, sl.results = m, make([]uint8, len(p.events))
+		}
+		switch sl.results[i] {
+		case 1:
+			return true
+		case 2:
+			continue
+		}
+		if p.elems == nil {
+			p.elems = make([][]string, len(p.events))
+		}
+		if p.elems[i] == nil {
+			p.elems[i] = pathElems(p.events[i].Path)
+		}
+		atomic.AddUint64(&m.matched, 1)
+		if matchSplit(p.elems[i], m.patterns) {
+			sl.results[i] = 1
+			return true
+		}
+		sl.results[i] = 2
+	}
+	return false
+}
+
+// keeps reports whether s receives e, events[i] of the pass or a copy of
+// it for its Filter.
+func (s *Subscription) keeps(pass *matchPass, i int, e *Event) bool {
+	if len(s.matchers) > 0 && !pass.match(s.matchers, i) {
+		return false
+	}
+	return s.filter == nil || s.filter(e)
+}
@@ -0,0 +1,251 @@
+package fsevents
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Subscription receives a copy of every batch a stream delivers, next to
+// the stream's own Events channel or Handler, which stay subscriber zero.
+// Each has its own buffer, Filter and OverflowPolicy, so a slow subscriber
+// only loses its own events.
+type Subscription struct {
+	stats Stats // first, for 64-bit alignment
+
+	// Events receives the batches. It's closed by Unsubscribe. A batch
+	// belongs to the receiver, and may be handed back with Recycle.
+	Events <-chan []Event
+
+	events   chan []Event
+	filter   func(*Event) bool
+	patterns []string
+	matchers []*sharedMatcher // those of patterns, set as it's added
+	overflow OverflowPolicy
+
+	mu   sync.Mutex // held while sending on events
+	done chan struct{}
+}
+
+// SubscribeOption configures a Subscription.
+type SubscribeOption func(*Subscription)
+
+// SubscribeBuffer sets the capacity of the subscription's channel. The
+// default is 16 batches.
+func SubscribeBuffer(n int) SubscribeOption {
+	return func(s *Subscription) { s.events = make(chan []Event, n) }
+}
+
+// SubscribeFilter makes the subscription receive only the events f keeps,
+// like EventStream.Filter, which has already run. f gets a copy of the
+// event, so it may modify it without affecting other subscribers.
+func SubscribeFilter(f func(*Event) bool) SubscribeOption {
+	return func(s *Subscription) { s.filter = f }
+}
+
+// SubscribeOverflow sets what happens when the subscription's channel is
+// full. The default is DropNewest. Block holds up the stream and so every
+// other subscriber, as BlockWithTimeout does up to its timeout; Spill
+// isn't available and acts as DropNewest.
+func SubscribeOverflow(p OverflowPolicy) SubscribeOption {
+	return func(s *Subscription) { s.overflow = p }
+}
+
+// Subscribe adds a subscriber to the stream's events, configured by opts.
+// It can be called at any time, and the subscription lasts across Stop
+// and Start until Unsubscribe. Subscribers don't see the batches of a
+// RawHandler.
+func (es *EventStream) Subscribe(opts ...SubscribeOption) *Subscription {
+	s := newSubscription(opts)
+	es.subMu.Lock()
+	defer es.subMu.Unlock()
+	s.matchers = es.matchers.acquire(s.patterns)
+	subs := es.subscribers()
+	es.subs.Store(append(subs[:len(subs):len(subs)], s))
+	return s
+}
+
+// Unsubscribe removes s from the stream's subscribers and closes its
+// channel. Batches already on it can still be received.
+func (es *EventStream) Unsubscribe(s *Subscription) {
+	es.subMu.Lock()
+	subs := es.subscribers()
+	kept := make([]*Subscription, 0, len(subs))
+	found := false
+	for _, sub := range subs {
+		if sub == s {
+			found = true
+			continue
+		}
+		kept = append(kept, sub)
+	}
+	es.subs.Store(kept)
+	if found {
+		es.matchers.release(s.matchers)
+	}
+	es.subMu.Unlock()
+	if !found {
+		return
+	}
+
+	s.close()
+}
+
+// close closes s's channel once no send is in progress.
+func (s *Subscription) close() {
+	close(s.done)
+	s.mu.Lock()
+	close(s.events)
+	s.mu.Unlock()
+}
+
+// newSubscription returns a subscription configured by opts.
+func newSubscription(opts []SubscribeOption) *Subscription {
+	s := &Subscription{overflow: DropNewest, done: make(chan struct{})}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.events == nil {
+		s.events = make(chan []Event, 16)
+	}
+	s.Events = s.events
+	return s
+}
+
+func (es *EventStream) subscribers() []*Subscription {
+	subs, _ := es.subs.Load().([]*Subscription)
+	return subs
+}
+
+// fanOut sends a copy of events to each subscriber, matching them
+// against the subscribers' patterns in one pass.
+func (es *EventStream) fanOut(events []Event) {
+	pass := &matchPass{events: events}
+	for _, s := range es.subscribers() {
+		s.deliver(events, pass)
+	}
+	if r, _ := es.prefixes.Load().(*prefixRouter); r != nil {
+		r.route(events, pass)
+	}
+}
+
+// deliver sends s the events its patterns and filter keep, in a batch of
+// its own.
+func (s *Subscription) deliver(events []Event, pass *matchPass) {
+	batch := newBatch(len(events))
+	kept := batch[:0]
+	for i, e := range events {
+		if s.keeps(pass, i, &e) {
+			kept = append(kept, e)
+		}
+	}
+	if n := len(events) - len(kept); n > 0 {
+		atomic.AddUint64(&s.stats.FilteredEvents, uint64(n))
+	}
+	if len(kept) == 0 {
+		recycle(batch)
+		return
+	}
+	s.send(kept)
+}
+
+// send puts a batch of s's own on its channel according to its policy.
+func (s *Subscription) send(kept []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		recycle(kept)
+		return
+	default:
+	}
+	switch s.overflow.kind {
+	case overflowBlock:
+		select {
+		case s.events <- kept:
+		case <-s.done:
+			recycle(kept)
+			return
+		}
+	case overflowBlockTimeout:
+		t := time.NewTimer(s.overflow.timeout)
+		defer t.Stop()
+		select {
+		case s.events <- kept:
+		case <-t.C:
+			s.countTimedOut(len(kept))
+			recycle(kept)
+			return
+		case <-s.done:
+			recycle(kept)
+			return
+		}
+	case overflowDropOldest:
+		for {
+			select {
+			case s.events <- kept:
+				s.countDelivered(len(kept))
+				return
+			default:
+			}
+			select {
+			case old := <-s.events:
+				// It was counted as delivered when it was sent.
+				atomic.AddUint64(&s.stats.DeliveredEvents, ^uint64(len(old)-1))
+				atomic.AddUint64(&s.stats.DeliveredBatches, ^uint64(0))
+				s.countDropped(len(old))
+				recycle(old)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.events <- kept:
+		default:
+			s.countDropped(len(kept))
+			recycle(kept)
+			return
+		}
+	}
+	s.countDelivered(len(kept))
+}
+
+func (s *Subscription) countDelivered(n int) {
+	atomic.AddUint64(&s.stats.DeliveredEvents, uint64(n))
+	atomic.AddUint64(&s.stats.DeliveredBatches, 1)
+}
+
+func (s *Subscription) countDropped(n int) {
+	atomic.AddUint64(&s.stats.DroppedEvents, uint64(n))
+	atomic.AddUint64(&s.stats.DroppedBatches, 1)
+}
+
+func (s *Subscription) countTimedOut(n int) {
+	s.countDropped(n)
+	atomic.AddUint64(&s.stats.TimedOutEvents, uint64(n))
+	atomic.AddUint64(&s.stats.TimedOutBatches, 1)
+}
+
+// Recycle returns a batch received from s.Events to the pool, like
+// EventStream.Recycle.
+func (s *Subscription) Recycle(batch []Event) {
+	recycle(batch)
+}
+
+// Stats returns the subscription's delivery counters: the events and
+// batches it was sent, filtered out, dropped and, of those, timed out,
+// and its channel's current length and capacity. The other fields are
+// zero.
+func (s *Subscription) Stats() Stats {
+	return Stats{
+		DeliveredEvents:  atomic.LoadUint64(&s.stats.DeliveredEvents),
+		DeliveredBatches: atomic.LoadUint64(&s.stats.DeliveredBatches),
+		FilteredEvents:   atomic.LoadUint64(&s.stats.FilteredEvents),
+		DroppedEvents:    atomic.LoadUint64(&s.stats.DroppedEvents),
+		DroppedBatches:   atomic.LoadUint64(&s.stats.DroppedBatches),
+		TimedOutEvents:   atomic.LoadUint64(&s.stats.TimedOutEvents),
+		TimedOutBatches:  atomic.LoadUint64(&s.stats.TimedOutBatches),
+		QueuedBatches:    len(s.events),
+		QueueCapacity:    cap(s.events),
+	}
+}
@@ -0,0 +1,193 @@
+package fsevents
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func batchIDs(batches ...[]Event) []uint64 {
+	var ids []uint64
+	for _, batch := range batches {
+		for _, e := range batch {
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids
+}
+
+// drain returns the IDs of the batches waiting on c.
+func drain(c <-chan []Event) []uint64 {
+	var got []uint64
+	for {
+		select {
+		case batch, ok := <-c:
+			if !ok {
+				return got
+			}
+			got = append(got, batchIDs(batch)...)
+		default:
+			return got
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 10)}
+	fast := es.Subscribe(SubscribeBuffer(10), SubscribeFilter(func(e *Event) bool {
+		e.Path = "changed"
+		return e.ID%2 == 0
+	}))
+	slow := es.Subscribe(SubscribeBuffer(1))
+	latest := es.Subscribe(SubscribeBuffer(2), SubscribeOverflow(DropOldest))
+
+	for id := uint64(1); id <= 10; id++ {
+		es.deliver([]Event{{Path: "/a", ID: id}})
+	}
+
+	primary := <-es.EventsChan()
+	if primary[0].Path != "/a" {
+		t.Errorf("a subscriber's filter changed the primary's event: %v", primary)
+	}
+	if have, want := append(batchIDs(primary), drain(es.Events)...), []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !reflect.DeepEqual(have, want) {
+		t.Errorf("primary got %v, want %v", have, want)
+	}
+	if have, want := drain(fast.Events), []uint64{2, 4, 6, 8, 10}; !reflect.DeepEqual(have, want) {
+		t.Errorf("fast subscriber got %v, want %v", have, want)
+	}
+	if have, want := drain(slow.Events), []uint64{1}; !reflect.DeepEqual(have, want) {
+		t.Errorf("slow subscriber got %v, want %v", have, want)
+	}
+	if have, want := drain(latest.Events), []uint64{9, 10}; !reflect.DeepEqual(have, want) {
+		t.Errorf("DropOldest subscriber got %v, want %v", have, want)
+	}
+
+	if st := fast.Stats(); st.DeliveredBatches != 5 || st.FilteredEvents != 5 || st.DroppedBatches != 0 {
+		t.Errorf("fast subscriber stats %+v", st)
+	}
+	if st := slow.Stats(); st.DeliveredBatches != 1 || st.DroppedBatches != 9 {
+		t.Errorf("slow subscriber stats %+v", st)
+	}
+	if st := latest.Stats(); st.DeliveredBatches != 2 || st.DroppedBatches != 8 {
+		t.Errorf("DropOldest subscriber stats %+v", st)
+	}
+	if st := es.Stats(); st.DeliveredBatches != 10 || st.DroppedBatches != 0 {
+		t.Errorf("stream stats %+v", st)
+	}
+
+	es.Unsubscribe(slow)
+	es.deliver([]Event{{ID: 12}})
+	if _, ok := <-slow.Events; ok {
+		t.Error("unsubscribed channel still open")
+	}
+	if have := drain(fast.Events); !reflect.DeepEqual(have, []uint64{12}) {
+		t.Errorf("fast subscriber got %v after another unsubscribed", have)
+	}
+	es.Unsubscribe(slow)
+}
+
+func TestUnsubscribeBlocked(t *testing.T) {
+	es := &EventStream{Handler: func([]Event) {}}
+	s := es.Subscribe(SubscribeBuffer(0), SubscribeOverflow(Block))
+
+	done := make(chan struct{})
+	go func() {
+		es.deliver([]Event{{ID: 1}})
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	es.Unsubscribe(s)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery still blocked on an unsubscribed Block subscriber")
+	}
+}
+
+func TestSubscribeBlockWithTimeout(t *testing.T) {
+	es := &EventStream{Handler: func([]Event) {}}
+	s := es.Subscribe(SubscribeBuffer(1), SubscribeOverflow(BlockWithTimeout(10*time.Millisecond)))
+	for id := uint64(1); id <= 3; id++ {
+		es.deliver([]Event{{ID: id}})
+	}
+	if have, want := drain(s.Events), []uint64{1}; !reflect.DeepEqual(have, want) {
+		t.Errorf("got %v, want %v", have, want)
+	}
+	if st := s.Stats(); st.DeliveredBatches != 1 || st.DroppedBatches != 2 || st.TimedOutBatches != 2 || st.TimedOutEvents != 2 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestSubscribePatterns(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 10)}
+	code := es.Subscribe(SubscribeBuffer(10), SubscribePatterns("*.go", "vendor"))
+	goOnly := es.Subscribe(SubscribeBuffer(10), SubscribePatterns("*.go", "*.go"), SubscribeFilter(func(e *Event) bool { return e.ID != 3 }))
+	docs := es.Subscribe(SubscribeBuffer(10), SubscribePatterns("*.md"))
+	if n := len(es.matchers.byText); n != 3 {
+		t.Fatalf("%d matchers compiled, want 3", n)
+	}
+	matched := func(text string) uint64 { return es.matchers.byText[text].matched }
+
+	es.deliver([]Event{
+		{Path: "/w/main.go", ID: 1},
+		{Path: "/w/README.md", ID: 2},
+		{Path: "/w/cmd/tool.go", ID: 3},
+		{Path: "/w/vendor/x/y.c", ID: 4},
+		{Path: "/w/Makefile", ID: 5},
+	})
+	for _, tt := range []struct {
+		name string
+		s    *Subscription
+		want []uint64
+	}{
+		{"code", code, []uint64{1, 3, 4}},
+		{"go only", goOnly, []uint64{1}},
+		{"docs", docs, []uint64{2}},
+	} {
+		if have := drain(tt.s.Events); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%s subscriber got %v, want %v", tt.name, have, tt.want)
+		}
+	}
+	if n := matched("*.go"); n != 5 {
+		t.Errorf("*.go, shared by two subscribers, matched %d times against 5 events", n)
+	}
+	// Only matched where *.go didn't.
+	if n := matched("vendor"); n != 3 {
+		t.Errorf("vendor matched %d times, want 3", n)
+	}
+	if st := goOnly.Stats(); st.FilteredEvents != 4 {
+		t.Errorf("go only subscriber stats %+v", st)
+	}
+
+	// What's shared stays until the last subscription using it goes.
+	es.Unsubscribe(code)
+	if _, ok := es.matchers.byText["vendor"]; ok || len(es.matchers.byText) != 2 {
+		t.Errorf("after Unsubscribe, matchers %v", es.matchers.byText)
+	}
+	goMatcher := es.matchers.byText["*.go"]
+	prefixed, cancel := es.SubscribePrefix("/w/cmd", SubscribeBuffer(10), SubscribePatterns("*.go"))
+	if goMatcher.refs != 2 {
+		t.Errorf("*.go used by %d subscriptions, want 2", goMatcher.refs)
+	}
+	es.deliver([]Event{{Path: "/w/cmd/a.go", ID: 6}, {Path: "/w/b.go", ID: 7}, {Path: "/w/cmd/c.md", ID: 8}})
+	if have := drain(prefixed); !reflect.DeepEqual(have, []uint64{6}) {
+		t.Errorf("prefix subscriber got %v, want [6]", have)
+	}
+	if have := drain(goOnly.Events); !reflect.DeepEqual(have, []uint64{6, 7}) {
+		t.Errorf("go only subscriber got %v, want [6 7]", have)
+	}
+	if n := goMatcher.matched; n != 8 {
+		t.Errorf("*.go matched %d times against 8 events", n)
+	}
+	cancel()
+	es.Unsubscribe(goOnly)
+	es.Unsubscribe(docs)
+	if len(es.matchers.byText) != 0 || goMatcher.refs != 0 {
+		t.Errorf("with no subscriptions left, matchers %v", es.matchers.byText)
+	}
+	for _, m := range es.matchers.slots {
+		if m != nil {
+			t.Errorf("slot %d still holds %q", m.slot, m.text)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package fsevents
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var errSuspendBackend = errors.New("fsevents: Suspend needs the Native backend, without PollNetwork or FallbackToPolling polling")
+
+// Suspend stops FSEvents calling back for the stream, as
+// FSEventStreamStop does, but keeps the stream itself, its dispatch queue
+// and its place in the registry, so that Continue can start it again
+// where it left off without recreating it. The events that happen in
+// between aren't lost: FSEvents delivers them once the stream is
+// continued, as it would after a long Latency, unlike a Stop and a Start,
+// which go on from the time of the Start unless Resume is set. The
+// events the stream already holds, for MaxBatchDelay and the like, are
+// still delivered, and the stream still counts as running. The streams
+// FollowSymlinks watches the links' targets with are suspended with it.
+// The suspension ends with the stream: Stop, Restart, or the stream
+// starting FSEvents afresh itself, as AutoRestart and WaitForRoot do.
+// Suspend does nothing on a stream already suspended, and fails if it
+// isn't running or isn't watched with FSEvents alone.
+func (es *EventStream) Suspend() error {
+	if es.inHandler() {
+		return ErrStopInHandler
+	}
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if atomic.LoadInt32(&es.running) == 0 {
+		return errNotRunning
+	}
+	if es.conf().Backend != Native || es.source != nil {
+		return errSuspendBackend
+	}
+	if es.stream == 0 {
+		// Waiting for AutoRestart.
+		return errNotRunning
+	}
+	if atomic.LoadInt32(&es.suspended) != 0 {
+		return nil
+	}
+	if err := es.suspend(true); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&es.suspended, 1)
+	for _, lw := range es.links {
+		lw.es.Suspend()
+	}
+	return nil
+}
+
+// Continue starts a stream Suspend stopped again, as FSEventStreamStart
+// does, for FSEvents to deliver what happened in the meantime. It does
+// nothing on a stream that isn't suspended.
+func (es *EventStream) Continue() error {
+	if es.inHandler() {
+		return ErrStopInHandler
+	}
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if atomic.LoadInt32(&es.suspended) == 0 {
+		return nil
+	}
+	if err := es.suspend(false); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&es.suspended, 0)
+	for _, lw := range es.links {
+		lw.es.Continue()
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SymlinkMode is what a stream does about symbolic links to directories
+// in the trees it watches.
+type SymlinkMode int
+
+const (
+	// SymlinksAsReported leaves the events as the backend reports them.
+	// FSEvents goes by where items are, so a change behind a link in a
+	// watched tree is reported only if the link's target is watched
+	// too.
+	SymlinksAsReported SymlinkMode = iota
+
+	// FollowSymlinks also watches the targets of the links to
+	// directories directly in each of the paths, with a stream of its
+	// own for each, and reports what happens there below the link, as
+	// if the target were in the tree. The links created, removed or
+	// pointed elsewhere later are followed once the stream reports the
+	// change. Links to within the paths, or to a directory a path is
+	// in, are left out: what's there is watched already, or would be
+	// twice. The IDs of the events from a target are those of its
+	// stream, with the Native backend only.
+	FollowSymlinks
+
+	// ConfineSymlinks drops the events below the paths whose directory,
+	// once symbolic links are resolved, is outside them all, such as
+	// those FollowSymlinks reports or a Manual stream is given.
+	ConfineSymlinks
+)
+
+func (m SymlinkMode) String() string {
+	switch m {
+	case SymlinksAsReported:
+		return "SymlinksAsReported"
+	case FollowSymlinks:
+		return "FollowSymlinks"
+	case ConfineSymlinks:
+		return "ConfineSymlinks"
+	}
+	return fmt.Sprintf("SymlinkMode(%d)", int(m))
+}
+
+// errSymlinks is returned by Start for a Symlinks setting that can't be
+// used with the stream's other settings.
+var errSymlinks = errors.New("fsevents: Symlinks needs a stream that isn't device-relative, and FollowSymlinks one without RawPaths")
+
+// checkSymlinks reports whether the stream's Symlinks can be used with
+// its other settings.
+func (es *EventStream) checkSymlinks() error {
+	if es.conf().Symlinks == SymlinksAsReported {
+		return nil
+	}
+	if es.conf().Device != 0 || es.conf().Symlinks == FollowSymlinks && es.conf().RawPaths {
+		return errSymlinks
+	}
+	return nil
+}
+
+// linkWatch is the stream FollowSymlinks runs on the target of link.
+type linkWatch struct {
+	link   string // as the stream reports it
+	target string // with symbolic links resolved
+	es     *EventStream
+}
+
+// startLinks sets up Symlinks for a stream being started: the resolved
+// paths, and with FollowSymlinks, the streams on the links' targets.
+func (es *EventStream) startLinks() {
+	es.linkRoots, es.linkDirs = nil, nil
+	if es.conf().Symlinks == SymlinksAsReported {
+		return
+	}
+	for _, path := range es.conf().Paths {
+		forms := rootForms(path, 0)
+		for _, form := range forms {
+			es.linkDirs = append(es.linkDirs, form.path)
+		}
+		es.linkRoots = append(es.linkRoots, forms[len(forms)-1].path)
+	}
+	if es.conf().Symlinks == FollowSymlinks {
+		es.linkCheck = make(chan struct{}, 1)
+		es.syncLinksLocked()
+	}
+}
+
+// stopLinks stops the streams on the links' targets.
+func (es *EventStream) stopLinks() {
+	if es.linkQuit != nil {
+		close(es.linkQuit)
+		es.linkQuit = nil
+	}
+	for link, lw := range es.links {
+		lw.es.Stop()
+		delete(es.links, link)
+	}
+}
+
+// checkLinks asks watchLinks to look at the paths' links again after
+// events about their entries, or about a path as a whole.
+func (es *EventStream) checkLinks(events []Event) {
+	for _, e := range events {
+		path := filepath.Clean(e.Path)
+		for _, dir := range es.linkDirs {
+			if filepath.Dir(path) == dir || path == dir && (e.Flags&itemKinds == 0 || e.Flags&MustScanSubDirs != 0) {
+				select {
+				case es.linkCheck <- struct{}{}:
+				default:
+				}
+				return
+			}
+		}
+	}
+}
+
+// watchLinks looks at the links again whenever check is signalled, until
+// quit is closed.
+func (es *EventStream) watchLinks(quit, check chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-check:
+			es.lifecycle.Lock()
+			if es.linkQuit == quit {
+				es.syncLinksLocked()
+			}
+			es.lifecycle.Unlock()
+		}
+	}
+}
+
+// syncLinksLocked starts streams on the targets of the links in the
+// paths that aren't watched yet, and stops those on targets links no
+// longer point to. es.lifecycle must be held.
+func (es *EventStream) syncLinksLocked() {
+	want := map[string]string{} // target by link
+	for _, path := range es.conf().Paths {
+		// Native reports paths with symlinks resolved, the others as
+		// given.
+		forms := rootForms(path, 0)
+		dir := forms[0].path
+		if es.conf().Backend == Native {
+			dir = forms[len(forms)-1].path
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, d := range entries {
+			if d.Type()&os.ModeSymlink == 0 {
+				continue
+			}
+			link := filepath.Join(dir, d.Name())
+			target, err := filepath.EvalSymlinks(link)
+			if err != nil {
+				continue
+			}
+			if fi, err := os.Stat(target); err != nil || !fi.IsDir() || underAny(target, es.linkRoots) || coversAny(target, es.linkRoots) {
+				continue
+			}
+			want[link] = target
+		}
+	}
+	if es.links == nil {
+		es.links = map[string]*linkWatch{}
+	}
+	for link, lw := range es.links {
+		if want[link] != lw.target {
+			lw.es.Stop()
+			delete(es.links, link)
+		}
+	}
+	for link, target := range want {
+		if _, ok := es.links[link]; ok {
+			continue
+		}
+		lw := &linkWatch{link: link, target: target}
+		lw.es = &EventStream{
+			Paths:        []string{target},
+			Flags:        es.conf().Flags,
+			Latency:      es.conf().Latency,
+			Backend:      es.conf().Backend,
+			PollInterval: es.conf().PollInterval,
+			QoS:          es.conf().QoS,
+			Handler:      func(batch []Event) { es.deliverLinked(lw, batch) },
+		}
+		if err := lw.es.Start(); err != nil {
+			es.report(err)
+			continue
+		}
+		es.links[link] = lw
+	}
+}
+
+// coversAny reports whether any of paths is below dir.
+func coversAny(dir string, paths []string) bool {
+	for _, path := range paths {
+		if underAny(path, []string{dir}) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverLinked delivers a batch from the stream on lw's target, with the
+// paths moved below the link.
+func (es *EventStream) deliverLinked(lw *linkWatch, batch []Event) {
+	events := newBatch(len(batch))
+	for i, e := range batch {
+		if underAny(e.Path, []string{lw.target}) {
+			e.Path = filepath.Join(lw.link, e.Path[len(lw.target):])
+		}
+		e.Root = ""
+		if es.conf().Backend != Native {
+			e.ID = 0
+		}
+		events[i] = e
+	}
+	es.deliver(events)
+}
+
+// confine drops, for ConfineSymlinks, the events below the paths whose
+// directory resolves to outside them.
+func (es *EventStream) confine(events []Event) []Event {
+	if es.conf().Symlinks != ConfineSymlinks {
+		return events
+	}
+	resolved := map[string]string{}
+	kept := events[:0]
+	for _, e := range events {
+		path := filepath.Clean(e.Path)
+		if underAny(path, es.linkDirs) && !containsString(es.linkDirs, path) {
+			dir := filepath.Dir(path)
+			r, ok := resolved[dir]
+			if !ok {
+				if r, _ = filepath.EvalSymlinks(dir); r == "" {
+					r = dir
+				}
+				resolved[dir] = r
+			}
+			if r != dir && !underAny(r, es.linkRoots) {
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
@@ -0,0 +1,196 @@
+package fsevents
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// realTempDir returns a fresh temp dir as a real path.
+func realTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// linkTarget returns the target FollowSymlinks watches for link, or "".
+func (es *EventStream) linkTarget(link string) string {
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if lw := es.links[link]; lw != nil {
+		return lw.target
+	}
+	return ""
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	root, ext, ext2 := realTempDir(t), realTempDir(t), realTempDir(t)
+	link := filepath.Join(root, "link")
+	if err := os.Symlink(ext, link); err != nil {
+		t.Fatal(err)
+	}
+	es := &EventStream{
+		Paths:        []string{root},
+		Backend:      Poll,
+		PollInterval: time.Hour,
+		Symlinks:     FollowSymlinks,
+		Events:       make(chan []Event, 100),
+	}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	// files writes them and returns the paths of the files the stream
+	// reports after a flush.
+	files := func(paths ...string) []string {
+		t.Helper()
+		for _, path := range paths {
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		es.Flush(true)
+		var have []string
+		for len(es.EventsChan()) > 0 {
+			for _, e := range <-es.EventsChan() {
+				if e.Flags&ItemIsFile != 0 {
+					have = append(have, e.Path)
+				}
+			}
+		}
+		sort.Strings(have)
+		return have
+	}
+	// waitLink waits for the stream to watch target for link.
+	waitLink := func(link, target string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); es.linkTarget(link) != target; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("watching %q for %s, want %q", es.linkTarget(link), link, target)
+			}
+		}
+	}
+
+	if have, want := files(filepath.Join(ext, "a")), []string{filepath.Join(link, "a")}; !reflect.DeepEqual(have, want) {
+		t.Errorf("through the link, got %q, want %q", have, want)
+	}
+
+	// Pointed elsewhere.
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(ext2, link); err != nil {
+		t.Fatal(err)
+	}
+	files()
+	waitLink(link, ext2)
+	if have, want := files(filepath.Join(ext, "b"), filepath.Join(ext2, "c")), []string{filepath.Join(link, "c")}; !reflect.DeepEqual(have, want) {
+		t.Errorf("after retargeting, got %q, want %q", have, want)
+	}
+
+	// Created, then removed.
+	other := filepath.Join(root, "other")
+	if err := os.Symlink(ext, other); err != nil {
+		t.Fatal(err)
+	}
+	files()
+	waitLink(other, ext)
+	if have, want := files(filepath.Join(ext, "d")), []string{filepath.Join(other, "d")}; !reflect.DeepEqual(have, want) {
+		t.Errorf("through a new link, got %q, want %q", have, want)
+	}
+	if err := os.Remove(other); err != nil {
+		t.Fatal(err)
+	}
+	files()
+	waitLink(other, "")
+	if have := files(filepath.Join(ext, "e")); len(have) != 0 {
+		t.Errorf("through a removed link, got %q", have)
+	}
+
+	// A link to within the root isn't followed.
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	inner := filepath.Join(root, "inner")
+	if err := os.Symlink(filepath.Join(root, "sub"), inner); err != nil {
+		t.Fatal(err)
+	}
+	files()
+	es.lifecycle.Lock()
+	es.syncLinksLocked()
+	es.lifecycle.Unlock()
+	if target := es.linkTarget(inner); target != "" {
+		t.Errorf("link within the root watched, on %s", target)
+	}
+
+	es.Stop()
+	if len(es.links) != 0 {
+		t.Errorf("%d link streams left after Stop", len(es.links))
+	}
+}
+
+func TestConfineSymlinks(t *testing.T) {
+	root, ext := realTempDir(t), realTempDir(t)
+	for _, link := range []struct{ name, target string }{{"out", ext}, {"in", root}} {
+		if err := os.Symlink(link.target, filepath.Join(root, link.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(ext, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	es := &EventStream{Paths: []string{root}, Backend: Manual, Symlinks: ConfineSymlinks, Events: make(chan []Event, 1)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	in := []Event{
+		{Path: filepath.Join(root, "out/x"), Flags: ItemCreated | ItemIsFile},
+		{Path: filepath.Join(root, "out/dir/y"), Flags: ItemCreated | ItemIsFile},
+		{Path: filepath.Join(root, "out"), Flags: ItemCreated | ItemIsSymlink},
+		{Path: filepath.Join(root, "in/z"), Flags: ItemCreated | ItemIsFile},
+		{Path: filepath.Join(root, "f"), Flags: ItemCreated | ItemIsFile},
+		{Path: root, Flags: RootChanged},
+		{Path: "/", Flags: KernelDropped},
+	}
+	if err := es.Inject(in); err != nil {
+		t.Fatal(err)
+	}
+	var have, want []string
+	for _, e := range <-es.EventsChan() {
+		have = append(have, e.Path)
+	}
+	for _, e := range in[2:] {
+		want = append(want, e.Path)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("got %q, want %q", have, want)
+	}
+}
+
+func TestSymlinksSettings(t *testing.T) {
+	for _, es := range []*EventStream{
+		{Paths: []string{"a"}, Device: 1, Symlinks: ConfineSymlinks},
+		{Paths: []string{"/"}, Backend: Manual, RawPaths: true, Symlinks: FollowSymlinks},
+	} {
+		if err := es.Start(); err != errSymlinks {
+			es.Stop()
+			t.Errorf("Start with %v = %v, want errSymlinks", es.Symlinks, err)
+		}
+	}
+	es := &EventStream{Paths: []string{"/"}, Backend: Manual, RawPaths: true}
+	if _, err := es.Clone(WithSymlinks(FollowSymlinks)); err != errSymlinks {
+		t.Errorf("Clone = %v, want errSymlinks", err)
+	}
+	if c, err := es.Clone(WithRawPaths(false), WithSymlinks(FollowSymlinks)); err != nil || c.Symlinks != FollowSymlinks {
+		t.Errorf("Clone = %v, %v", c, err)
+	}
+}
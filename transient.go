@@ -0,0 +1,63 @@
+package fsevents
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// dropTransients leaves out, for TransientWindow, the events on the items
+// the batch has both created and removed, reusing its storage. FSEvents
+// may report both on one event, for an item that was created and
+// removed, or removed and created again; the item is looked for then,
+// and a device-relative stream keeps its events.
+func (es *EventStream) dropTransients(events []Event) []Event {
+	type item struct {
+		created bool
+		last    EventFlags // of the item's last event
+	}
+	items := map[string]item{}
+	for _, e := range events {
+		if e.Flags&streamFlags != 0 || e.Flags&itemKinds == 0 {
+			continue
+		}
+		it := items[e.Path]
+		it.created = it.created || e.Flags&ItemCreated != 0
+		it.last = e.Flags
+		items[e.Path] = it
+	}
+	var gone map[string]bool
+	for path, it := range items {
+		if !it.created || it.last&ItemRemoved == 0 {
+			continue
+		}
+		if it.last&ItemCreated != 0 {
+			if es.conf().Device != 0 {
+				continue
+			}
+			if _, err := os.Lstat(path); err == nil {
+				continue
+			}
+		}
+		if gone == nil {
+			gone = map[string]bool{}
+		}
+		gone[path] = true
+	}
+	if gone == nil {
+		return events
+	}
+
+	kept := events[:0]
+	for _, e := range events {
+		if e.Flags&streamFlags == 0 && gone[e.Path] {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	atomic.AddUint64(&es.stats.FilteredEvents, uint64(len(events)-len(kept)))
+	tail := events[len(kept):]
+	for i := range tail {
+		tail[i] = Event{}
+	}
+	return kept
+}
@@ -0,0 +1,83 @@
+package fsevents
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTransientWindow(t *testing.T) {
+	root := realTempDir(t)
+	es := &EventStream{Paths: []string{root}, Backend: Manual, TransientWindow: time.Hour, Events: make(chan []Event, 10)}
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Stop()
+
+	// delivered injects the batches and returns the paths and flags of
+	// what a flush delivers.
+	delivered := func(batches ...[]Event) []string {
+		t.Helper()
+		for _, batch := range batches {
+			if err := es.Inject(batch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		es.Flush(true)
+		var have []string
+		for len(es.EventsChan()) > 0 {
+			for _, e := range <-es.EventsChan() {
+				have = append(have, fmt.Sprint(filepath.Base(e.Path), " ", e.Flags))
+			}
+		}
+		return have
+	}
+
+	// A build's temporary files, made and removed, next to its outputs,
+	// which stay.
+	var created, removed []Event
+	var want []string
+	for i := 0; i < 50; i++ {
+		tmp, out := filepath.Join(root, fmt.Sprint("tmp", i)), filepath.Join(root, fmt.Sprint("out", i))
+		for _, path := range []string{tmp, out} {
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			created = append(created, Event{Path: path, Flags: ItemCreated | ItemIsFile})
+		}
+		if err := os.Remove(tmp); err != nil {
+			t.Fatal(err)
+		}
+		removed = append(removed, Event{Path: tmp, Flags: ItemRemoved | ItemIsFile}, Event{Path: out, Flags: ItemModified | ItemIsFile})
+		want = append(want, fmt.Sprint("out", i, " ", ItemCreated|ItemIsFile))
+	}
+	for i := 0; i < 50; i++ {
+		want = append(want, fmt.Sprint("out", i, " ", ItemModified|ItemIsFile))
+	}
+	if have := delivered(created, removed); !reflect.DeepEqual(have, want) {
+		t.Errorf("got %q, want %q", have, want)
+	}
+	if n := es.Stats().FilteredEvents; n != 100 {
+		t.Errorf("FilteredEvents = %d, want 100", n)
+	}
+
+	// Created in a batch delivered already.
+	late := filepath.Join(root, "late")
+	if have := delivered([]Event{{Path: late, Flags: ItemCreated | ItemIsFile}}); len(have) != 1 {
+		t.Errorf("got %q for the creation", have)
+	}
+	if have, want := delivered([]Event{{Path: late, Flags: ItemRemoved | ItemIsFile}}), []string{fmt.Sprint("late ", ItemRemoved|ItemIsFile)}; !reflect.DeepEqual(have, want) {
+		t.Errorf("got %q for the removal, want %q", have, want)
+	}
+
+	// Both on one event: removed and made again, or made and removed.
+	again, gone := filepath.Join(root, "out0"), filepath.Join(root, "tmp0")
+	both := ItemCreated | ItemRemoved | ItemIsFile
+	have := delivered([]Event{{Path: again, Flags: both}, {Path: gone, Flags: both}, {Path: root, Flags: MustScanSubDirs}})
+	if want := []string{fmt.Sprint("out0 ", both), fmt.Sprint(filepath.Base(root), " ", MustScanSubDirs)}; !reflect.DeepEqual(have, want) {
+		t.Errorf("got %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,355 @@
+package fsevents
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MirrorEntry describes an item of a TreeMirror.
+type MirrorEntry struct {
+	Path string
+
+	// Kind is ItemIsFile, ItemIsDir or ItemIsSymlink.
+	Kind EventFlags
+
+	Size    int64
+	ModTime time.Time
+	Mode    fs.FileMode
+
+	// Inode is the item's inode number, or zero on platforms without.
+	Inode uint64
+}
+
+// TreeMirror keeps a listing of the tree below a root in memory, up to
+// date with the events handed to Apply, for looking at the tree without
+// walking it. It walks the tree once to begin with, and again only for
+// what events can't tell: the subtree of a MustScanSubDirs, Mount or
+// Unmount event, or the whole tree after lost events or RootChanged.
+// For the other events it looks at the items they're about again. A
+// rename within a batch whose two paths have the same inode moves the
+// mirrored subtree instead of walking the new path.
+//
+// Events of a stream without FileEvents are about directories only; the
+// entries of each are compared with the mirror's then. A directory's
+// size and modification time are as of the last event about the
+// directory itself. The root should be a real path, like the event
+// paths. The methods may be called concurrently; readers wait while
+// Apply runs.
+type TreeMirror struct {
+	root string
+
+	mu       sync.RWMutex
+	entries  map[string]pollEntry
+	children map[string]map[string]struct{} // names of each directory's entries
+	gen      uint64
+	changed  bool // by the Apply running
+}
+
+// NewTreeMirror returns a TreeMirror of the tree below root as it is now.
+func NewTreeMirror(root string) *TreeMirror {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	m := &TreeMirror{
+		root:     filepath.Clean(root),
+		entries:  map[string]pollEntry{},
+		children: map[string]map[string]struct{}{},
+	}
+	m.rewalk(m.root)
+	return m
+}
+
+// Root returns the TreeMirror's root.
+func (m *TreeMirror) Root() string {
+	return m.root
+}
+
+// Apply brings the mirror up to date with a batch of events. Events
+// outside the root are ignored.
+func (m *TreeMirror) Apply(events []Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.changed = false
+	for _, r := range m.renames(events) {
+		m.move(r[0], r[1])
+	}
+	for _, e := range events {
+		path := filepath.Clean(e.Path)
+		switch {
+		case e.Flags&(KernelDropped|UserDropped|RootChanged) != 0:
+			m.rewalk(m.root)
+		case !m.under(path), e.Flags&(HistoryDone|EventIDsWrapped) != 0:
+		case e.Flags&(MustScanSubDirs|Mount|Unmount) != 0:
+			m.rewalk(path)
+		case e.Flags&(ItemIsFile|ItemIsDir|ItemIsSymlink) == 0:
+			m.syncDir(path)
+		default:
+			m.update(path)
+		}
+	}
+	if m.changed {
+		m.gen++
+	}
+}
+
+// Lookup returns the entry for path, and whether there is one.
+func (m *TreeMirror) Lookup(path string) (MirrorEntry, bool) {
+	path = filepath.Clean(path)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.entries[path]
+	if !ok {
+		return MirrorEntry{}, false
+	}
+	return e.mirrorEntry(path), true
+}
+
+// List returns the entries of dir sorted by name, or nil if dir isn't a
+// directory of the mirror.
+func (m *TreeMirror) List(dir string) []MirrorEntry {
+	dir = filepath.Clean(dir)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if e, ok := m.entries[dir]; !ok || e.kind != ItemIsDir {
+		return nil
+	}
+	names := make([]string, 0, len(m.children[dir]))
+	for name := range m.children[dir] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]MirrorEntry, len(names))
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		list[i] = m.entries[path].mirrorEntry(path)
+	}
+	return list
+}
+
+// Len returns the number of items in the mirror, the root included.
+func (m *TreeMirror) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.entries)
+}
+
+// Generation returns the number of calls to Apply that changed the
+// mirror, for telling cheaply whether it changed since it was last
+// looked at.
+func (m *TreeMirror) Generation() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.gen
+}
+
+func (e pollEntry) mirrorEntry(path string) MirrorEntry {
+	return MirrorEntry{Path: path, Kind: e.kind, Size: e.size, ModTime: time.Unix(0, e.mtime), Mode: e.mode, Inode: e.ino}
+}
+
+func (m *TreeMirror) under(path string) bool {
+	return underAny(path, []string{m.root})
+}
+
+// renames pairs the paths of a batch's ItemRenamed events that are gone
+// with those the same items are at now, by inode. A directory with other
+// events of the batch below either path isn't paired: what the mirror
+// has of it may be out of date.
+func (m *TreeMirror) renames(events []Event) [][2]string {
+	gone := map[uint64]string{}
+	var arrived []string
+	for _, e := range events {
+		path := filepath.Clean(e.Path)
+		if e.Flags&ItemRenamed == 0 || !m.under(path) || path == m.root {
+			continue
+		}
+		if _, err := os.Lstat(path); err == nil {
+			arrived = append(arrived, path)
+		} else if old, ok := m.entries[path]; ok && old.ino != 0 {
+			gone[old.ino] = path
+		}
+	}
+	var pairs [][2]string
+	for _, path := range arrived {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			continue
+		}
+		ino, _ := inode(fi)
+		src, ok := gone[ino]
+		if !ok || ino == 0 || m.entries[src].kind != newPollEntry(fi).kind || m.entries[path].ino == ino {
+			continue
+		}
+		delete(gone, ino)
+		if m.entries[src].kind == ItemIsDir && eventsBelow(events, src, path) {
+			continue
+		}
+		pairs = append(pairs, [2]string{src, path})
+	}
+	return pairs
+}
+
+// eventsBelow reports whether any of events is strictly below one of
+// dirs.
+func eventsBelow(events []Event, dirs ...string) bool {
+	for _, e := range events {
+		path := filepath.Clean(e.Path)
+		for _, dir := range dirs {
+			if path != dir && underAny(path, []string{dir}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// move moves the entries of src and below to dst.
+func (m *TreeMirror) move(src, dst string) {
+	moved := map[string]pollEntry{}
+	m.collect(src, moved)
+	m.remove(src)
+	if _, ok := m.entries[filepath.Dir(dst)]; !ok {
+		return
+	}
+	m.remove(dst)
+	paths := sortedKeys(moved)
+	for _, p := range paths {
+		m.set(dst+p[len(src):], moved[p])
+	}
+}
+
+// update looks at the item at path again.
+func (m *TreeMirror) update(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		m.remove(path)
+		return
+	}
+	if top := m.missingAncestor(path); top != "" {
+		m.rewalk(top)
+		return
+	}
+	e := newPollEntry(fi)
+	if old, ok := m.entries[path]; e.kind == ItemIsDir && (!ok || old.kind != e.kind || old.ino != e.ino) {
+		m.rewalk(path)
+		return
+	}
+	m.set(path, e)
+}
+
+// syncDir looks at the directory at path and at each of its entries
+// again.
+func (m *TreeMirror) syncDir(path string) {
+	m.update(path)
+	if e, ok := m.entries[path]; !ok || e.kind != ItemIsDir {
+		return
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return
+	}
+	names := map[string]struct{}{}
+	for _, d := range entries {
+		names[d.Name()] = struct{}{}
+		m.update(filepath.Join(path, d.Name()))
+	}
+	for name := range m.children[path] {
+		if _, ok := names[name]; !ok {
+			m.remove(filepath.Join(path, name))
+		}
+	}
+}
+
+// rewalk walks the tree below path again, or below its highest ancestor
+// missing from the mirror.
+func (m *TreeMirror) rewalk(path string) {
+	if top := m.missingAncestor(path); top != "" {
+		path = top
+	}
+	cur := walkTree([]string{path}, 0)
+	old := map[string]pollEntry{}
+	m.collect(path, old)
+	for p := range old {
+		if _, ok := cur[p]; !ok {
+			m.remove(p)
+		}
+	}
+	// Sorted, a directory comes before its entries.
+	for _, p := range sortedKeys(cur) {
+		m.set(p, cur[p])
+	}
+}
+
+// missingAncestor returns the highest of the directories between the root
+// and path, both included, that's missing from the mirror, or "".
+func (m *TreeMirror) missingAncestor(path string) string {
+	top := ""
+	for p := path; p != m.root; {
+		p = filepath.Dir(p)
+		if _, ok := m.entries[p]; !ok {
+			top = p
+		}
+	}
+	return top
+}
+
+// collect adds the entries of path and below to into.
+func (m *TreeMirror) collect(path string, into map[string]pollEntry) {
+	e, ok := m.entries[path]
+	if !ok {
+		return
+	}
+	into[path] = e
+	for name := range m.children[path] {
+		m.collect(filepath.Join(path, name), into)
+	}
+}
+
+// set records e for path, whose directory must be in the mirror. An item
+// of another kind or inode replaces the one there with its entries.
+func (m *TreeMirror) set(path string, e pollEntry) {
+	old, ok := m.entries[path]
+	if ok && old == e {
+		return
+	}
+	if ok && (old.kind != e.kind || old.ino != e.ino) {
+		m.remove(path)
+	}
+	m.entries[path] = e
+	if path != m.root {
+		dir := filepath.Dir(path)
+		if m.children[dir] == nil {
+			m.children[dir] = map[string]struct{}{}
+		}
+		m.children[dir][filepath.Base(path)] = struct{}{}
+	}
+	m.changed = true
+}
+
+// remove removes path and the entries below it.
+func (m *TreeMirror) remove(path string) {
+	if _, ok := m.entries[path]; !ok {
+		return
+	}
+	for name := range m.children[path] {
+		m.remove(filepath.Join(path, name))
+	}
+	delete(m.children, path)
+	delete(m.entries, path)
+	if path != m.root {
+		delete(m.children[filepath.Dir(path)], filepath.Base(path))
+	}
+	m.changed = true
+}
+
+func sortedKeys(entries map[string]pollEntry) []string {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,232 @@
+package fsevents
+
+import (
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// checkMirror compares m with a fresh walk of its root.
+func checkMirror(t *testing.T, m *TreeMirror) {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(m.Root(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		n++
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		want := newPollEntry(fi).mirrorEntry(path)
+		have, ok := m.Lookup(path)
+		if !ok {
+			t.Errorf("%s is missing", path)
+			return nil
+		}
+		if want.Kind == ItemIsDir {
+			// Only changes to a directory's entries are seen.
+			have.Size, have.ModTime = want.Size, want.ModTime
+		}
+		if !have.ModTime.Equal(want.ModTime) || have.Path != want.Path || have.Kind != want.Kind ||
+			have.Size != want.Size || have.Mode != want.Mode || have.Inode != want.Inode {
+			t.Errorf("Lookup(%q) = %+v, want %+v", path, have, want)
+		}
+		if d.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			var names, listed []string
+			for _, d := range entries {
+				names = append(names, d.Name())
+			}
+			for _, e := range m.List(path) {
+				listed = append(listed, filepath.Base(e.Path))
+			}
+			if !reflect.DeepEqual(listed, names) {
+				t.Errorf("List(%q) has %v, want %v", path, listed, names)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != n {
+		t.Errorf("Len() = %d, want %d", m.Len(), n)
+	}
+}
+
+// scramble makes n random changes to the tree below root: creating,
+// writing to, renaming, replacing and removing files and directories.
+func scramble(t *testing.T, rng *rand.Rand, root string, n int, next *int) {
+	t.Helper()
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		var dirs, items []string
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if d.IsDir() {
+				dirs = append(dirs, path)
+			}
+			if path != root {
+				items = append(items, path)
+			}
+			return nil
+		})
+		*next++
+		name := fmt.Sprintf("n%d", *next)
+		dir := dirs[rng.Intn(len(dirs))]
+		switch op := rng.Intn(7); {
+		case op == 0 || len(items) == 0:
+			must(os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644))
+		case op == 1:
+			must(os.Mkdir(filepath.Join(dir, name), 0o755))
+		case op == 2:
+			item := items[rng.Intn(len(items))]
+			if underAny(dir, []string{item}) {
+				continue
+			}
+			must(os.Rename(item, filepath.Join(dir, name)))
+		case op == 3:
+			must(os.RemoveAll(items[rng.Intn(len(items))]))
+		default:
+			item := items[rng.Intn(len(items))]
+			if fi := mustStat(t, item); fi.IsDir() {
+				must(os.Chmod(item, 0o700|fi.Mode().Perm()^0o005))
+				continue
+			}
+			switch op {
+			case 4:
+				f, err := os.OpenFile(item, os.O_APPEND|os.O_WRONLY, 0)
+				must(err)
+				_, err = f.WriteString(name)
+				must(err)
+				must(f.Close())
+			case 5:
+				must(os.Chmod(item, mustStat(t, item).Mode()^0o020))
+			case 6:
+				// Replaced by a file renamed over it.
+				tmp := filepath.Join(dir, name)
+				must(os.WriteFile(tmp, []byte(name), 0o644))
+				must(os.Rename(tmp, item))
+			}
+		}
+	}
+}
+
+func TestTreeMirror(t *testing.T) {
+	es := &EventStream{Events: make(chan []Event, 100)}
+	tmp := startPollStream(t, es)
+	rng, next := rand.New(rand.NewSource(1)), 0
+	scramble(t, rng, tmp, 30, &next)
+	// Polled first, so that the stream's walk and the mirror's agree.
+	es.Flush(true)
+	for len(es.EventsChan()) > 0 {
+		<-es.EventsChan()
+	}
+
+	m := NewTreeMirror(tmp)
+	checkMirror(t, m)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			m.List(tmp)
+			m.Lookup(filepath.Join(tmp, "n1"))
+			m.Len()
+			m.Generation()
+		}
+	}()
+
+	for round := 0; round < 30; round++ {
+		scramble(t, rng, tmp, 10, &next)
+		es.Flush(true)
+		gen := m.Generation()
+		for len(es.EventsChan()) > 0 {
+			m.Apply(<-es.EventsChan())
+		}
+		if m.Generation() == gen {
+			t.Errorf("round %d: Generation() stayed %d", round, gen)
+		}
+	}
+	checkMirror(t, m)
+
+	// The first brings the root's size and modification time up to date.
+	unchanged := []Event{{Path: tmp, Flags: ItemInodeMetaMod | ItemIsDir}, {Path: "/elsewhere", Flags: ItemRemoved | ItemIsFile}}
+	m.Apply(unchanged)
+	gen := m.Generation()
+	m.Apply(unchanged)
+	if m.Generation() != gen {
+		t.Errorf("events changing nothing moved Generation() from %d to %d", gen, m.Generation())
+	}
+}
+
+func TestTreeMirrorRescan(t *testing.T) {
+	tmp := rescanTree(t)
+	m := NewTreeMirror(tmp)
+	mutate(t, tmp)
+
+	// Only sub is walked again.
+	m.Apply([]Event{{Path: filepath.Join(tmp, "sub"), Flags: MustScanSubDirs}})
+	if _, ok := m.Lookup(filepath.Join(tmp, "sub/renamed")); !ok {
+		t.Error("sub wasn't walked again")
+	}
+	if _, ok := m.Lookup(filepath.Join(tmp, "gone/e")); !ok {
+		t.Error("more than sub was walked again")
+	}
+
+	m.Apply([]Event{{Path: "/", Flags: MustScanSubDirs | UserDropped}})
+	checkMirror(t, m)
+	if gen := m.Generation(); gen != 2 {
+		t.Errorf("Generation() = %d, want 2", gen)
+	}
+}
+
+func TestTreeMirrorRename(t *testing.T) {
+	tmp := rescanTree(t)
+	m := NewTreeMirror(tmp)
+	if _, ok := inode(mustStat(t, tmp)); !ok {
+		t.Skip("no inodes to pair renames with")
+	}
+
+	// The pair moves what the mirror has of sub rather than walking it
+	// again, so a file created without an event stays unseen.
+	sub, moved := filepath.Join(tmp, "sub"), filepath.Join(tmp, "gone/moved")
+	if err := os.WriteFile(filepath.Join(sub, "unseen"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mustRename(t, sub, moved)
+	m.Apply([]Event{
+		{Path: sub, Flags: ItemRenamed | ItemIsDir},
+		{Path: moved, Flags: ItemRenamed | ItemIsDir},
+	})
+	if _, ok := m.Lookup(filepath.Join(moved, "d")); !ok {
+		t.Errorf("d wasn't moved along: %v", m.List(moved))
+	}
+	if _, ok := m.Lookup(filepath.Join(moved, "unseen")); ok {
+		t.Error("the renamed directory was walked")
+	}
+	if list := m.List(sub); list != nil {
+		t.Errorf("List of the old path = %v", list)
+	}
+
+	// Without FileEvents, the directory's entries are compared.
+	m.Apply([]Event{{Path: moved}, {Path: tmp}})
+	checkMirror(t, m)
+}
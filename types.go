@@ -0,0 +1,63 @@
+package fsevents
+
+type CreateFlags uint32
+
+const (
+	NoDefer    CreateFlags = 0x00000002
+	WatchRoot  CreateFlags = 0x00000004
+	IgnoreSelf CreateFlags = 0x00000008
+	FileEvents CreateFlags = 0x00000010
+)
+
+type EventFlags uint32
+
+const (
+	MustScanSubDirs   EventFlags = 0x00000001
+	KernelDropped     EventFlags = 0x00000002
+	UserDropped       EventFlags = 0x00000004
+	EventIDsWrapped   EventFlags = 0x00000008
+	HistoryDone       EventFlags = 0x00000010
+	RootChanged       EventFlags = 0x00000020
+	Mount             EventFlags = 0x00000040
+	Unmount           EventFlags = 0x00000080
+	ItemCreated       EventFlags = 0x00000100
+	ItemRemoved       EventFlags = 0x00000200
+	ItemInodeMetaMod  EventFlags = 0x00000400
+	ItemRenamed       EventFlags = 0x00000800
+	ItemModified      EventFlags = 0x00001000
+	ItemFinderInfoMod EventFlags = 0x00002000
+	ItemChangeOwner   EventFlags = 0x00004000
+	ItemXattrMod      EventFlags = 0x00008000
+	ItemIsFile        EventFlags = 0x00010000
+	ItemIsDir         EventFlags = 0x00020000
+	ItemIsSymlink     EventFlags = 0x00040000
+)
+
+type (
+	fsEventStreamRef   uintptr
+	fsDispatchQueueRef uintptr
+	CFStringRef        uintptr
+	CFURLRef           uintptr
+	CFArrayRef         uintptr
+)
+
+// DeviceInfo describes a mounted volume.
+type DeviceInfo struct {
+	// Dev is the device ID, as used by EventStream.Device.
+	Dev int32
+
+	// MountPoint is where the volume is mounted.
+	MountPoint string
+
+	// FSType is the file system type, such as "apfs" or "smbfs".
+	FSType string
+
+	// Local reports whether the volume is stored locally rather than
+	// on a network server.
+	Local bool
+
+	// UUID identifies the volume's FSEvents history, as returned by
+	// GetDeviceUUID. It's empty for volumes without one, such as some
+	// network mounts.
+	UUID string
+}
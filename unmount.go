@@ -0,0 +1,104 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// UnmountedError is sent on Errors when the volume of a device-relative
+// stream goes away. The stream has stopped itself, and closed Events or
+// BatchesMeta if it delivers on it; Start can pick it up again once the volume is back.
+type UnmountedError struct {
+	Device int32
+}
+
+func (e *UnmountedError) Error() string {
+	return fmt.Sprintf("fsevents: device %d was unmounted", e.Device)
+}
+
+// unmountCheckInterval is how often a device-relative stream checks that
+// its volume is still mounted when no Unmount event prompts it to.
+var unmountCheckInterval = 10 * time.Second
+
+// deviceMounted reports whether dev is in the mount table. Where the table
+// can't be read, devices are assumed to stay.
+var deviceMounted = func(dev int32) bool {
+	mountPoints.invalidate()
+	_, err := MountPointForDevice(dev)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// watchMount stops the stream once mounted reports its device gone,
+// asking every interval and whenever check is signalled after an Unmount
+// event. It returns when quit is closed.
+func (es *EventStream) watchMount(quit, check chan struct{}, interval time.Duration, mounted func(int32) bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		case <-check:
+		}
+		if !mounted(es.conf().Device) {
+			es.unmounted(quit)
+			return
+		}
+	}
+}
+
+// checkMount has watchMount look for the device now.
+func (es *EventStream) checkMount() {
+	if es.mountCheck == nil {
+		return
+	}
+	select {
+	case es.mountCheck <- struct{}{}:
+	default:
+	}
+}
+
+// unmounted ends the stream after its device went away, unless it was
+// stopped or restarted since watchMount was started with quit.
+func (es *EventStream) unmounted(quit chan struct{}) {
+	es.lifecycle.Lock()
+	defer es.lifecycle.Unlock()
+	if es.mountQuit != quit {
+		return
+	}
+	es.end(&UnmountedError{Device: es.conf().Device})
+}
+
+// end stops the stream on its own, reports err, and closes Events or
+// BatchesMeta if the stream delivers on it. Callers hold lifecycle.
+func (es *EventStream) end(err error) {
+	// No callback may be left sending on Events when it's closed.
+	es.stopWait = true
+	es.stopLocked()
+	es.stopWait = false
+	atomic.StoreInt32(&es.state, int32(stateFailed))
+	es.report(err)
+	if es.conf().Handler == nil && es.conf().RawHandler == nil {
+		if es.BatchesMeta != nil {
+			close(es.BatchesMeta)
+		} else {
+			close(es.Events)
+		}
+		es.eventsClosed = true
+	}
+}
+
+// report sends err on Errors, if there's room.
+func (es *EventStream) report(err error) {
+	if es.Errors == nil {
+		return
+	}
+	select {
+	case es.Errors <- err:
+	default:
+	}
+}
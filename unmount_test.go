@@ -0,0 +1,91 @@
+package fsevents
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withFakeMounts makes device-relative streams see their device as
+// mounted until the returned func is called, checking every interval.
+func withFakeMounts(t *testing.T, interval time.Duration) (eject func()) {
+	var gone int32
+	prevMounted, prevInterval := deviceMounted, unmountCheckInterval
+	deviceMounted = func(int32) bool { return atomic.LoadInt32(&gone) == 0 }
+	unmountCheckInterval = interval
+	t.Cleanup(func() { deviceMounted, unmountCheckInterval = prevMounted, prevInterval })
+	return func() { atomic.StoreInt32(&gone, 1) }
+}
+
+func TestUnmounted(t *testing.T) {
+	eject := withFakeMounts(t, time.Hour)
+
+	// Poll ignores Device, but the stream still watches for it.
+	es := &EventStream{Device: 5, Events: make(chan []Event, 1), Errors: make(chan error, 1)}
+	startPollStream(t, es)
+	events := es.Events
+
+	// An Unmount for another volume changes nothing.
+	es.deliver([]Event{{Path: "Volumes/Other", Flags: Unmount}})
+	<-events
+	select {
+	case err := <-es.ErrorsChan():
+		t.Fatalf("stream ended while its device is mounted: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	eject()
+	es.deliver([]Event{{Path: "", Flags: Unmount}})
+	if batch := <-events; len(batch) != 1 || batch[0].Flags != Unmount {
+		t.Errorf("last batch = %v", batch)
+	}
+	err := <-es.ErrorsChan()
+	var uerr *UnmountedError
+	if !errors.As(err, &uerr) || uerr.Device != 5 {
+		t.Fatalf("Errors got %v, want an UnmountedError for device 5", err)
+	}
+	select {
+	case batch, ok := <-events:
+		if ok {
+			t.Fatalf("got %v after the UnmountedError", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Events not closed")
+	}
+	if es.Stats().Running {
+		t.Error("Stats().Running after the stream ended")
+	}
+
+	// Stop is still fine, and Start begins afresh.
+	es.Stop()
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if es.Events == events || !es.Stats().Running {
+		t.Error("Start after the stream ended didn't start over")
+	}
+}
+
+func TestUnmountedRun(t *testing.T) {
+	eject := withFakeMounts(t, 10*time.Millisecond)
+
+	es := &EventStream{Paths: []string{t.TempDir()}, Backend: Poll, PollInterval: time.Hour, Device: 5}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Run(context.Background(), es, func(context.Context, []Event) error { return nil })
+	}()
+	time.Sleep(50 * time.Millisecond)
+	eject()
+
+	select {
+	case err := <-errc:
+		var uerr *UnmountedError
+		if !errors.As(err, &uerr) {
+			t.Errorf("Run() = %v, want an UnmountedError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the device went away")
+	}
+}
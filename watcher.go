@@ -0,0 +1,508 @@
+package fsevents
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Watcher runs several EventStreams and merges their events into one
+// channel: one per volume with WatchAllVolumes, one per volume paths are
+// on with WatchDevices, or shards of a long list of paths with
+// WatchPaths. If opts set MaxBatchDelay, the Watcher merges the batches
+// of all its streams, as a stream does its callbacks', so that
+// MaxBatchDelay and MaxBatchSize apply to the batches on Events rather
+// than to each stream's.
+type Watcher struct {
+	// Events receives the merged batches. It's closed by Close.
+	//
+	// Deprecated: use EventsChan, whose channel can't be closed or sent
+	// on. The field stays for the code that reads it.
+	Events chan []Event
+
+	opts []Option
+
+	mu      sync.Mutex // guards the fields below
+	mounts  *EventStream
+	shards  []*EventStream // set by WatchPaths, before it returns
+	volumes map[int32]*volume
+	resume  map[string]uint64 // last event ID by volume UUID
+	closed  bool
+
+	sendMu     sync.Mutex // held while sending on Events
+	sendClosed bool
+	merger     *merger // if opts set MaxBatchDelay
+	done       chan struct{}
+}
+
+// EventsChan returns w.Events, receive-only.
+func (w *Watcher) EventsChan() <-chan []Event { return w.Events }
+
+// volume is a stream watching one whole volume.
+type volume struct {
+	info DeviceInfo
+	es   *EventStream
+	quit chan struct{} // closed when the volume is dropped
+}
+
+// Seams for the tests.
+var (
+	listDevices   = ListDevices
+	deviceForPath = DeviceForPath
+	startStream   = (*EventStream).Start
+)
+
+// WatchAllVolumes watches every mounted local volume that has an FSEvents
+// history, each with a device-relative stream configured by opts. A stream
+// on "/" that only looks for Mount and Unmount events starts streams for
+// volumes as they're attached and stops them as they're ejected. A volume
+// that comes back resumes from the last event seen on it, going by its
+// UUID, so nothing that happened in between is missed.
+//
+// Events have Device set and their paths prefixed with the volume's mount
+// point, unless opts set RawPaths.
+func WatchAllVolumes(opts ...Option) (*Watcher, error) {
+	w := &Watcher{
+		Events:  make(chan []Event),
+		opts:    opts,
+		volumes: map[int32]*volume{},
+		resume:  map[string]uint64{},
+		done:    make(chan struct{}),
+	}
+	w.startMerging()
+	// Started first, so no volume attached meanwhile is missed.
+	mounts := &EventStream{Paths: []string{"/"}, Handler: w.mountEvent}
+	if err := startStream(mounts); err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	w.mounts = mounts
+	w.mu.Unlock()
+	if err := w.sync(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// WatchDevices watches paths that may be on several volumes, with a
+// device-relative stream configured by opts for each volume, on the paths
+// there. Unlike a stream with Device set, which ignores the paths on
+// other volumes, or one without, whose event IDs can't be resumed from
+// volume by volume, each stream resumes from the event ID of the state in
+// resume, if any, with its volume's UUID; SaveState saves them again.
+// Events have Device set and their paths prefixed with the volume's mount
+// point, unless opts set RawPaths, so that they look as they would on any
+// stream. A path that can't be found, or whose volume isn't mounted, is
+// an error, as is a stream that can't be started: those that were are
+// stopped then.
+func WatchDevices(paths []string, resume []ResumeState, opts ...Option) (*Watcher, error) {
+	groups, err := groupByDevice(paths)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := listDevices()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		Events:  make(chan []Event),
+		opts:    opts,
+		volumes: map[int32]*volume{},
+		resume:  map[string]uint64{},
+		done:    make(chan struct{}),
+	}
+	w.startMerging()
+	for _, st := range resume {
+		if st.UUID != "" && st.EventID != 0 {
+			w.resume[st.UUID] = st.EventID
+		}
+	}
+	for _, g := range groups {
+		err := fmt.Errorf("fsevents: device %d of %s: %w", g.dev, g.paths[0], os.ErrNotExist)
+		for _, d := range devices {
+			if d.Dev != g.dev {
+				continue
+			}
+			var rel []string
+			if rel, err = relativePaths(g.paths, d.MountPoint); err == nil {
+				w.mu.Lock()
+				err = w.addVolume(d, rel)
+				w.mu.Unlock()
+			}
+			break
+		}
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// deviceGroup is paths of WatchDevices on one volume.
+type deviceGroup struct {
+	dev   int32
+	paths []string // absolute, symbolic links resolved
+}
+
+// groupByDevice groups paths by the device they're on, in the order the
+// devices first come up.
+func groupByDevice(paths []string) ([]deviceGroup, error) {
+	var groups []deviceGroup
+	at := map[int32]int{}
+	for _, path := range paths {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		// The mount point is a prefix of the real path only.
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		dev, err := deviceForPath(path)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := at[dev]
+		if !ok {
+			i = len(groups)
+			at[dev] = i
+			groups = append(groups, deviceGroup{dev: dev})
+		}
+		groups[i].paths = append(groups[i].paths, path)
+	}
+	return groups, nil
+}
+
+// relativePaths returns paths relative to the mount point they're below,
+// as a device-relative stream takes them.
+func relativePaths(paths []string, mount string) ([]string, error) {
+	rel := make([]string, len(paths))
+	for i, path := range paths {
+		if !underAny(path, []string{mount}) {
+			return nil, fmt.Errorf("fsevents: %s isn't below the mount point %s", path, mount)
+		}
+		rel[i] = strings.TrimPrefix(strings.TrimPrefix(path, mount), "/")
+	}
+	return rel, nil
+}
+
+// WatchPaths watches paths with streams configured by opts, as many as
+// it takes for none to have more paths than its MaxPaths, merging their
+// events into Events in the order each stream delivers them. The streams
+// are clones of one made by New, each on its share of paths, with the
+// paths nested in another given to the same stream, and with its Handler
+// set to forward the events, so opts shouldn't set Handler, Events or
+// BatchesMeta. If a stream can't be started, those that were are stopped
+// and the error is returned.
+func WatchPaths(paths []string, opts ...Option) (*Watcher, error) {
+	w := &Watcher{
+		Events: make(chan []Event),
+		opts:   opts,
+		done:   make(chan struct{}),
+	}
+	w.startMerging()
+	proto := New(nil, opts...)
+	var groups [][]string
+	if proto.KeepNestedPaths {
+		for i := range paths {
+			groups = append(groups, paths[i:i+1])
+		}
+	} else {
+		groups = groupNested(paths, proto.Device)
+	}
+	size := proto.maxPaths()
+	if size == 0 {
+		size = len(groups)
+	}
+	for start := 0; start < len(groups); start += size {
+		end := start + size
+		if end > len(groups) {
+			end = len(groups)
+		}
+		var shard []string
+		for _, g := range groups[start:end] {
+			shard = append(shard, g...)
+		}
+		es, err := proto.Clone(WithPaths(shard...))
+		if err == nil {
+			if w.merger != nil {
+				es.MaxBatchDelay = 0
+			}
+			es.Handler = func(batch []Event) { w.send(append([]Event(nil), batch...), nil) }
+			err = startStream(es)
+		}
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.shards = append(w.shards, es)
+	}
+	return w, nil
+}
+
+// mountEvent resyncs the volumes after a Mount or Unmount event.
+func (w *Watcher) mountEvent(batch []Event) {
+	for _, e := range batch {
+		if e.Flags&(Mount|Unmount) != 0 {
+			w.sync()
+			return
+		}
+	}
+}
+
+// sync starts streams for the volumes that aren't watched yet and stops
+// those of the volumes that are gone. A volume whose stream can't be
+// started is left out until the next sync.
+func (w *Watcher) sync() error {
+	devices, err := listDevices()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	seen := map[int32]bool{}
+	for _, d := range devices {
+		if !d.Local || d.UUID == "" {
+			continue
+		}
+		seen[d.Dev] = true
+		if v, ok := w.volumes[d.Dev]; ok {
+			if v.info == d {
+				continue
+			}
+			w.dropVolume(v)
+		}
+		w.addVolume(d, []string{""})
+	}
+	for dev, v := range w.volumes {
+		if !seen[dev] {
+			w.dropVolume(v)
+		}
+	}
+	return nil
+}
+
+// addVolume starts a stream for paths, relative to the root of d. w.mu
+// must be held.
+func (w *Watcher) addVolume(d DeviceInfo, paths []string) error {
+	v := &volume{info: d, quit: make(chan struct{})}
+	v.es = New(paths, w.opts...)
+	v.es.Device = d.Dev
+	if w.merger != nil {
+		v.es.MaxBatchDelay = 0
+	}
+	v.es.Handler = func(batch []Event) { w.forward(v, batch) }
+	if id, ok := w.resume[d.UUID]; ok {
+		v.es.Resume = true
+		v.es.EventID = id
+	}
+	if err := startStream(v.es); err != nil {
+		return err
+	}
+	w.volumes[d.Dev] = v
+	return nil
+}
+
+// dropVolume stops v's stream and remembers where it got to. w.mu must be
+// held.
+func (w *Watcher) dropVolume(v *volume) {
+	close(v.quit)
+	v.es.Stop()
+	if id := atomic.LoadUint64(&v.es.EventID); id != 0 {
+		w.resume[v.info.UUID] = id
+	}
+	delete(w.volumes, v.info.Dev)
+}
+
+// forward passes a batch from v's stream on to Events, with the paths
+// and roots made absolute unless the stream has RawPaths.
+func (w *Watcher) forward(v *volume, batch []Event) {
+	out := make([]Event, len(batch))
+	for i, e := range batch {
+		if !v.es.conf().RawPaths {
+			e.Path = filepath.Join(v.info.MountPoint, e.Path)
+			if e.Root != "" {
+				e.Root = filepath.Join(v.info.MountPoint, e.Root)
+			}
+		}
+		e.Device = v.info.Dev
+		out[i] = e
+	}
+	w.send(out, v.quit)
+}
+
+// send passes out on to Events, or to the merger if there is one, unless
+// quit or w.done is closed first. Of the two channels, that not in use is
+// nil, so that it's never chosen.
+func (w *Watcher) send(out []Event, quit chan struct{}) {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	if w.sendClosed {
+		return
+	}
+	events, merge := w.Events, (chan []Event)(nil)
+	if m := w.merger; m != nil {
+		events, merge = nil, m.in
+	}
+	select {
+	case events <- out:
+	case merge <- out:
+	case <-quit:
+	case <-w.done:
+	}
+}
+
+// merger merges the batches of a Watcher's streams for Events.
+type merger struct {
+	delay time.Duration
+	size  int
+	in    chan []Event
+	done  chan struct{}
+}
+
+// startMerging starts the merger if w.opts set MaxBatchDelay, which the
+// streams then leave to it.
+func (w *Watcher) startMerging() {
+	proto := New(nil, w.opts...)
+	if proto.MaxBatchDelay <= 0 {
+		return
+	}
+	m := &merger{
+		delay: proto.MaxBatchDelay,
+		size:  proto.MaxBatchSize,
+		in:    make(chan []Event),
+		done:  make(chan struct{}),
+	}
+	w.merger = m
+	go w.merge(m)
+}
+
+// merge sends on Events what the streams send to m, merged, once m.delay
+// has passed since the first batch of it arrived, or earlier when it
+// holds at least m.size events. It returns, dropping what it holds, once
+// w.done is closed, as send does.
+func (w *Watcher) merge(m *merger) {
+	defer close(m.done)
+	var (
+		pending []Event
+		timer   *time.Timer
+		timerC  <-chan time.Time
+	)
+	emit := func() bool {
+		if timer != nil {
+			timer.Stop()
+			timer, timerC = nil, nil
+		}
+		out := pending
+		pending = nil
+		select {
+		case w.Events <- out:
+			return true
+		case <-w.done:
+			return false
+		}
+	}
+	for {
+		select {
+		case batch := <-m.in:
+			pending = append(pending, batch...)
+			if m.size > 0 && len(pending) >= m.size {
+				if !emit() {
+					return
+				}
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(m.delay)
+				timerC = timer.C
+			}
+		case <-timerC:
+			if !emit() {
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// EventIDs returns the last event ID seen on each volume, keyed by the
+// volume's UUID, including volumes that have been ejected. It's empty for
+// a Watcher from WatchPaths. Each ID, set as the EventID of a stream on
+// its volume with Resume set, replays what happened there since; SaveState
+// saves them for WatchDevices.
+func (w *Watcher) EventIDs() map[string]uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ids := make(map[string]uint64, len(w.resume)+len(w.volumes))
+	for uuid, id := range w.resume {
+		ids[uuid] = id
+	}
+	for _, v := range w.volumes {
+		if id := atomic.LoadUint64(&v.es.EventID); id != 0 {
+			ids[v.info.UUID] = id
+		}
+	}
+	return ids
+}
+
+// SaveState saves EventIDs to s, a state for each volume, for passing
+// back to WatchDevices once loaded with StateStore.LoadAll. It does
+// nothing while EventIDs is empty.
+func (w *Watcher) SaveState(s *StateStore) error {
+	ids := w.EventIDs()
+	if len(ids) == 0 {
+		return nil
+	}
+	states := make([]ResumeState, 0, len(ids))
+	for uuid, id := range ids {
+		states = append(states, ResumeState{EventID: id, UUID: uuid})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].UUID < states[j].UUID })
+	return s.SaveAll(states)
+}
+
+// Close stops all streams and closes Events.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	mounts := w.mounts
+	w.mu.Unlock()
+
+	// Stopped without w.mu, as its handler may be waiting for it in sync.
+	if mounts != nil {
+		mounts.Stop()
+	}
+	for _, es := range w.shards {
+		es.Stop()
+	}
+	w.mu.Lock()
+	for _, v := range w.volumes {
+		w.dropVolume(v)
+	}
+	w.mu.Unlock()
+
+	if m := w.merger; m != nil {
+		<-m.done
+	}
+	w.sendMu.Lock()
+	w.sendClosed = true
+	close(w.Events)
+	w.sendMu.Unlock()
+	return nil
+}
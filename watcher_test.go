@@ -0,0 +1,343 @@
+package fsevents
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVolumes replaces the mount table and stream starts for the duration
+// of the test, so the volume orchestration runs without FSEvents. The
+// streams are never started: the test delivers to them directly.
+type fakeVolumes struct {
+	mu      sync.Mutex
+	devices []DeviceInfo
+}
+
+func withFakeVolumes(t *testing.T, devices ...DeviceInfo) *fakeVolumes {
+	f := &fakeVolumes{devices: devices}
+	prevList, prevStart := listDevices, startStream
+	listDevices = func() ([]DeviceInfo, error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return append([]DeviceInfo(nil), f.devices...), nil
+	}
+	startStream = func(*EventStream) error { return nil }
+	t.Cleanup(func() { listDevices, startStream = prevList, prevStart })
+	return f
+}
+
+func (f *fakeVolumes) set(devices ...DeviceInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.devices = devices
+}
+
+func (w *Watcher) volume(dev int32) *volume {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.volumes[dev]
+}
+
+func TestWatchAllVolumes(t *testing.T) {
+	root := DeviceInfo{Dev: 1, MountPoint: "/", FSType: "apfs", Local: true, UUID: "ROOT"}
+	disk := DeviceInfo{Dev: 2, MountPoint: "/Volumes/Disk", FSType: "apfs", Local: true, UUID: "DISK"}
+	f := withFakeVolumes(t,
+		root,
+		disk,
+		DeviceInfo{Dev: 3, MountPoint: "/Volumes/Share", FSType: "smbfs", UUID: "SHARE"},
+		DeviceInfo{Dev: 4, MountPoint: "/dev", FSType: "devfs", Local: true},
+	)
+
+	w, err := WatchAllVolumes(WithLatency(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for dev, want := range map[int32]bool{1: true, 2: true, 3: false, 4: false} {
+		if v := w.volume(dev); (v != nil) != want {
+			t.Errorf("device %d watched = %v, want %v", dev, v != nil, want)
+		}
+	}
+	v := w.volume(2)
+	if v.es.Device != 2 || v.es.Latency != time.Second || len(v.es.Paths) != 1 || v.es.Paths[0] != "" {
+		t.Errorf("volume stream device=%d latency=%s paths=%q", v.es.Device, v.es.Latency, v.es.Paths)
+	}
+
+	go v.es.deliver([]Event{{Path: "a/b", Flags: ItemCreated | ItemIsFile, ID: 7}})
+	have := <-w.EventsChan()
+	want := Event{Path: "/Volumes/Disk/a/b", Flags: ItemCreated | ItemIsFile, Device: 2, ID: 7}
+	if len(have) != 1 || have[0] != want {
+		t.Fatalf("got %v, want [%v]", have, want)
+	}
+
+	// Ejecting the disk stops its stream.
+	f.set(root)
+	w.mountEvent([]Event{{Path: "/Volumes/Disk", Flags: Unmount}})
+	if w.volume(2) != nil {
+		t.Fatal("ejected volume still watched")
+	}
+	if id := w.EventIDs()["DISK"]; id != 7 {
+		t.Errorf("EventIDs()[DISK] = %d, want 7", id)
+	}
+
+	// Other events don't touch the volumes.
+	f.set(root, disk)
+	w.mountEvent([]Event{{Path: "/Volumes", Flags: ItemCreated}})
+	if w.volume(2) != nil {
+		t.Fatal("volume added without a Mount event")
+	}
+
+	// Attached again, under another device ID, it resumes.
+	disk.Dev = 5
+	f.set(root, disk)
+	w.mountEvent([]Event{{Path: "/Volumes/Disk", Flags: Mount}})
+	v = w.volume(5)
+	if v == nil {
+		t.Fatal("reattached volume not watched")
+	}
+	if !v.es.Resume || v.es.EventID != 7 {
+		t.Errorf("reattached stream Resume=%v EventID=%d, want true, 7", v.es.Resume, v.es.EventID)
+	}
+
+	// Close abandons a batch that's waiting for the consumer.
+	sent := make(chan struct{})
+	go func() {
+		v.es.deliver([]Event{{Path: "c", ID: 8}})
+		close(sent)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	<-sent
+	for range w.EventsChan() {
+	}
+	if w.volume(1) != nil || w.volume(5) != nil {
+		t.Error("volumes still watched after Close")
+	}
+}
+
+func TestTooManyPaths(t *testing.T) {
+	paths := make([]string, DefaultMaxPaths+1)
+	for i := range paths {
+		paths[i] = filepath.Join(t.TempDir(), fmt.Sprint(i))
+	}
+	es := New(paths, WithBackend(Poll), WithPollInterval(time.Hour))
+	if err := es.Start(); err != ErrTooManyPaths {
+		es.Stop()
+		t.Fatalf("Start with %d paths = %v, want ErrTooManyPaths", len(paths), err)
+	}
+	if _, err := es.Clone(WithMaxPaths(10)); err != ErrTooManyPaths {
+		t.Errorf("Clone with MaxPaths 10 = %v, want ErrTooManyPaths", err)
+	}
+
+	es.MaxPaths = -1
+	if err := es.Start(); err != nil {
+		t.Fatalf("Start without a limit: %v", err)
+	}
+	es.Stop()
+}
+
+func TestWatchPaths(t *testing.T) {
+	tmp := t.TempDir()
+	paths := make([]string, 2000)
+	for i := range paths {
+		paths[i] = filepath.Join(tmp, fmt.Sprint(i))
+		if err := os.Mkdir(paths[i], 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := WatchPaths(paths, WithBackend(Poll), WithPollInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if len(w.shards) != (len(paths)+DefaultMaxPaths-1)/DefaultMaxPaths {
+		t.Fatalf("%d paths sharded across %d streams", len(paths), len(w.shards))
+	}
+	var watched []string
+	for _, es := range w.shards {
+		if len(es.Paths) > DefaultMaxPaths {
+			t.Errorf("a stream has %d paths", len(es.Paths))
+		}
+		if !es.Stats().Running {
+			t.Error("a stream isn't running")
+		}
+		watched = append(watched, es.Paths...)
+	}
+	if len(watched) != len(paths) {
+		t.Fatalf("%d paths watched, want %d", len(watched), len(paths))
+	}
+	for i := range watched {
+		if watched[i] != paths[i] {
+			t.Fatalf("path %d watched is %s, want %s", i, watched[i], paths[i])
+		}
+	}
+
+	// A file in the first and the last directory of each stream.
+	var want []string
+	for _, es := range w.shards {
+		for _, dir := range []string{es.Paths[0], es.Paths[len(es.Paths)-1]} {
+			path := filepath.Join(dir, "file")
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, path)
+		}
+	}
+	go func() {
+		for _, es := range w.shards {
+			es.Flush(true)
+		}
+	}()
+	var have []string
+	timeout := time.After(10 * time.Second)
+	for len(have) < len(want) {
+		select {
+		case batch := <-w.EventsChan():
+			for _, e := range batch {
+				if e.Flags&ItemIsFile != 0 {
+					have = append(have, e.Path)
+				}
+			}
+		case <-timeout:
+			t.Fatalf("got %d events of %d", len(have), len(want))
+		}
+	}
+	sort.Strings(have)
+	sort.Strings(want)
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("got %q, want %q", have, want)
+		}
+	}
+
+	if _, err := WatchPaths(paths, WithBackend(Poll), WithDeliveryMode(DispatchThread), func(es *EventStream) { es.RateLimit = 1 }); err != errDispatchThread {
+		t.Errorf("WatchPaths with an invalid configuration = %v, want errDispatchThread", err)
+	}
+}
+
+// TestWatchPathsMerged has MaxBatchDelay and MaxBatchSize bound the
+// batches of all the streams together.
+func TestWatchPathsMerged(t *testing.T) {
+	paths := []string{"/a", "/b", "/c"}
+	batching := func(delay time.Duration, size int) Option {
+		return func(es *EventStream) { es.MaxBatchDelay, es.MaxBatchSize = delay, size }
+	}
+	inject := func(w *Watcher, n int) {
+		for i, es := range w.shards {
+			batch := make([]Event, n)
+			for j := range batch {
+				batch[j] = Event{Path: paths[i] + "/f", ID: uint64(n*i + j + 1)}
+			}
+			if err := es.Inject(batch); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+
+	// The streams' batches held for an hour, but for the size.
+	w, err := WatchPaths(paths, WithBackend(Manual), WithMaxPaths(1), batching(time.Hour, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if len(w.shards) != len(paths) {
+		t.Fatalf("%d streams, want %d", len(w.shards), len(paths))
+	}
+	go inject(w, 2)
+	select {
+	case batch := <-w.EventsChan():
+		if len(batch) != 6 {
+			t.Errorf("got a batch of %d events, want all 6", len(batch))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no batch once the streams had 6 events")
+	}
+
+	// Once the delay is up, what there is.
+	w, err = WatchPaths(paths, WithBackend(Manual), WithMaxPaths(1), batching(10*time.Millisecond, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	go inject(w, 1)
+	for n := 0; n < len(paths); {
+		select {
+		case batch := <-w.EventsChan():
+			n += len(batch)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d events of %d", n, len(paths))
+		}
+	}
+}
+
+func TestWatchDevices(t *testing.T) {
+	root := DeviceInfo{Dev: 1, MountPoint: "/", FSType: "apfs", Local: true, UUID: "ROOT"}
+	disk := DeviceInfo{Dev: 2, MountPoint: "/Volumes/Disk", FSType: "apfs", Local: true, UUID: "DISK"}
+	withFakeVolumes(t, root, disk)
+	prev := deviceForPath
+	deviceForPath = func(path string) (int32, error) {
+		switch {
+		case underAny(path, []string{"/nowhere"}):
+			return 0, os.ErrNotExist
+		case underAny(path, []string{"/Volumes/Disk"}):
+			return 2, nil
+		case underAny(path, []string{"/Volumes/Gone"}):
+			return 3, nil
+		}
+		return 1, nil
+	}
+	t.Cleanup(func() { deviceForPath = prev })
+
+	paths := []string{"/Volumes/Disk/photos", "/Users/me/src", "/Volumes/Disk"}
+	w, err := WatchDevices(paths, []ResumeState{{EventID: 7, UUID: "DISK"}, {EventID: 9, UUID: "OTHER"}}, WithLatency(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	v, r := w.volume(2), w.volume(1)
+	if v == nil || r == nil {
+		t.Fatalf("volumes watched: disk %v, root %v", v != nil, r != nil)
+	}
+	if v.es.Device != 2 || v.es.Latency != time.Second || !reflect.DeepEqual(v.es.Paths, []string{"photos", ""}) {
+		t.Errorf("disk stream device=%d latency=%s paths=%q", v.es.Device, v.es.Latency, v.es.Paths)
+	}
+	if !v.es.Resume || v.es.EventID != 7 {
+		t.Errorf("disk stream Resume=%v EventID=%d, want true, 7", v.es.Resume, v.es.EventID)
+	}
+	if r.es.Device != 1 || !reflect.DeepEqual(r.es.Paths, []string{"Users/me/src"}) || r.es.Resume {
+		t.Errorf("root stream device=%d paths=%q resume=%v", r.es.Device, r.es.Paths, r.es.Resume)
+	}
+
+	// As Start would, so that events get their Root.
+	r.es.rootIndex = newRootIndex(r.es.Paths, r.es.Device)
+	go r.es.deliver([]Event{{Path: "Users/me/src/a", Flags: ItemCreated | ItemIsFile, ID: 11}})
+	have := <-w.EventsChan()
+	want := Event{Path: "/Users/me/src/a", Flags: ItemCreated | ItemIsFile, Device: 1, Root: "/Users/me/src", ID: 11}
+	if len(have) != 1 || have[0] != want {
+		t.Fatalf("got %v, want [%v]", have, want)
+	}
+
+	s := NewStateStore(filepath.Join(t.TempDir(), "state"))
+	if err := w.SaveState(s); err != nil {
+		t.Fatal(err)
+	}
+	states, err := s.LoadAll()
+	if wantStates := []ResumeState{{EventID: 7, UUID: "DISK"}, {EventID: 9, UUID: "OTHER"}, {EventID: 11, UUID: "ROOT"}}; err != nil || !reflect.DeepEqual(states, wantStates) {
+		t.Errorf("saved %+v, %v, want %+v", states, err, wantStates)
+	}
+
+	for _, bad := range [][]string{{"/Users/me", "/nowhere"}, {"/Volumes/Gone/x"}} {
+		if w, err := WatchDevices(bad, nil); err == nil {
+			w.Close()
+			t.Errorf("WatchDevices(%q) succeeded", bad)
+		}
+	}
+}
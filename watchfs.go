@@ -0,0 +1,174 @@
+package fsevents
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WatchFS is something that can report changes below a path, for code that
+// passes file systems around without caring how they are watched.
+//
+// Watch reports the changes at or below root made after it returns, in
+// batches on the returned channel. The channel is closed once ctx is done
+// and watching has stopped; the receiver may stop receiving at any time
+// after cancelling ctx. Paths are reported in the implementation's form:
+// Backend reports the paths its EventStream reports, FS reports FS paths.
+// Event IDs only need to increase within one Watch.
+//
+// Backend implements WatchFS, and WatchFunc turns a function into one, for
+// example to watch with a configured EventStream or to fake changes in
+// tests.
+type WatchFS interface {
+	Watch(ctx context.Context, root string) (<-chan []Event, error)
+}
+
+// WatchFunc adapts a function to WatchFS.
+type WatchFunc func(ctx context.Context, root string) (<-chan []Event, error)
+
+// Watch calls f.
+func (f WatchFunc) Watch(ctx context.Context, root string) (<-chan []Event, error) {
+	return f(ctx, root)
+}
+
+// Watch watches root with a stream using the backend and FileEvents, which
+// is stopped when ctx is done. Use WatchFunc and WatchStream for a stream
+// configured otherwise.
+func (b Backend) Watch(ctx context.Context, root string) (<-chan []Event, error) {
+	return WatchStream(ctx, &EventStream{Paths: []string{root}, Flags: FileEvents, Backend: b})
+}
+
+// WatchStream starts es and passes its batches on the returned channel
+// until ctx is done or es stops itself as its volume goes away. The
+// channel is closed once es has stopped. es must
+// not have a Handler or RawHandler, and shouldn't be used otherwise until
+// the channel is closed. Batches still queued when ctx is done are
+// discarded.
+func WatchStream(ctx context.Context, es *EventStream) (<-chan []Event, error) {
+	if es.conf().Handler != nil || es.conf().RawHandler != nil {
+		return nil, errors.New("fsevents: WatchStream needs the Events channel, but Handler or RawHandler is set")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := es.Start(); err != nil {
+		return nil, err
+	}
+	events := es.Events
+
+	c := make(chan []Event)
+	go func() {
+		defer close(c)
+		for {
+			select {
+			case <-ctx.Done():
+				es.stopDraining(events)
+				return
+			case batch, ok := <-events:
+				if !ok {
+					// The stream stopped itself as its volume went away.
+					return
+				}
+				select {
+				case c <- batch:
+				case <-ctx.Done():
+					es.Recycle(batch)
+					es.stopDraining(events)
+					return
+				}
+			}
+		}
+	}()
+	return c, nil
+}
+
+// FS joins a file system for reading with a WatchFS for changes to it.
+// Watch takes and reports FS paths, slash-separated and relative to Dir.
+type FS struct {
+	// FS reads the files.
+	fs.FS
+
+	// Dir is the directory FS reads from, for example the one passed to
+	// os.DirFS.
+	Dir string
+
+	// Watcher watches below Dir. If nil, Native is used.
+	Watcher WatchFS
+}
+
+// DirFS returns an FS for the directory dir that reads with os.DirFS and
+// watches with Native.
+func DirFS(dir string) *FS {
+	return &FS{FS: os.DirFS(dir), Dir: dir}
+}
+
+// Watch reports the changes at or below the FS path root. Events for paths
+// outside Dir are left out.
+func (f *FS) Watch(ctx context.Context, root string) (<-chan []Event, error) {
+	if !fs.ValidPath(root) {
+		return nil, &fs.PathError{Op: "watch", Path: root, Err: fs.ErrInvalid}
+	}
+	dir, err := filepath.Abs(f.Dir)
+	if err != nil {
+		return nil, err
+	}
+	// Native reports paths with symlinks resolved, the others as given.
+	prefixes := []string{dir}
+	if real, err := filepath.EvalSymlinks(dir); err == nil && real != dir {
+		prefixes = append(prefixes, real)
+	}
+
+	w := f.Watcher
+	if w == nil {
+		w = Native
+	}
+	in, err := w.Watch(ctx, filepath.Join(dir, filepath.FromSlash(root)))
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan []Event)
+	go func() {
+		defer close(c)
+		for batch := range in {
+			out := make([]Event, 0, len(batch))
+			for _, e := range batch {
+				if name, ok := fsPath(prefixes, e.Path); ok {
+					e.Path = name
+					out = append(out, e)
+				}
+			}
+			if len(out) == 0 {
+				continue
+			}
+			select {
+			case c <- out:
+			case <-ctx.Done():
+				// Let the watcher finish, so the channel still closes
+				// only once it has stopped.
+				for range in {
+				}
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// fsPath converts path to an FS path relative to the first of prefixes it
+// lies under.
+func fsPath(prefixes []string, path string) (string, bool) {
+	for _, p := range prefixes {
+		if path == p {
+			return ".", true
+		}
+		dir := strings.TrimSuffix(p, string(filepath.Separator)) + string(filepath.Separator)
+		if rest := strings.TrimPrefix(path, dir); rest != path {
+			return filepath.ToSlash(rest), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,169 @@
+package fsevents
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWatchFS checks every WatchFS implementation against the contract:
+// a change after Watch returns is reported, and the channel closes once
+// the context is cancelled.
+func TestWatchFS(t *testing.T) {
+	poll := WatchFunc(func(ctx context.Context, root string) (<-chan []Event, error) {
+		return WatchStream(ctx, &EventStream{Paths: []string{root}, Backend: Poll, PollInterval: 20 * time.Millisecond})
+	})
+
+	for _, tc := range []struct {
+		name string
+		w    WatchFS
+	}{
+		{"Native", Native},
+		{"KQueue", KQueue},
+		{"Poll", poll},
+	} {
+		w := tc.w
+		t.Run(tc.name, func(t *testing.T) {
+			// FSEvents reports paths with symlinks resolved.
+			tmp, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			testWatchFS(t, w, tmp, func(name string) (string, error) {
+				p := filepath.Join(tmp, name)
+				return p, os.WriteFile(p, nil, 0o644)
+			})
+		})
+	}
+
+	t.Run("FS", func(t *testing.T) {
+		tmp := t.TempDir()
+		if err := os.Mkdir(filepath.Join(tmp, "sub"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		f := &FS{FS: os.DirFS(tmp), Dir: tmp, Watcher: poll}
+		testWatchFS(t, f, "sub", func(name string) (string, error) {
+			return "sub/" + name, os.WriteFile(filepath.Join(tmp, "sub", name), nil, 0o644)
+		})
+	})
+
+	t.Run("Fake", func(t *testing.T) {
+		changes := make(chan string)
+		fake := WatchFunc(func(ctx context.Context, root string) (<-chan []Event, error) {
+			c := make(chan []Event)
+			go func() {
+				defer close(c)
+				var id uint64
+				for {
+					select {
+					case name := <-changes:
+						id++
+						select {
+						case c <- []Event{{Path: path.Join(root, name), Flags: ItemCreated | ItemIsFile, ID: id}}:
+						case <-ctx.Done():
+							return
+						}
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return c, nil
+		})
+		testWatchFS(t, fake, "/fake", func(name string) (string, error) {
+			changes <- name
+			return "/fake/" + name, nil
+		})
+	})
+}
+
+// testWatchFS watches root with w, then calls create, which makes a file
+// and returns the path w should report it as.
+func testWatchFS(t *testing.T, w WatchFS, root string, create func(name string) (string, error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := w.Watch(ctx, root)
+	if errors.Is(err, ErrUnsupportedPlatform) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	// FSEvents can take a moment to start reporting.
+	time.Sleep(100 * time.Millisecond)
+
+	want, err := create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+wait:
+	for {
+		select {
+		case batch, ok := <-c:
+			if !ok {
+				t.Fatal("channel closed before the change was reported")
+			}
+			for _, e := range batch {
+				if e.Path == want && e.Flags&ItemCreated != 0 {
+					break wait
+				}
+			}
+		case <-timeout:
+			t.Fatalf("no ItemCreated event for %s", want)
+		}
+	}
+
+	cancel()
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("channel not closed after cancel")
+		}
+	}
+}
+
+func TestFS(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, "file"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := DirFS(tmp)
+	if b, err := fs.ReadFile(f, "file"); err != nil || string(b) != "data" {
+		t.Errorf("ReadFile = %q, %v", b, err)
+	}
+
+	for _, root := range []string{"../up", "/abs", "a/"} {
+		if _, err := f.Watch(context.Background(), root); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Watch(%q) = %v, want fs.ErrInvalid", root, err)
+		}
+	}
+}
+
+func TestFSPath(t *testing.T) {
+	for _, tc := range []struct {
+		prefixes []string
+		path     string
+		want     string
+		ok       bool
+	}{
+		{[]string{"/a/b"}, "/a/b", ".", true},
+		{[]string{"/a/b"}, "/a/b/c/d", "c/d", true},
+		{[]string{"/a/b"}, "/a/bc", "", false},
+		{[]string{"/var/x", "/private/var/x"}, "/private/var/x/f", "f", true},
+		{[]string{"/"}, "/etc", "etc", true},
+	} {
+		have, ok := fsPath(tc.prefixes, filepath.FromSlash(tc.path))
+		if have != tc.want || ok != tc.ok {
+			t.Errorf("fsPath(%q, %q) = %q, %v, want %q, %v", tc.prefixes, tc.path, have, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -5,159 +5,61 @@ package fsevents
 import (
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/ebitengine/purego"
 )
 
-type CreateFlags uint32
-
-const (
-	NoDefer    CreateFlags = 0x00000002
-	WatchRoot  CreateFlags = 0x00000004
-	IgnoreSelf CreateFlags = 0x00000008
-	FileEvents CreateFlags = 0x00000010
-)
-
-type EventFlags uint32
-
-const (
-	MustScanSubDirs   EventFlags = 0x00000001
-	KernelDropped     EventFlags = 0x00000002
-	UserDropped       EventFlags = 0x00000004
-	EventIDsWrapped   EventFlags = 0x00000008
-	HistoryDone       EventFlags = 0x00000010
-	RootChanged       EventFlags = 0x00000020
-	Mount             EventFlags = 0x00000040
-	Unmount           EventFlags = 0x00000080
-	ItemCreated       EventFlags = 0x00000100
-	ItemRemoved       EventFlags = 0x00000200
-	ItemInodeMetaMod  EventFlags = 0x00000400
-	ItemRenamed       EventFlags = 0x00000800
-	ItemModified      EventFlags = 0x00001000
-	ItemFinderInfoMod EventFlags = 0x00002000
-	ItemChangeOwner   EventFlags = 0x00004000
-	ItemXattrMod      EventFlags = 0x00008000
-	ItemIsFile        EventFlags = 0x00010000
-	ItemIsDir         EventFlags = 0x00020000
-	ItemIsSymlink     EventFlags = 0x00040000
-)
-
 const (
 	eventIDSinceNow = ^uint64(0) // kFSEventStreamEventIdSinceNow
 )
 
-var (
-	// CoreServices function pointers
-	fseventsCreateRelativeToDevice            uintptr
-	fseventsCreate                            uintptr
-	fseventsStart                             uintptr
-	fseventsStop                              uintptr
-	fseventsInvalidate                        uintptr
-	fseventsRelease                           uintptr
-	fseventsGetLatestEventID                  uintptr
-	fseventsGetDeviceBeingWatched             uintptr
-	fseventsCopyDescription                   uintptr
-	fseventsCopyPaths                         uintptr
-	fseventsFlushAsync                        uintptr
-	fseventsFlushSync                         uintptr
-	fseventsSetDispatchQueue                  uintptr
-	fseventsCopyUUIDForDevice                 uintptr
-	fseventsGetLastEventIDForDeviceBeforeTime uintptr
-
-	// CoreFoundation function pointers
-	cfRelease                 uintptr
-	cfStringCreateWithCString uintptr
-	cfURLCreateWithString     uintptr
-	cfStringGetCStringPtr     uintptr
-	cfURLGetString            uintptr
-	cfStringGetLength         uintptr
-	cfStringGetCString        uintptr
-	cfArrayGetCount           uintptr
-	cfArrayGetValueAtIndex    uintptr
-	cfArrayCreateMutable      uintptr
-	cfArrayAppendValue        uintptr
-	cfUUIDCreateString        uintptr
-	cfAbsoluteTime            uintptr
-
-	// Dispatch function pointers
-	dispatchQueueCreate uintptr
-	dispatchRelease     uintptr
-)
-
 const (
 	kCFStringEncodingUTF8 = 0x08000100
 	kCFAllocatorDefault   = 0
 )
 
-type (
-	fsEventStreamRef   uintptr
-	fsDispatchQueueRef uintptr
-	CFStringRef        uintptr
-	CFURLRef           uintptr
-	CFArrayRef         uintptr
-)
-
-func init() {
-	// Load CoreServices framework
-	coreServices, err := purego.Dlopen("/System/Library/Frameworks/CoreServices.framework/CoreServices", purego.RTLD_LAZY)
-	if err != nil {
-		panic(err)
-	}
-
-	// Register CoreServices functions
-	fseventsCreateRelativeToDevice, _ = purego.Dlsym(coreServices, "FSEventStreamCreateRelativeToDevice")
-	fseventsCreateRelativeToDevice, _ = purego.Dlsym(coreServices, "FSEventStreamCreateRelativeToDevice")
-	fseventsCreate, _ = purego.Dlsym(coreServices, "FSEventStreamCreate")
-	fseventsStart, _ = purego.Dlsym(coreServices, "FSEventStreamStart")
-	fseventsStop, _ = purego.Dlsym(coreServices, "FSEventStreamStop")
-	fseventsInvalidate, _ = purego.Dlsym(coreServices, "FSEventStreamInvalidate")
-	fseventsRelease, _ = purego.Dlsym(coreServices, "FSEventStreamRelease")
-	fseventsGetLatestEventID, _ = purego.Dlsym(coreServices, "FSEventStreamGetLatestEventId")
-	fseventsGetDeviceBeingWatched, _ = purego.Dlsym(coreServices, "FSEventStreamGetDeviceBeingWatched")
-	fseventsCopyDescription, _ = purego.Dlsym(coreServices, "FSEventStreamCopyDescription")
-	fseventsCopyPaths, _ = purego.Dlsym(coreServices, "FSEventStreamCopyPathsBeingWatched")
-	fseventsFlushAsync, _ = purego.Dlsym(coreServices, "FSEventStreamFlushAsync")
-	fseventsFlushSync, _ = purego.Dlsym(coreServices, "FSEventStreamFlushSync")
-	fseventsSetDispatchQueue, _ = purego.Dlsym(coreServices, "FSEventStreamSetDispatchQueue")
-	fseventsCopyUUIDForDevice, _ = purego.Dlsym(coreServices, "FSEventsCopyUUIDForDevice")
-	fseventsGetLastEventIDForDeviceBeforeTime, _ = purego.Dlsym(coreServices, "FSEventsGetLastEventIDForDeviceBeforeTime")
-
-	// Register CoreFoundation functions
-	cfRelease, _ = purego.Dlsym(coreServices, "CFRelease")
-	cfStringCreateWithCString, _ = purego.Dlsym(coreServices, "CFStringCreateWithCString")
-	cfURLCreateWithString, _ = purego.Dlsym(coreServices, "CFURLCreateWithString")
-	cfStringGetCStringPtr, _ = purego.Dlsym(coreServices, "CFStringGetCStringPtr")
-	cfURLGetString, _ = purego.Dlsym(coreServices, "CFURLGetString")
-	cfStringGetLength, _ = purego.Dlsym(coreServices, "CFStringGetLength")
-	cfStringGetCString, _ = purego.Dlsym(coreServices, "CFStringGetCString")
-	cfArrayGetCount, _ = purego.Dlsym(coreServices, "CFArrayGetCount")
-	cfArrayGetValueAtIndex, _ = purego.Dlsym(coreServices, "CFArrayGetValueAtIndex")
-	cfArrayCreateMutable, _ = purego.Dlsym(coreServices, "CFArrayCreateMutable")
-	cfArrayAppendValue, _ = purego.Dlsym(coreServices, "CFArrayAppendValue")
-	cfUUIDCreateString, _ = purego.Dlsym(coreServices, "CFUUIDCreateString")
-	cfAbsoluteTime, _ = purego.Dlsym(coreServices, "CFAbsoluteTimeGetCurrent")
-
-	// Register Dispatch functions
-	dispatch, err := purego.Dlopen("/usr/lib/system/libdispatch.dylib", purego.RTLD_LAZY)
-	if err != nil {
-		panic(err)
-	}
-	dispatchQueueCreate, _ = purego.Dlsym(dispatch, "dispatch_queue_create")
-	dispatchRelease, _ = purego.Dlsym(dispatch, "dispatch_release")
-}
-
 func cfReleaseCall(ref interface{}) {
 	if _, ok := ref.(uintptr); ok {
-		purego.SyscallN(cfRelease, ref.(uintptr))
+		releaseCF(ref.(uintptr))
 	}
 }
 
-func cStringToGoString(cstr uintptr) string {
+// releaseCF releases a CF object the package created or copied.
+func releaseCF(ref uintptr) {
+	purego.SyscallN(lib.cfRelease, ref)
+	trackRelease(ref)
+}
+
+// newCallback creates a purego callback, which is never freed.
+func newCallback(fn interface{}) uintptr {
+	trackCallback()
+	return purego.NewCallback(fn)
+}
+
+// scratchBuffers holds conversion buffers for cfStringToGoString. Each
+// buffer grows to the longest string it has held; only the final Go
+// string, sized exactly, is allocated per conversion. A pool rather than
+// a per-stream buffer keeps this safe when callbacks for different
+// streams run concurrently.
+var scratchBuffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, 1024)
+	return &b
+}}
+
+// cStringBytes returns the bytes of a NUL-terminated C string, without the
+// terminator. The slice aliases the C memory.
+func cStringBytes(cstr uintptr) []byte {
 	if cstr == 0 {
-		return ""
+		return nil
 	}
 	// Find the length of the null-terminated C string
 	length := 0
@@ -169,23 +71,37 @@ func cStringToGoString(cstr uintptr) string {
 		length++
 	}
 	if length == 0 {
-		return ""
+		return nil
 	}
-	// Convert the C string to a Go string using unsafe.Slice
-	data := unsafe.Slice((*byte)(unsafe.Pointer(cstr)), length)
-	return string(data)
+	return unsafe.Slice((*byte)(unsafe.Pointer(cstr)), length)
 }
 
-// goStringToCFString converts a Go string to a CFStringRef
+// cStringToGoString copies a NUL-terminated C string into a Go string. It
+// reads the C memory in place, so the result is the only allocation.
+func cStringToGoString(cstr uintptr) string {
+	return string(cStringBytes(cstr))
+}
+
+// goStringToCFString converts a Go string to a CFStringRef. As a C string
+// would, it ends at the first NUL, and invalid UTF-8, for which
+// CFStringCreateWithCString returns NULL, is replaced by U+FFFD, so the
+// result is only 0 if CF fails.
 func goStringToCFString(s string) CFStringRef {
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "\uFFFD")
+	}
 	// Convert to null-terminated byte slice
 	bytes := append([]byte(s), 0) // Safe allocation, null-terminated
 	cStr := unsafe.Pointer(&bytes[0])
-	ret, _, _ := purego.SyscallN(cfStringCreateWithCString,
+	ret, _, _ := purego.SyscallN(lib.cfStringCreateWithCString,
 		0,             // allocator (NULL)
 		uintptr(cStr), // C string pointer
 		kCFStringEncodingUTF8,
 	)
+	trackCreate("CFString", ret)
 	return CFStringRef(ret)
 }
 
@@ -195,12 +111,13 @@ func goStringToCFURL(s string) CFURLRef {
 	if urlStr == 0 {
 		return 0
 	}
-	ret, _, _ := purego.SyscallN(cfURLCreateWithString,
+	ret, _, _ := purego.SyscallN(lib.cfURLCreateWithString,
 		0, // allocator (NULL)
 		uintptr(urlStr),
 		0, // baseURL (NULL)
 	)
 	cfReleaseCall(uintptr(urlStr))
+	trackCreate("CFURL", ret)
 	return CFURLRef(ret)
 }
 
@@ -211,83 +128,138 @@ func cfStringToGoString(ref CFStringRef) string {
 	}
 
 	// Get the length of the string in UTF-16 code units
-	length, _, _ := purego.SyscallN(cfStringGetLength, uintptr(ref))
+	length, _, _ := purego.SyscallN(lib.cfStringGetLength, uintptr(ref))
 	if length == 0 {
 		return ""
 	}
 
-	// Estimate buffer size: assume max 3 bytes per UTF-16 unit (worst-case UTF-8)
-	// Add 1 for null terminator
-	maxBytes := (length * 5) + 1
-	buffer := make([]byte, maxBytes)
+	// Size the scratch buffer for the worst case; the string itself is
+	// allocated from the byte count CFStringGetBytes reports.
+	maxBytes, _, _ := purego.SyscallN(lib.cfStringGetMaximumSizeForEncoding, length, kCFStringEncodingUTF8)
+	bp := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(bp)
+	if uintptr(cap(*bp)) < maxBytes {
+		*bp = make([]byte, maxBytes)
+	}
+	buffer := (*bp)[:maxBytes]
 
-	// Copy the string into the buffer as UTF-8
-	success, _, _ := purego.SyscallN(cfStringGetCString,
-		uintptr(ref),                        // CFStringRef
-		uintptr(unsafe.Pointer(&buffer[0])), // Buffer
-		maxBytes,                            // Buffer size
-		kCFStringEncodingUTF8,               // Encoding
+	// The CFRange{location, length} argument is passed in two registers.
+	var used uintptr
+	converted, _, _ := purego.SyscallN(lib.cfStringGetBytes,
+		uintptr(ref),
+		0, length, // range
+		kCFStringEncodingUTF8,
+		0, // lossByte: fail rather than substitute
+		0, // isExternalRepresentation: no BOM
+		uintptr(unsafe.Pointer(&buffer[0])),
+		maxBytes,
+		uintptr(unsafe.Pointer(&used)),
 	)
-
-	if success == 0 {
+	if converted != length {
 		return "" // Failed to convert, return empty string
 	}
-
-	// Find the null terminator to determine actual length
-	for i, b := range buffer {
-		if b == 0 {
-			return string(buffer[:i])
-		}
-	}
-	return string(buffer[:maxBytes-1]) // Fallback, assume full buffer minus null
+	return string(buffer[:used])
 }
 
 func cfURLToGoString(ref CFURLRef) string {
 	if ref == 0 {
 		return ""
 	}
-	urlStrRef, _, _ := purego.SyscallN(cfURLGetString, uintptr(ref))
+	urlStrRef, _, _ := purego.SyscallN(lib.cfURLGetString, uintptr(ref))
 	return cfStringToGoString(CFStringRef(urlStrRef))
 }
 
 // Callback function for FSEvents
 func callback(stream uintptr, info uintptr, numEvents int, paths uintptr, flags uintptr, ids uintptr) {
+	handleCallback(info, numEvents, paths, flags, ids)
+}
+
+// inject hands the stream a batch laid out the way FSEvents passes it to
+// the callback, as if FSEvents had called back with it: it also goes by
+// way of the registry, so nothing reaches a stream that isn't registered.
+// It lets tests drive the whole pipeline with batches of their choosing.
+func (es *EventStream) inject(numEvents int, paths, flags, ids uintptr) {
+	handleCallback(es.registryID, numEvents, paths, flags, ids)
+}
+
+// handleCallback delivers a batch from FSEvents to the stream registered
+// as info.
+func handleCallback(info uintptr, numEvents int, paths uintptr, flags uintptr, ids uintptr) {
 	es := registry.Get(info)
 	if es == nil {
 		log.Printf("failed to retrieve registry %d", info)
 		return
 	}
+	if !es.enterCallback() {
+		return
+	}
+	defer es.exitCallback()
 
 	l := numEvents
-	events := make([]Event, l)
 
 	pathSlice := (*[1 << 30]uintptr)(unsafe.Pointer(paths))[:l:l]
 	flagSlice := (*[1 << 30]uint32)(unsafe.Pointer(flags))[:l:l]
 	idSlice := (*[1 << 30]uint64)(unsafe.Pointer(ids))[:l:l]
 
+	if es.conf().RawHandler != nil {
+		es.deliverRaw(pathSlice, flagSlice, idSlice)
+		return
+	}
+
+	in := es.interner
+	events := newBatch(l)
 	for i := 0; i < l; i++ {
-		path := cStringToGoString(pathSlice[i])
+		var path string
+		if in != nil {
+			path = in.intern(cStringBytes(pathSlice[i]))
+		} else {
+			path = cStringToGoString(pathSlice[i])
+		}
 		events[i] = Event{
-			Path:  path,
-			Flags: EventFlags(flagSlice[i]),
-			ID:    idSlice[i],
+			Path:   path,
+			Flags:  EventFlags(flagSlice[i]),
+			Device: es.conf().Device,
+			ID:     idSlice[i],
 		}
-		es.EventID = idSlice[i]
 	}
 
-	es.Events <- events
+	es.deliver(events)
 }
 
+// deliverRaw copies the callback's arrays into the stream's arena and
+// passes a view of them to es.RawHandler.
+func (es *EventStream) deliverRaw(paths []uintptr, flags []uint32, ids []uint64) {
+	a := &es.raw
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reset()
+	for i := range paths {
+		a.buf = append(a.buf, cStringBytes(paths[i])...)
+		a.add(EventFlags(flags[i]), ids[i])
+	}
+	es.handRaw(a)
+}
+
+// callbackPtr is the C-callable pointer to callback. purego can only create
+// a limited number of callbacks and never frees them, so a single one is
+// shared by every stream; the context info tells the streams apart.
+var (
+	callbackOnce sync.Once
+	callbackPtr  uintptr
+)
+
+// createPaths builds a CFArray of the absolute paths. The array retains
+// its elements, which come from pathStrings; release it with CFRelease.
 func createPaths(paths []string) (CFArrayRef, error) {
-	cfArray, _, _ := purego.SyscallN(cfArrayCreateMutable, 0, uintptr(len(paths)), 0)
+	cfArray, _, _ := purego.SyscallN(lib.cfArrayCreateMutable, 0, uintptr(len(paths)), lib.cfTypeArrayCallBacks)
+	trackCreate("CFArray", cfArray)
 	var errs []error
 	for _, path := range paths {
 		p, err := filepath.Abs(path)
 		if err != nil {
 			errs = append(errs, err)
 		}
-		cfStr := goStringToCFString(p)
-		purego.SyscallN(cfArrayAppendValue, cfArray, uintptr(cfStr))
+		pathStrings.appendTo(cfArray, p)
 	}
 	var err error
 	if len(errs) > 0 {
@@ -301,127 +273,352 @@ func setupStream(paths []string, flags CreateFlags, callbackInfo uintptr, eventI
 	if err != nil {
 		log.Printf("Error creating paths: %s", err)
 	}
-	defer purego.SyscallN(cfRelease, uintptr(cPaths))
+	defer releaseCF(uintptr(cPaths))
 
 	var context [5]uintptr // FSEventStreamContext: {version, info, retain, release, copyDescription}
 	context[1] = callbackInfo
 
 	since := eventID
 	cfinv := float64(latency) / float64(time.Second)
-	cb := purego.NewCallback(callback)
+	callbackOnce.Do(func() { callbackPtr = newCallback(callback) })
+	cb := callbackPtr
 
+	// The latency is a CFTimeInterval, a double passed in a floating
+	// point register, which SyscallN can't do: RegisterFunc can. The
+	// functions are bound on each call, as lib may have changed.
 	var ref uintptr
 	if deviceID != 0 {
-		ref, _, _ = purego.SyscallN(fseventsCreateRelativeToDevice,
-			0, cb, uintptr(unsafe.Pointer(&context)), uintptr(deviceID), uintptr(cPaths), uintptr(since), uintptr(unsafe.Pointer(&cfinv)), uintptr(flags))
+		var create func(alloc, cb, ctx uintptr, dev int32, paths uintptr, since uint64, latency float64, flags uint32) uintptr
+		purego.RegisterFunc(&create, lib.fseventsCreateRelativeToDevice)
+		ref = create(0, cb, uintptr(unsafe.Pointer(&context)), deviceID, uintptr(cPaths), since, cfinv, uint32(flags))
 	} else {
-		ref, _, _ = purego.SyscallN(fseventsCreate,
-			0, cb, uintptr(unsafe.Pointer(&context)), uintptr(cPaths), uintptr(since), uintptr(unsafe.Pointer(&cfinv)), uintptr(flags))
+		var create func(alloc, cb, ctx, paths uintptr, since uint64, latency float64, flags uint32) uintptr
+		purego.RegisterFunc(&create, lib.fseventsCreate)
+		ref = create(0, cb, uintptr(unsafe.Pointer(&context)), uintptr(cPaths), since, cfinv, uint32(flags))
 	}
+	trackCreate("FSEventStream", ref)
 
 	return fsEventStreamRef(ref)
 }
 
 func (es *EventStream) start(paths []string, cbInfo uintptr) error {
+	needed := []symbol{{&lib.fseventsCreate, "FSEventStreamCreate"}, {&lib.fseventsStart, "FSEventStreamStart"}}
+	if es.conf().Device != 0 {
+		needed[0] = symbol{&lib.fseventsCreateRelativeToDevice, "FSEventStreamCreateRelativeToDevice"}
+	}
+	switch {
+	case es.runLoop != 0:
+		needed = append(needed, symbol{&lib.fseventsScheduleWithRunLoop, "FSEventStreamScheduleWithRunLoop"})
+	case es.conf().DispatchQueue != 0:
+		needed = append(needed, symbol{&lib.fseventsSetDispatchQueue, "FSEventStreamSetDispatchQueue"},
+			symbol{&lib.dispatchRetain, "dispatch_retain"})
+	case es.conf().SharedQueue != nil:
+		needed = append(needed, symbol{&lib.fseventsSetDispatchQueue, "FSEventStreamSetDispatchQueue"})
+		if es.conf().SharedQueue.qos != QoSDefault {
+			needed = append(needed, symbol{&lib.dispatchQueueAttrMakeWithQoS, "dispatch_queue_attr_make_with_qos_class"})
+		}
+	case es.conf().QoS != QoSDefault:
+		needed = append(needed, symbol{&lib.fseventsSetDispatchQueue, "FSEventStreamSetDispatchQueue"},
+			symbol{&lib.dispatchQueueAttrMakeWithQoS, "dispatch_queue_attr_make_with_qos_class"})
+	default:
+		needed = append(needed, symbol{&lib.fseventsSetDispatchQueue, "FSEventStreamSetDispatchQueue"})
+	}
+	exclusions, _ := es.splitExclusions()
+	if len(exclusions) > 0 {
+		needed = append(needed, symbol{&lib.fseventsSetExclusionPaths, "FSEventStreamSetExclusionPaths"})
+	}
+	if err := missing(needed...); err != nil {
+		return err
+	}
+
 	since := eventIDSinceNow
 	if es.Resume {
-		since = es.EventID
+		since = atomic.LoadUint64(&es.EventID)
 	}
 
-	es.stream = setupStream(paths, es.Flags, cbInfo, since, es.Latency, es.Device)
+	es.setStream(setupStream(paths, es.conf().Flags, cbInfo, since, es.EffectiveLatency(), es.conf().Device))
+	if len(exclusions) > 0 {
+		cPaths, _ := createPaths(exclusions)
+		res, _, _ := purego.SyscallN(lib.fseventsSetExclusionPaths, uintptr(es.stream), uintptr(cPaths))
+		releaseCF(uintptr(cPaths))
+		if res == 0 {
+			es.stop()
+			return fmt.Errorf("fsevents: %v: setting exclusion paths %q failed", es, exclusions)
+		}
+	}
 
-	res, _, _ := purego.SyscallN(dispatchQueueCreate, 0, 0)
-	es.qref = fsDispatchQueueRef(res)
-	purego.SyscallN(fseventsSetDispatchQueue, uintptr(es.stream), uintptr(es.qref))
+	if es.runLoop != 0 {
+		mode := es.runLoopMode
+		if mode == "" {
+			mode = "kCFRunLoopDefaultMode"
+		}
+		es.runLoopModeRef = goStringToCFString(mode)
+		purego.SyscallN(lib.fseventsScheduleWithRunLoop, uintptr(es.stream), es.runLoop, uintptr(es.runLoopModeRef))
+	} else {
+		if es.conf().DispatchQueue != 0 {
+			// Balanced by the dispatch_release in stop.
+			purego.SyscallN(lib.dispatchRetain, es.conf().DispatchQueue)
+			trackCreate("dispatch_queue", es.conf().DispatchQueue)
+			purego.SyscallN(lib.dispatchQueueSetSpecific, es.conf().DispatchQueue, queueKey(), 1, 0)
+			es.qref = fsDispatchQueueRef(es.conf().DispatchQueue)
+		} else if es.conf().SharedQueue != nil {
+			// Balanced by the detach in stop.
+			es.cbMu.Lock()
+			if es.cbIdle == nil {
+				es.cbIdle = sync.NewCond(&es.cbMu)
+			}
+			es.cbDetached = false
+			es.cbMu.Unlock()
+			es.shared = es.conf().SharedQueue
+			es.qref = es.shared.attach()
+		} else {
+			es.qref = newDispatchQueue(es.conf().QoS)
+		}
+		purego.SyscallN(lib.fseventsSetDispatchQueue, uintptr(es.stream), uintptr(es.qref))
+	}
 
-	if res, _, _ := purego.SyscallN(fseventsStart, uintptr(es.stream)); res == 0 {
-		purego.SyscallN(fseventsInvalidate, uintptr(es.stream))
-		purego.SyscallN(fseventsRelease, uintptr(es.stream))
-		purego.SyscallN(dispatchRelease, uintptr(es.qref))
-		return fmt.Errorf("failed to start eventstream")
+	if res, _, _ := purego.SyscallN(lib.fseventsStart, uintptr(es.stream)); res == 0 {
+		es.stop()
+		return fmt.Errorf("fsevents: failed to start %v", es)
 	}
 
 	return nil
 }
 
-func flush(stream fsEventStreamRef, sync bool) {
+// flush flushes stream, returning, when sync is false, the ID
+// FSEventStreamFlushAsync does: that of the latest event ever queued for
+// the stream, or zero.
+func flush(stream fsEventStreamRef, sync bool) uint64 {
 	if stream == 0 {
-		return
+		return 0
 	}
 
 	if sync {
-		purego.SyscallN(fseventsFlushSync, uintptr(stream))
-	} else {
-		purego.SyscallN(fseventsFlushAsync, uintptr(stream))
+		purego.SyscallN(lib.fseventsFlushSync, uintptr(stream))
+		return 0
 	}
+	id, _, _ := purego.SyscallN(lib.fseventsFlushAsync, uintptr(stream))
+	return uint64(id)
 }
 
-func stop(stream fsEventStreamRef, qref fsDispatchQueueRef) {
+// suspend stops the stream with FSEventStreamStop, or starts it again,
+// keeping it.
+func (es *EventStream) suspend(on bool) error {
+	if on {
+		purego.SyscallN(lib.fseventsStop, uintptr(es.stream))
+		return nil
+	}
+	if res, _, _ := purego.SyscallN(lib.fseventsStart, uintptr(es.stream)); res == 0 {
+		return fmt.Errorf("fsevents: failed to start %v", es)
+	}
+	return nil
+}
+
+// stop tears down the stream, ending a suspension. A stream on a DispatchQueue or a
+// SharedQueue, or one being closed by unmounted, also waits for a
+// callback of its own that's still running on its queue, unless stop is
+// itself called from that queue.
+func (es *EventStream) stop() {
+	stream := uintptr(es.stream)
 	if stream == 0 {
 		return
 	}
 
-	purego.SyscallN(fseventsStop, uintptr(stream))
-	purego.SyscallN(fseventsInvalidate, uintptr(stream))
-	purego.SyscallN(fseventsRelease, uintptr(stream))
-	purego.SyscallN(dispatchRelease, uintptr(qref))
+	if atomic.SwapInt32(&es.suspended, 0) == 0 {
+		purego.SyscallN(lib.fseventsStop, stream)
+	}
+	if es.runLoopModeRef != 0 {
+		// Unscheduled explicitly, as FSEvents requires before Invalidate.
+		purego.SyscallN(lib.fseventsUnscheduleFromRunLoop, stream, es.runLoop, uintptr(es.runLoopModeRef))
+		releaseCF(uintptr(es.runLoopModeRef))
+		es.runLoopModeRef = 0
+	}
+	purego.SyscallN(lib.fseventsInvalidate, stream)
+	if es.qref != 0 {
+		onQueue, _, _ := purego.SyscallN(lib.dispatchGetSpecific, queueKey())
+		switch {
+		case es.shared != nil:
+			// Another stream's callback may be blocked on the queue;
+			// only this stream's are waited for.
+			es.detachCallbacks(onQueue == 0)
+		case (es.conf().DispatchQueue != 0 || es.stopWait) && onQueue == 0:
+			purego.SyscallN(lib.dispatchSyncF, uintptr(es.qref), 0, noopFunction())
+		}
+	}
+	es.dumpMu.Lock()
+	purego.SyscallN(lib.fseventsRelease, stream)
+	trackRelease(stream)
+	es.stream = 0
+	es.dumpMu.Unlock()
+	if es.shared != nil {
+		es.shared.detach()
+		es.shared = nil
+	} else if es.qref != 0 {
+		releaseDispatchQueue(es.qref)
+	}
+	es.qref = 0
+}
+
+// newDispatchQueue creates a serial dispatch queue with the given
+// quality-of-service class.
+func newDispatchQueue(qos QoS) fsDispatchQueueRef {
+	var attr uintptr // DISPATCH_QUEUE_SERIAL
+	if qos != QoSDefault {
+		attr, _, _ = purego.SyscallN(lib.dispatchQueueAttrMakeWithQoS, attr, uintptr(qos.class()), 0)
+	}
+	res, _, _ := purego.SyscallN(lib.dispatchQueueCreate, 0, attr)
+	trackCreate("dispatch_queue", res)
+	return fsDispatchQueueRef(res)
+}
+
+// newSharedDispatchQueue creates the queue of a SharedQueue, marked for
+// stop to tell when it runs on it.
+func newSharedDispatchQueue(qos QoS) fsDispatchQueueRef {
+	q := newDispatchQueue(qos)
+	purego.SyscallN(lib.dispatchQueueSetSpecific, uintptr(q), queueKey(), 1, 0)
+	return q
 }
 
+func releaseDispatchQueue(q fsDispatchQueueRef) {
+	purego.SyscallN(lib.dispatchRelease, uintptr(q))
+	trackRelease(uintptr(q))
+}
+
+var (
+	// queueKeyVar's address marks queues supplied through
+	// EventStream.DispatchQueue and those of SharedQueues, so stop can
+	// tell when it runs on one.
+	queueKeyVar byte
+
+	syncNoopOnce sync.Once
+	syncNoop     uintptr // dispatch_function_t that does nothing
+)
+
+func queueKey() uintptr { return uintptr(unsafe.Pointer(&queueKeyVar)) }
+
+func noopFunction() uintptr {
+	syncNoopOnce.Do(func() { syncNoop = newCallback(func(uintptr) uintptr { return 0 }) })
+	return syncNoop
+}
+
+// CFArrayLen retrieves the length of CFArray.
 func CFArrayLen(ref CFArrayRef) int {
 	if ref == 0 {
 		return 0
 	}
-	count, _, _ := purego.SyscallN(cfArrayGetCount, uintptr(ref))
+	count, _, _ := purego.SyscallN(lib.cfArrayGetCount, uintptr(ref))
 	return int(count)
 }
 
-// Additional helper functions
-func LatestEventID() uint64 {
-	res, _, _ := purego.SyscallN(fseventsGetLatestEventID, 0)
+// CurrentEventID returns the most recently generated event ID,
+// system-wide, whether or not any stream was told about it. It returns 0
+// where the FSEvents history isn't available.
+func CurrentEventID() uint64 {
+	if missing(symbol{&lib.fseventsGetCurrentEventID, "FSEventsGetCurrentEventId"}) != nil {
+		return 0
+	}
+	res, _, _ := purego.SyscallN(lib.fseventsGetCurrentEventID)
 	return uint64(res)
 }
 
+// LatestEventID returns CurrentEventID().
+//
+// Deprecated: it was named after FSEventStreamGetLatestEventId, which is
+// about one stream, as EventStream.LatestEventID is; use CurrentEventID.
+func LatestEventID() uint64 {
+	return CurrentEventID()
+}
+
 // EventIDForDeviceBeforeTime returns an event ID before a given time.
+// It returns 0 where the FSEvents history isn't available.
 func EventIDForDeviceBeforeTime(dev int32, before time.Time) uint64 {
-	tm, _, _ := purego.SyscallN(cfAbsoluteTime, uintptr(before.Unix()))
-	eventID, _, _ := purego.SyscallN(fseventsGetLastEventIDForDeviceBeforeTime, uintptr(dev), tm)
-	return uint64(eventID)
+	if missing(symbol{&lib.fseventsGetLastEventIDForDeviceBeforeTime, "FSEventsGetLastEventIDForDeviceBeforeTime"}) != nil {
+		return 0
+	}
+	return eventIDBefore(dev, before)
+}
+
+// EventIDForDeviceSince returns the ID of the last event on device dev
+// from before ago before now, for a stream to resume from to get the
+// events since. It fails if FSEvents isn't available or dev isn't
+// mounted, where FSEvents would return an ID that means nothing.
+func EventIDForDeviceSince(dev int32, ago time.Duration) (uint64, error) {
+	if err := missing(symbol{&lib.fseventsGetLastEventIDForDeviceBeforeTime, "FSEventsGetLastEventIDForDeviceBeforeTime"}); err != nil {
+		return 0, err
+	}
+	if !deviceMounted(dev) {
+		return 0, fmt.Errorf("fsevents: device %d: %w", dev, os.ErrNotExist)
+	}
+	return eventIDBefore(dev, time.Now().Add(-ago)), nil
+}
+
+// cfAbsoluteEpoch is the Unix time of 2001-01-01 00:00:00 UTC, where
+// CFAbsoluteTime counts from.
+const cfAbsoluteEpoch = 978307200
+
+func eventIDBefore(dev int32, before time.Time) uint64 {
+	// The time is a CFAbsoluteTime, a double passed in a floating point
+	// register, which SyscallN can't do: RegisterFunc can.
+	var get func(dev int32, before float64) uint64
+	purego.RegisterFunc(&get, lib.fseventsGetLastEventIDForDeviceBeforeTime)
+	return get(dev, float64(before.UnixNano())/1e9-cfAbsoluteEpoch)
+}
+
+// DeviceForPath returns the device ID for the specified volume.
+func DeviceForPath(path string) (int32, error) {
+	stat := syscall.Stat_t{}
+	if err := syscall.Lstat(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Dev, nil
 }
 
 // GetDeviceUUID retrieves the UUID required to identify an EventID
 // in the FSEvents database
 func GetDeviceUUID(deviceID int32) string {
-	uuid, _, _ := purego.SyscallN(fseventsCopyUUIDForDevice, uintptr(deviceID))
+	if missing(symbol{&lib.fseventsCopyUUIDForDevice, "FSEventsCopyUUIDForDevice"}) != nil {
+		return ""
+	}
+	uuid, _, _ := purego.SyscallN(lib.fseventsCopyUUIDForDevice, uintptr(deviceID))
 	if uuid == 0 {
 		return ""
 	}
-	uuidStr, _, _ := purego.SyscallN(cfUUIDCreateString, kCFAllocatorDefault, uintptr(uuid))
+	trackCreate("CFUUID", uuid)
+	defer releaseCF(uuid)
+	uuidStr, _, _ := purego.SyscallN(lib.cfUUIDCreateString, kCFAllocatorDefault, uintptr(uuid))
+	if uuidStr == 0 {
+		return ""
+	}
+	trackCreate("CFString", uuidStr)
+	defer releaseCF(uuidStr)
 	return cfStringToGoString(CFStringRef(uuidStr))
 }
 
 func getStreamRefEventID(stream fsEventStreamRef) uint64 {
-	res, _, _ := purego.SyscallN(fseventsGetLatestEventID, uintptr(stream))
+	res, _, _ := purego.SyscallN(lib.fseventsGetLatestEventID, uintptr(stream))
 	return uint64(res)
 }
 
 func getStreamRefDeviceID(stream fsEventStreamRef) int32 {
-	res, _, _ := purego.SyscallN(fseventsGetDeviceBeingWatched, uintptr(stream))
+	res, _, _ := purego.SyscallN(lib.fseventsGetDeviceBeingWatched, uintptr(stream))
 	return int32(res)
 }
 
 func getStreamRefDescription(stream fsEventStreamRef) string {
-	cfStr, _, _ := purego.SyscallN(fseventsCopyDescription, uintptr(stream))
-	defer purego.SyscallN(cfRelease, cfStr)
+	cfStr, _, _ := purego.SyscallN(lib.fseventsCopyDescription, uintptr(stream))
+	trackCreate("CFString", cfStr)
+	defer releaseCF(cfStr)
 	return cfStringToGoString(CFStringRef(cfStr))
 }
 
 func getStreamRefPaths(stream fsEventStreamRef) []string {
-	arr, _, _ := purego.SyscallN(fseventsCopyPaths, uintptr(stream))
-	defer purego.SyscallN(cfRelease, arr)
-	l, _, _ := purego.SyscallN(cfArrayGetCount, arr)
+	arr, _, _ := purego.SyscallN(lib.fseventsCopyPaths, uintptr(stream))
+	trackCreate("CFArray", arr)
+	defer releaseCF(arr)
+	l, _, _ := purego.SyscallN(lib.cfArrayGetCount, arr)
 	ss := make([]string, l)
 	for i := 0; i < int(l); i++ {
-		cfStr, _, _ := purego.SyscallN(cfArrayGetValueAtIndex, arr, uintptr(i))
+		cfStr, _, _ := purego.SyscallN(lib.cfArrayGetValueAtIndex, arr, uintptr(i))
 		ss[i] = cfStringToGoString(CFStringRef(cfStr))
 	}
 	return ss
@@ -0,0 +1,140 @@
+//go:build darwin && go1.18
+
+package fsevents
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// stringSeeds are file names that stress the conversions: emoji and other
+// 4-byte UTF-8, NFD sequences, invalid and truncated UTF-8, embedded NULs.
+var stringSeeds = []string{
+	"",
+	"/tmp/a",
+	"/tmp/😀",
+	"/tmp/𝄞𐍈",
+	"/tmp/e\u0301\u0308",   // NFD: combining marks
+	"/Users/me/Cafe\u0301", // NFD café
+	"/tmp/日本語",
+	"/tmp/\xff\xfe",
+	"/tmp/\xf0\x9f\x98", // truncated 4-byte sequence
+	"/tmp/\xed\xa0\x80", // UTF-16 surrogate, invalid in UTF-8
+	"/tmp/a\x00b",
+	"\x00",
+}
+
+// asCString is what s looks like to C and CF: it ends at its first NUL,
+// and invalid UTF-8 becomes U+FFFD.
+func asCString(s string) string {
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.ToValidUTF8(s, "\uFFFD")
+}
+
+func FuzzCFStringRoundTrip(f *testing.F) {
+	for _, s := range stringSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		ref := goStringToCFString(s)
+		if ref == 0 {
+			t.Fatalf("goStringToCFString(%q) = 0", s)
+		}
+		defer cfReleaseCall(uintptr(ref))
+		have := cfStringToGoString(ref)
+		if want := asCString(s); have != want {
+			t.Errorf("cfStringToGoString(goStringToCFString(%q)) = %q, want %q", s, have, want)
+		}
+		if !utf8.ValidString(have) {
+			t.Errorf("cfStringToGoString returned invalid UTF-8 %q", have)
+		}
+	})
+}
+
+func FuzzCFURL(f *testing.F) {
+	for _, s := range []string{
+		"file:///tmp/a",
+		"file:///tmp/caf%C3%A9",
+		"file:///tmp/cafe%CC%81",
+		"file:///tmp/%F0%9F%98%80",
+		"file:///tmp/%zz",
+		"file:///tmp/a%00b",
+		"file:///tmp/a b",
+		"file:///tmp/日本語",
+		"file:///tmp/😀",
+		"http://[::1]:80/%2F?q=%25#frag",
+		"file:///tmp/\xff",
+		"",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		url := goStringToCFURL(s)
+		if url == 0 {
+			return // not a URL CF accepts
+		}
+		defer cfReleaseCall(uintptr(url))
+		if have, want := cfURLToGoString(url), asCString(s); have != want {
+			t.Errorf("cfURLToGoString(goStringToCFURL(%q)) = %q, want %q", s, have, want)
+		}
+	})
+}
+
+// guardedCString lays out b and a NUL terminator at the very end of a page
+// followed by an inaccessible one, so that reading past the terminator
+// faults instead of going unnoticed. It returns the address of the string
+// and a function to unmap it.
+func guardedCString(t *testing.T, b []byte) (uintptr, func()) {
+	page := syscall.Getpagesize()
+	if len(b) >= page {
+		b = b[:page-1]
+	}
+	mem, err := syscall.Mmap(-1, 0, 2*page, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mprotect(mem[page:], syscall.PROT_NONE); err != nil {
+		t.Fatal(err)
+	}
+	start := page - len(b) - 1
+	copy(mem[start:], b)
+	mem[page-1] = 0
+	return uintptr(unsafe.Pointer(&mem[start])), func() { syscall.Munmap(mem) }
+}
+
+func FuzzCStringBytes(f *testing.F) {
+	for _, s := range stringSeeds {
+		f.Add([]byte(s))
+	}
+	f.Add([]byte("\x00\x00"))
+	f.Add([]byte("no terminator of its own"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cstr, free := guardedCString(t, b)
+		defer free()
+		if len(b) >= syscall.Getpagesize() {
+			b = b[:syscall.Getpagesize()-1]
+		}
+
+		want := b
+		if i := strings.IndexByte(string(b), 0); i >= 0 {
+			want = b[:i]
+		}
+		if have := cStringBytes(cstr); string(have) != string(want) {
+			t.Errorf("cStringBytes(%q) = %q, want %q", b, have, want)
+		}
+		if have := cStringToGoString(cstr); have != string(want) {
+			t.Errorf("cStringToGoString(%q) = %q, want %q", b, have, want)
+		}
+		// A C string converts to CF as it would from Go.
+		ref := goStringToCFString(string(b))
+		defer cfReleaseCall(uintptr(ref))
+		if have := cfStringToGoString(ref); have != asCString(string(want)) {
+			t.Errorf("cfStringToGoString(goStringToCFString(%q)) = %q, want %q", b, have, asCString(string(want)))
+		}
+	})
+}
@@ -3,8 +3,12 @@
 package fsevents
 
 import (
+	"strings"
 	"testing"
 	"time"
+	"unsafe"
+
+	"github.com/ebitengine/purego"
 )
 
 func TestCreatePath(t *testing.T) {
@@ -62,3 +66,51 @@ func TestEventIDSinceNow(t *testing.T) {
 		t.Errorf("got: %v wanted: %v", eventIDSinceNow, expected)
 	}
 }
+
+func TestCStringToGoStringAllocs(t *testing.T) {
+	cstr := []byte("/tmp/some/watched/file\x00")
+	p := uintptr(unsafe.Pointer(&cstr[0]))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		cStringToGoString(p)
+	})
+	if allocs > 1 {
+		t.Errorf("cStringToGoString: %v allocs per call, want at most 1", allocs)
+	}
+}
+
+func TestCFStringToGoStringAllocs(t *testing.T) {
+	ref := goStringToCFString(strings.Repeat("/tmp/some/watched/file", 20))
+	defer cfReleaseCall(uintptr(ref))
+
+	// Each SyscallN may move its argument block to the heap; only count
+	// the allocations the conversion itself adds on top of its three calls.
+	base := testing.AllocsPerRun(100, func() {
+		purego.SyscallN(lib.cfStringGetLength, uintptr(ref))
+	})
+	allocs := testing.AllocsPerRun(100, func() {
+		cfStringToGoString(ref)
+	})
+	if allocs > 3*base+1 {
+		t.Errorf("cfStringToGoString: %v allocs per call, want at most %v", allocs, 3*base+1)
+	}
+}
+
+func TestCFStringRoundTrip(t *testing.T) {
+	for _, tc := range []struct{ name, s string }{
+		{"ascii", "/Users/someone/src/file.go"},
+		{"cjk", "/Users/someone/文档/日本語のファイル.txt"},
+		{"emoji", "/tmp/😀/🇯🇵/👩‍👩‍👧.txt"},
+		{"combining", "/tmp/cafe\u0301/n\u0303o\u0308"},
+		{"long", strings.Repeat("/ü", 1000)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ref := goStringToCFString(tc.s)
+			defer cfReleaseCall(uintptr(ref))
+
+			if have := cfStringToGoString(ref); have != tc.s {
+				t.Errorf("round trip mismatch:\nhave %q\nwant %q", have, tc.s)
+			}
+		})
+	}
+}